@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var cacheClearFlags = struct {
+	cacheDir             string
+	packageIndexCacheDir string
+	gitCacheDir          string
+	blobCacheDir         string
+}{}
+
+func newCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "cache",
+		DisableAutoGenTag: true,
+		Short:             "Manage the caches used by zbuild update",
+	}
+
+	cmd.AddCommand(newCacheClearCmd())
+
+	return cmd
+}
+
+func newCacheClearCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "clear",
+		DisableAutoGenTag: true,
+		Short:             "Remove cached lock resolutions, repository indexes, git repositories, image blobs and tarballs",
+		Run:               HandleCacheClearCmd,
+	}
+
+	cmd.Flags().StringVar(&cacheClearFlags.cacheDir, "cache-dir", lockcache.DefaultDir(), "Where lock resolutions are cached")
+	cmd.Flags().StringVar(&cacheClearFlags.packageIndexCacheDir, "package-index-cache-dir", pkgsolver.DefaultIndexCacheDir(), "Where repository indexes are cached")
+	cmd.Flags().StringVar(&cacheClearFlags.gitCacheDir, "git-cache-dir", statesolver.DefaultGitCacheDir(), "Where git repositories used as build context are cached")
+	cmd.Flags().StringVar(&cacheClearFlags.blobCacheDir, "blob-cache-dir", statesolver.DefaultBlobCacheDir(), "Where image blobs fetched with --solver=registry and tarballs of HTTP contexts are cached")
+
+	return cmd
+}
+
+func HandleCacheClearCmd(cmd *cobra.Command, args []string) {
+	cache := lockcache.Cache{Dir: cacheClearFlags.cacheDir}
+	if err := cache.Clear(); err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	for _, dir := range []string{
+		cacheClearFlags.packageIndexCacheDir,
+		cacheClearFlags.gitCacheDir,
+		cacheClearFlags.blobCacheDir,
+	} {
+		if dir == "" {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Fatalf("%+v", err)
+		}
+	}
+}
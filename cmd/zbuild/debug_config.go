@@ -40,7 +40,7 @@ func HandleDebugConfigCmd(cmd *cobra.Command, args []string) {
 	b := builder.Builder{
 		Registry: registry.Registry,
 	}
-	solver := newLocalSolver(debugConfigFlags.context)
+	solver := newSolver(debugConfigFlags.context)
 
 	dump, err := b.DumpConfig(solver,
 		debugConfigFlags.file,
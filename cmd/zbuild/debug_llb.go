@@ -16,6 +16,7 @@ var debugFlags = struct {
 	stage   string
 	context string
 	asJSON  bool
+	strict  bool
 }{}
 
 const debugDescription = `Output LLB DAG in binary or JSON format.
@@ -49,6 +50,7 @@ func newDebugLLBCmd() *cobra.Command {
 	AddStageFlag(cmd, &debugFlags.stage)
 
 	cmd.Flags().BoolVar(&debugFlags.asJSON, "json", false, "Output the LLB DAG in JSON format")
+	cmd.Flags().BoolVar(&debugFlags.strict, "strict", false, "Fail when a non-dev stage has external files with no locked checksum")
 
 	return cmd
 }
@@ -57,9 +59,9 @@ func HandleDebugLLBCmd(cmd *cobra.Command, args []string) {
 	b := builder.Builder{
 		Registry: registry.Registry,
 	}
-	solver := newLocalSolver(debugFlags.context)
+	solver := newSolver(debugFlags.context)
 
-	state, err := b.Debug(solver, debugFlags.file, debugFlags.stage)
+	state, err := b.Debug(solver, debugFlags.file, debugFlags.stage, debugFlags.strict)
 	if err != nil {
 		logrus.Fatalf("%+v", err)
 	}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/NiR-/zbuild/pkg/builddef"
 	_ "github.com/NiR-/zbuild/pkg/defkinds/nodejs"
 	_ "github.com/NiR-/zbuild/pkg/defkinds/php"
 	_ "github.com/NiR-/zbuild/pkg/defkinds/webserver"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/docker/client"
+	"github.com/moby/buildkit/util/appdefaults"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -19,6 +25,17 @@ var (
 	zbuildCmd *cobra.Command
 )
 
+var rootFlags = struct {
+	solver       string
+	buildkitAddr string
+}{}
+
+const (
+	solverDocker   = "docker"
+	solverBuildkit = "buildkit"
+	solverRegistry = "registry"
+)
+
 func main() {
 	zbuildCmd = &cobra.Command{
 		Use:               "zbuild",
@@ -26,24 +43,51 @@ func main() {
 		Short:             "zbuild is a tool made to easily manage Docker-based environments and help developers working on web projects",
 	}
 
+	zbuildCmd.PersistentFlags().StringVar(&rootFlags.solver, "solver", solverDocker, "What to use to read files from images and run commands in them (one of: docker, buildkit, registry)")
+	zbuildCmd.PersistentFlags().StringVar(&rootFlags.buildkitAddr, "buildkit-addr", defaultBuildkitAddr(), "Address of the buildkitd daemon (used with --solver=buildkit)")
+
 	zbuildCmd.AddCommand(newUpdateCmd())
 	zbuildCmd.AddCommand(newDebugLLBCmd())
 	zbuildCmd.AddCommand(newLLBGraphCmd())
 	zbuildCmd.AddCommand(newDebugConfigCmd())
+	zbuildCmd.AddCommand(newSBOMCmd())
+	zbuildCmd.AddCommand(newCacheCmd())
+
+	handleInterrupts()
 
 	if err := zbuildCmd.Execute(); err != nil {
 		logrus.Fatalf("%+v", err)
 	}
+
+	// Commands exit through logrus such that solvers are closed (see
+	// newSolver).
+	logrus.Exit(0)
 }
 
-func newLocalSolver(rootDir string) statesolver.LocalSolver {
-	c, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		logrus.Fatalf("%+v", err)
-	}
+// handleInterrupts makes zbuild exit through logrus when it's interrupted, in
+// order to run its exit handlers. Another interrupt kills zbuild right away.
+func handleInterrupts() {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigch
+		signal.Stop(sigch)
+		logrus.Exit(130)
+	}()
+}
 
-	c.NegotiateAPIVersion(context.TODO())
+func defaultBuildkitAddr() string {
+	if addr := os.Getenv("BUILDKIT_HOST"); addr != "" {
+		return addr
+	}
+	return appdefaults.Address
+}
 
+// newSolver returns the solver selected with --solver. rootDir is the build
+// context dir, it defaults to the working directory. The solver is closed
+// when zbuild exits.
+func newSolver(rootDir string) statesolver.StateSolver {
 	if rootDir == "" {
 		var err error
 		rootDir, err = os.Getwd()
@@ -52,11 +96,102 @@ func newLocalSolver(rootDir string) statesolver.LocalSolver {
 		}
 	}
 
-	return statesolver.LocalSolver{
-		Client:        c,
-		Labels:        map[string]string{},
+	switch rootFlags.solver {
+	case solverDocker:
+		return newLocalSolver(rootDir)
+	case solverBuildkit:
+		return newBuildkitSolver(rootDir)
+	case solverRegistry:
+		return newRegistrySolver(rootDir)
+	}
+
+	logrus.Fatalf("Unsupported solver %q (supported: %s, %s, %s).",
+		rootFlags.solver, solverDocker, solverBuildkit, solverRegistry)
+	return nil
+}
+
+// newBuildkitSolver returns a BuildkitSolver backed by a build session with
+// the buildkitd daemon at --buildkit-addr, for hosts without a Docker daemon.
+func newBuildkitSolver(rootDir string) statesolver.StateSolver {
+	session, err := statesolver.NewBuildkitSession(context.Background(),
+		rootFlags.buildkitAddr, rootDir)
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	logrus.RegisterExitHandler(func() {
+		if err := session.Close(); err != nil {
+			logrus.Errorf("%+v", err)
+		}
+	})
+
+	return session.Solver
+}
+
+// newRegistrySolver returns a RegistrySolver reading files straight from
+// image registries. It needs neither Docker nor buildkitd, but it can't run
+// commands in images.
+func newRegistrySolver(rootDir string) statesolver.StateSolver {
+	return statesolver.RegistrySolver{
 		RootDir:       rootDir,
 		ImageResolver: docker.NewResolver(docker.ResolverOptions{}),
+		BlobCacheDir:  statesolver.DefaultBlobCacheDir(),
+		Tarballs:      statesolver.NewTarballCache(statesolver.DefaultBlobCacheDir()),
+	}
+}
+
+func newLocalSolver(rootDir string) statesolver.LocalSolver {
+	c, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	c.NegotiateAPIVersion(context.TODO())
+
+	solver := statesolver.LocalSolver{
+		Client: c,
+		Labels: map[string]string{
+			builddef.ZbuildLabel: "true",
+			labelSession:         newSessionID(),
+		},
+		Containers:    statesolver.NewContainerPool(),
+		RootDir:       rootDir,
+		ImageResolver: docker.NewResolver(docker.ResolverOptions{}),
+		GitCacheDir:   statesolver.DefaultGitCacheDir(),
+		Tarballs:      statesolver.NewTarballCache(statesolver.DefaultBlobCacheDir()),
+		// Secrets used by git contexts are read from the environment
+		// variable of the same name.
+		LookupSecret: os.LookupEnv,
+	}
+
+	// Containers are kept until zbuild exits, including when it's
+	// interrupted or when it fails.
+	logrus.RegisterExitHandler(func() {
+		closeLocalSolver(solver)
+	})
+
+	return solver
+}
+
+// labelSession is the label identifying the containers created by a single
+// run of zbuild.
+const labelSession = "io.zbuild.session"
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func closeLocalSolver(solver statesolver.LocalSolver) {
+	metrics := solver.Containers.Metrics()
+	logrus.Debugf("Containers: %d created, %d reused, %d commands executed",
+		metrics.Created, metrics.Reused, metrics.Execs)
+
+	if err := solver.Close(context.Background()); err != nil {
+		logrus.Errorf("Failed to remove containers: %+v", err)
 	}
 }
 
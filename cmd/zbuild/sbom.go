@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/NiR-/zbuild/pkg/builder"
+	"github.com/NiR-/zbuild/pkg/registry"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var sbomFlags = struct {
+	file    string
+	stage   string
+	context string
+	format  string
+	output  string
+}{}
+
+const sbomDescription = `Generate the SBOM of a stage.
+
+This command lists the packages installed in a stage (base image, system
+packages, PHP extensions, external files, and the packages locked by
+composer, npm or yarn) and writes them as an SPDX or CycloneDX JSON document.
+It uses the lockfile, so make sure it's up-to-date with zbuild update first.`
+
+func newSBOMCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sbom",
+		Short: "Generate the SBOM of a stage.",
+		Long:  sbomDescription,
+		Run:   HandleSBOMCmd,
+	}
+
+	AddFileFlag(cmd, &sbomFlags.file)
+	AddStageFlag(cmd, &sbomFlags.stage)
+	AddContextFlag(cmd, &sbomFlags.context)
+	cmd.Flags().StringVar(&sbomFlags.format, "format", sbom.FormatSPDX, "Format of the SBOM (one of: spdx, cyclonedx)")
+	cmd.Flags().StringVarP(&sbomFlags.output, "output", "o", "", "Path of the file to write the SBOM to (defaults to stdout)")
+
+	return cmd
+}
+
+func HandleSBOMCmd(cmd *cobra.Command, args []string) {
+	b := builder.Builder{
+		Registry: registry.Registry,
+	}
+	solver := newSolver(sbomFlags.context)
+
+	out, err := b.SBOM(solver,
+		sbomFlags.file,
+		sbomFlags.stage,
+		sbomFlags.format)
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	if sbomFlags.output == "" {
+		fmt.Fprint(os.Stdout, string(out))
+		return
+	}
+	if err := ioutil.WriteFile(sbomFlags.output, out, 0644); err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+}
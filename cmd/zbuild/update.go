@@ -1,10 +1,15 @@
 package main
 
 import (
+	"time"
+
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/builder"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/lockcache"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/registry"
+	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/twpayne/go-vfs"
@@ -17,6 +22,15 @@ var updateFlags = struct {
 	noImageUpdate         bool
 	noPackagesUpdate      bool
 	noPHPExtensionsUpdate bool
+	noExternalFilesUpdate bool
+	lockDependencies      bool
+	debianSnapshotURL     string
+	packageIndexes        bool
+	packageIndexURL       string
+	packageIndexCacheDir  string
+	cacheDir              string
+	cacheTTL              time.Duration
+	refresh               bool
 }{
 	logLevel: "warn",
 }
@@ -36,6 +50,15 @@ func newUpdateCmd() *cobra.Command {
 	cmd.Flags().BoolVar(&updateFlags.noImageUpdate, "no-image-update", false, "Do not update the base image reference")
 	cmd.Flags().BoolVar(&updateFlags.noPackagesUpdate, "no-pacakges-update", false, "Do not update system packages")
 	cmd.Flags().BoolVar(&updateFlags.noPHPExtensionsUpdate, "no-php-extensions-update", false, "Do not update PHP extensions")
+	cmd.Flags().BoolVar(&updateFlags.noExternalFilesUpdate, "no-external-files-update", false, "Do not update checksums of external files")
+	cmd.Flags().BoolVar(&updateFlags.lockDependencies, "lock-dependencies", false, "Lock the whole dependency closure of system packages")
+	cmd.Flags().StringVar(&updateFlags.debianSnapshotURL, "debian-snapshot-url", llbutils.DefaultDebianSnapshotURL, "Base URL of the Debian snapshot archive used to resolve system packages")
+	cmd.Flags().BoolVar(&updateFlags.packageIndexes, "package-indexes", false, "Resolve system packages from repository indexes instead of running containers")
+	cmd.Flags().StringVar(&updateFlags.packageIndexURL, "package-index-url", "", "Base URL of a mirror of the repositories configured in base images (used with --package-indexes)")
+	cmd.Flags().StringVar(&updateFlags.packageIndexCacheDir, "package-index-cache-dir", pkgsolver.DefaultIndexCacheDir(), "Where repository indexes are cached (used with --package-indexes)")
+	cmd.Flags().StringVar(&updateFlags.cacheDir, "cache-dir", lockcache.DefaultDir(), "Where lock resolutions are cached (an empty value disables the cache)")
+	cmd.Flags().DurationVar(&updateFlags.cacheTTL, "cache-ttl", lockcache.DefaultTTL, "How long cached lock resolutions are reused")
+	cmd.Flags().BoolVar(&updateFlags.refresh, "refresh", false, "Resolve everything again instead of reusing cached lock resolutions and package indexes")
 
 	return cmd
 }
@@ -53,19 +76,37 @@ func HandleUpdateCmd(cmd *cobra.Command, args []string) {
 
 	updateOpts := builddef.UpdateLocksOpts{
 		BuildOpts: &builddef.BuildOpts{
-			File:         updateFlags.file,
-			LockFile:     builddef.LockFilepath(updateFlags.file),
-			BuildContext: buildctx,
+			File:              updateFlags.file,
+			LockFile:          builddef.LockFilepath(updateFlags.file),
+			BuildContext:      buildctx,
+			DebianSnapshotURL: updateFlags.debianSnapshotURL,
 		},
-		UpdateImageRef:       !updateFlags.noImageUpdate,
-		UpdateSystemPackages: !updateFlags.noPackagesUpdate,
-		UpdatePHPExtensions:  !updateFlags.noPHPExtensionsUpdate,
+		UpdateImageRef:          !updateFlags.noImageUpdate,
+		UpdateSystemPackages:    !updateFlags.noPackagesUpdate,
+		UpdatePHPExtensions:     !updateFlags.noPHPExtensionsUpdate,
+		UpdateExternalFiles:     !updateFlags.noExternalFilesUpdate,
+		LockPackageDependencies: updateFlags.lockDependencies,
+	}
+
+	pkgSolvers := pkgsolver.DefaultPackageSolversMap
+	if updateFlags.packageIndexes {
+		pkgSolvers = pkgsolver.IndexPackageSolversMap(pkgsolver.IndexOpts{
+			BaseURL:  updateFlags.packageIndexURL,
+			CacheDir: updateFlags.packageIndexCacheDir,
+			Refresh:  updateFlags.refresh,
+		})
+	}
+
+	cache := &lockcache.Cache{
+		Dir:     updateFlags.cacheDir,
+		TTL:     updateFlags.cacheTTL,
+		Refresh: updateFlags.refresh,
 	}
 
-	solver := newLocalSolver(buildctx.Source)
+	solver := statesolver.NewCachingSolver(newSolver(buildctx.Source), cache)
 	b := builder.Builder{
 		Registry:   registry.Registry,
-		PkgSolvers: pkgsolver.DefaultPackageSolversMap,
+		PkgSolvers: pkgsolver.CachingPackageSolversMap(pkgSolvers, cache),
 		Filesystem: vfs.HostOSFS,
 	}
 
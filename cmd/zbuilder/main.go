@@ -7,6 +7,7 @@ import (
 	_ "github.com/NiR-/zbuild/pkg/defkinds/php"
 	_ "github.com/NiR-/zbuild/pkg/defkinds/webserver"
 	_ "github.com/NiR-/zbuild/pkg/defkinds/nodejs"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/registry"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/moby/buildkit/frontend/gateway/client"
@@ -17,7 +18,8 @@ import (
 
 func main() {
 	b := builder.Builder{
-		Registry: registry.Registry,
+		Registry:   registry.Registry,
+		PkgSolvers: pkgsolver.DefaultPackageSolversMap,
 	}
 	f := func(ctx context.Context, c client.Client) (*client.Result, error) {
 		solver := statesolver.NewBuildkitSolver(c)
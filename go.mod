@@ -9,6 +9,7 @@ require (
 	github.com/containerd/containerd v1.4.0-0
 	github.com/docker/distribution v2.7.1-0.20190205005809-0d3efadf0154+incompatible
 	github.com/docker/docker v1.14.0-0.20190319215453-e7b5f7dbe98c
+	github.com/go-git/go-git/v5 v5.1.0
 	github.com/go-test/deep v1.0.6
 	github.com/gogo/protobuf v1.3.1
 	github.com/golang/mock v1.4.3
@@ -23,6 +24,7 @@ require (
 	github.com/spf13/cobra v0.0.7
 	github.com/tonistiigi/fsutil v0.0.0-20200326231323-c2c7d7b0e144
 	github.com/twpayne/go-vfs v1.4.2
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	golang.org/x/xerrors v0.0.0-20191011141410-1b5146add898
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -3,6 +3,7 @@ package builddef
 import (
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/moby/buildkit/client/llb"
 )
@@ -24,10 +25,32 @@ type BuildOpts struct {
 	// custom cache to store downloaded pckages, compiled files, etc...
 	WithCacheMounts  bool
 	CacheIDNamespace string
-	File             string
-	LockFile         string
-	Stage            string
-	BuildContext     *Context
+	// Strict makes specialized builders fail when building a non-dev stage
+	// with external files that have no locked checksum.
+	Strict bool
+	// DebianSnapshotURL is the base URL of the archive serving Debian
+	// snapshots (see snapshot.debian.org). It lets a local mirror stand in
+	// for the official one.
+	DebianSnapshotURL string
+	// AutoLock makes the Builder resolve the locks during the build instead
+	// of loading them from the lockfile.
+	AutoLock bool
+	// SBOMFormat is the format of the SBOM generated along with images (see
+	// sbom.Marshal). No SBOM is generated when it's empty.
+	SBOMFormat string
+	// SourceDateEpoch is the time used as the creation time of images and
+	// of the files copied into them, in order to make builds reproducible
+	// (see https://reproducible-builds.org/specs/source-date-epoch/).
+	SourceDateEpoch *time.Time
+	// Revision is the VCS revision of the source files, used when the
+	// source context doesn't provide one (e.g. local contexts).
+	Revision string
+	// Version is the version of the image, set as an OCI label.
+	Version      string
+	File         string
+	LockFile     string
+	Stage        string
+	BuildContext *Context
 }
 
 func NewBuildOpts(file, context, stage, sessionID, cacheIDNamespace string) (BuildOpts, error) {
@@ -53,6 +76,21 @@ func NewBuildOpts(file, context, stage, sessionID, cacheIDNamespace string) (Bui
 	return opts, err
 }
 
+// SourceDate returns the time builds should use as the creation time of
+// images and of the files copied into them, in order to be reproducible. It's
+// either the SourceDateEpoch or the commit time of the given source context,
+// when it's a locked git context. It returns false when there's no such time,
+// in which case the current time should be used.
+func (opts BuildOpts) SourceDate(srcContext *Context) (time.Time, bool) {
+	if opts.SourceDateEpoch != nil {
+		return *opts.SourceDateEpoch, true
+	}
+	if srcContext.IsGitContext() && srcContext.CommitTime != 0 {
+		return time.Unix(srcContext.CommitTime, 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
 func LockFilepath(ymlFile string) string {
 	ext := filepath.Ext(ymlFile)
 	return strings.TrimSuffix(ymlFile, ext) + ".lock"
@@ -72,4 +110,14 @@ type UpdateLocksOpts struct {
 	// UpdatePHPExtensions indicates whether PHP community extensions shall be
 	// updated.
 	UpdatePHPExtensions bool
+	// UpdateExternalFiles indicates whether the checksums of external files
+	// shall be updated.
+	UpdateExternalFiles bool
+	// LockPackageDependencies indicates whether the whole dependency closure
+	// of system packages shall be locked, instead of only the packages
+	// explicitly listed.
+	LockPackageDependencies bool
+	// SnapshotTime is the point in time of the Debian archive snapshot locked
+	// along with system packages. The current time is used when it's zero.
+	SnapshotTime time.Time
 }
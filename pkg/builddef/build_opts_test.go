@@ -0,0 +1,65 @@
+package builddef_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+)
+
+func TestBuildOptsSourceDate(t *testing.T) {
+	epoch := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	gitContext := &builddef.Context{
+		Type:   builddef.ContextTypeGit,
+		Source: "git://github.com/some/repo",
+		GitContext: builddef.GitContext{
+			Reference:  "2ad1ae7b8b4ba0b3d2dbc8bd7c0c7db2fc5e4e02",
+			CommitTime: 1588291200,
+		},
+	}
+
+	testcases := map[string]struct {
+		opts       builddef.BuildOpts
+		srcContext *builddef.Context
+		expected   time.Time
+		expectedOk bool
+	}{
+		"use SourceDateEpoch when it's set": {
+			opts:       builddef.BuildOpts{SourceDateEpoch: &epoch},
+			srcContext: gitContext,
+			expected:   epoch,
+			expectedOk: true,
+		},
+		"use the commit time of locked git contexts": {
+			srcContext: gitContext,
+			expected:   time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC),
+			expectedOk: true,
+		},
+		"no source date for local contexts": {
+			srcContext: &builddef.Context{
+				Type:   builddef.ContextTypeLocal,
+				Source: "context",
+			},
+		},
+		"no source date for unlocked git contexts": {
+			srcContext: &builddef.Context{
+				Type:   builddef.ContextTypeGit,
+				Source: "git://github.com/some/repo",
+			},
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			sourceDate, ok := tc.opts.SourceDate(tc.srcContext)
+			if ok != tc.expectedOk {
+				t.Fatalf("Expected ok to be %t, got %t.", tc.expectedOk, ok)
+			}
+			if !sourceDate.Equal(tc.expected) {
+				t.Fatalf("Expected: %v\nGot: %v", tc.expected, sourceDate)
+			}
+		})
+	}
+}
@@ -46,6 +46,13 @@ type RawLocks struct {
 	Raw     map[string]interface{} `yaml:",inline"`
 }
 
+// Hash returns a FNV hash of the RawLocks. It's used to trace which lockfile
+// an image has been built from.
+func (locks RawLocks) Hash() uint64 {
+	hash, _ := hashstructure.Hash(locks, nil)
+	return hash
+}
+
 // Locks define a common interface implemented by all specialized Locks structs.
 // Its unique method returns the locks as a map of interfaces, as used by
 // mapstructure. This lets builder package arbitrarily manipulate the locks
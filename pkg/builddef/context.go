@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/opencontainers/go-digest"
 	"golang.org/x/xerrors"
 )
 
@@ -12,28 +13,53 @@ type ContextType string
 var (
 	ContextTypeGit   = ContextType("git")
 	ContextTypeLocal = ContextType("local")
+	// ContextTypeHTTP is used for tarballs fetched over HTTP(S).
+	ContextTypeHTTP = ContextType("http")
+	// ContextTypeImage is used for images whose filesystem provides the
+	// sources.
+	ContextTypeImage = ContextType("image")
 )
 
+const imageContextPrefix = "docker-image://"
+
 func (ctype ContextType) IsValid() error {
 	switch ctype {
 	case ContextTypeGit:
 		return nil
 	case ContextTypeLocal:
 		return nil
+	case ContextTypeHTTP:
+		return nil
+	case ContextTypeImage:
+		return nil
 	}
 
-	return xerrors.New("invalid context type: only \"local\" and \"git\" are supported")
+	return xerrors.New("invalid context type: only \"local\", \"git\", \"http\" and \"image\" are supported")
 }
 
 // NewContext takes a source which can be either a string starting with
-// "git://" followed by a repo URI or a local context name. It also takes an
-// optional contextType that can be used to force the type of the context (no
-// inference on the source format will be done).
+// "git://" followed by a repo URI, an HTTP(S) URL of a tarball, a string
+// starting with "docker-image://" followed by an image reference or a local
+// context name. It also takes an optional contextType that can be used to
+// force the type of the context (no inference on the source format will be
+// done).
 func NewContext(source string, contextType string) (*Context, error) {
 	if contextType == string(ContextTypeGit) ||
 		strings.HasPrefix(source, "git://") {
 		return newGitContext(source)
 	}
+	if contextType == string(ContextTypeHTTP) ||
+		strings.HasPrefix(source, "http://") ||
+		strings.HasPrefix(source, "https://") {
+		return newHTTPContext(source)
+	}
+	if contextType == string(ContextTypeImage) ||
+		strings.HasPrefix(source, imageContextPrefix) {
+		return &Context{
+			Type:   ContextTypeImage,
+			Source: strings.TrimPrefix(source, imageContextPrefix),
+		}, nil
+	}
 
 	context := &Context{
 		Source: source,
@@ -69,8 +95,29 @@ func newGitContext(sourceURL string) (*Context, error) {
 	return context, nil
 }
 
+// newHTTPContext creates a context from the URL of a tarball. The URL
+// fragment, if any, is used as the checksum of the tarball (e.g.
+// https://example.org/src.tar.gz#sha256:...).
+func newHTTPContext(sourceURL string) (*Context, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	context := &Context{
+		Type: ContextTypeHTTP,
+	}
+	context.Checksum = u.Fragment
+
+	u.Fragment = ""
+	context.Source = u.String()
+
+	return context, nil
+}
+
 type Context struct {
-	GitContext `mapstructure:",squash"`
+	GitContext  `mapstructure:",squash"`
+	HTTPContext `mapstructure:",squash"`
 
 	Type ContextType
 	// Source is either the name of the local context or the URI of the remote
@@ -83,11 +130,19 @@ func (base *Context) Copy() *Context {
 		return nil
 	}
 
-	return &Context{
-		GitContext: base.GitContext,
-		Type:       base.Type,
-		Source:     base.Source,
+	copy := &Context{
+		GitContext:  base.GitContext,
+		HTTPContext: base.HTTPContext,
+		Type:        base.Type,
+		Source:      base.Source,
+	}
+	if base.SubmoduleCommits != nil {
+		copy.SubmoduleCommits = make(map[string]string, len(base.SubmoduleCommits))
+		for path, commit := range base.SubmoduleCommits {
+			copy.SubmoduleCommits[path] = commit
+		}
 	}
+	return copy
 }
 
 func (c *Context) IsValid() error {
@@ -103,16 +158,48 @@ func (c *Context) IsValid() error {
 		return xerrors.New("invalid context: context source is empty")
 	}
 
+	if c.IsHTTPContext() && c.Checksum != "" {
+		if _, err := digest.Parse(c.Checksum); err != nil {
+			return xerrors.Errorf("invalid context: invalid checksum %q: %w", c.Checksum, err)
+		}
+	}
+
+	// BuildKit can't be told to not fetch submodules.
+	if c.IsGitContext() && c.Submodules != nil && !*c.Submodules {
+		return xerrors.New("invalid context: submodules can't be disabled as BuildKit always fetches them")
+	}
+
 	return nil
 }
 
 func (c *Context) RawLocks() map[string]interface{} {
-	return map[string]interface{}{
+	locks := map[string]interface{}{
 		"type":      c.Type,
 		"source":    c.Source,
 		"reference": c.Reference,
 		"path":      c.Path,
 	}
+	if c.IsHTTPContext() {
+		locks["checksum"] = c.Checksum
+	}
+	// Git options are only added when they're set, to not clutter the
+	// locks of most git contexts.
+	if c.Submodules != nil {
+		locks["submodules"] = *c.Submodules
+	}
+	if len(c.SubmoduleCommits) > 0 {
+		locks["submodule_commits"] = c.SubmoduleCommits
+	}
+	if c.KeepGitDir {
+		locks["keep_git_dir"] = true
+	}
+	if c.AuthSecret != "" {
+		locks["auth_secret"] = c.AuthSecret
+	}
+	if c.CommitTime != 0 {
+		locks["commit_time"] = c.CommitTime
+	}
+	return locks
 }
 
 func (c *Context) IsGitContext() bool {
@@ -123,6 +210,14 @@ func (c *Context) IsLocalContext() bool {
 	return c != nil && c.Type == ContextTypeLocal
 }
 
+func (c *Context) IsHTTPContext() bool {
+	return c != nil && c.Type == ContextTypeHTTP
+}
+
+func (c *Context) IsImageContext() bool {
+	return c != nil && c.Type == ContextTypeImage
+}
+
 // Subdir returns the context Path if the context is Git-based. This method
 // should be prefered over accessing Path directly since the Path can be
 // set by users.
@@ -140,4 +235,34 @@ type GitContext struct {
 	Reference string
 	// Path contains the base root dir of the context in the git repo.
 	Path string
+	// Submodules indicates whether zbuild update should read files from the
+	// submodules of the repo and lock them. It's enabled when unset and it
+	// can't be set to false, as BuildKit always fetches submodules during
+	// builds.
+	Submodules *bool
+	// KeepGitDir indicates whether the .git dir should be kept in the
+	// context.
+	KeepGitDir bool `mapstructure:"keep_git_dir"`
+	// AuthSecret is the name of the secret containing the token used to
+	// fetch the repo over HTTPS.
+	AuthSecret string `mapstructure:"auth_secret"`
+	// SubmoduleCommits contains the commits of the submodules of the repo,
+	// indexed by their path. It's set when the context is locked.
+	SubmoduleCommits map[string]string `mapstructure:"submodule_commits"`
+	// CommitTime is the time of the commit the reference points to, in
+	// seconds since the Unix epoch. It's set when the context is locked and
+	// it's used to make builds reproducible (see BuildOpts.SourceDate).
+	CommitTime int64 `mapstructure:"commit_time"`
+}
+
+// SubmodulesEnabled returns true unless Submodules is set to false, like
+// BuildKit which always fetches submodules.
+func (c GitContext) SubmodulesEnabled() bool {
+	return c.Submodules == nil || *c.Submodules
+}
+
+type HTTPContext struct {
+	// Checksum is the digest of the tarball (e.g. sha256:...). It's resolved
+	// when locking the context and verified each time the tarball is fetched.
+	Checksum string
 }
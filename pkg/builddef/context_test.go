@@ -1,6 +1,7 @@
 package builddef_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
@@ -57,6 +58,37 @@ func TestNewContext(t *testing.T) {
 				},
 			},
 		},
+		"HTTP URL": {
+			source: "https://example.org/src.tar.gz",
+			expected: &builddef.Context{
+				Type:   builddef.ContextTypeHTTP,
+				Source: "https://example.org/src.tar.gz",
+			},
+		},
+		"HTTP URL with checksum": {
+			source: "https://example.org/src.tar.gz#sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			expected: &builddef.Context{
+				Type:   builddef.ContextTypeHTTP,
+				Source: "https://example.org/src.tar.gz",
+				HTTPContext: builddef.HTTPContext{
+					Checksum: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+				},
+			},
+		},
+		"image reference": {
+			source: "docker-image://registry.example.org/artefacts/api:v1",
+			expected: &builddef.Context{
+				Type:   builddef.ContextTypeImage,
+				Source: "registry.example.org/artefacts/api:v1",
+			},
+		},
+		"local context": {
+			source: "context",
+			expected: &builddef.Context{
+				Type:   builddef.ContextTypeLocal,
+				Source: "context",
+			},
+		},
 	}
 
 	for tcname := range testcases {
@@ -81,3 +113,54 @@ func TestNewContext(t *testing.T) {
 		})
 	}
 }
+
+func TestContextIsValid(t *testing.T) {
+	submodules := true
+	noSubmodules := false
+
+	testcases := map[string]struct {
+		context     *builddef.Context
+		expectedErr error
+	}{
+		"git context with submodules": {
+			context: &builddef.Context{
+				Type:       builddef.ContextTypeGit,
+				Source:     "git://github.com/some/repo",
+				GitContext: builddef.GitContext{Submodules: &submodules},
+			},
+		},
+		"fail when submodules are disabled": {
+			context: &builddef.Context{
+				Type:       builddef.ContextTypeGit,
+				Source:     "git://github.com/some/repo",
+				GitContext: builddef.GitContext{Submodules: &noSubmodules},
+			},
+			expectedErr: errors.New("invalid context: submodules can't be disabled as BuildKit always fetches them"),
+		},
+		"fail when the checksum is invalid": {
+			context: &builddef.Context{
+				Type:        builddef.ContextTypeHTTP,
+				Source:      "https://example.org/src.tar.gz",
+				HTTPContext: builddef.HTTPContext{Checksum: "sha256:foo"},
+			},
+			expectedErr: errors.New("invalid context: invalid checksum \"sha256:foo\": invalid checksum digest length"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			err := tc.context.IsValid()
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected error: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
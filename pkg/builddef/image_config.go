@@ -0,0 +1,159 @@
+package builddef
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NiR-/zbuild/pkg/image"
+	"golang.org/x/xerrors"
+)
+
+// ImageConfig represents the image config parameters that can be specified in
+// the image section of definition files. They're applied on top of the image
+// config computed by specialized builders, and thus take precedence over it.
+type ImageConfig struct {
+	// Ports is the list of ports exposed by the image, in the form
+	// <port>[/<proto>]. The protocol defaults to tcp.
+	Ports []string `mapstructure:"ports"`
+	// Env is the set of environment variables added to the ones set by
+	// specialized builders. It overrides the variables with the same name.
+	Env        map[string]string `mapstructure:"env"`
+	Entrypoint *[]string         `mapstructure:"entrypoint"`
+	StopSignal string            `mapstructure:"stop_signal"`
+	User       string            `mapstructure:"user"`
+}
+
+func (c ImageConfig) IsValid() error {
+	for _, port := range c.Ports {
+		if _, err := normalizePort(port); err != nil {
+			return err
+		}
+	}
+
+	for name := range c.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return xerrors.Errorf("invalid env var name %q", name)
+		}
+	}
+
+	return nil
+}
+
+func (c ImageConfig) Copy() ImageConfig {
+	new := ImageConfig{
+		Entrypoint: c.Entrypoint,
+		StopSignal: c.StopSignal,
+		User:       c.User,
+	}
+
+	if c.Ports != nil {
+		new.Ports = append([]string{}, c.Ports...)
+	}
+
+	if c.Env != nil {
+		new.Env = make(map[string]string, len(c.Env))
+		for name, value := range c.Env {
+			new.Env[name] = value
+		}
+	}
+
+	return new
+}
+
+// Merge returns a copy of the ImageConfig merged with the overriding one.
+// Ports are appended to the current ones, env vars are merged together and
+// other parameters are replaced when they're defined by the overriding
+// ImageConfig.
+func (c ImageConfig) Merge(overriding ImageConfig) ImageConfig {
+	new := c.Copy()
+	new.Ports = append(new.Ports, overriding.Ports...)
+
+	if new.Env == nil && overriding.Env != nil {
+		new.Env = make(map[string]string, len(overriding.Env))
+	}
+	for name, value := range overriding.Env {
+		new.Env[name] = value
+	}
+
+	if overriding.Entrypoint != nil {
+		entrypoint := *overriding.Entrypoint
+		new.Entrypoint = &entrypoint
+	}
+	if overriding.StopSignal != "" {
+		new.StopSignal = overriding.StopSignal
+	}
+	if overriding.User != "" {
+		new.User = overriding.User
+	}
+
+	return new
+}
+
+// ApplyTo sets the parameters of this ImageConfig on the given image. Env vars
+// already set on the image keep their position, such that only new env vars
+// are appended, sorted by name. It returns an error if a port is invalid.
+func (c ImageConfig) ApplyTo(img *image.Image) error {
+	if len(c.Ports) > 0 && img.Config.ExposedPorts == nil {
+		img.Config.ExposedPorts = map[string]struct{}{}
+	}
+	for _, port := range c.Ports {
+		normalized, err := normalizePort(port)
+		if err != nil {
+			return err
+		}
+		img.Config.ExposedPorts[normalized] = struct{}{}
+	}
+
+	applied := make(map[string]struct{}, len(c.Env))
+	for i, envVar := range img.Config.Env {
+		name := strings.SplitN(envVar, "=", 2)[0]
+		if value, ok := c.Env[name]; ok {
+			img.Config.Env[i] = name + "=" + value
+			applied[name] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		if _, ok := applied[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		img.Config.Env = append(img.Config.Env, name+"="+c.Env[name])
+	}
+
+	if c.Entrypoint != nil {
+		img.Config.Entrypoint = append([]string{}, *c.Entrypoint...)
+	}
+	if c.StopSignal != "" {
+		img.Config.StopSignal = c.StopSignal
+	}
+	if c.User != "" {
+		img.Config.User = c.User
+	}
+
+	return nil
+}
+
+// normalizePort returns the given port in the form <port>/<proto>, as used by
+// image configs.
+func normalizePort(port string) (string, error) {
+	parts := strings.SplitN(port, "/", 2)
+	proto := "tcp"
+	if len(parts) == 2 {
+		proto = strings.ToLower(parts[1])
+	}
+
+	num, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || num == 0 {
+		return "", xerrors.Errorf("invalid port %q", port)
+	}
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return "", xerrors.Errorf("invalid port %q: protocol should be one of tcp, udp or sctp", port)
+	}
+
+	return strconv.FormatUint(num, 10) + "/" + proto, nil
+}
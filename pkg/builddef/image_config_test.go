@@ -0,0 +1,174 @@
+package builddef_test
+
+import (
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/image"
+	"github.com/go-test/deep"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestImageConfigApplyTo(t *testing.T) {
+	testcases := map[string]struct {
+		config      builddef.ImageConfig
+		img         image.ImageConfig
+		expected    image.ImageConfig
+		expectedErr string
+	}{
+		"override the computed config": {
+			config: builddef.ImageConfig{
+				Ports: []string{"8080", "53/UDP"},
+				Env: map[string]string{
+					"PATH":      "/app/bin:/usr/bin",
+					"LOG_LEVEL": "info",
+					"APP_ENV":   "prod",
+				},
+				Entrypoint: &[]string{"tini", "--"},
+				StopSignal: "SIGQUIT",
+				User:       "www-data",
+			},
+			img: image.ImageConfig{
+				ImageConfig: specs.ImageConfig{
+					User:       "1000",
+					Env:        []string{"PATH=/usr/bin", "NODE_ENV=production"},
+					StopSignal: "SIGSTOP",
+				},
+			},
+			expected: image.ImageConfig{
+				ImageConfig: specs.ImageConfig{
+					User: "www-data",
+					ExposedPorts: map[string]struct{}{
+						"8080/tcp": {},
+						"53/udp":   {},
+					},
+					Env: []string{
+						"PATH=/app/bin:/usr/bin",
+						"NODE_ENV=production",
+						"APP_ENV=prod",
+						"LOG_LEVEL=info",
+					},
+					Entrypoint: []string{"tini", "--"},
+					StopSignal: "SIGQUIT",
+				},
+			},
+		},
+		"keep the computed config when empty": {
+			config: builddef.ImageConfig{},
+			img: image.ImageConfig{
+				ImageConfig: specs.ImageConfig{
+					User:       "1000",
+					Env:        []string{"PATH=/usr/bin"},
+					StopSignal: "SIGSTOP",
+				},
+			},
+			expected: image.ImageConfig{
+				ImageConfig: specs.ImageConfig{
+					User:       "1000",
+					Env:        []string{"PATH=/usr/bin"},
+					StopSignal: "SIGSTOP",
+				},
+			},
+		},
+		"fail with an invalid port": {
+			config: builddef.ImageConfig{
+				Ports: []string{"http"},
+			},
+			expectedErr: `invalid port "http"`,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			img := image.Image{Config: tc.img}
+			err := tc.config.ApplyTo(&img)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("Expected error: %s\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if diff := deep.Equal(img.Config, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestImageConfigIsValid(t *testing.T) {
+	testcases := map[string]struct {
+		config      builddef.ImageConfig
+		expectedErr string
+	}{
+		"valid config": {
+			config: builddef.ImageConfig{
+				Ports: []string{"80", "443/tcp", "53/udp"},
+				Env:   map[string]string{"APP_ENV": "prod"},
+			},
+		},
+		"port out of range": {
+			config: builddef.ImageConfig{
+				Ports: []string{"70000"},
+			},
+			expectedErr: `invalid port "70000"`,
+		},
+		"unsupported protocol": {
+			config: builddef.ImageConfig{
+				Ports: []string{"9000/fcgi"},
+			},
+			expectedErr: `invalid port "9000/fcgi": protocol should be one of tcp, udp or sctp`,
+		},
+		"invalid env var name": {
+			config: builddef.ImageConfig{
+				Env: map[string]string{"APP_ENV=prod": ""},
+			},
+			expectedErr: `invalid env var name "APP_ENV=prod"`,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.config.IsValid()
+			if tc.expectedErr == "" && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Fatalf("Expected error: %s\nGot: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestImageConfigMerge(t *testing.T) {
+	base := builddef.ImageConfig{
+		Env:  map[string]string{"APP_ENV": "dev"},
+		User: "1000",
+	}
+	merged := base.Merge(builddef.ImageConfig{
+		Env: map[string]string{"APP_ENV": "prod"},
+	})
+
+	expected := builddef.ImageConfig{
+		Env:  map[string]string{"APP_ENV": "prod"},
+		User: "1000",
+	}
+	if diff := deep.Equal(merged, expected); diff != nil {
+		t.Fatal(diff)
+	}
+	// The base config should be left untouched.
+	if base.Env["APP_ENV"] != "dev" {
+		t.Fatalf("Expected base env to be left untouched, got: %v", base.Env)
+	}
+}
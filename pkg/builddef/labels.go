@@ -0,0 +1,122 @@
+package builddef
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/image"
+	"github.com/docker/distribution/reference"
+)
+
+// These labels are the OCI annotations set on images built by zbuild (see
+// https://github.com/opencontainers/image-spec/blob/master/annotations.md).
+const (
+	LabelCreated    = "org.opencontainers.image.created"
+	LabelSource     = "org.opencontainers.image.source"
+	LabelRevision   = "org.opencontainers.image.revision"
+	LabelVersion    = "org.opencontainers.image.version"
+	LabelTitle      = "org.opencontainers.image.title"
+	LabelBaseDigest = "org.opencontainers.image.base.digest"
+)
+
+// These labels are used to trace which zbuildfile and lockfile an image has
+// been built from, and which SBOM describes it (when one is generated).
+const (
+	DefHashLabel    = "io.zbuild.defhash"
+	LockHashLabel   = "io.zbuild.lockhash"
+	SBOMDigestLabel = "io.zbuild.sbom.digest"
+)
+
+// Labels is a set of image labels, indexed by their name.
+type Labels map[string]string
+
+func (labels Labels) Copy() Labels {
+	if labels == nil {
+		return nil
+	}
+
+	new := Labels{}
+	for name, value := range labels {
+		new[name] = value
+	}
+	return new
+}
+
+// Merge returns a copy of the labels along with the overriding ones, which
+// take precedence.
+func (labels Labels) Merge(overriding Labels) Labels {
+	if labels == nil && overriding == nil {
+		return nil
+	}
+
+	new := labels.Copy()
+	if new == nil {
+		new = Labels{}
+	}
+	for name, value := range overriding {
+		new[name] = value
+	}
+	return new
+}
+
+// ApplyTo sets the labels on the given image, overriding the labels of the
+// same name already set.
+func (labels Labels) ApplyTo(img *image.Image) {
+	if len(labels) > 0 && img.Config.Labels == nil {
+		img.Config.Labels = map[string]string{}
+	}
+	for name, value := range labels {
+		img.Config.Labels[name] = value
+	}
+}
+
+// ImageLabels returns the OCI labels of an image built with the given
+// BuildOpts from the given locked base image and source context. The title is
+// the name of the stage built, if any. The source and the revision come from
+// the source context when it's a git context. For other contexts, the revision
+// comes from the BuildOpts, if any.
+func ImageLabels(
+	opts BuildOpts,
+	baseImage string,
+	srcContext *Context,
+	created time.Time,
+) Labels {
+	labels := Labels{
+		LabelCreated: created.UTC().Format(time.RFC3339),
+	}
+	if opts.Stage != "" {
+		labels[LabelTitle] = opts.Stage
+	}
+	if opts.Version != "" {
+		labels[LabelVersion] = opts.Version
+	}
+
+	revision := opts.Revision
+	if srcContext.IsGitContext() || srcContext.IsHTTPContext() {
+		labels[LabelSource] = srcContext.Source
+	}
+	if srcContext.IsGitContext() && srcContext.Reference != "" {
+		revision = srcContext.Reference
+	}
+	if revision != "" {
+		labels[LabelRevision] = revision
+	}
+
+	if named, err := reference.ParseNormalizedNamed(baseImage); err == nil {
+		if digested, ok := named.(reference.Digested); ok {
+			labels[LabelBaseDigest] = digested.Digest().String()
+		}
+	}
+
+	return labels
+}
+
+// HashLabels returns the labels tracing which zbuildfile and lockfile the
+// given BuildDef comes from. Hashes are formatted like the defhash of
+// lockfiles.
+func HashLabels(def *BuildDef) Labels {
+	return Labels{
+		DefHashLabel:  strconv.FormatUint(def.Hash(), 10),
+		LockHashLabel: strconv.FormatUint(def.RawLocks.Hash(), 10),
+	}
+}
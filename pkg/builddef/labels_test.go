@@ -0,0 +1,155 @@
+package builddef_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/image"
+	"github.com/go-test/deep"
+)
+
+func TestImageLabels(t *testing.T) {
+	created := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	baseImage := "docker.io/library/php:7.4-fpm-buster@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	testcases := map[string]struct {
+		opts       builddef.BuildOpts
+		baseImage  string
+		srcContext *builddef.Context
+		expected   builddef.Labels
+	}{
+		"with a locked git source context": {
+			opts: builddef.BuildOpts{
+				Stage:    "prod",
+				Revision: "ignored",
+				Version:  "v1.2.0",
+			},
+			baseImage: baseImage,
+			srcContext: &builddef.Context{
+				Type:   builddef.ContextTypeGit,
+				Source: "git://github.com/some/repo",
+				GitContext: builddef.GitContext{
+					Reference: "2ad1ae7b8b4ba0b3d2dbc8bd7c0c7db2fc5e4e02",
+				},
+			},
+			expected: builddef.Labels{
+				builddef.LabelCreated:    "2020-03-01T10:00:00Z",
+				builddef.LabelTitle:      "prod",
+				builddef.LabelVersion:    "v1.2.0",
+				builddef.LabelSource:     "git://github.com/some/repo",
+				builddef.LabelRevision:   "2ad1ae7b8b4ba0b3d2dbc8bd7c0c7db2fc5e4e02",
+				builddef.LabelBaseDigest: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			},
+		},
+		"with a local context and a revision": {
+			opts: builddef.BuildOpts{
+				Stage:    "dev",
+				Revision: "1f8ac10f",
+			},
+			baseImage: baseImage,
+			srcContext: &builddef.Context{
+				Type:   builddef.ContextTypeLocal,
+				Source: "context",
+			},
+			expected: builddef.Labels{
+				builddef.LabelCreated:    "2020-03-01T10:00:00Z",
+				builddef.LabelTitle:      "dev",
+				builddef.LabelRevision:   "1f8ac10f",
+				builddef.LabelBaseDigest: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			},
+		},
+		"with a base image without digest": {
+			opts: builddef.BuildOpts{
+				Stage: "dev",
+			},
+			baseImage: "docker.io/library/php:7.4-fpm-buster",
+			srcContext: &builddef.Context{
+				Type:   builddef.ContextTypeLocal,
+				Source: "context",
+			},
+			expected: builddef.Labels{
+				builddef.LabelCreated: "2020-03-01T10:00:00Z",
+				builddef.LabelTitle:   "dev",
+			},
+		},
+		"without stage": {
+			baseImage: baseImage,
+			srcContext: &builddef.Context{
+				Type:   builddef.ContextTypeLocal,
+				Source: "context",
+			},
+			expected: builddef.Labels{
+				builddef.LabelCreated:    "2020-03-01T10:00:00Z",
+				builddef.LabelBaseDigest: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			},
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			labels := builddef.ImageLabels(tc.opts, tc.baseImage, tc.srcContext, created)
+			if diff := deep.Equal(labels, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestLabelsApplyTo(t *testing.T) {
+	img := image.Image{}
+	img.Config.Labels = map[string]string{
+		builddef.ZbuildLabel: "true",
+		builddef.LabelTitle:  "dev",
+	}
+
+	labels := builddef.Labels{builddef.LabelTitle: "prod"}
+	labels.Merge(builddef.Labels{"com.example.team": "web"}).ApplyTo(&img)
+
+	expected := map[string]string{
+		builddef.ZbuildLabel: "true",
+		builddef.LabelTitle:  "prod",
+		"com.example.team":   "web",
+	}
+	if diff := deep.Equal(img.Config.Labels, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Images without labels should get a label map.
+	img = image.Image{}
+	labels.ApplyTo(&img)
+	if img.Config.Labels[builddef.LabelTitle] != "prod" {
+		t.Fatalf("Expected the title label to be set, got: %v", img.Config.Labels)
+	}
+}
+
+func TestHashLabels(t *testing.T) {
+	def := &builddef.BuildDef{
+		Kind: "php",
+		RawConfig: map[string]interface{}{
+			"version": "7.4",
+		},
+		RawLocks: builddef.RawLocks{
+			Raw: map[string]interface{}{
+				"base_image": "docker.io/library/php:7.4-fpm-buster",
+			},
+		},
+	}
+
+	labels := builddef.HashLabels(def)
+	if labels[builddef.DefHashLabel] == "" || labels[builddef.LockHashLabel] == "" {
+		t.Fatalf("Expected both hashes to be set, got: %v", labels)
+	}
+
+	// Changing the locks shouldn't change the hash of the zbuildfile.
+	def.RawLocks.Raw["base_image"] = "docker.io/library/php:7.4-cli-buster"
+	updated := builddef.HashLabels(def)
+	if updated[builddef.DefHashLabel] != labels[builddef.DefHashLabel] {
+		t.Fatalf("Expected defhash to be unchanged: %v", updated)
+	}
+	if updated[builddef.LockHashLabel] == labels[builddef.LockHashLabel] {
+		t.Fatalf("Expected lockhash to change: %v", updated)
+	}
+}
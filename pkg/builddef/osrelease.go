@@ -14,6 +14,9 @@ type OSRelease struct {
 	Name        string
 	VersionName string
 	VersionID   string
+	// IDLike is the list of distributions this one is derived from (e.g.
+	// debian for Ubuntu), as found in ID_LIKE field.
+	IDLike []string `yaml:",omitempty"`
 }
 
 // ParseOSRelease takes the raw content of a /etc/os-release file and
@@ -27,11 +30,13 @@ func ParseOSRelease(file []byte) (OSRelease, error) {
 
 		switch parts[0] {
 		case "ID":
-			res.Name = parts[1]
+			res.Name = strings.Trim(parts[1], "\"")
 		case "VERSION_CODENAME":
-			res.VersionName = parts[1]
+			res.VersionName = strings.Trim(parts[1], "\"")
 		case "VERSION_ID":
 			res.VersionID = strings.Trim(parts[1], "\"")
+		case "ID_LIKE":
+			res.IDLike = strings.Fields(strings.Trim(parts[1], "\""))
 		}
 	}
 
@@ -44,3 +49,42 @@ func ParseOSRelease(file []byte) (OSRelease, error) {
 
 	return res, nil
 }
+
+const (
+	// DistroFamilyDebian is the family of Debian and its derivatives (e.g.
+	// Ubuntu), which use apt.
+	DistroFamilyDebian = "debian"
+	// DistroFamilyAlpine is the family of Alpine and the distributions using
+	// apk (e.g. Wolfi).
+	DistroFamilyAlpine = "alpine"
+	// DistroFamilyRHEL is the family of Red Hat Enterprise Linux and its
+	// derivatives (e.g. Fedora, Rocky Linux), which use dnf.
+	DistroFamilyRHEL = "rhel"
+)
+
+// distroFamilies associates known distribution IDs to their family. It
+// contains only the distributions that aren't derived from another one
+// through ID_LIKE.
+var distroFamilies = map[string]string{
+	"debian":    DistroFamilyDebian,
+	"ubuntu":    DistroFamilyDebian,
+	"alpine":    DistroFamilyAlpine,
+	"wolfi":     DistroFamilyAlpine,
+	"rhel":      DistroFamilyRHEL,
+	"fedora":    DistroFamilyRHEL,
+	"centos":    DistroFamilyRHEL,
+	"rocky":     DistroFamilyRHEL,
+	"almalinux": DistroFamilyRHEL,
+}
+
+// Family returns the family of the distribution (one of the DistroFamily*
+// consts), determined from its ID first and then from ID_LIKE. It returns
+// an empty string if the distribution is unknown.
+func (r OSRelease) Family() string {
+	for _, id := range append([]string{r.Name}, r.IDLike...) {
+		if family, ok := distroFamilies[id]; ok {
+			return family
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package builddef
+
+import (
+	"regexp"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultUID is the ID of the user running images and owning the files copied
+// into them when no user is specified in definition files. It's also used as
+// the default group ID.
+const DefaultUID = 1000
+
+// userNameRegexp matches the names accepted by useradd and adduser. As user
+// names are put in the commands creating users, nothing else is allowed.
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// UserConfig represents the user running images and owning the files copied
+// into them, as specified in definition files.
+type UserConfig struct {
+	UID *int `mapstructure:"uid"`
+	// GID defaults to the UID when it's not specified.
+	GID *int `mapstructure:"gid"`
+	// Name is optional. When it's specified, the user and its group are
+	// created in the image, such that they exist in /etc/passwd and
+	// /etc/group.
+	Name string `mapstructure:"name"`
+}
+
+func (u *UserConfig) IsValid() error {
+	if u == nil {
+		return nil
+	}
+	if u.UID == nil {
+		return xerrors.New("user has no uid")
+	}
+	if *u.UID < 0 {
+		return xerrors.Errorf("invalid uid %d", *u.UID)
+	}
+	if u.GID != nil && *u.GID < 0 {
+		return xerrors.Errorf("invalid gid %d", *u.GID)
+	}
+	if u.Name != "" && !userNameRegexp.MatchString(u.Name) {
+		return xerrors.Errorf("invalid user name %q", u.Name)
+	}
+	return nil
+}
+
+// Copy returns a deep copy of the UserConfig.
+func (u *UserConfig) Copy() *UserConfig {
+	if u == nil {
+		return nil
+	}
+
+	new := &UserConfig{Name: u.Name}
+	if u.UID != nil {
+		uid := *u.UID
+		new.UID = &uid
+	}
+	if u.GID != nil {
+		gid := *u.GID
+		new.GID = &gid
+	}
+	return new
+}
+
+func (u *UserConfig) uid() int {
+	if u == nil || u.UID == nil {
+		return DefaultUID
+	}
+	return *u.UID
+}
+
+func (u *UserConfig) gid() int {
+	if u == nil || u.UID == nil {
+		return DefaultUID
+	}
+	if u.GID == nil {
+		return *u.UID
+	}
+	return *u.GID
+}
+
+// UserID returns the uid of the user, as used to run commands and as the
+// user of images. The DefaultUID is used when the UserConfig is nil.
+func (u *UserConfig) UserID() string {
+	return strconv.Itoa(u.uid())
+}
+
+// GroupID returns the gid of the user. The DefaultUID is used when the
+// UserConfig is nil.
+func (u *UserConfig) GroupID() string {
+	return strconv.Itoa(u.gid())
+}
+
+// Owner returns the owner of files copied into images, in the form uid:gid.
+func (u *UserConfig) Owner() string {
+	return u.UserID() + ":" + u.GroupID()
+}
@@ -0,0 +1,72 @@
+package builddef_test
+
+import (
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+)
+
+func TestUserConfig(t *testing.T) {
+	uid, gid, negative := 1500, 0, -1
+
+	testcases := map[string]struct {
+		user          *builddef.UserConfig
+		expectedOwner string
+		expectedUID   string
+		expectedErr   string
+	}{
+		"default user": {
+			user:          nil,
+			expectedOwner: "1000:1000",
+			expectedUID:   "1000",
+		},
+		"user without gid": {
+			user:          &builddef.UserConfig{UID: &uid},
+			expectedOwner: "1500:1500",
+			expectedUID:   "1500",
+		},
+		"user with root group": {
+			user:          &builddef.UserConfig{UID: &uid, GID: &gid, Name: "app"},
+			expectedOwner: "1500:0",
+			expectedUID:   "1500",
+		},
+		"user without uid": {
+			user:        &builddef.UserConfig{Name: "app"},
+			expectedErr: "user has no uid",
+		},
+		"user with a negative gid": {
+			user:        &builddef.UserConfig{UID: &uid, GID: &negative},
+			expectedErr: "invalid gid -1",
+		},
+		"user with an invalid name": {
+			user:        &builddef.UserConfig{UID: &uid, Name: "app; rm -rf /"},
+			expectedErr: `invalid user name "app; rm -rf /"`,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.user.IsValid()
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("Expected error: %s\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if owner := tc.user.Owner(); owner != tc.expectedOwner {
+				t.Fatalf("Expected owner: %s\nGot: %s", tc.expectedOwner, owner)
+			}
+			if uid := tc.user.UserID(); uid != tc.expectedUID {
+				t.Fatalf("Expected uid: %s\nGot: %s", tc.expectedUID, uid)
+			}
+		})
+	}
+}
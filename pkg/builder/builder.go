@@ -7,7 +7,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/defloader"
@@ -15,10 +18,12 @@ import (
 	"github.com/NiR-/zbuild/pkg/llbutils"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/registry"
+	"github.com/NiR-/zbuild/pkg/sbom"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/opencontainers/go-digest"
 	"github.com/twpayne/go-vfs"
 	"golang.org/x/xerrors"
 	"gopkg.in/yaml.v2"
@@ -32,8 +37,44 @@ const (
 	keyFilename      = "filename"
 	keyNoCache       = "no-cache"
 	keyCacheNS       = "build-arg:BUILDKIT_CACHE_MOUNT_NS"
+	// keyStrict is the build arg used to enable strict mode (see
+	// builddef.BuildOpts.Strict).
+	keyStrict = "build-arg:ZBUILD_STRICT"
+	// keyDebianSnapshotURL is the build arg used to change the base URL of
+	// the Debian snapshot archive (see builddef.BuildOpts.DebianSnapshotURL).
+	keyDebianSnapshotURL = "build-arg:ZBUILD_DEBIAN_SNAPSHOT_URL"
+	// keyAutoLock is the build arg used to enable auto-lock mode (see
+	// builddef.BuildOpts.AutoLock).
+	keyAutoLock = "build-arg:ZBUILD_AUTOLOCK"
+	// keyRevision and keyVersion are the build args used to set the OCI
+	// revision and version labels (see builddef.BuildOpts.Revision and
+	// builddef.BuildOpts.Version).
+	keyRevision = "build-arg:ZBUILD_REVISION"
+	keyVersion  = "build-arg:ZBUILD_VERSION"
+	// keySourceDateEpoch is the build arg used to make builds reproducible
+	// (see builddef.BuildOpts.SourceDateEpoch). Unlike other build args, it
+	// has no ZBUILD_ prefix as it's a standard variable.
+	keySourceDateEpoch = "build-arg:SOURCE_DATE_EPOCH"
+	// keySBOM is the build arg used to generate an SBOM along with the
+	// image, in the given format (see builddef.BuildOpts.SBOMFormat).
+	keySBOM = "build-arg:ZBUILD_SBOM"
 )
 
+// LockfileTarget is the build target exporting the lockfile generated in
+// auto-lock mode, instead of an image. Using it implies auto-lock mode.
+const LockfileTarget = "zbuild-lockfile"
+
+// LockfileMetadataKey is the key of the result metadata holding the lockfile
+// generated in auto-lock mode, along with the image built from it. BuildKit
+// returns the metadata prefixed with "frontend." to its clients (e.g. with
+// buildctl build --metadata-file).
+const LockfileMetadataKey = "frontend.zbuild.lockfile"
+
+// SBOMTargetPrefix is the prefix of the build targets exporting the SBOM of
+// a stage, instead of an image (e.g. zbuild-sbom-prod). SBOMs are generated
+// in SPDX format, unless another format is set with ZBUILD_SBOM.
+const SBOMTargetPrefix = "zbuild-sbom-"
+
 // Builder takes a KindRegistry, which contains all the specialized handlers
 // supported by zbuild. It's used to execute generic operations for specialized
 // build definitions, by calling the appropriate kind handlers' methods.
@@ -93,9 +134,43 @@ func buildOptsFromBuildkitOpts(c client.Client) (builddef.BuildOpts, error) {
 		buildOpts.IgnoreLayerCache = true
 	}
 
+	if isEnabled(opts, keyStrict) {
+		buildOpts.Strict = true
+	}
+
+	if isEnabled(opts, keyAutoLock) || buildOpts.Stage == LockfileTarget {
+		buildOpts.AutoLock = true
+	}
+
+	if v, ok := opts[keyDebianSnapshotURL]; ok {
+		buildOpts.DebianSnapshotURL = v
+	}
+
+	buildOpts.Revision = opts[keyRevision]
+	buildOpts.Version = opts[keyVersion]
+
+	buildOpts.SBOMFormat = opts[keySBOM]
+	if isSBOMTarget(buildOpts.Stage) && buildOpts.SBOMFormat == "" {
+		buildOpts.SBOMFormat = sbom.FormatSPDX
+	}
+
+	if v := opts[keySourceDateEpoch]; v != "" {
+		epoch, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return buildOpts, xerrors.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", v, err)
+		}
+		sourceDate := time.Unix(epoch, 0).UTC()
+		buildOpts.SourceDateEpoch = &sourceDate
+	}
+
 	return buildOpts, err
 }
 
+func isEnabled(opts map[string]string, key string) bool {
+	v, ok := opts[key]
+	return ok && v != "" && v != "0" && v != "false"
+}
+
 func (b Builder) Build(
 	ctx context.Context,
 	solver statesolver.StateSolver,
@@ -112,6 +187,21 @@ func (b Builder) Build(
 	}
 	buildOpts.Def = def
 
+	// In auto-lock mode, the locks are resolved on the fly and the lockfile
+	// (if any) is ignored. The generated lockfile is exported when building
+	// the LockfileTarget, or returned along with the image built from it.
+	var lockfile []byte
+	if buildOpts.AutoLock {
+		lockfile, err = b.autoLock(ctx, solver, buildOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		if buildOpts.Stage == LockfileTarget {
+			return solveFile(ctx, c, path.Base(buildOpts.LockFile), lockfile)
+		}
+	}
+
 	// At this point, the defloader loaded both the zbuildfile and its lockfile
 	// but it didn't check if the RawLocks are out-of-sync with the generic
 	// BuildDef. If it's the case (eg. a property in the zbuildfile has been
@@ -121,12 +211,48 @@ func (b Builder) Build(
 		return nil, OutOfSyncLockfileError{}
 	}
 
+	if isSBOMTarget(buildOpts.Stage) {
+		buildOpts.Stage = strings.TrimPrefix(buildOpts.Stage, SBOMTargetPrefix)
+		out, err := b.marshalSBOM(ctx, solver, buildOpts)
+		if err != nil {
+			return nil, err
+		}
+		return solveFile(ctx, c, sbomFilename(buildOpts.SBOMFormat), out)
+	}
+
 	state, img, err := b.build(ctx, solver, buildOpts)
 	if err != nil {
 		return nil, err
 	}
 
-	return solveStateWithImage(ctx, c, state, img)
+	// Hashes are taken from the zbuildfile, and not from the BuildDef built
+	// by the kind handler, as webserver stages have their own BuildDef.
+	if img != nil {
+		if img.Config.Labels == nil {
+			img.Config.Labels = map[string]string{}
+		}
+		for name, value := range builddef.HashLabels(def) {
+			img.Config.Labels[name] = value
+		}
+
+		if buildOpts.SBOMFormat != "" {
+			out, err := b.marshalSBOM(ctx, solver, buildOpts)
+			if err != nil {
+				return nil, err
+			}
+			img.Config.Labels[builddef.SBOMDigestLabel] = digest.FromBytes(out).String()
+		}
+	}
+
+	res, err := solveStateWithImage(ctx, c, state, img)
+	if err != nil {
+		return nil, err
+	}
+	if lockfile != nil {
+		res.AddMeta(LockfileMetadataKey, lockfile)
+	}
+
+	return res, nil
 }
 
 // OutOfSyncLockfileError is returned by Builder.Build() when the hash of the
@@ -138,6 +264,56 @@ func (err OutOfSyncLockfileError) Error() string {
 	return "your lockfile is out-of-sync with your definition file, please run `zbuild update`"
 }
 
+// autoLock resolves all the locks of buildOpts.Def and replaces its RawLocks
+// with them. It returns the content of the lockfile generated.
+func (b Builder) autoLock(
+	ctx context.Context,
+	solver statesolver.StateSolver,
+	buildOpts builddef.BuildOpts,
+) ([]byte, error) {
+	def := buildOpts.Def
+	lockfile, err := b.generateLockFile(ctx, solver, builddef.UpdateLocksOpts{
+		BuildOpts:            &buildOpts,
+		UpdateImageRef:       true,
+		UpdateSystemPackages: true,
+		UpdatePHPExtensions:  true,
+		UpdateExternalFiles:  true,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("could not resolve locks: %w", err)
+	}
+
+	// The lockfile is decoded like the defloader does, such that kind
+	// handlers get the same RawLocks as when building from a lockfile.
+	def.RawLocks = builddef.RawLocks{}
+	if err := yaml.Unmarshal(lockfile, &def.RawLocks); err != nil {
+		return nil, xerrors.Errorf("could not decode generated locks: %w", err)
+	}
+
+	return lockfile, nil
+}
+
+// solveFile returns a Result made of a single file with the given name and
+// content (e.g. a lockfile). It's meant to be exported with the local
+// exporter.
+func solveFile(
+	ctx context.Context,
+	c client.Client,
+	name string,
+	content []byte,
+) (*client.Result, error) {
+	state := llb.Scratch().File(
+		llb.Mkfile("/"+name, 0640, content))
+
+	res, ref, err := llbutils.SolveState(ctx, c, state)
+	if err != nil {
+		return nil, err
+	}
+	res.SetRef(ref)
+
+	return res, nil
+}
+
 func (b Builder) build(
 	ctx context.Context,
 	solver statesolver.StateSolver,
@@ -227,6 +403,7 @@ func (b Builder) Debug(
 	solver statesolver.StateSolver,
 	file,
 	stage string,
+	strict bool,
 ) (llb.State, error) {
 	var state llb.State
 
@@ -234,6 +411,7 @@ func (b Builder) Debug(
 	if err != nil {
 		return state, err
 	}
+	buildOpts.Strict = strict
 
 	ctx := context.Background()
 	def, err := defloader.Load(ctx, solver, buildOpts)
@@ -282,6 +460,69 @@ func (b Builder) DumpConfig(
 	return yaml.Marshal(dumpable)
 }
 
+// SBOM generates the SBOM of the given stage in the given format (see
+// sbom.Marshal). Packages are listed from the locks of the stage and from the
+// lockfiles of its source context.
+func (b Builder) SBOM(
+	solver statesolver.StateSolver,
+	file,
+	stage,
+	format string,
+) ([]byte, error) {
+	buildOpts, err := builddef.NewBuildOpts(file, "", stage, "", "")
+	if err != nil {
+		return nil, err
+	}
+	buildOpts.SBOMFormat = format
+
+	ctx := context.Background()
+	buildOpts.Def, err = defloader.Load(ctx, solver, buildOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.marshalSBOM(ctx, solver, buildOpts)
+}
+
+// marshalSBOM generates the SBOM of buildOpts.Stage in buildOpts.SBOMFormat.
+// The same bytes are exported by the SBOM targets and hashed to label images,
+// so the SBOM must not depend on the image built.
+func (b Builder) marshalSBOM(
+	ctx context.Context,
+	solver statesolver.StateSolver,
+	buildOpts builddef.BuildOpts,
+) ([]byte, error) {
+	webserverStage := isWebserverStage(buildOpts.Stage)
+	if webserverStage {
+		buildOpts.Def = newBuildDefForWebserver(buildOpts.Def)
+	}
+
+	handler, err := b.findHandler(buildOpts.Def.Kind, solver, webserverStage)
+	if err != nil {
+		return nil, err
+	}
+	sbomHandler, ok := handler.(registry.SBOMHandler)
+	if !ok {
+		return nil, xerrors.Errorf("kind %q doesn't support SBOM generation", buildOpts.Def.Kind)
+	}
+
+	bom, err := sbomHandler.SBOM(ctx, buildOpts)
+	if err != nil {
+		return nil, xerrors.Errorf("could not generate SBOM: %w", err)
+	}
+
+	return sbom.Marshal(bom, buildOpts.SBOMFormat)
+}
+
+func isSBOMTarget(stage string) bool {
+	return strings.HasPrefix(stage, SBOMTargetPrefix)
+}
+
+// sbomFilename returns the name of the file the SBOM is exported to.
+func sbomFilename(format string) string {
+	return "sbom." + format + ".json"
+}
+
 func (b Builder) UpdateLockFile(
 	solver statesolver.StateSolver,
 	opts builddef.UpdateLocksOpts,
@@ -294,29 +535,41 @@ func (b Builder) UpdateLockFile(
 		return err
 	}
 
-	rawLocks, err := b.updateLocks(ctx, solver, opts)
+	buf, err := b.generateLockFile(ctx, solver, opts)
 	if err != nil {
 		return err
 	}
 
+	err = b.Filesystem.WriteFile(opts.BuildOpts.LockFile, buf, 0640)
+	if err != nil {
+		return xerrors.Errorf("could not write %s: %w", opts.BuildOpts.LockFile, err)
+	}
+
+	return nil
+}
+
+// generateLockFile resolves the locks of opts.BuildOpts.Def and returns the
+// content of the lockfile.
+func (b Builder) generateLockFile(
+	ctx context.Context,
+	solver statesolver.StateSolver,
+	opts builddef.UpdateLocksOpts,
+) ([]byte, error) {
 	// The raw BuildDef (Kind + RawConfig) is hashed and the hash is added to
 	// the locked properties to be able to compare the hash of the BuildDef
 	// to the locked one later on, when loading both files. This is used to
 	// detect any changes on the BuildDef made without re-running
-	// `zbuild update`.
-	rawLocks["defhash"] = opts.BuildOpts.Def.Hash()
-
-	buf, err := yaml.Marshal(rawLocks)
-	if err != nil {
-		return err
-	}
+	// `zbuild update`. It's computed first as updateLocks replaces the
+	// BuildDef when locking webserver definitions.
+	defHash := opts.BuildOpts.Def.Hash()
 
-	err = b.Filesystem.WriteFile(opts.BuildOpts.LockFile, buf, 0640)
+	rawLocks, err := b.updateLocks(ctx, solver, opts)
 	if err != nil {
-		return xerrors.Errorf("could not write %s: %w", opts.BuildOpts.LockFile, err)
+		return nil, err
 	}
+	rawLocks["defhash"] = defHash
 
-	return nil
+	return yaml.Marshal(rawLocks)
 }
 
 func (b Builder) updateLocks(
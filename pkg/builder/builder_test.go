@@ -1,28 +1,37 @@
 package builder_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/builder"
 	"github.com/NiR-/zbuild/pkg/image"
 	"github.com/NiR-/zbuild/pkg/llbtest"
 	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/registry"
+	"github.com/NiR-/zbuild/pkg/sbom"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/go-test/deep"
 	"github.com/golang/mock/gomock"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/twpayne/go-vfs"
 	"github.com/twpayne/go-vfs/vfst"
 	"golang.org/x/xerrors"
+	"gopkg.in/yaml.v2"
 )
 
 var flagTestdata = flag.Bool("testdata", false, "Use this flag to (re)generate testdata (lockfiles)")
@@ -41,14 +50,20 @@ func TestBuilderBuild(t *testing.T) {
 	}
 
 	testcases := map[string]func(*testing.T, *gomock.Controller) buildTC{
-		"build default stage and file":         initBuildDefaultStageAndFileTC,
-		"build custom stage and file":          initBuildCustomStageAndFileTC,
-		"build from git context":               initBuildFromGitContextTC,
-		"build webserver stage":                initBuildWebserverStageTC,
-		"fail to read zbuild.yml file":         failToReadYmlTC,
-		"fail to find a suitable kind handler": failToFindASutableKindHandlerTC,
-		"fail when kind handler fails":         failWhenKindHandlerFailsTC,
-		"fail when lockfile is out-of-sync":    failWhenLockfileIsOutOfSyncTC,
+		"build default stage and file":            initBuildDefaultStageAndFileTC,
+		"build custom stage and file":             initBuildCustomStageAndFileTC,
+		"build from git context":                  initBuildFromGitContextTC,
+		"build webserver stage":                   initBuildWebserverStageTC,
+		"fail to read zbuild.yml file":            failToReadYmlTC,
+		"fail with an invalid SOURCE_DATE_EPOCH":  failWithInvalidSourceDateEpochTC,
+		"fail to find a suitable kind handler":    failToFindASutableKindHandlerTC,
+		"fail when kind handler fails":            failWhenKindHandlerFailsTC,
+		"fail when lockfile is out-of-sync":       failWhenLockfileIsOutOfSyncTC,
+		"build with locks resolved on the fly":    initBuildWithAutoLockTC,
+		"export lockfile resolved on the fly":     initExportAutoLockedLockfileTC,
+		"build with an SBOM":                      initBuildWithSBOMTC,
+		"export the SBOM of a stage":              initExportSBOMTC,
+		"fail to export SBOM of unsupported kind": failToExportSBOMOfUnsupportedKindTC,
 	}
 
 	for tcname := range testcases {
@@ -141,7 +156,7 @@ func initBuildDefaultStageAndFileTC(t *testing.T, mockCtrl *gomock.Controller) b
 	}
 	c.EXPECT().Solve(gomock.Any(), gomock.Any()).Return(resImg, nil)
 
-	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{}}`
+	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{"Labels":{"io.zbuild.defhash":"2808197596929273290","io.zbuild.lockhash":"8625541142500985978"}}}`
 	return buildTC{
 		client:   c,
 		solver:   solver,
@@ -212,7 +227,7 @@ func initBuildFromGitContextTC(t *testing.T, mockCtrl *gomock.Controller) buildT
 	}
 	c.EXPECT().Solve(gomock.Any(), gomock.Any()).Return(resImg, nil)
 
-	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{}}`
+	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{"Labels":{"io.zbuild.defhash":"2808197596929273290","io.zbuild.lockhash":"8625541142500985978"}}}`
 	return buildTC{
 		client:   c,
 		solver:   solver,
@@ -232,8 +247,11 @@ func initBuildCustomStageAndFileTC(t *testing.T, mockCtrl *gomock.Controller) bu
 	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
 		SessionID: "<SESSION-ID>",
 		Opts: map[string]string{
-			"filename": "api.zbuild.yml",
-			"target":   "prod",
+			"filename":                    "api.zbuild.yml",
+			"target":                      "prod",
+			"build-arg:ZBUILD_REVISION":   "1f8ac10f",
+			"build-arg:ZBUILD_VERSION":    "v1.2.0",
+			"build-arg:SOURCE_DATE_EPOCH": "1583056800",
 		},
 	})
 
@@ -279,12 +297,21 @@ func initBuildCustomStageAndFileTC(t *testing.T, mockCtrl *gomock.Controller) bu
 	handler.EXPECT().WithSolver(gomock.Any()).Times(1)
 	handler.EXPECT().Build(
 		ctx, MatchBuildOpts(buildOpts),
-	).Return(state, &img, nil)
+	).DoAndReturn(func(_ context.Context, opts builddef.BuildOpts) (llb.State, *image.Image, error) {
+		if opts.Revision != "1f8ac10f" || opts.Version != "v1.2.0" {
+			t.Errorf("Unexpected revision and version: %q, %q", opts.Revision, opts.Version)
+		}
+		expectedDate := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+		if opts.SourceDateEpoch == nil || !opts.SourceDateEpoch.Equal(expectedDate) {
+			t.Errorf("Unexpected SourceDateEpoch: %v", opts.SourceDateEpoch)
+		}
+		return state, &img, nil
+	})
 
 	registry := registry.NewKindRegistry()
 	registry.Register("php", handler, false)
 
-	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{}}`
+	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{"Labels":{"io.zbuild.defhash":"2808197596929273290","io.zbuild.lockhash":"8625541142500985978"}}}`
 	return buildTC{
 		client:   c,
 		solver:   solver,
@@ -368,7 +395,7 @@ func initBuildWebserverStageTC(t *testing.T, mockCtrl *gomock.Controller) buildT
 	registry.Register("php", phpHandler, true)
 	registry.Register("webserver", webHandler, false)
 
-	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{}}`
+	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{"Labels":{"io.zbuild.defhash":"2808197596929273290","io.zbuild.lockhash":"8625541142500985978"}}}`
 	return buildTC{
 		client:   c,
 		solver:   solver,
@@ -405,6 +432,23 @@ func failToReadYmlTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
 	}
 }
 
+func failWithInvalidSourceDateEpochTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"build-arg:SOURCE_DATE_EPOCH": "yesterday",
+		},
+	})
+
+	return buildTC{
+		client:      c,
+		solver:      mocks.NewMockStateSolver(mockCtrl),
+		registry:    registry.NewKindRegistry(),
+		expectedErr: errors.New("invalid SOURCE_DATE_EPOCH \"yesterday\": strconv.ParseInt: parsing \"yesterday\": invalid syntax"),
+	}
+}
+
 func failToFindASutableKindHandlerTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
 	c := llbtest.NewMockClient(mockCtrl)
 	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
@@ -513,6 +557,628 @@ func failWhenLockfileIsOutOfSyncTC(t *testing.T, mockCtrl *gomock.Controller) bu
 	}
 }
 
+func initBuildWithAutoLockTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context":                   "some-context-name",
+			"build-arg:ZBUILD_AUTOLOCK": "1",
+		},
+	})
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/out-of-sync.yml")
+	zbuildLock := loadRawTestdata(t, "testdata/build/out-of-sync.lock")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any()).Times(1)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.yml", gomock.Any(),
+	).Return(zbuildYml, nil)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.lock", gomock.Any(),
+	).Return(zbuildLock, nil)
+
+	handler := mocks.NewMockKindHandler(mockCtrl)
+	handler.EXPECT().WithSolver(gomock.Any()).Times(2)
+	handler.EXPECT().UpdateLocks(
+		gomock.Any(), gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(_ context.Context, _ pkgsolver.PackageSolversMap, opts builddef.UpdateLocksOpts) (builddef.Locks, error) {
+		if !opts.UpdateImageRef || !opts.UpdateSystemPackages || !opts.UpdateExternalFiles {
+			t.Errorf("Expected all locks to be updated, got: %+v", opts)
+		}
+		return stubLocks{map[string]interface{}{
+			"base_image": "docker.io/library/nginx:alpine@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		}}, nil
+	})
+
+	img := image.Image{
+		Image: specs.Image{
+			Author: "zbuild",
+		},
+	}
+	handler.EXPECT().Build(
+		gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(_ context.Context, opts builddef.BuildOpts) (llb.State, *image.Image, error) {
+		expected := builddef.RawLocks{
+			DefHash: opts.Def.Hash(),
+			Raw: map[string]interface{}{
+				"base_image": "docker.io/library/nginx:alpine@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			},
+		}
+		if diff := deep.Equal(opts.Def.RawLocks, expected); diff != nil {
+			t.Errorf("Unexpected locks: %v", diff)
+		}
+		return llb.State{}, &img, nil
+	})
+
+	registry := registry.NewKindRegistry()
+	registry.Register("webserver", handler, false)
+
+	refImage := llbtest.NewMockReference(mockCtrl)
+	resImg := &client.Result{
+		Refs: map[string]client.Reference{"linux/amd64": refImage},
+		Ref:  refImage,
+	}
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).Return(resImg, nil)
+
+	imgConfig := `{"author":"zbuild","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{"Labels":{"io.zbuild.defhash":"7741932647118453699","io.zbuild.lockhash":"7780208374194420581"}}}`
+	lockfile := "base_image: docker.io/library/nginx:alpine@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae\ndefhash: 7741932647118453699\n"
+	return buildTC{
+		client:   c,
+		solver:   solver,
+		registry: registry,
+		expectedRes: &client.Result{
+			Refs: map[string]client.Reference{"linux/amd64": refImage},
+			Ref:  refImage,
+			Metadata: map[string][]byte{
+				"containerimage.config":     []byte(imgConfig),
+				builder.LockfileMetadataKey: []byte(lockfile),
+			},
+		},
+	}
+}
+
+func initExportAutoLockedLockfileTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context": "some-context-name",
+			"target":  builder.LockfileTarget,
+		},
+	})
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/out-of-sync.yml")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any()).Times(1)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.yml", gomock.Any(),
+	).Return(zbuildYml, nil)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.lock", gomock.Any(),
+	).Return(nil, statesolver.FileNotFound)
+
+	handler := mocks.NewMockKindHandler(mockCtrl)
+	handler.EXPECT().WithSolver(gomock.Any()).Times(1)
+	handler.EXPECT().UpdateLocks(
+		gomock.Any(), gomock.Any(), gomock.Any(),
+	).Return(stubLocks{map[string]interface{}{
+		"base_image": "docker.io/library/nginx:alpine@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+	}}, nil)
+
+	registry := registry.NewKindRegistry()
+	registry.Register("webserver", handler, false)
+
+	lockfile := "base_image: docker.io/library/nginx:alpine@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae\n"
+	refLockfile := llbtest.NewMockReference(mockCtrl)
+	resLockfile := &client.Result{
+		Refs: map[string]client.Reference{"linux/amd64": refLockfile},
+		Ref:  refLockfile,
+	}
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, req client.SolveRequest) (*client.Result, error) {
+		var found bool
+		for _, op := range req.Definition.Def {
+			found = found || bytes.Contains(op, []byte(lockfile))
+		}
+		if !found {
+			t.Errorf("Expected the lockfile to be written in the solved state.")
+		}
+		return resLockfile, nil
+	})
+
+	return buildTC{
+		client:   c,
+		solver:   solver,
+		registry: registry,
+		expectedRes: &client.Result{
+			Refs: map[string]client.Reference{"linux/amd64": refLockfile},
+			Ref:  refLockfile,
+		},
+	}
+}
+
+// sbomKindHandler is a KindHandler able to generate SBOMs.
+type sbomKindHandler struct {
+	*mocks.MockKindHandler
+	*mocks.MockSBOMHandler
+}
+
+func newSBOMKindHandler(mockCtrl *gomock.Controller) sbomKindHandler {
+	return sbomKindHandler{
+		MockKindHandler: mocks.NewMockKindHandler(mockCtrl),
+		MockSBOMHandler: mocks.NewMockSBOMHandler(mockCtrl),
+	}
+}
+
+func newTestBOM(stage string) sbom.BOM {
+	bom := sbom.New(builddef.BuildOpts{Stage: stage}, nil)
+	bom.Add(sbom.NamedPackage(sbom.TypeComposer, "symfony/console", "v5.0.5"))
+	return bom
+}
+
+func initBuildWithSBOMTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context":               "some-context-name",
+			"target":                "prod",
+			"build-arg:ZBUILD_SBOM": "cyclonedx",
+		},
+	})
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/zbuild.yml")
+	zbuildLock := loadRawTestdata(t, "testdata/build/zbuild.lock")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any()).Times(1)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.yml", gomock.Any(),
+	).Return(zbuildYml, nil)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.lock", gomock.Any(),
+	).Return(zbuildLock, nil)
+
+	created := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	img := image.Image{
+		Image: specs.Image{
+			Created: &created,
+		},
+	}
+	bom := newTestBOM("prod")
+
+	handler := newSBOMKindHandler(mockCtrl)
+	handler.MockKindHandler.EXPECT().WithSolver(gomock.Any()).Times(2)
+	handler.MockKindHandler.EXPECT().Build(
+		gomock.Any(), gomock.Any(),
+	).Return(llb.State{}, &img, nil)
+	handler.MockSBOMHandler.EXPECT().SBOM(
+		gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(_ context.Context, opts builddef.BuildOpts) (sbom.BOM, error) {
+		if opts.Stage != "prod" || opts.SBOMFormat != sbom.FormatCycloneDX {
+			t.Errorf("Unexpected stage and SBOM format: %q, %q", opts.Stage, opts.SBOMFormat)
+		}
+		return bom, nil
+	})
+
+	registry := registry.NewKindRegistry()
+	registry.Register("php", handler, false)
+
+	refImage := llbtest.NewMockReference(mockCtrl)
+	resImg := &client.Result{
+		Refs: map[string]client.Reference{"linux/amd64": refImage},
+		Ref:  refImage,
+	}
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).Return(resImg, nil)
+
+	rawSBOM, err := sbom.Marshal(bom, sbom.FormatCycloneDX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imgConfig := fmt.Sprintf(`{"created":"2020-03-01T10:00:00Z","architecture":"","os":"","rootfs":{"type":"","diff_ids":null},"config":{"Labels":{"io.zbuild.defhash":"2808197596929273290","io.zbuild.lockhash":"8625541142500985978","io.zbuild.sbom.digest":"%s"}}}`,
+		digest.FromBytes(rawSBOM))
+	return buildTC{
+		client:   c,
+		solver:   solver,
+		registry: registry,
+		expectedRes: &client.Result{
+			Refs: map[string]client.Reference{"linux/amd64": refImage},
+			Ref:  refImage,
+			Metadata: map[string][]byte{
+				"containerimage.config": []byte(imgConfig),
+			},
+		},
+	}
+}
+
+func initExportSBOMTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context": "some-context-name",
+			"target":  builder.SBOMTargetPrefix + "prod",
+		},
+	})
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/zbuild.yml")
+	zbuildLock := loadRawTestdata(t, "testdata/build/zbuild.lock")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any()).Times(1)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.yml", gomock.Any(),
+	).Return(zbuildYml, nil)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.lock", gomock.Any(),
+	).Return(zbuildLock, nil)
+
+	bom := newTestBOM("prod")
+	handler := newSBOMKindHandler(mockCtrl)
+	handler.MockKindHandler.EXPECT().WithSolver(gomock.Any()).Times(1)
+	handler.MockSBOMHandler.EXPECT().SBOM(
+		gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(_ context.Context, opts builddef.BuildOpts) (sbom.BOM, error) {
+		// SBOMs are exported in SPDX format by default.
+		if opts.Stage != "prod" || opts.SBOMFormat != sbom.FormatSPDX {
+			t.Errorf("Unexpected stage and SBOM format: %q, %q", opts.Stage, opts.SBOMFormat)
+		}
+		return bom, nil
+	})
+
+	registry := registry.NewKindRegistry()
+	registry.Register("php", handler, false)
+
+	rawSBOM, err := sbom.Marshal(bom, sbom.FormatSPDX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refSBOM := llbtest.NewMockReference(mockCtrl)
+	resSBOM := &client.Result{
+		Refs: map[string]client.Reference{"linux/amd64": refSBOM},
+		Ref:  refSBOM,
+	}
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, req client.SolveRequest) (*client.Result, error) {
+		var found bool
+		for _, op := range req.Definition.Def {
+			found = found || (bytes.Contains(op, rawSBOM) && bytes.Contains(op, []byte("/sbom.spdx.json")))
+		}
+		if !found {
+			t.Errorf("Expected the SBOM to be written in the solved state.")
+		}
+		return resSBOM, nil
+	})
+
+	return buildTC{
+		client:   c,
+		solver:   solver,
+		registry: registry,
+		expectedRes: &client.Result{
+			Refs: map[string]client.Reference{"linux/amd64": refSBOM},
+			Ref:  refSBOM,
+		},
+	}
+}
+
+func failToExportSBOMOfUnsupportedKindTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context": "some-context-name",
+			"target":  builder.SBOMTargetPrefix + "prod",
+		},
+	})
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/zbuild.yml")
+	zbuildLock := loadRawTestdata(t, "testdata/build/zbuild.lock")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any()).Times(1)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.yml", gomock.Any(),
+	).Return(zbuildYml, nil)
+
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.lock", gomock.Any(),
+	).Return(zbuildLock, nil)
+
+	handler := mocks.NewMockKindHandler(mockCtrl)
+	handler.EXPECT().WithSolver(gomock.Any()).Times(1)
+
+	registry := registry.NewKindRegistry()
+	registry.Register("php", handler, false)
+
+	return buildTC{
+		client:      c,
+		solver:      solver,
+		registry:    registry,
+		expectedErr: xerrors.New(`kind "php" doesn't support SBOM generation`),
+	}
+}
+
+// TestSBOMDigestLabelMatchesExportedSBOM checks that the SBOM exported with
+// the zbuild-sbom-<stage> target is the one whose digest is labelled on the
+// image, even when the build isn't reproducible.
+func TestSBOMDigestLabelMatchesExportedSBOM(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/zbuild.yml")
+	zbuildLock := loadRawTestdata(t, "testdata/build/zbuild.lock")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any()).Times(2)
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.yml", gomock.Any(),
+	).Return(zbuildYml, nil).Times(2)
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.lock", gomock.Any(),
+	).Return(zbuildLock, nil).Times(2)
+
+	created := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	handler := newSBOMKindHandler(mockCtrl)
+	handler.MockKindHandler.EXPECT().WithSolver(gomock.Any()).AnyTimes()
+	handler.MockKindHandler.EXPECT().Build(
+		gomock.Any(), gomock.Any(),
+	).Return(llb.State{}, &image.Image{
+		Image: specs.Image{Created: &created},
+	}, nil)
+	handler.MockSBOMHandler.EXPECT().SBOM(
+		gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(_ context.Context, opts builddef.BuildOpts) (sbom.BOM, error) {
+		return newTestBOM(opts.Stage), nil
+	}).Times(2)
+
+	registry := registry.NewKindRegistry()
+	registry.Register("php", handler, false)
+	b := builder.Builder{Registry: registry}
+
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context":               "some-context-name",
+			"target":                "prod",
+			"build-arg:ZBUILD_SBOM": "spdx",
+		},
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).Return(&client.Result{}, nil)
+
+	res, err := b.Build(context.TODO(), solver, c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var img image.Image
+	if err := json.Unmarshal(res.Metadata["containerimage.config"], &img); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported []byte
+	c = llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context": "some-context-name",
+			"target":  builder.SBOMTargetPrefix + "prod",
+		},
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, req client.SolveRequest) (*client.Result, error) {
+		exported = readMkfile(t, req.Definition, "/sbom.spdx.json")
+		return &client.Result{}, nil
+	})
+
+	if _, err := b.Build(context.TODO(), solver, c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := digest.FromBytes(exported).String()
+	if label := img.Config.Labels[builddef.SBOMDigestLabel]; label != expected {
+		t.Fatalf("Expected: %s\nGot: %s", expected, label)
+	}
+}
+
+// TestAutoLockedImageAndLockfileComeFromOneResolution checks that the
+// lockfile returned along with an image built in auto-lock mode is the one
+// the image has been built from, even when locks change between two
+// resolutions.
+func TestAutoLockedImageAndLockfileComeFromOneResolution(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/out-of-sync.yml")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any()).Times(1)
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.yml", gomock.Any(),
+	).Return(zbuildYml, nil)
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "zbuild.lock", gomock.Any(),
+	).Return(nil, statesolver.FileNotFound)
+
+	var resolutions int
+	var builtFrom builddef.RawLocks
+	handler := mocks.NewMockKindHandler(mockCtrl)
+	handler.EXPECT().WithSolver(gomock.Any()).AnyTimes()
+	handler.EXPECT().UpdateLocks(
+		gomock.Any(), gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(_ context.Context, _ pkgsolver.PackageSolversMap, _ builddef.UpdateLocksOpts) (builddef.Locks, error) {
+		resolutions++
+		return stubLocks{map[string]interface{}{
+			"base_image": fmt.Sprintf("docker.io/library/nginx:1.19.%d", resolutions),
+		}}, nil
+	}).AnyTimes()
+	handler.EXPECT().Build(
+		gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(_ context.Context, opts builddef.BuildOpts) (llb.State, *image.Image, error) {
+		builtFrom = opts.Def.RawLocks
+		return llb.State{}, &image.Image{}, nil
+	})
+
+	registry := registry.NewKindRegistry()
+	registry.Register("webserver", handler, false)
+	b := builder.Builder{Registry: registry}
+
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context":                   "some-context-name",
+			"build-arg:ZBUILD_AUTOLOCK": "1",
+		},
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).Return(&client.Result{}, nil)
+
+	res, err := b.Build(context.TODO(), solver, c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resolutions != 1 {
+		t.Fatalf("Expected locks to be resolved once, got %d resolutions.", resolutions)
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(res.Metadata["containerimage.config"], &img); err != nil {
+		t.Fatal(err)
+	}
+	var lockfile builddef.RawLocks
+	if err := yaml.Unmarshal(res.Metadata[builder.LockfileMetadataKey], &lockfile); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(lockfile, builtFrom); diff != nil {
+		t.Fatal(diff)
+	}
+	expected := strconv.FormatUint(lockfile.Hash(), 10)
+	if label := img.Config.Labels[builddef.LockHashLabel]; label != expected {
+		t.Fatalf("Expected: %s\nGot: %s", expected, label)
+	}
+}
+
+// TestAutoLockResolvesPackagesWithoutLayerCache checks that locks resolved
+// on the fly by zbuilder don't come from commands cached by buildkitd during
+// a previous build, as package versions and git refs change over time.
+func TestAutoLockResolvesPackagesWithoutLayerCache(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	zbuildYml := loadRawTestdata(t, "testdata/build/out-of-sync.yml")
+	madison := "      curl | 7.64.0-4+deb10u1 | http://deb.debian.org/debian buster/main amd64 Packages\n"
+
+	ref := llbtest.NewMockReference(mockCtrl)
+	ref.EXPECT().ReadFile(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+		func(_ context.Context, req client.ReadRequest) ([]byte, error) {
+			switch req.Filename {
+			case "zbuild.yml":
+				return zbuildYml, nil
+			case "/tmp/result":
+				return []byte(madison), nil
+			case "/tmp/exitcode":
+				return []byte("0\n"), nil
+			}
+			return nil, xerrors.Errorf("open %s: no such file or directory", req.Filename)
+		})
+
+	var execs int
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"context": "some-context-name",
+			"target":  builder.LockfileTarget,
+		},
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+		func(_ context.Context, req client.SolveRequest) (*client.Result, error) {
+			for _, raw := range req.Definition.Def {
+				var op pb.Op
+				if err := op.Unmarshal(raw); err != nil {
+					t.Fatal(err)
+				}
+				if op.GetExec() == nil {
+					continue
+				}
+				execs++
+				if !req.Definition.Metadata[digest.FromBytes(raw)].IgnoreCache {
+					t.Errorf("Expected %q to be run without the layer cache.", op.GetExec().Meta.Args)
+				}
+			}
+			return &client.Result{Ref: ref}, nil
+		})
+
+	var handlerSolver statesolver.StateSolver
+	handler := mocks.NewMockKindHandler(mockCtrl)
+	handler.EXPECT().WithSolver(gomock.Any()).Do(func(solver statesolver.StateSolver) {
+		handlerSolver = solver
+	})
+	handler.EXPECT().UpdateLocks(
+		gomock.Any(), gomock.Any(), gomock.Any(),
+	).DoAndReturn(func(ctx context.Context, pkgSolvers pkgsolver.PackageSolversMap, _ builddef.UpdateLocksOpts) (builddef.Locks, error) {
+		pkgSolver := pkgSolvers.New(pkgsolver.APT, handlerSolver)
+		versions, err := pkgSolver.ResolveVersions(ctx, "docker.io/library/debian:buster", map[string]string{
+			"curl": "*",
+		})
+		if err != nil {
+			return nil, err
+		}
+		return stubLocks{map[string]interface{}{
+			"system_packages": versions,
+		}}, nil
+	})
+
+	registry := registry.NewKindRegistry()
+	registry.Register("webserver", handler, false)
+	b := builder.Builder{
+		Registry:   registry,
+		PkgSolvers: pkgsolver.DefaultPackageSolversMap,
+	}
+
+	solver := statesolver.NewBuildkitSolver(c)
+	if _, err := b.Build(context.TODO(), solver, c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if execs == 0 {
+		t.Fatalf("Expected package versions to be resolved with buildkit.")
+	}
+}
+
+// readMkfile returns the content of the file created at the given path by
+// the given LLB definition.
+func readMkfile(t *testing.T, def *pb.Definition, path string) []byte {
+	for _, raw := range def.Def {
+		var op pb.Op
+		if err := op.Unmarshal(raw); err != nil {
+			t.Fatal(err)
+		}
+		file := op.GetFile()
+		if file == nil {
+			continue
+		}
+		for _, action := range file.Actions {
+			if mkfile := action.GetMkfile(); mkfile != nil && mkfile.Path == path {
+				return mkfile.Data
+			}
+		}
+	}
+
+	t.Fatalf("No file created at %s.", path)
+	return nil
+}
+
 func MatchBuildOpts(expected builddef.BuildOpts) buildOptsMatcher {
 	return buildOptsMatcher{expected}
 }
@@ -527,7 +1193,7 @@ func (m buildOptsMatcher) Matches(x interface{}) bool {
 }
 
 func (m buildOptsMatcher) String() string {
-	return fmt.Sprintf("{%s %s %s %s %s}",
+	return fmt.Sprintf("{%s %s %s %s %v}",
 		m.opts.File,
 		m.opts.LockFile,
 		m.opts.Stage,
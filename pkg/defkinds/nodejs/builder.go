@@ -3,13 +3,14 @@ package nodejs
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"path"
 	"strings"
-	"time"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/image"
 	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/registry"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/moby/buildkit/client/llb"
@@ -37,13 +38,20 @@ func RegisterKind(reg *registry.KindRegistry) {
 }
 
 type NodeJSHandler struct {
-	solver statesolver.StateSolver
+	solver     statesolver.StateSolver
+	httpClient *http.Client
 }
 
 func (h *NodeJSHandler) WithSolver(solver statesolver.StateSolver) {
 	h.solver = solver
 }
 
+// WithHTTPClient sets the HTTP client used to download external files when
+// their checksums are locked.
+func (h *NodeJSHandler) WithHTTPClient(c *http.Client) {
+	h.httpClient = c
+}
+
 func (h *NodeJSHandler) DebugConfig(
 	buildOpts builddef.BuildOpts,
 ) (interface{}, error) {
@@ -70,6 +78,14 @@ func (h *NodeJSHandler) Build(
 		return state, img, err
 	}
 
+	stageDef.ExternalFiles = llbutils.WithLockedChecksums(
+		stageDef.ExternalFiles, stageDef.StageLocks.ExternalFiles)
+	if buildOpts.Strict && !*stageDef.Dev {
+		if err := llbutils.CheckExternalFilesChecksums(stageDef.ExternalFiles); err != nil {
+			return state, img, err
+		}
+	}
+
 	stageDef.PackageManager, err = h.determinePackageManager(ctx, stageDef, buildOpts)
 	if err != nil {
 		return state, img, err
@@ -98,26 +114,41 @@ func (h *NodeJSHandler) buildNodeJS(
 	img := image.CloneMeta(baseImg)
 	img.Config.Labels[builddef.ZbuildLabel] = "true"
 
-	pkgManager := llbutils.APT
-	if stageDef.DefLocks.OSRelease.Name == "alpine" {
-		pkgManager = llbutils.APK
+	srcContext := resolveSourceContext(stageDef, buildOpts)
+	if sourceDate, ok := buildOpts.SourceDate(srcContext); ok {
+		state = llbutils.WithCreatedTime(state, sourceDate)
+	}
+
+	_, pkgManager, err := pkgsolver.ResolvePackageManager(stageDef.DefLocks.OSRelease)
+	if err != nil {
+		return state, img, err
 	}
 
 	if buildOpts.WithCacheMounts && len(stageDef.StageLocks.SystemPackages) > 0 {
 		state = llbutils.SetupSystemPackagesCache(state, pkgManager)
 	}
 
+	pkgOpts := llbutils.NewCachingStrategyFromBuildOpts(buildOpts)
+	pkgOpts.DebianSnapshot = llbutils.LockedDebianSnapshot(buildOpts,
+		stageDef.DefLocks.OSRelease, stageDef.DefLocks.DebianSnapshot)
+
 	state, err = llbutils.InstallSystemPackages(state, pkgManager,
-		stageDef.StageLocks.SystemPackages,
-		llbutils.NewCachingStrategyFromBuildOpts(buildOpts))
+		stageDef.StageLocks.SystemPackages, pkgOpts)
 	if err != nil {
 		return state, img, xerrors.Errorf("failed to add \"install system pacakges\" steps: %w", err)
 	}
 
 	state = llbutils.CopyExternalFiles(state, stageDef.ExternalFiles)
-	state = llbutils.Mkdir(state, "1000:1000",
+
+	state, err = llbutils.CreateUser(state, pkgManager, stageDef.User,
+		buildOpts.IgnoreLayerCache)
+	if err != nil {
+		return state, img, xerrors.Errorf("failed to add \"create user\" step: %w", err)
+	}
+
+	state = llbutils.Mkdir(state, stageDef.User.Owner(),
 		append([]string{WorkingDir}, stageDef.StatefulDirs...)...)
-	state = state.User("1000")
+	state = state.User(stageDef.User.UserID())
 	state = state.Dir(WorkingDir)
 
 	state = h.globalPackagesInstall(state, stageDef, buildOpts)
@@ -132,12 +163,19 @@ func (h *NodeJSHandler) buildNodeJS(
 		state = h.build(stageDef, state, buildOpts)
 	}
 
-	setImageMetadata(stageDef, state, img)
+	if err := setImageMetadata(stageDef, state, img); err != nil {
+		return state, img, err
+	}
+	// Labels are set after the metadata, as the creation date of the image
+	// is used.
+	labels := builddef.ImageLabels(buildOpts, stageDef.DefLocks.BaseImage,
+		resolveSourceContext(stageDef, buildOpts), *img.Created)
+	labels.Merge(stageDef.Labels).ApplyTo(img)
 
 	return state, img, nil
 }
 
-func setImageMetadata(stageDef StageDefinition, state llb.State, img *image.Image) {
+func setImageMetadata(stageDef StageDefinition, state llb.State, img *image.Image) error {
 	for _, dir := range stageDef.StatefulDirs {
 		fullpath := dir
 		if !path.IsAbs(fullpath) {
@@ -156,18 +194,22 @@ func setImageMetadata(stageDef StageDefinition, state llb.State, img *image.Imag
 		nodeEnv = "production"
 	}
 
-	img.Config.User = "1000"
+	img.Config.User = stageDef.User.UserID()
 	img.Config.WorkingDir = WorkingDir
 	img.Config.Env = []string{
 		"PATH=" + getEnv(state, "PATH"),
 		"NODE_ENV=" + nodeEnv,
 	}
-	now := time.Now()
-	img.Created = &now
-
 	if stageDef.Command != nil {
 		img.Config.Cmd = *stageDef.Command
 	}
+
+	// The image config from the stage takes precedence over the one above.
+	if err := stageDef.Image.ApplyTo(img); err != nil {
+		return err
+	}
+
+	return llbutils.SetImageCreated(state, img)
 }
 
 func getEnv(src llb.State, name string) string {
@@ -192,7 +234,7 @@ func (h *NodeJSHandler) globalPackagesInstall(
 		pkgs = append(pkgs, pkg)
 	}
 
-	runOpts := []llb.RunOption{llb.User("1000")}
+	runOpts := []llb.RunOption{llb.User(stageDef.User.UserID())}
 	if stageDef.PackageManager == pkgManagerYarn {
 		runOpts = append(runOpts,
 			llbutils.Shell("yarn global add "+strings.Join(pkgs, " ")),
@@ -208,7 +250,7 @@ func (h *NodeJSHandler) globalPackagesInstall(
 	}
 
 	runOpts, state = cacheMountOptForJSDeps(
-		runOpts, state, buildOpts, stageDef.PackageManager)
+		runOpts, state, stageDef, buildOpts)
 
 	return state.Run(runOpts...).Root()
 }
@@ -216,22 +258,22 @@ func (h *NodeJSHandler) globalPackagesInstall(
 func cacheMountOptForJSDeps(
 	runOpts []llb.RunOption,
 	state llb.State,
+	stageDef StageDefinition,
 	buildOpts builddef.BuildOpts,
-	pkgMgr string,
 ) ([]llb.RunOption, llb.State) {
 	if !buildOpts.WithCacheMounts {
 		return runOpts, state
 	}
 
-	if pkgMgr == pkgManagerYarn {
+	if stageDef.PackageManager == pkgManagerYarn {
 		runOpts = append(runOpts, llbutils.CacheMountOpt(
-			"/home/node/.cache/yarn", buildOpts.CacheIDNamespace, "1000"))
+			"/home/node/.cache/yarn", buildOpts.CacheIDNamespace, stageDef.User.UserID()))
 		return runOpts, state
 	}
 
 	state = state.AddEnv("NPM_CONFIG_PREFIX", "/home/node/.npm")
 	runOpts = append(runOpts, llbutils.CacheMountOpt(
-		"/home/node/.npm/", buildOpts.CacheIDNamespace, "1000"))
+		"/home/node/.npm/", buildOpts.CacheIDNamespace, stageDef.User.UserID()))
 
 	return runOpts, state
 }
@@ -285,14 +327,14 @@ func (h *NodeJSHandler) depsInstall(
 		llb.WithCustomName(srcLabel))
 
 	state = llbutils.Copy(
-		srcState, include[0], state, "/app/", "1000:1000", buildOpts.IgnoreLayerCache)
+		srcState, include[0], state, "/app/", stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 	state = llbutils.Copy(
-		srcState, include[1], state, "/app/", "1000:1000", buildOpts.IgnoreLayerCache)
+		srcState, include[1], state, "/app/", stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 
 	runOpts := []llb.RunOption{
 		llbutils.Shell(installCmd),
 		llb.Dir(state.GetDir()),
-		llb.User("1000"),
+		llb.User(stageDef.User.UserID()),
 		llb.WithCustomName(installLabel)}
 
 	if buildOpts.IgnoreLayerCache {
@@ -300,7 +342,7 @@ func (h *NodeJSHandler) depsInstall(
 	}
 
 	runOpts, state = cacheMountOptForJSDeps(
-		runOpts, state, buildOpts, stageDef.PackageManager)
+		runOpts, state, stageDef, buildOpts)
 
 	return state.Run(runOpts...).Root()
 }
@@ -322,7 +364,7 @@ func (h *NodeJSHandler) copySources(
 	if sourceContext.Type == builddef.ContextTypeLocal {
 		srcPath := prefixContextPath(sourceContext, "/")
 		return llbutils.Copy(
-			srcState, srcPath, state, WorkingDir, "1000:1000", buildOpts.IgnoreLayerCache)
+			srcState, srcPath, state, WorkingDir, stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 	}
 
 	// Despite the IncludePatterns() above, the source state might also
@@ -333,7 +375,7 @@ func (h *NodeJSHandler) copySources(
 		srcPath := prefixContextPath(sourceContext, srcfile)
 		destPath := path.Join(WorkingDir, srcfile)
 		state = llbutils.Copy(
-			srcState, srcPath, state, destPath, "1000:1000", buildOpts.IgnoreLayerCache)
+			srcState, srcPath, state, destPath, stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 	}
 
 	return state
@@ -370,7 +412,7 @@ func (h *NodeJSHandler) copyConfigFiles(
 	// if the cache is fresh (when using a local context). As such, we can't
 	// just copy the whole source state to the dest state.
 	state = llbutils.CopyAll(
-		srcState, state, interpolated, "1000:1000", buildOpts.IgnoreLayerCache)
+		srcState, state, interpolated, stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 
 	return state, nil
 }
@@ -1,8 +1,11 @@
 package nodejs_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/defkinds/nodejs"
@@ -73,7 +76,9 @@ func initBuildLLBForDevStageTC(t *testing.T, mockCtrl *gomock.Controller) buildT
 					},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:4d1016eefc4e6dc52ba9be6550dcb25a6e1826117507e65eda3650d6eb19f042",
+						builddef.LabelTitle:      "dev",
+						"io.zbuild":              "true",
 					},
 				},
 			},
@@ -127,7 +132,8 @@ func initBuildLLBForProdFrontendStageTC(t *testing.T, mockCtrl *gomock.Controlle
 					Volumes:    map[string]struct{}{},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelTitle: "prod",
+						"io.zbuild":         "true",
 					},
 				},
 			},
@@ -185,7 +191,9 @@ func initBuildLLBForWorkerStageTC(t *testing.T, mockCtrl *gomock.Controller) bui
 					},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:4d1016eefc4e6dc52ba9be6550dcb25a6e1826117507e65eda3650d6eb19f042",
+						builddef.LabelTitle:      "worker",
+						"io.zbuild":              "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -247,7 +255,10 @@ func initBuildLLBWithGitBuildContextTC(t *testing.T, mockCtrl *gomock.Controller
 					},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:4d1016eefc4e6dc52ba9be6550dcb25a6e1826117507e65eda3650d6eb19f042",
+						builddef.LabelSource:     "git://github.com/some/repo",
+						builddef.LabelTitle:      "prod",
+						"io.zbuild":              "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -304,7 +315,11 @@ func initBuildLLBWithGitSourceContextTC(t *testing.T, mockCtrl *gomock.Controlle
 					Volumes:    map[string]struct{}{},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:4d1016eefc4e6dc52ba9be6550dcb25a6e1826117507e65eda3650d6eb19f042",
+						builddef.LabelRevision:   "5ecd2177087afbcce8f88ddfedbc7b95e738d961",
+						builddef.LabelSource:     "github.com/api-platform/demo",
+						builddef.LabelTitle:      "prod",
+						"io.zbuild":              "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -364,7 +379,11 @@ func initBuildLLBWithGitBuildAndSourceContextTC(t *testing.T, mockCtrl *gomock.C
 					Volumes:    map[string]struct{}{},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:4d1016eefc4e6dc52ba9be6550dcb25a6e1826117507e65eda3650d6eb19f042",
+						builddef.LabelRevision:   "5ecd2177087afbcce8f88ddfedbc7b95e738d961",
+						builddef.LabelSource:     "github.com/api-platform/demo",
+						builddef.LabelTitle:      "prod",
+						"io.zbuild":              "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -421,7 +440,8 @@ func initBuildLLBForNpmBasedProjectTC(t *testing.T, mockCtrl *gomock.Controller)
 					Volumes:    map[string]struct{}{},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelTitle: "prod",
+						"io.zbuild":         "true",
 					},
 				},
 			},
@@ -475,7 +495,9 @@ func initBuildLLBForAlpineBasedBaseImageTC(t *testing.T, mockCtrl *gomock.Contro
 					Volumes:    map[string]struct{}{},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:1dd4309479f031295f3dfb61cf3afc3efeb1a991b012e105d1a95efc038b72f6",
+						builddef.LabelTitle:      "prod",
+						"io.zbuild":              "true",
 					},
 				},
 			},
@@ -533,7 +555,9 @@ func initBuildLLBForWorkerStageWithCacheMountsTC(t *testing.T, mockCtrl *gomock.
 					Volumes:    map[string]struct{}{},
 					WorkingDir: "/app",
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:4d1016eefc4e6dc52ba9be6550dcb25a6e1826117507e65eda3650d6eb19f042",
+						builddef.LabelTitle:      "worker",
+						"io.zbuild":              "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -599,6 +623,7 @@ func TestBuild(t *testing.T) {
 			}
 
 			img.Created = nil
+			delete(img.Config.Labels, builddef.LabelCreated)
 			img.History = nil
 			img.RootFS.DiffIDs = nil
 			if diff := deep.Equal(img, tc.expectedImage); diff != nil {
@@ -701,3 +726,88 @@ func TestDebugConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildWithSourceDateEpochIsReproducible(t *testing.T) {
+	if *flagTestdata {
+		return
+	}
+
+	created := time.Date(2020, time.January, 21, 0, 0, 0, 0, time.UTC)
+	baseImage := llbtest.NewImageRegistry(t, "library/node", specs.Image{
+		Created:      &created,
+		Architecture: "amd64",
+		OS:           "linux",
+		Config: specs.ImageConfig{
+			Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			Entrypoint: []string{"docker-entrypoint.sh"},
+			Cmd:        []string{"node"},
+		},
+		RootFS: specs.RootFS{Type: "layers"},
+		History: []specs.History{
+			{Created: &created, CreatedBy: "/bin/sh -c #(nop) CMD [\"node\"]", EmptyLayer: true},
+		},
+	})
+
+	genericDef := loadBuildDef(t, "testdata/build/with-cache-mounts.yml")
+	genericDef.RawLocks = loadDefLocks(t, "testdata/build/with-cache-mounts.lock")
+	genericDef.RawLocks.Raw["base"] = baseImage
+
+	sourceDate := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	buildOpts := builddef.BuildOpts{
+		Def:             genericDef,
+		Stage:           "prod",
+		SessionID:       "<SESSION-ID>",
+		LocalUniqueID:   "x1htr02606a9rk8b0daewh9es",
+		SourceDateEpoch: &sourceDate,
+		BuildContext: &builddef.Context{
+			Source: "context",
+			Type:   builddef.ContextTypeLocal,
+		},
+	}
+
+	build := func() (string, []byte) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		solver := mocks.NewMockStateSolver(mockCtrl)
+		solver.EXPECT().
+			FileExists(gomock.Any(), "package-lock.json", gomock.Any()).
+			Return(false, nil)
+
+		handler := nodejs.NodeJSHandler{}
+		handler.WithSolver(solver)
+
+		state, img, err := handler.Build(context.Background(), buildOpts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		imgConfig, err := json.Marshal(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return llbtest.StateToJSON(t, state), imgConfig
+	}
+
+	firstState, firstConfig := build()
+	// Ensure the current time changes between the two builds.
+	time.Sleep(10 * time.Millisecond)
+	secondState, secondConfig := build()
+
+	if firstState != secondState {
+		t.Fatalf("Expected LLB states to be identical:\n%s\n%s", firstState, secondState)
+	}
+	if !bytes.Equal(firstConfig, secondConfig) {
+		t.Fatalf("Expected image configs to be identical:\n%s\n%s", firstConfig, secondConfig)
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(firstConfig, &img); err != nil {
+		t.Fatal(err)
+	}
+	if !img.Created.Equal(sourceDate) {
+		t.Fatalf("Expected image to be created at %v, got %v.", sourceDate, img.Created)
+	}
+	if created := img.Config.Labels[builddef.LabelCreated]; created != "2020-03-01T10:00:00Z" {
+		t.Fatalf("Unexpected %s label: %q", builddef.LabelCreated, created)
+	}
+}
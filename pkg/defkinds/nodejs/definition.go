@@ -190,11 +190,23 @@ func (d Definition) IsValid() error {
 	if !d.BaseStage.Healthcheck.IsValid(allowedHCTypes) {
 		return xerrors.New("base stage has an invalid healthcheck")
 	}
+	if err := d.BaseStage.Image.IsValid(); err != nil {
+		return xerrors.Errorf("base stage has an invalid image config: %w", err)
+	}
+	if err := d.BaseStage.User.IsValid(); err != nil {
+		return xerrors.Errorf("base stage has an invalid user: %w", err)
+	}
 
 	for name, stage := range d.Stages {
 		if !stage.Healthcheck.IsValid(allowedHCTypes) {
 			return xerrors.Errorf("stage %q has an invalid healthcheck", name)
 		}
+		if err := stage.Image.IsValid(); err != nil {
+			return xerrors.Errorf("stage %q has an invalid image config: %w", name, err)
+		}
+		if err := stage.User.IsValid(); err != nil {
+			return xerrors.Errorf("stage %q has an invalid user: %w", name, err)
+		}
 	}
 
 	return nil
@@ -238,6 +250,9 @@ type Stage struct {
 	Sources        []string                    `mapstructure:"sources"`
 	StatefulDirs   []string                    `mapstructure:"stateful_dirs"`
 	Healthcheck    *builddef.HealthcheckConfig `mapstructure:"healthcheck"`
+	Labels         builddef.Labels             `mapstructure:"labels"`
+	Image          builddef.ImageConfig        `mapstructure:"image"`
+	User           *builddef.UserConfig        `mapstructure:"user"`
 }
 
 func (s Stage) Copy() Stage {
@@ -251,6 +266,9 @@ func (s Stage) Copy() Stage {
 		Sources:        make([]string, len(s.Sources)),
 		StatefulDirs:   make([]string, len(s.StatefulDirs)),
 		Healthcheck:    s.Healthcheck,
+		Labels:         s.Labels.Copy(),
+		Image:          s.Image.Copy(),
+		User:           s.User.Copy(),
 	}
 
 	copy(new.ExternalFiles, s.ExternalFiles)
@@ -266,6 +284,8 @@ func (s Stage) Merge(overriding Stage) Stage {
 	new.Sources = append(new.Sources, overriding.Sources...)
 	new.ConfigFiles = new.ConfigFiles.Merge(overriding.ConfigFiles)
 	new.StatefulDirs = append(new.StatefulDirs, overriding.StatefulDirs...)
+	new.Labels = new.Labels.Merge(overriding.Labels)
+	new.Image = new.Image.Merge(overriding.Image)
 	new.SystemPackages.Merge(overriding.SystemPackages)
 	new.GlobalPackages.Merge(overriding.GlobalPackages)
 
@@ -281,6 +301,9 @@ func (s Stage) Merge(overriding Stage) Stage {
 		healthcheck := *overriding.Healthcheck
 		new.Healthcheck = &healthcheck
 	}
+	if overriding.User != nil {
+		new.User = overriding.User.Copy()
+	}
 
 	return new
 }
@@ -959,6 +959,143 @@ func initIgnoreNilHealthcheckTC() mergeStageTC {
 	}
 }
 
+func initMergeLabelsWithBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() nodejs.Stage {
+			return nodejs.Stage{
+				Labels: builddef.Labels{
+					"com.example.team":                "api",
+					"org.opencontainers.image.vendor": "Example",
+				},
+			}
+		},
+		overriding: nodejs.Stage{
+			Labels: builddef.Labels{
+				"com.example.team": "backend",
+			},
+		},
+		expected: func() nodejs.Stage {
+			s := emptyStage()
+			s.Labels = builddef.Labels{
+				"com.example.team":                "backend",
+				"org.opencontainers.image.vendor": "Example",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeLabelsWithoutBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() nodejs.Stage {
+			return nodejs.Stage{}
+		},
+		overriding: nodejs.Stage{
+			Labels: builddef.Labels{
+				"com.example.team": "backend",
+			},
+		},
+		expected: func() nodejs.Stage {
+			s := emptyStage()
+			s.Labels = builddef.Labels{
+				"com.example.team": "backend",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeImageConfigWithBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() nodejs.Stage {
+			return nodejs.Stage{
+				Image: builddef.ImageConfig{
+					Ports:      []string{"8080"},
+					Env:        map[string]string{"APP_ENV": "dev", "LOG_LEVEL": "debug"},
+					StopSignal: "SIGQUIT",
+				},
+			}
+		},
+		overriding: nodejs.Stage{
+			Image: builddef.ImageConfig{
+				Ports:      []string{"9090/udp"},
+				Env:        map[string]string{"APP_ENV": "prod"},
+				Entrypoint: &[]string{"tini", "--"},
+			},
+		},
+		expected: func() nodejs.Stage {
+			s := emptyStage()
+			s.Image = builddef.ImageConfig{
+				Ports:      []string{"8080", "9090/udp"},
+				Env:        map[string]string{"APP_ENV": "prod", "LOG_LEVEL": "debug"},
+				Entrypoint: &[]string{"tini", "--"},
+				StopSignal: "SIGQUIT",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeImageConfigWithoutBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() nodejs.Stage {
+			return nodejs.Stage{}
+		},
+		overriding: nodejs.Stage{
+			Image: builddef.ImageConfig{
+				Env:  map[string]string{"APP_ENV": "prod"},
+				User: "www-data",
+			},
+		},
+		expected: func() nodejs.Stage {
+			s := emptyStage()
+			s.Image = builddef.ImageConfig{
+				Env:  map[string]string{"APP_ENV": "prod"},
+				User: "www-data",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeUserWithBaseTC() mergeStageTC {
+	baseUID, uid, gid := 1000, 1500, 0
+
+	return mergeStageTC{
+		base: func() nodejs.Stage {
+			return nodejs.Stage{
+				User: &builddef.UserConfig{UID: &baseUID},
+			}
+		},
+		overriding: nodejs.Stage{
+			User: &builddef.UserConfig{UID: &uid, GID: &gid, Name: "app"},
+		},
+		expected: func() nodejs.Stage {
+			s := emptyStage()
+			s.User = &builddef.UserConfig{UID: &uid, GID: &gid, Name: "app"}
+			return s
+		},
+	}
+}
+
+func initIgnoreNilUserTC() mergeStageTC {
+	uid := 1500
+
+	return mergeStageTC{
+		base: func() nodejs.Stage {
+			return nodejs.Stage{
+				User: &builddef.UserConfig{UID: &uid},
+			}
+		},
+		overriding: nodejs.Stage{},
+		expected: func() nodejs.Stage {
+			s := emptyStage()
+			s.User = &builddef.UserConfig{UID: &uid}
+			return s
+		},
+	}
+}
+
 func TestStageMerge(t *testing.T) {
 	testcases := map[string]func() mergeStageTC{
 		"merge external files with base":     initMergeExternalFilesWithBaseTC,
@@ -980,6 +1117,12 @@ func TestStageMerge(t *testing.T) {
 		"merge healthcheck with base":        initMergeHealthcheckWithBaseTC,
 		"merge healthcheck without base":     initMergeHealthcheckWithoutBaseTC,
 		"ignore nil healthcheck":             initIgnoreNilHealthcheckTC,
+		"merge labels with base":             initMergeLabelsWithBaseTC,
+		"merge labels without base":          initMergeLabelsWithoutBaseTC,
+		"merge image config with base":       initMergeImageConfigWithBaseTC,
+		"merge image config without base":    initMergeImageConfigWithoutBaseTC,
+		"merge user with base":               initMergeUserWithBaseTC,
+		"ignore nil user":                    initIgnoreNilUserTC,
 	}
 
 	for tcname := range testcases {
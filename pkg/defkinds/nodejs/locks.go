@@ -4,8 +4,10 @@ import (
 	"context"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/statesolver"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 )
 
@@ -14,14 +16,18 @@ type DefinitionLocks struct {
 	OSRelease     builddef.OSRelease    `mapstructure:"osrelease"`
 	Stages        map[string]StageLocks `mapstructure:"stages"`
 	SourceContext *builddef.Context     `mapstructure:"source_context"`
+	// DebianSnapshot is the timestamp of the Debian archive snapshot system
+	// packages are installed from (only for Debian-based images).
+	DebianSnapshot string `mapstructure:"debian_snapshot"`
 }
 
 // @TODO: add a generic way to transform locks into rawlocks
 func (l DefinitionLocks) RawLocks() map[string]interface{} {
 	lockdata := map[string]interface{}{
-		"base":           l.BaseImage,
-		"osrelease":      l.OSRelease,
-		"source_context": nil,
+		"base":            l.BaseImage,
+		"osrelease":       l.OSRelease,
+		"source_context":  nil,
+		"debian_snapshot": l.DebianSnapshot,
 	}
 
 	if l.SourceContext != nil {
@@ -39,11 +45,15 @@ func (l DefinitionLocks) RawLocks() map[string]interface{} {
 
 type StageLocks struct {
 	SystemPackages map[string]string `mapstructure:"system_packages"`
+	// ExternalFiles is a map of external file URLs associated to the
+	// checksum of their content.
+	ExternalFiles map[string]string `mapstructure:"external_files"`
 }
 
 func (l StageLocks) RawLocks() map[string]interface{} {
 	return map[string]interface{}{
 		"system_packages": l.SystemPackages,
+		"external_files":  l.ExternalFiles,
 	}
 }
 
@@ -57,41 +67,66 @@ func (h *NodeJSHandler) UpdateLocks(
 		return nil, err
 	}
 
-	if opts.UpdateImageRef {
-		def.Locks.BaseImage, err = h.solver.ResolveImageRef(ctx, def.BaseImage)
-		if err != nil {
-			return nil, xerrors.Errorf("could not resolve image %q: %w",
-				def.BaseImage, err)
-		}
-
-		osrelease, err := statesolver.ResolveImageOS(ctx, h.solver, def.Locks.BaseImage)
-		if err != nil {
-			return nil, xerrors.Errorf("could not resolve OS details from base image: %w", err)
-		}
-		def.Locks.OSRelease = osrelease
+	if err := h.lockImageAndContext(ctx, &def, opts); err != nil {
+		return nil, err
 	}
 
-	var pkgSolverType pkgsolver.SolverType
-	if def.Locks.OSRelease.Name == "debian" {
-		pkgSolverType = pkgsolver.APT
-	} else if def.Locks.OSRelease.Name == "alpine" {
-		pkgSolverType = pkgsolver.APK
-	} else {
-		return nil, xerrors.Errorf("unsupported OS %q: only debian-based and alpine-based base images are supported", def.Locks.OSRelease.Name)
+	pkgSolverType, _, err := pkgsolver.ResolvePackageManager(def.Locks.OSRelease)
+	if err != nil {
+		return nil, err
 	}
 
 	pkgSolver := pkgSolvers.New(pkgSolverType, h.solver)
+	if opts.UpdateSystemPackages {
+		def.Locks.DebianSnapshot = pkgsolver.LockDebianSnapshot(pkgSolver,
+			def.Locks.OSRelease, opts)
+	}
+
 	def.Locks.Stages, err = h.updateStagesLocks(ctx, pkgSolver, def, opts)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to update stages locks: %w", err)
 	}
 
-	def.Locks.SourceContext, err = h.lockSourceContext(ctx, def.SourceContext)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to lock source context: %w", err)
+	return def.Locks, err
+}
+
+// lockImageAndContext concurrently resolves the base image (and the OS
+// details it provides) and the source context.
+func (h *NodeJSHandler) lockImageAndContext(
+	ctx context.Context,
+	def *Definition,
+	opts builddef.UpdateLocksOpts,
+) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	if opts.UpdateImageRef {
+		eg.Go(func() error {
+			baseImage, err := h.solver.ResolveImageRef(ctx, def.BaseImage)
+			if err != nil {
+				return xerrors.Errorf("could not resolve image %q: %w",
+					def.BaseImage, err)
+			}
+			def.Locks.BaseImage = baseImage
+
+			osrelease, err := statesolver.ResolveImageOS(ctx, h.solver, baseImage)
+			if err != nil {
+				return xerrors.Errorf("could not resolve OS details from base image: %w", err)
+			}
+			def.Locks.OSRelease = osrelease
+			return nil
+		})
 	}
 
-	return def.Locks, err
+	eg.Go(func() error {
+		sourceContext, err := h.lockSourceContext(ctx, def.SourceContext)
+		if err != nil {
+			return xerrors.Errorf("failed to lock source context: %w", err)
+		}
+		def.Locks.SourceContext = sourceContext
+		return nil
+	})
+
+	return eg.Wait()
 }
 
 func (h *NodeJSHandler) updateStagesLocks(
@@ -100,24 +135,50 @@ func (h *NodeJSHandler) updateStagesLocks(
 	def Definition,
 	opts builddef.UpdateLocksOpts,
 ) (map[string]StageLocks, error) {
-	locks := map[string]StageLocks{}
-
+	stageDefs := make(map[string]StageDefinition, len(def.Stages))
 	for name := range def.Stages {
 		stageDef, err := def.ResolveStageDefinition(name, false)
 		if err != nil {
 			return nil, xerrors.Errorf("could not resolve stage %q: %w", name, err)
 		}
+		stageDefs[name] = stageDef
+	}
+
+	// System packages of all stages are looked up at once as each lookup
+	// might need to run a container. Each stage is still resolved on its
+	// own, with its own constraints.
+	var systemPackages map[string]map[string]string
+	if opts.UpdateSystemPackages {
+		stagesPkgs := make(map[string]map[string]string, len(stageDefs))
+		for name, stageDef := range stageDefs {
+			stagesPkgs[name] = stageDef.SystemPackages.Map()
+		}
+
+		var err error
+		systemPackages, err = pkgsolver.ResolveStages(ctx, pkgSolver,
+			def.Locks.BaseImage, stagesPkgs, opts)
+		if err != nil {
+			return nil, xerrors.Errorf("could not resolve versions of system packages to install: %w", err)
+		}
+	}
 
+	locks := map[string]StageLocks{}
+	for name, stageDef := range stageDefs {
 		stageLocks, ok := def.Locks.Stages[name]
 		if !ok {
 			stageLocks = StageLocks{}
 		}
 
 		if opts.UpdateSystemPackages {
-			stageLocks.SystemPackages, err = pkgSolver.ResolveVersions(ctx,
-				def.Locks.BaseImage, stageDef.SystemPackages.Map())
+			stageLocks.SystemPackages = systemPackages[name]
+		}
+
+		if opts.UpdateExternalFiles {
+			var err error
+			stageLocks.ExternalFiles, err = llbutils.LockExternalFiles(ctx,
+				h.httpClient, stageDef.ExternalFiles)
 			if err != nil {
-				return nil, xerrors.Errorf("could not resolve versions of system packages to install: %w", err)
+				return nil, xerrors.Errorf("could not lock external files: %w", err)
 			}
 		}
 
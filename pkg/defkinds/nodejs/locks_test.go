@@ -8,6 +8,7 @@ import (
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/defkinds/nodejs"
+	"github.com/NiR-/zbuild/pkg/llbtest"
 	"github.com/NiR-/zbuild/pkg/mocks"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/statesolver"
@@ -26,40 +27,18 @@ type updateLocksTC struct {
 	expectedErr error
 }
 
-var rawDebianOSRelease = []byte(`PRETTY_NAME="Debian GNU/Linux 10 (buster)"
-NAME="Debian GNU/Linux"
-VERSION_ID="10"
-VERSION="10 (buster)"
-VERSION_CODENAME=buster
-ID=debian
-HOME_URL="https://www.debian.org/"
-SUPPORT_URL="https://www.debian.org/support"
-BUG_REPORT_URL="https://bugs.debian.org/"`)
-
 func initUpdateLocksForDebianTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-	solver.EXPECT().ResolveImageRef(
-		gomock.Any(), "docker.io/library/node:12-buster-slim",
-	).Return("docker.io/library/node:12-buster-slim@sha256", nil)
-
-	solver.EXPECT().FromImage("docker.io/library/node:12-buster-slim@sha256").Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(),
-		"/etc/os-release",
-		gomock.Any(),
-	).Return(rawDebianOSRelease, nil)
-
 	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
 	pkgSolver.EXPECT().ResolveVersions(
 		gomock.Any(),
-		"docker.io/library/node:12-buster-slim@sha256",
+		llbtest.ImageRef("docker.io/library/node:12-buster-slim"),
 		map[string]string{"curl": "*"},
 	).AnyTimes().Return(map[string]string{
 		"curl": "curl-version",
 	}, nil)
 
 	h := nodejs.NodeJSHandler{}
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/debian.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -79,38 +58,18 @@ func initUpdateLocksForDebianTC(t *testing.T, mockCtrl *gomock.Controller) updat
 	}
 }
 
-var rawAlpine3103OSRelease = []byte(`NAME="Alpine Linux"
-ID=alpine
-VERSION_ID=3.10.3
-PRETTY_NAME="Alpine Linux v3.10"
-HOME_URL="https://alpinelinux.org/"
-BUG_REPORT_URL="https://bugs.alpinelinux.org/"
-`)
-
 func initUpdateLocksForAlpineTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-	solver.EXPECT().ResolveImageRef(
-		gomock.Any(), "docker.io/library/node:12-alpine",
-	).Return("docker.io/library/node:12-alpine@sha256", nil)
-
-	solver.EXPECT().FromImage("docker.io/library/node:12-alpine@sha256").Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(),
-		"/etc/os-release",
-		gomock.Any(),
-	).Return(rawAlpine3103OSRelease, nil)
-
 	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
 	pkgSolver.EXPECT().ResolveVersions(
 		gomock.Any(),
-		"docker.io/library/node:12-alpine@sha256",
+		llbtest.ImageRef("docker.io/library/node:12-alpine"),
 		map[string]string{"libsass-dev": "*"},
 	).AnyTimes().Return(map[string]string{
 		"libsass-dev": "1.2.3",
 	}, nil)
 
 	h := nodejs.NodeJSHandler{}
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/alpine.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -131,19 +90,18 @@ func initUpdateLocksForAlpineTC(t *testing.T, mockCtrl *gomock.Controller) updat
 }
 
 func initUpdateLocksButNotTheImageRefTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-
 	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
 	pkgSolver.EXPECT().ResolveVersions(
 		gomock.Any(),
-		"docker.io/library/node:12-alpine@sha256",
+		llbtest.ImageRef("docker.io/library/node:12-alpine"),
 		map[string]string{"libsass-dev": "*"},
 	).AnyTimes().Return(map[string]string{
 		"libsass-dev": "3.2.1",
 	}, nil)
 
 	h := nodejs.NodeJSHandler{}
-	h.WithSolver(solver)
+	// The solver isn't used when the image ref isn't updated.
+	h.WithSolver(statesolver.Replayer{})
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -163,31 +121,11 @@ func initUpdateLocksButNotTheImageRefTC(t *testing.T, mockCtrl *gomock.Controlle
 	}
 }
 
-var rawAlpine3112OSRelease = []byte(`NAME="Alpine Linux"
-ID=alpine
-VERSION_ID=3.11.2
-PRETTY_NAME="Alpine Linux v3.11"
-HOME_URL="https://alpinelinux.org/"
-BUG_REPORT_URL="https://bugs.alpinelinux.org/"
-`)
-
 func initUpdateLocksButNotSystemPackagesTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-	solver.EXPECT().ResolveImageRef(
-		gomock.Any(), "docker.io/library/node:12-alpine",
-	).Return("docker.io/library/node:12-alpine@some-other-sha256", nil)
-
-	solver.EXPECT().FromImage("docker.io/library/node:12-alpine@some-other-sha256").Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(),
-		"/etc/os-release",
-		gomock.Any(),
-	).Return(rawAlpine3112OSRelease, nil)
-
 	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
 
 	h := nodejs.NodeJSHandler{}
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/update-image-ref-only.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -207,6 +145,31 @@ func initUpdateLocksButNotSystemPackagesTC(t *testing.T, mockCtrl *gomock.Contro
 	}
 }
 
+func initUpdateExternalFilesOnlyTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
+	h := nodejs.NodeJSHandler{}
+	h.WithSolver(statesolver.Replayer{})
+	h.WithHTTPClient(llbtest.NewHTTPClient(t, map[string]string{
+		"https://github.com/krallin/tini/releases/download/v0.19.0/tini":                "tini",
+		"https://github.com/NiR-/fcgi-client/releases/download/v0.1.0/fcgi-client.phar": "fcgi-client",
+	}))
+
+	return updateLocksTC{
+		opts: builddef.UpdateLocksOpts{
+			BuildOpts: &builddef.BuildOpts{
+				Def: loadBuildDefWithLocks(t, "testdata/locks/external-files.yml"),
+			},
+			UpdateExternalFiles: true,
+		},
+		handler: &h,
+		pkgSolvers: pkgsolver.PackageSolversMap{
+			pkgsolver.APT: func(statesolver.StateSolver) pkgsolver.PackageSolver {
+				return mocks.NewMockPackageSolver(mockCtrl)
+			},
+		},
+		expected: "testdata/locks/expected-external-files-update.lock",
+	}
+}
+
 func loadBuildDefWithLocks(t *testing.T, filepath string) *builddef.BuildDef {
 	def := loadBuildDef(t, filepath)
 	def.RawLocks = loadRawLocks(t, builddef.LockFilepath(filepath))
@@ -231,6 +194,7 @@ func TestUpdateLocks(t *testing.T) {
 		"update locks for alpine base iamge":   initUpdateLocksForAlpineTC,
 		"update locks but not the image ref":   initUpdateLocksButNotTheImageRefTC,
 		"update locks but not system packages": initUpdateLocksButNotSystemPackagesTC,
+		"update only external files":           initUpdateExternalFilesOnlyTC,
 	}
 
 	for tcname := range testcases {
@@ -0,0 +1,195 @@
+package nodejs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/moby/buildkit/client/llb"
+	"golang.org/x/xerrors"
+)
+
+// loadJSPackages loads the lockfile of the given package manager from the
+// source context and returns the packages it lists. It returns no packages
+// if the lockfile couldn't be found.
+func loadJSPackages(
+	ctx context.Context,
+	solver statesolver.StateSolver,
+	sourceContext *builddef.Context,
+	pkgManager string,
+) ([]sbom.Package, error) {
+	lockfile := "package-lock.json"
+	parse := parsePackageLock
+	if pkgManager == pkgManagerYarn {
+		lockfile = "yarn.lock"
+		parse = parseYarnLock
+	}
+
+	lockpath := prefixContextPath(sourceContext, lockfile)
+	src := solver.FromContext(sourceContext,
+		llb.IncludePatterns([]string{lockpath}),
+		llb.SharedKeyHint(SharedKeys.PackageFiles),
+		llb.WithCustomName("load "+lockfile+" from build context"))
+
+	lockdata, err := solver.ReadFile(ctx, lockpath, src)
+	if xerrors.Is(err, statesolver.FileNotFound) {
+		return []sbom.Package{}, nil
+	} else if err != nil {
+		return nil, xerrors.Errorf("could not load %s: %w", lockfile, err)
+	}
+
+	return parse(lockdata)
+}
+
+type npmPkg struct {
+	Version   string `json:"version"`
+	Resolved  string `json:"resolved"`
+	Integrity string `json:"integrity"`
+	Link      bool   `json:"link"`
+}
+
+// npmDep is a dependency listed in package-lock.json v1. Its dependencies
+// are the versions of its own dependencies that couldn't be hoisted.
+type npmDep struct {
+	npmPkg
+	Dependencies map[string]npmDep `json:"dependencies"`
+}
+
+// parsePackageLock returns the packages listed in the given package-lock.json.
+// Both the "packages" key of lockfile v2+ and the nested "dependencies" of
+// lockfile v1 are supported.
+func parsePackageLock(lockdata []byte) ([]sbom.Package, error) {
+	parsed := struct {
+		Packages     map[string]npmPkg `json:"packages"`
+		Dependencies map[string]npmDep `json:"dependencies"`
+	}{}
+
+	if err := json.Unmarshal(lockdata, &parsed); err != nil {
+		return nil, xerrors.Errorf("could not unmarshal package-lock.json: %w", err)
+	}
+
+	pkgs := []sbom.Package{}
+	if len(parsed.Packages) > 0 {
+		for pkgPath, pkg := range parsed.Packages {
+			// The root package has an empty path.
+			i := strings.LastIndex(pkgPath, "node_modules/")
+			if i == -1 || pkg.Link {
+				continue
+			}
+			name := pkgPath[i+len("node_modules/"):]
+			pkgs = append(pkgs, newNPMPackage(name, pkg))
+		}
+		return pkgs, nil
+	}
+
+	var walk func(deps map[string]npmDep)
+	walk = func(deps map[string]npmDep) {
+		for name, dep := range deps {
+			pkgs = append(pkgs, newNPMPackage(name, dep.npmPkg))
+			walk(dep.Dependencies)
+		}
+	}
+	walk(parsed.Dependencies)
+
+	return pkgs, nil
+}
+
+// parseYarnLock returns the packages listed in the given yarn.lock.
+func parseYarnLock(lockdata []byte) ([]sbom.Package, error) {
+	pkgs := []sbom.Package{}
+
+	var name string
+	var pkg npmPkg
+	flush := func() {
+		if name != "" {
+			pkgs = append(pkgs, newNPMPackage(name, pkg))
+		}
+		name = ""
+		pkg = npmPkg{}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(lockdata))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// Entries start with the list of the version ranges they resolve,
+		// e.g. "@babel/core@^7.0.0", "@babel/core@^7.9.0":
+		if line[0] != ' ' {
+			flush()
+			spec := strings.Split(strings.TrimSuffix(trimmed, ":"), ",")[0]
+			spec = strings.Trim(spec, `"`)
+			if i := strings.LastIndex(spec, "@"); i > 0 {
+				name = spec[:i]
+			}
+			continue
+		}
+
+		// Fields nested deeper than the entry fields (e.g. dependencies)
+		// are ignored.
+		fields := strings.SplitN(trimmed, " ", 2)
+		if strings.HasPrefix(line, "   ") || len(fields) != 2 {
+			continue
+		}
+		value := strings.Trim(fields[1], `"`)
+		switch strings.TrimSuffix(fields[0], ":") {
+		case "version":
+			pkg.Version = value
+		case "resolved":
+			pkg.Resolved = value
+		case "integrity":
+			pkg.Integrity = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("could not parse yarn.lock: %w", err)
+	}
+	flush()
+
+	return pkgs, nil
+}
+
+func newNPMPackage(name string, pkg npmPkg) sbom.Package {
+	p := sbom.NamedPackage(sbom.TypeNPM, name, pkg.Version)
+	p.Checksum = integrityToChecksum(pkg.Integrity)
+
+	// Yarn appends the sha1 of the tarball to the resolved URL.
+	if i := strings.Index(pkg.Resolved, "#"); i != -1 {
+		pkg.Resolved = pkg.Resolved[:i]
+	}
+	p.DownloadURL = pkg.Resolved
+
+	return p
+}
+
+// integrityToChecksum converts the first hash of the given Subresource
+// Integrity string (e.g. sha512-<base64>) into a checksum (e.g.
+// sha512:<hex>). It returns an empty string if the integrity string is
+// empty or invalid.
+func integrityToChecksum(integrity string) string {
+	fields := strings.Fields(integrity)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	parts := strings.SplitN(fields[0], "-", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	raw, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	return parts[0] + ":" + hex.EncodeToString(raw)
+}
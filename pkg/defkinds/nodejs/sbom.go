@@ -0,0 +1,52 @@
+package nodejs
+
+import (
+	"context"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"golang.org/x/xerrors"
+)
+
+// SBOM returns the packages installed in the given stage: its base image,
+// its system packages, its external files and, except for dev stages, the
+// packages locked in package-lock.json or yarn.lock.
+func (h *NodeJSHandler) SBOM(
+	ctx context.Context,
+	buildOpts builddef.BuildOpts,
+) (sbom.BOM, error) {
+	stageDef, err := h.loadDefs(buildOpts)
+	if err != nil {
+		return sbom.BOM{}, err
+	}
+
+	srcContext := resolveSourceContext(stageDef, buildOpts)
+	bom := sbom.New(buildOpts, srcContext)
+
+	baseImage, err := sbom.BaseImage(stageDef.DefLocks.BaseImage)
+	if err != nil {
+		return bom, err
+	}
+	bom.Add(baseImage)
+
+	bom.Add(sbom.SystemPackages(stageDef.DefLocks.OSRelease,
+		stageDef.StageLocks.SystemPackages)...)
+
+	bom.Add(sbom.LockedExternalFiles(stageDef.ExternalFiles,
+		stageDef.StageLocks.ExternalFiles)...)
+
+	err = bom.AddSourcePackages(*stageDef.Dev, func() ([]sbom.Package, error) {
+		pkgManager, err := h.determinePackageManager(ctx, stageDef, buildOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		pkgs, err := loadJSPackages(ctx, h.solver, srcContext, pkgManager)
+		if err != nil {
+			return nil, xerrors.Errorf("could not list %s packages: %w", pkgManager, err)
+		}
+		return pkgs, nil
+	})
+
+	return bom, err
+}
@@ -0,0 +1,149 @@
+package nodejs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/defkinds/nodejs"
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/golang/mock/gomock"
+	"golang.org/x/xerrors"
+)
+
+type sbomTC struct {
+	handler     *nodejs.NodeJSHandler
+	buildOpts   builddef.BuildOpts
+	expected    string
+	expectedErr error
+}
+
+func newSBOMTC(
+	t *testing.T,
+	solver statesolver.StateSolver,
+	stage string,
+	expected string,
+) sbomTC {
+	h := &nodejs.NodeJSHandler{}
+	h.WithSolver(solver)
+
+	genericDef := loadBuildDefWithLocks(t, "testdata/sbom/zbuild.yml")
+	sourceDate := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+	return sbomTC{
+		handler: h,
+		buildOpts: builddef.BuildOpts{
+			Def:             genericDef,
+			Stage:           stage,
+			SourceDateEpoch: &sourceDate,
+			BuildContext: &builddef.Context{
+				Type:   builddef.ContextTypeLocal,
+				Source: "context",
+			},
+		},
+		expected: expected,
+	}
+}
+
+func initSBOMWithPackageLockTC(t *testing.T, mockCtrl *gomock.Controller) sbomTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FileExists(gomock.Any(), "package-lock.json", gomock.Any()).Return(true, nil)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
+	solver.EXPECT().ReadFile(gomock.Any(), "package-lock.json", gomock.Any()).Return(
+		loadRawTestdata(t, "testdata/sbom/package-lock.json"), nil)
+
+	return newSBOMTC(t, solver, "prod", "testdata/sbom/prod-with-npm.cdx.json")
+}
+
+func initSBOMWithPackageLockV2TC(t *testing.T, mockCtrl *gomock.Controller) sbomTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FileExists(gomock.Any(), "package-lock.json", gomock.Any()).Return(true, nil)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
+	solver.EXPECT().ReadFile(gomock.Any(), "package-lock.json", gomock.Any()).Return(
+		loadRawTestdata(t, "testdata/sbom/package-lock-v2.json"), nil)
+
+	return newSBOMTC(t, solver, "prod", "testdata/sbom/prod-with-npm-v2.cdx.json")
+}
+
+func initSBOMWithYarnLockTC(t *testing.T, mockCtrl *gomock.Controller) sbomTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FileExists(gomock.Any(), "package-lock.json", gomock.Any()).Return(false, nil)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
+	solver.EXPECT().ReadFile(gomock.Any(), "yarn.lock", gomock.Any()).Return(
+		loadRawTestdata(t, "testdata/sbom/yarn.lock"), nil)
+
+	return newSBOMTC(t, solver, "prod", "testdata/sbom/prod-with-yarn.cdx.json")
+}
+
+func initSBOMOfDevStageTC(t *testing.T, mockCtrl *gomock.Controller) sbomTC {
+	// JS packages aren't installed in dev stages, so lockfiles aren't read.
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	return newSBOMTC(t, solver, "dev", "testdata/sbom/dev.cdx.json")
+}
+
+func initFailToLoadBrokenPackageLockTC(t *testing.T, mockCtrl *gomock.Controller) sbomTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FileExists(gomock.Any(), "package-lock.json", gomock.Any()).Return(true, nil)
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
+	solver.EXPECT().ReadFile(gomock.Any(), "package-lock.json", gomock.Any()).Return(
+		[]byte("{"), nil)
+
+	tc := newSBOMTC(t, solver, "prod", "")
+	tc.expectedErr = xerrors.New("could not list npm packages: could not unmarshal package-lock.json: unexpected end of JSON input")
+	return tc
+}
+
+func TestSBOM(t *testing.T) {
+	testcases := map[string]func(*testing.T, *gomock.Controller) sbomTC{
+		"list packages from package-lock.json":    initSBOMWithPackageLockTC,
+		"list packages from package-lock.json v2": initSBOMWithPackageLockV2TC,
+		"list packages from yarn.lock":            initSBOMWithYarnLockTC,
+		"list no JS packages for dev stages":      initSBOMOfDevStageTC,
+		"fail to load broken package-lock.json":   initFailToLoadBrokenPackageLockTC,
+	}
+
+	for tcname := range testcases {
+		tcinit := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			tc := tcinit(t, mockCtrl)
+
+			bom, err := tc.handler.SBOM(context.TODO(), tc.buildOpts)
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected error: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			raw, err := sbom.Marshal(bom, sbom.FormatCycloneDX)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *flagTestdata {
+				writeTestdata(t, tc.expected, string(raw))
+				return
+			}
+
+			expected := string(loadRawTestdata(t, tc.expected))
+			if expected != string(raw) {
+				tempfile := newTempFile(t)
+				writeTestdata(t, tempfile, string(raw))
+
+				t.Fatalf("Expected: <%s>\nGot: <%s>", tc.expected, tempfile)
+			}
+		})
+	}
+}
@@ -3,14 +3,15 @@ package php
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"path"
 	"strings"
-	"time"
 
 	"github.com/NiR-/notpecl/pecl"
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/image"
 	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/registry"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/moby/buildkit/client/llb"
@@ -46,13 +47,15 @@ func RegisterKind(registry *registry.KindRegistry) {
 }
 
 type PHPHandler struct {
-	pecl   pecl.Backend
-	solver statesolver.StateSolver
+	pecl       pecl.Backend
+	solver     statesolver.StateSolver
+	httpClient *http.Client
 }
 
 func NewPHPHandler() *PHPHandler {
 	return &PHPHandler{
-		pecl: pecl.New(),
+		pecl:       pecl.New(),
+		httpClient: http.DefaultClient,
 	}
 }
 
@@ -64,6 +67,12 @@ func (h *PHPHandler) WithPeclBackend(pb pecl.Backend) {
 	h.pecl = pb
 }
 
+// WithHTTPClient sets the HTTP client used to download external files when
+// their checksums are locked.
+func (h *PHPHandler) WithHTTPClient(c *http.Client) {
+	h.httpClient = c
+}
+
 func (h *PHPHandler) DebugConfig(
 	buildOpts builddef.BuildOpts,
 ) (interface{}, error) {
@@ -91,6 +100,14 @@ func (h *PHPHandler) Build(
 		return state, img, err
 	}
 
+	stageDef.ExternalFiles = llbutils.WithLockedChecksums(
+		stageDef.ExternalFiles, stageDef.StageLocks.ExternalFiles)
+	if buildOpts.Strict && !stageDef.Dev {
+		if err := llbutils.CheckExternalFilesChecksums(stageDef.ExternalFiles); err != nil {
+			return state, img, err
+		}
+	}
+
 	state, img, err = h.buildPHP(ctx, stageDef, buildOpts)
 	if err != nil {
 		err = xerrors.Errorf("could not build php stage: %w", err)
@@ -114,22 +131,34 @@ func (h *PHPHandler) buildPHP(
 	img := image.CloneMeta(baseImg)
 	img.Config.Labels[builddef.ZbuildLabel] = "true"
 
-	composer := llbutils.ImageSource(defaultComposerImageTag, false)
+	srcContext := resolveSourceContext(stageDef, buildOpts)
+	if sourceDate, ok := buildOpts.SourceDate(srcContext); ok {
+		state = llbutils.WithCreatedTime(state, sourceDate)
+	}
+
+	composerImage := stageDef.DefLocks.ComposerImage
+	if composerImage == "" {
+		composerImage = defaultComposerImageTag
+	}
+	composer := llbutils.ImageSource(composerImage, false)
 	state = llbutils.Copy(
 		composer, "/usr/bin/composer", state, "/usr/bin/composer", "", buildOpts.IgnoreLayerCache)
 
-	pkgManager := llbutils.APT
-	if stageDef.DefLocks.OSRelease.Name == "alpine" {
-		pkgManager = llbutils.APK
+	_, pkgManager, err := pkgsolver.ResolvePackageManager(stageDef.DefLocks.OSRelease)
+	if err != nil {
+		return state, img, err
 	}
 
 	if buildOpts.WithCacheMounts && len(stageDef.StageLocks.SystemPackages) > 0 {
 		state = llbutils.SetupSystemPackagesCache(state, pkgManager)
 	}
 
+	pkgOpts := llbutils.NewCachingStrategyFromBuildOpts(buildOpts)
+	pkgOpts.DebianSnapshot = llbutils.LockedDebianSnapshot(buildOpts,
+		stageDef.DefLocks.OSRelease, stageDef.DefLocks.DebianSnapshot)
+
 	state, err = llbutils.InstallSystemPackages(state, pkgManager,
-		stageDef.StageLocks.SystemPackages,
-		llbutils.NewCachingStrategyFromBuildOpts(buildOpts))
+		stageDef.StageLocks.SystemPackages, pkgOpts)
 	if err != nil {
 		return state, img, xerrors.Errorf("failed to add \"install system pacakges\" steps: %w", err)
 	}
@@ -137,9 +166,15 @@ func (h *PHPHandler) buildPHP(
 	state = InstallExtensions(stageDef, state, buildOpts)
 	state = llbutils.CopyExternalFiles(state, stageDef.ExternalFiles)
 
-	state = llbutils.Mkdir(state, "1000:1000",
+	state, err = llbutils.CreateUser(state, pkgManager, stageDef.User,
+		buildOpts.IgnoreLayerCache)
+	if err != nil {
+		return state, img, xerrors.Errorf("failed to add \"create user\" step: %w", err)
+	}
+
+	state = llbutils.Mkdir(state, stageDef.User.Owner(),
 		append([]string{WorkingDir, ComposerDir}, stageDef.StatefulDirs...)...)
-	state = state.User("1000")
+	state = state.User(stageDef.User.UserID())
 	state = state.Dir(WorkingDir)
 	state = state.AddEnv("COMPOSER_HOME", ComposerDir)
 
@@ -158,7 +193,14 @@ func (h *PHPHandler) buildPHP(
 		}
 	}
 
-	setImageMetadata(stageDef, state, img)
+	if err := setImageMetadata(stageDef, state, img); err != nil {
+		return state, img, err
+	}
+	// Labels are set after the metadata, as the creation date of the image
+	// is used.
+	labels := builddef.ImageLabels(buildOpts, stageDef.DefLocks.BaseImage,
+		resolveSourceContext(stageDef, buildOpts), *img.Created)
+	labels.Merge(stageDef.Labels).ApplyTo(img)
 
 	return state, img, nil
 }
@@ -199,7 +241,7 @@ func copyConfigFiles(
 	// if the cache is fresh (when using a local context). As such, we can't
 	// just copy the whole source state to the dest state.
 	state = llbutils.CopyAll(
-		srcState, state, interpolated, "1000:1000", buildOpts.IgnoreLayerCache)
+		srcState, state, interpolated, stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 
 	return state, nil
 }
@@ -221,7 +263,7 @@ func copySourceFiles(
 	if sourceContext.Type == builddef.ContextTypeLocal {
 		srcPath := prefixContextPath(sourceContext, "/")
 		return llbutils.Copy(
-			srcState, srcPath, state, WorkingDir+"/", "1000:1000", buildOpts.IgnoreLayerCache)
+			srcState, srcPath, state, WorkingDir+"/", stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 	}
 
 	// Despite the IncludePatterns() above, the source state might also
@@ -232,7 +274,7 @@ func copySourceFiles(
 		srcPath := prefixContextPath(sourceContext, srcfile)
 		destPath := path.Join(WorkingDir, srcfile)
 		state = llbutils.Copy(
-			srcState, srcPath, state, destPath, "1000:1000", buildOpts.IgnoreLayerCache)
+			srcState, srcPath, state, destPath, stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 	}
 
 	return state
@@ -252,7 +294,7 @@ func setImageMetadata(
 	stage StageDefinition,
 	state llb.State,
 	img *image.Image,
-) {
+) error {
 	for _, dir := range stage.StatefulDirs {
 		fullpath := dir
 		if !path.IsAbs(fullpath) {
@@ -266,7 +308,7 @@ func setImageMetadata(
 		img.Config.Healthcheck = stage.Healthcheck.ToImageConfig()
 	}
 
-	img.Config.User = "1000"
+	img.Config.User = stage.User.UserID()
 	img.Config.WorkingDir = WorkingDir
 	img.Config.Env = []string{
 		"PATH=/composer/vendor/bin:" + getEnv(state, "PATH"),
@@ -274,12 +316,16 @@ func setImageMetadata(
 		"PHP_VERSION=" + getEnv(state, "PHP_VERSION"),
 		"PHP_INI_DIR=" + getEnv(state, "PHP_INI_DIR"),
 	}
-	now := time.Now()
-	img.Created = &now
-
 	if stage.Command != nil {
 		img.Config.Cmd = *stage.Command
 	}
+
+	// The image config from the stage takes precedence over the one above.
+	if err := stage.Image.ApplyTo(img); err != nil {
+		return err
+	}
+
+	return llbutils.SetImageCreated(state, img)
 }
 
 func excludePatterns(srcContext *builddef.Context, stageDef *StageDefinition) []string {
@@ -334,7 +380,7 @@ func globalComposerInstall(stageDef StageDefinition, state llb.State, buildOpts
 
 	runOpts := []llb.RunOption{
 		llb.Dir(state.GetDir()),
-		llb.User("1000"),
+		llb.User(stageDef.User.UserID()),
 		llb.AddEnv("COMPOSER_CACHE_DIR", composerCacheDir),
 		llb.WithCustomNamef("Run composer global require (%s)", strings.Join(deps, ", "))}
 
@@ -343,7 +389,7 @@ func globalComposerInstall(stageDef StageDefinition, state llb.State, buildOpts
 	}
 
 	if buildOpts.WithCacheMounts {
-		runOpts = append(runOpts, cacheMountOptForComposer(buildOpts))
+		runOpts = append(runOpts, cacheMountOptForComposer(stageDef, buildOpts))
 	} else {
 		cmds = append(cmds, "composer clear-cache")
 	}
@@ -370,13 +416,13 @@ func composerInstall(
 
 	srcPath := prefixContextPath(srcContext, "composer.*")
 	state = llbutils.Copy(
-		srcState, srcPath, state, WorkingDir+"/", "1000:1000", buildOpts.IgnoreLayerCache)
+		srcState, srcPath, state, WorkingDir+"/", stageDef.User.Owner(), buildOpts.IgnoreLayerCache)
 
 	cmds := []string{
 		"composer install --no-dev --prefer-dist --no-scripts --no-autoloader"}
 	runOpts := []llb.RunOption{
 		llb.Dir(state.GetDir()),
-		llb.User("1000"),
+		llb.User(stageDef.User.UserID()),
 		llb.AddEnv("COMPOSER_CACHE_DIR", composerCacheDir),
 		llb.WithCustomName("Run composer install")}
 
@@ -385,7 +431,7 @@ func composerInstall(
 	}
 
 	if buildOpts.WithCacheMounts {
-		runOpts = append(runOpts, cacheMountOptForComposer(buildOpts))
+		runOpts = append(runOpts, cacheMountOptForComposer(stageDef, buildOpts))
 	} else {
 		cmds = append(cmds, "composer clear-cache")
 	}
@@ -394,8 +440,12 @@ func composerInstall(
 	return state.Run(runOpts...).Root()
 }
 
-func cacheMountOptForComposer(buildOpts builddef.BuildOpts) llb.RunOption {
-	return llbutils.CacheMountOpt(composerCacheDir, buildOpts.CacheIDNamespace, "1000")
+func cacheMountOptForComposer(
+	stageDef StageDefinition,
+	buildOpts builddef.BuildOpts,
+) llb.RunOption {
+	return llbutils.CacheMountOpt(composerCacheDir, buildOpts.CacheIDNamespace,
+		stageDef.User.UserID())
 }
 
 func postInstall(
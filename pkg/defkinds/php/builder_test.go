@@ -1,7 +1,9 @@
 package php_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"testing"
 	"time"
@@ -15,6 +17,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/moby/buildkit/frontend/gateway/client"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/xerrors"
 	"gopkg.in/yaml.v2"
 )
 
@@ -83,7 +86,8 @@ func initBuildLLBForDevStageTC(t *testing.T, mockCtrl *gomock.Controller) buildT
 						"9000/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelTitle: "dev",
+						"io.zbuild":         "true",
 					},
 				},
 			},
@@ -147,7 +151,8 @@ func initBuildLLBForProdStageTC(t *testing.T, mockCtrl *gomock.Controller) build
 						"9000/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelTitle: "prod",
+						"io.zbuild":         "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -220,7 +225,9 @@ func initBuildProdStageFromGitBasedBuildContextTC(t *testing.T, mockCtrl *gomock
 						"9000/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelSource: "git://github.com/some/repo",
+						builddef.LabelTitle:  "prod",
+						"io.zbuild":          "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -288,7 +295,11 @@ func initBuildProdStageFromGitBasedSourceContextTC(t *testing.T, mockCtrl *gomoc
 						"9000/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:db5bce28b6eabd8bd963cfd95131a01171acea9cff500447bb8d9e05afd34e4b",
+						builddef.LabelRevision:   "5ecd2177087afbcce8f88ddfedbc7b95e738d961",
+						builddef.LabelSource:     "github.com/api-platform/demo",
+						builddef.LabelTitle:      "prod",
+						"io.zbuild":              "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -353,7 +364,9 @@ func initBuildProdStageForAlpineImageTC(t *testing.T, mockCtrl *gomock.Controlle
 						"9000/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelBaseDigest: "sha256:2f8cd58527382276c6556beba6ff49f0a56fc5690d6907e4dba4b3384ac7f564",
+						builddef.LabelTitle:      "prod",
+						"io.zbuild":              "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -422,7 +435,8 @@ func initBuildProdStageWithCacheMountsTC(t *testing.T, mockCtrl *gomock.Controll
 						"9000/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild": "true",
+						builddef.LabelTitle: "prod",
+						"io.zbuild":         "true",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -436,14 +450,47 @@ func initBuildProdStageWithCacheMountsTC(t *testing.T, mockCtrl *gomock.Controll
 	}
 }
 
+func initFailToBuildProdStageWithUnlockedExternalFilesInStrictModeTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
+	genericDef := loadBuildDefWithLocks(t, "testdata/build/zbuild.yml")
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+
+	raw := loadRawTestdata(t, "testdata/composer/valid/composer-symfony4.4.lock")
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "composer.lock", gomock.Any(),
+	).Return(raw, nil)
+
+	kindHandler := php.NewPHPHandler()
+	kindHandler.WithSolver(solver)
+
+	return buildTC{
+		handler: kindHandler,
+		client:  llbtest.NewMockClient(mockCtrl),
+		buildOpts: builddef.BuildOpts{
+			Def:           genericDef,
+			Stage:         "prod",
+			SessionID:     "<SESSION-ID>",
+			LocalUniqueID: "x1htr02606a9rk8b0daewh9es",
+			Strict:        true,
+			BuildContext: &builddef.Context{
+				Source: "context",
+				Type:   builddef.ContextTypeLocal,
+			},
+		},
+		expectedErr: xerrors.New("external files https://blackfire.io/api/v1/releases/probe/php/linux/amd64/72, https://github.com/NiR-/fcgi-client/releases/download/v0.1.0/fcgi-client.phar have no locked checksum, please run `zbuild update`"),
+	}
+}
+
 func TestBuild(t *testing.T) {
 	testcases := map[string]func(*testing.T, *gomock.Controller) buildTC{
-		"build LLB DAG for dev stage":                    initBuildLLBForDevStageTC,
-		"build LLB DAG for prod stage":                   initBuildLLBForProdStageTC,
-		"build prod stage from git-based build context":  initBuildProdStageFromGitBasedBuildContextTC,
-		"build prod stage from git-based source context": initBuildProdStageFromGitBasedSourceContextTC,
-		"build prod stage for alpine-based image":        initBuildProdStageForAlpineImageTC,
-		"build prod stage with cache mounts":             initBuildProdStageWithCacheMountsTC,
+		"build LLB DAG for dev stage":                                          initBuildLLBForDevStageTC,
+		"build LLB DAG for prod stage":                                         initBuildLLBForProdStageTC,
+		"build prod stage from git-based build context":                        initBuildProdStageFromGitBasedBuildContextTC,
+		"build prod stage from git-based source context":                       initBuildProdStageFromGitBasedSourceContextTC,
+		"build prod stage for alpine-based image":                              initBuildProdStageForAlpineImageTC,
+		"build prod stage with cache mounts":                                   initBuildProdStageWithCacheMountsTC,
+		"fail to build prod stage with unlocked external files in strict mode": initFailToBuildProdStageWithUnlockedExternalFilesInStrictModeTC,
 	}
 
 	for tcname := range testcases {
@@ -487,6 +534,7 @@ func TestBuild(t *testing.T) {
 			}
 
 			img.Created = nil
+			delete(img.Config.Labels, builddef.LabelCreated)
 			img.History = nil
 			img.RootFS.DiffIDs = nil
 			if diff := deep.Equal(img, tc.expectedImage); diff != nil {
@@ -612,3 +660,87 @@ func newTempFile(t *testing.T) string {
 	defer file.Close()
 	return file.Name()
 }
+
+func TestBuildWithSourceDateEpochIsReproducible(t *testing.T) {
+	if *flagTestdata {
+		return
+	}
+
+	created := time.Date(2020, time.January, 21, 0, 0, 0, 0, time.UTC)
+	baseImage := llbtest.NewImageRegistry(t, "library/php", specs.Image{
+		Created:      &created,
+		Architecture: "amd64",
+		OS:           "linux",
+		Config: specs.ImageConfig{
+			Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			Entrypoint: []string{"docker-php-entrypoint"},
+			Cmd:        []string{"php-fpm"},
+		},
+		RootFS: specs.RootFS{Type: "layers"},
+		History: []specs.History{
+			{Created: &created, CreatedBy: "/bin/sh -c #(nop) CMD [\"php-fpm\"]", EmptyLayer: true},
+		},
+	})
+
+	genericDef := loadBuildDefWithLocks(t, "testdata/build/zbuild.yml")
+	genericDef.RawLocks.Raw["base_image"] = baseImage
+	composerLock := loadRawTestdata(t, "testdata/composer/valid/composer-symfony4.4.lock")
+
+	sourceDate := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	buildOpts := builddef.BuildOpts{
+		Def:             genericDef,
+		Stage:           "prod",
+		SessionID:       "<SESSION-ID>",
+		LocalUniqueID:   "x1htr02606a9rk8b0daewh9es",
+		SourceDateEpoch: &sourceDate,
+		BuildContext: &builddef.Context{
+			Source: "context",
+			Type:   builddef.ContextTypeLocal,
+		},
+	}
+
+	build := func() (string, []byte) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		solver := mocks.NewMockStateSolver(mockCtrl)
+		solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
+		solver.EXPECT().ReadFile(gomock.Any(), "composer.lock", gomock.Any()).Return(composerLock, nil)
+
+		handler := php.NewPHPHandler()
+		handler.WithSolver(solver)
+
+		state, img, err := handler.Build(context.Background(), buildOpts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		imgConfig, err := json.Marshal(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return llbtest.StateToJSON(t, state), imgConfig
+	}
+
+	firstState, firstConfig := build()
+	// Ensure the current time changes between the two builds.
+	time.Sleep(10 * time.Millisecond)
+	secondState, secondConfig := build()
+
+	if firstState != secondState {
+		t.Fatalf("Expected LLB states to be identical:\n%s\n%s", firstState, secondState)
+	}
+	if !bytes.Equal(firstConfig, secondConfig) {
+		t.Fatalf("Expected image configs to be identical:\n%s\n%s", firstConfig, secondConfig)
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(firstConfig, &img); err != nil {
+		t.Fatal(err)
+	}
+	if !img.Created.Equal(sourceDate) {
+		t.Fatalf("Expected image to be created at %v, got %v.", sourceDate, img.Created)
+	}
+	if created := img.Config.Labels[builddef.LabelCreated]; created != "2020-03-01T10:00:00Z" {
+		t.Fatalf("Unexpected %s label: %q", builddef.LabelCreated, created)
+	}
+}
@@ -14,6 +14,9 @@ import (
 type ComposerLock struct {
 	PlatformReqs    *builddef.VersionMap
 	PlatformReqsDev *builddef.VersionMap
+	// Packages is the locked versions of the packages installed by composer
+	// in non-dev stages, indexed by package name.
+	Packages *builddef.VersionMap
 }
 
 func (h *PHPHandler) composerLockCacheLoader(
@@ -98,9 +101,11 @@ func parseComposerLock(lockdata []byte) (ComposerLock, error) {
 	lock := ComposerLock{
 		PlatformReqs:    &builddef.VersionMap{},
 		PlatformReqsDev: &builddef.VersionMap{},
+		Packages:        &builddef.VersionMap{},
 	}
 	for _, pkg := range parsed.Packages {
 		addExtRequirements(lock.PlatformReqs, pkg.Require)
+		lock.Packages.Add(pkg.Name, pkg.Version)
 	}
 	for _, pkg := range parsed.PackagesDev {
 		addExtRequirements(lock.PlatformReqsDev, pkg.Require)
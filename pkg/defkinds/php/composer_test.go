@@ -46,6 +46,9 @@ func initSuccessfullyLoadAndParseComposerLockTC(
 			PlatformReqsDev: &builddef.VersionMap{
 				"ctype": "*",
 			},
+			Packages: &builddef.VersionMap{
+				"clue/stream-filter": "v1.4.0",
+			},
 		},
 	}
 }
@@ -75,6 +78,9 @@ func initLoadComposerLockFromGitSubdirTC(t *testing.T, mockCtrl *gomock.Controll
 				"iconv": "*",
 			},
 			PlatformReqsDev: &builddef.VersionMap{},
+			Packages: &builddef.VersionMap{
+				"symfony/framework-bundle": "v4.4.1",
+			},
 		},
 	}
 }
@@ -287,6 +287,9 @@ type Stage struct {
 	StatefulDirs      []string                    `mapstructure:"stateful_dirs"`
 	Healthcheck       *builddef.HealthcheckConfig `mapstructure:"healthcheck"`
 	PostInstall       []string                    `mapstructure:"post_install"`
+	Labels            builddef.Labels             `mapstructure:"labels"`
+	Image             builddef.ImageConfig        `mapstructure:"image"`
+	User              *builddef.UserConfig        `mapstructure:"user"`
 }
 
 func (s Stage) Copy() Stage {
@@ -304,6 +307,9 @@ func (s Stage) Copy() Stage {
 		StatefulDirs:      make([]string, len(s.StatefulDirs)),
 		Healthcheck:       s.Healthcheck,
 		PostInstall:       make([]string, len(s.PostInstall)),
+		Labels:            s.Labels.Copy(),
+		Image:             s.Image.Copy(),
+		User:              s.User.Copy(),
 	}
 
 	copy(new.ExternalFiles, s.ExternalFiles)
@@ -324,6 +330,8 @@ func (s Stage) Merge(overriding Stage) Stage {
 	new.Integrations = append(new.Integrations, overriding.Integrations...)
 	new.StatefulDirs = append(new.StatefulDirs, overriding.StatefulDirs...)
 	new.PostInstall = append(new.PostInstall, overriding.PostInstall...)
+	new.Labels = new.Labels.Merge(overriding.Labels)
+	new.Image = new.Image.Merge(overriding.Image)
 
 	new.SystemPackages.Merge(overriding.SystemPackages)
 	new.GlobalDeps.Merge(overriding.GlobalDeps)
@@ -337,6 +345,9 @@ func (s Stage) Merge(overriding Stage) Stage {
 		cmd := *overriding.Command
 		new.Command = &cmd
 	}
+	if overriding.User != nil {
+		new.User = overriding.User.Copy()
+	}
 	if overriding.ComposerDumpFlags != nil {
 		dumpFlags := *overriding.ComposerDumpFlags
 		new.ComposerDumpFlags = &dumpFlags
@@ -479,6 +490,14 @@ func (stageDef StageDefinition) IsValid() error {
 		return err
 	}
 
+	if err := stageDef.Image.IsValid(); err != nil {
+		return xerrors.Errorf("invalid image config: %w", err)
+	}
+
+	if err := stageDef.User.IsValid(); err != nil {
+		return xerrors.Errorf("invalid user: %w", err)
+	}
+
 	return nil
 }
 
@@ -600,29 +619,83 @@ func reverseStages(stages []DerivedStage) []DerivedStage {
 	return reversed
 }
 
+const (
+	artefactBlackfire  = "blackfire"
+	artefactFCGIClient = "fcgi-client"
+	artefactNotpecl    = "notpecl"
+)
+
+// artefactURLs is the list of the files implicitly downloaded by this builder.
+// Some of these URLs are not immutable, that's why they're resolved and
+// locked by UpdateLocks.
+var artefactURLs = map[string]string{
+	artefactBlackfire:  "https://blackfire.io/api/v1/releases/probe/php/linux/amd64/72",
+	artefactFCGIClient: "https://github.com/NiR-/fcgi-client/releases/download/v0.1.0/fcgi-client.phar",
+	// @TODO: change this URL once notpecl v0.1 has been released.
+	artefactNotpecl: "https://storage.googleapis.com/notpecl/notpecl",
+}
+
+// stageArtefacts returns the name of the artefacts needed to build the given
+// stage.
+func stageArtefacts(stageDef StageDefinition) []string {
+	artefacts := []string{}
+
+	for _, integration := range stageDef.Integrations {
+		if integration == "blackfire" {
+			artefacts = append(artefacts, artefactBlackfire)
+		}
+	}
+
+	if stageDef.Healthcheck != nil &&
+		stageDef.Healthcheck.Type == builddef.HealthcheckTypeFCGI {
+		artefacts = append(artefacts, artefactFCGIClient)
+	}
+
+	for _, extName := range stageDef.Extensions.Names() {
+		if isNotCoreExtension(extName) {
+			artefacts = append(artefacts, artefactNotpecl)
+			break
+		}
+	}
+
+	return artefacts
+}
+
+// lockedArtefact returns the ExternalFile matching the given artefact name.
+// Its locked URL and checksum are used when available.
+func lockedArtefact(defLocks DefinitionLocks, name string) llbutils.ExternalFile {
+	if locks, ok := defLocks.Artefacts[name]; ok {
+		return llbutils.ExternalFile{
+			URL:      locks.URL,
+			Checksum: locks.Checksum,
+		}
+	}
+
+	return llbutils.ExternalFile{URL: artefactURLs[name]}
+}
+
 func addIntegrations(defLocks DefinitionLocks, stageDef *StageDefinition) error {
 	for _, integration := range stageDef.Integrations {
 		switch integration {
 		case "blackfire":
-			dest := path.Join(defLocks.ExtensionDir, "blackfire.so")
-			stageDef.ExternalFiles = append(stageDef.ExternalFiles, llbutils.ExternalFile{
-				URL:         "https://blackfire.io/api/v1/releases/probe/php/linux/amd64/72",
-				Compressed:  true,
-				Pattern:     "blackfire-*.so",
-				Destination: dest,
-				Mode:        0644,
-			})
+			blackfire := lockedArtefact(defLocks, artefactBlackfire)
+			blackfire.Compressed = true
+			blackfire.Pattern = "blackfire-*.so"
+			blackfire.Destination = path.Join(defLocks.ExtensionDir, "blackfire.so")
+			blackfire.Mode = 0644
+
+			stageDef.ExternalFiles = append(stageDef.ExternalFiles, blackfire)
 		}
 	}
 
 	if stageDef.Healthcheck != nil &&
 		stageDef.Healthcheck.Type == builddef.HealthcheckTypeFCGI {
-		stageDef.ExternalFiles = append(stageDef.ExternalFiles, llbutils.ExternalFile{
-			URL:         "https://github.com/NiR-/fcgi-client/releases/download/v0.1.0/fcgi-client.phar",
-			Destination: "/usr/local/bin/fcgi-client",
-			Mode:        0750,
-			Owner:       "1000:1000",
-		})
+		fcgiClient := lockedArtefact(defLocks, artefactFCGIClient)
+		fcgiClient.Destination = "/usr/local/bin/fcgi-client"
+		fcgiClient.Mode = 0750
+		fcgiClient.Owner = stageDef.User.Owner()
+
+		stageDef.ExternalFiles = append(stageDef.ExternalFiles, fcgiClient)
 	}
 
 	return nil
@@ -693,7 +766,7 @@ func inferExtensions(def *StageDefinition) {
 }
 
 func inferSystemPackages(stageDef *StageDefinition) {
-	distro := stageDef.DefLocks.OSRelease.Name
+	distroFamily := stageDef.DefLocks.OSRelease.Family()
 
 	for _, ext := range stageDef.Extensions.Names() {
 		deps, ok := extensionsDeps[ext]
@@ -701,13 +774,13 @@ func inferSystemPackages(stageDef *StageDefinition) {
 			continue
 		}
 
-		for name, ver := range deps[distro] {
+		for name, ver := range deps[distroFamily] {
 			stageDef.SystemPackages.Add(name, ver)
 		}
 	}
 
 	// Add unzip and git packages as they're used by Composer. Both packages
-	// are named the same on Alpine and debian.
+	// are named the same on all supported distros.
 	stageDef.SystemPackages.Add("unzip", "*")
 	stageDef.SystemPackages.Add("git", "*")
 }
@@ -789,6 +789,36 @@ func initFailWhenComposerFlagsAreInvalidTC(t *testing.T, _ *gomock.Controller) r
 	}
 }
 
+func initFailWhenImageConfigIsInvalidTC(t *testing.T, _ *gomock.Controller) resolveStageTC {
+	composerLockLoader := mockComposerLockLoader(map[string]string{})
+
+	return resolveStageTC{
+		file:     "testdata/def/invalid-image-config.yml",
+		lockFile: "",
+		stage:    "dev",
+		osrelease: builddef.OSRelease{
+			Name: "debian",
+		},
+		composerLockLoader: composerLockLoader,
+		expectedErr:        errors.New(`invalid final stage config: invalid image config: invalid port "9000/fcgi": protocol should be one of tcp, udp or sctp`),
+	}
+}
+
+func initFailWhenUserIsInvalidTC(t *testing.T, _ *gomock.Controller) resolveStageTC {
+	composerLockLoader := mockComposerLockLoader(map[string]string{})
+
+	return resolveStageTC{
+		file:     "testdata/def/invalid-user.yml",
+		lockFile: "",
+		stage:    "dev",
+		osrelease: builddef.OSRelease{
+			Name: "debian",
+		},
+		composerLockLoader: composerLockLoader,
+		expectedErr:        errors.New(`invalid final stage config: invalid user: user has no uid`),
+	}
+}
+
 func initInferAlpinePackagesRequiredByExtsTC(t *testing.T, mockCtrl *gomock.Controller) resolveStageTC {
 	fpmMode := true
 
@@ -849,20 +879,34 @@ func initInferAlpinePackagesRequiredByExtsTC(t *testing.T, mockCtrl *gomock.Cont
 	}
 }
 
+func initInferPackagesRequiredByExtsOnDerivedDistroTC(t *testing.T, mockCtrl *gomock.Controller) resolveStageTC {
+	tc := initInferAlpinePackagesRequiredByExtsTC(t, mockCtrl)
+	tc.osrelease = builddef.OSRelease{
+		Name:   "postmarketos",
+		IDLike: []string{"alpine"},
+	}
+	tc.expected.DefLocks.OSRelease = tc.osrelease
+
+	return tc
+}
+
 func TestResolveStageDefinition(t *testing.T) {
 	if *flagTestdata {
 		return
 	}
 
 	testcases := map[string]func(*testing.T, *gomock.Controller) resolveStageTC{
-		"successfully resolve default dev stage":    initSuccessfullyResolveDefaultDevStageTC,
-		"successfully resolve worker stage":         initSuccessfullyResolveWorkerStageTC,
-		"fail to resolve unknown stage":             initFailToResolveUnknownStageTC,
-		"fail to resolve stage with cyclic deps":    initFailToResolveStageWithCyclicDepsTC,
-		"fail when composer flags are invalid":      initFailWhenComposerFlagsAreInvalidTC,
-		"remove default extensions":                 initRemoveDefaultExtensionsTC,
-		"preserve predefined extension constraints": initPreservePredefinedExtensionConstraintsTC,
-		"infer alpine packages required by exts":    initInferAlpinePackagesRequiredByExtsTC,
+		"successfully resolve default dev stage":            initSuccessfullyResolveDefaultDevStageTC,
+		"successfully resolve worker stage":                 initSuccessfullyResolveWorkerStageTC,
+		"fail to resolve unknown stage":                     initFailToResolveUnknownStageTC,
+		"fail to resolve stage with cyclic deps":            initFailToResolveStageWithCyclicDepsTC,
+		"fail when composer flags are invalid":              initFailWhenComposerFlagsAreInvalidTC,
+		"fail when image config is invalid":                 initFailWhenImageConfigIsInvalidTC,
+		"fail when user is invalid":                         initFailWhenUserIsInvalidTC,
+		"remove default extensions":                         initRemoveDefaultExtensionsTC,
+		"preserve predefined extension constraints":         initPreservePredefinedExtensionConstraintsTC,
+		"infer alpine packages required by exts":            initInferAlpinePackagesRequiredByExtsTC,
+		"infer packages required by exts on derived distro": initInferPackagesRequiredByExtsOnDerivedDistroTC,
 	}
 
 	for tcname := range testcases {
@@ -1875,6 +1919,143 @@ func initMergeGlobalDepsWithoutBaseTC() mergeStageTC {
 	}
 }
 
+func initMergeLabelsWithBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() php.Stage {
+			return php.Stage{
+				Labels: builddef.Labels{
+					"com.example.team":                "api",
+					"org.opencontainers.image.vendor": "Example",
+				},
+			}
+		},
+		overriding: php.Stage{
+			Labels: builddef.Labels{
+				"com.example.team": "backend",
+			},
+		},
+		expected: func() php.Stage {
+			s := emptyStage()
+			s.Labels = builddef.Labels{
+				"com.example.team":                "backend",
+				"org.opencontainers.image.vendor": "Example",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeLabelsWithoutBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() php.Stage {
+			return php.Stage{}
+		},
+		overriding: php.Stage{
+			Labels: builddef.Labels{
+				"com.example.team": "backend",
+			},
+		},
+		expected: func() php.Stage {
+			s := emptyStage()
+			s.Labels = builddef.Labels{
+				"com.example.team": "backend",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeImageConfigWithBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() php.Stage {
+			return php.Stage{
+				Image: builddef.ImageConfig{
+					Ports:      []string{"8080"},
+					Env:        map[string]string{"APP_ENV": "dev", "LOG_LEVEL": "debug"},
+					StopSignal: "SIGQUIT",
+				},
+			}
+		},
+		overriding: php.Stage{
+			Image: builddef.ImageConfig{
+				Ports:      []string{"9090/udp"},
+				Env:        map[string]string{"APP_ENV": "prod"},
+				Entrypoint: &[]string{"tini", "--"},
+			},
+		},
+		expected: func() php.Stage {
+			s := emptyStage()
+			s.Image = builddef.ImageConfig{
+				Ports:      []string{"8080", "9090/udp"},
+				Env:        map[string]string{"APP_ENV": "prod", "LOG_LEVEL": "debug"},
+				Entrypoint: &[]string{"tini", "--"},
+				StopSignal: "SIGQUIT",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeImageConfigWithoutBaseTC() mergeStageTC {
+	return mergeStageTC{
+		base: func() php.Stage {
+			return php.Stage{}
+		},
+		overriding: php.Stage{
+			Image: builddef.ImageConfig{
+				Env:  map[string]string{"APP_ENV": "prod"},
+				User: "www-data",
+			},
+		},
+		expected: func() php.Stage {
+			s := emptyStage()
+			s.Image = builddef.ImageConfig{
+				Env:  map[string]string{"APP_ENV": "prod"},
+				User: "www-data",
+			}
+			return s
+		},
+	}
+}
+
+func initMergeUserWithBaseTC() mergeStageTC {
+	baseUID, uid, gid := 1000, 1500, 0
+
+	return mergeStageTC{
+		base: func() php.Stage {
+			return php.Stage{
+				User: &builddef.UserConfig{UID: &baseUID},
+			}
+		},
+		overriding: php.Stage{
+			User: &builddef.UserConfig{UID: &uid, GID: &gid, Name: "app"},
+		},
+		expected: func() php.Stage {
+			s := emptyStage()
+			s.User = &builddef.UserConfig{UID: &uid, GID: &gid, Name: "app"}
+			return s
+		},
+	}
+}
+
+func initIgnoreNilUserTC() mergeStageTC {
+	uid := 1500
+
+	return mergeStageTC{
+		base: func() php.Stage {
+			return php.Stage{
+				User: &builddef.UserConfig{UID: &uid},
+			}
+		},
+		overriding: php.Stage{},
+		expected: func() php.Stage {
+			s := emptyStage()
+			s.User = &builddef.UserConfig{UID: &uid}
+			return s
+		},
+	}
+}
+
 func TestStageMerge(t *testing.T) {
 	testcases := map[string]func() mergeStageTC{
 		"merge external files with base":         initMergeExternalFilesWithBaseTC,
@@ -1903,6 +2084,12 @@ func TestStageMerge(t *testing.T) {
 		"merge healthcheck without base":         initMergeHealthcheckWithoutBaseTC,
 		"merge post install with base":           initMergePostInstallWithBaseTC,
 		"merge post install without base":        initMergePostInstallWithoutBaseTC,
+		"merge labels with base":                 initMergeLabelsWithBaseTC,
+		"merge labels without base":              initMergeLabelsWithoutBaseTC,
+		"merge image config with base":           initMergeImageConfigWithBaseTC,
+		"merge image config without base":        initMergeImageConfigWithoutBaseTC,
+		"merge user with base":                   initMergeUserWithBaseTC,
+		"ignore nil user":                        initIgnoreNilUserTC,
 	}
 
 	for tcname := range testcases {
@@ -83,214 +83,267 @@ var coreExts = map[string]bool{
 	"zip":          true,
 }
 
+// extensionsDeps lists the system packages needed to build each extension,
+// for each distro family (see builddef.DistroFamily* consts).
 var extensionsDeps = map[string]map[string]map[string]string{
 	// Native extensions
 	"bz2": {
 		"alpine": {"bzip2-dev": "*"},
 		"debian": {"libbz2-dev": "*"},
+		"rhel":   {"bzip2-devel": "*"},
 	},
 	"curl": { // @TODO: remove - this extension is preinstalled
 		"alpine": {"curl-dev": "*"},
 		"debian": {"libcurl4-openssl-dev": "*"},
+		"rhel":   {"libcurl-devel": "*"},
 	},
 	"dom": { // @TODO: enabled by default?
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"enchant": {
 		"alpine": {"enchant-dev": "*"},
 		"debian": {"libenchant-dev": "*"},
+		"rhel":   {"enchant-devel": "*"},
 	},
 	"ffi": {
 		"alpine": {"libffi-dev": "*"},
 		"debian": {"libffi-dev": "*"},
+		"rhel":   {"libffi-devel": "*"},
 	},
 	"ftp": {
 		"alpine": {"openssl-dev": "*"},
 		"debian": {"libssl-dev": "*"},
+		"rhel":   {"openssl-devel": "*"},
 	},
 	"gd": {
 		"alpine": {"libpng-dev": "*", "zlib-dev": "*"},
 		"debian": {"libpng-dev": "*"},
+		"rhel":   {"libpng-devel": "*", "zlib-devel": "*"},
 	},
 	"gd.freetype": {
 		"alpine": {"freetype-dev": "*"},
 		"debian": {"libfreetype6-dev": "*"},
+		"rhel":   {"freetype-devel": "*"},
 	},
 	"gd.jpeg": {
 		"alpine": {"libjpeg-turbo-dev": "*"},
 		"debian": {"libjpeg-dev": "*"},
+		"rhel":   {"libjpeg-turbo-devel": "*"},
 	},
 	"gd.webp": {
 		"alpine": {"libwebp-dev": "*"},
 		"debian": {"libwebp-dev": "*"},
+		"rhel":   {"libwebp-devel": "*"},
 	},
 	"gmp": {
 		"alpine": {"gmp-dev": "*"},
 		"debian": {"libgmp-dev": "*"},
+		"rhel":   {"gmp-devel": "*"},
 	},
 	"imap": {
 		"alpine": {"imap-dev": "*"},
 		"debian": {"libc-client-dev": "*", "libkrb5-dev": "*"},
+		"rhel":   {"krb5-devel": "*", "uw-imap-devel": "*"},
 	},
 	"interbase": { // @TODO: remove
 		"alpine": {}, // @TODO: could not find needed dependencies
 		"debian": {}, // @TODO: could not find needed dependencies
+		"rhel":   {}, // @TODO: could not find needed dependencies
 	},
 	"intl": {
 		"alpine": {"icu-dev": "*"},
 		"debian": {"libicu-dev": "*"},
+		"rhel":   {"libicu-devel": "*"},
 	},
 	"ldap": {
 		"alpine": {"openldap-dev": "*"},
 		"debian": {"libldap2-dev": "*"},
+		"rhel":   {"openldap-devel": "*"},
 	},
 	"mcrypt": { // @TODO: removed from latest 7.4/7.3/7.2 images
 		"debian": {"libmcrypt-dev": "*"},
+		"rhel":   {"libmcrypt-devel": "*"},
 	},
 	"oci8": {
 		"alpine": {}, // @TODO
 		"debian": {}, // @TODO
+		"rhel":   {}, // @TODO
 	},
 	"odbc": {
 		"alpine": {}, // @TODO
 		"debian": {}, // @TODO
+		"rhel":   {}, // @TODO
 	},
 	"pdo_dblib": {
 		"alpine": {}, // @TODO
 		"debian": {}, // @TODO
+		"rhel":   {}, // @TODO
 	},
 	"pdo_firebird": {
 		"alpine": {}, // @TODO
 		"debian": {}, // @TODO
+		"rhel":   {}, // @TODO
 	},
 	"pdo_oci": {
 		"alpine": {}, // @TODO
 		"debian": {}, // @TODO
+		"rhel":   {}, // @TODO
 	},
 	"pdo_odbc": {
 		"alpine": {}, // @TODO
 		"debian": {}, // @TODO
+		"rhel":   {}, // @TODO
 	},
 	"pdo_pgsql": {
 		"alpine": {"postgresql-dev": "*"},
 		"debian": {"libpq-dev": "*"},
+		"rhel":   {"libpq-devel": "*"},
 	},
 	"pdo_sqlite": {
 		"alpine": {"sqlite-dev": "*"},
 		"debian": {"libsqlite3-dev": "*"},
+		"rhel":   {"sqlite-devel": "*"},
 	},
 	"pgsql": {
 		"alpine": {"postgresql-dev": "*"},
 		"debian": {"libpq-dev": "*"},
+		"rhel":   {"libpq-devel": "*"},
 	},
 	"phar": {
 		"alpine": {"openssl-dev": "*"},
 		"debian": {"libssl-dev": "*"},
+		"rhel":   {"openssl-devel": "*"},
 	},
 	"pspell": {
 		"alpine": {"aspell-dev": "*"},
 		"debian": {"libpspell-dev": "*"},
+		"rhel":   {"aspell-devel": "*"},
 	},
 	"readline": {
 		"alpine": {"libedit-dev": "*"},
 		"debian": {"libedit-dev": "*"},
+		"rhel":   {"libedit-devel": "*"},
 	},
 	"recode": { // @TODO: removed from php7.4
 		"alpine": {"recode-dev": "*"},
 		"debian": {"librecode-dev": "*"},
+		"rhel":   {"recode-devel": "*"},
 	},
 	"simplexml": {
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"snmp": {
 		"alpine": {"net-snmp-dev": "*"},
 		"debian": {"libsnmp-dev": "*"},
+		"rhel":   {"net-snmp-devel": "*"},
 	},
 	"soap": {
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"sodium": {
 		"alpine": {"libsodium-dev": "*"},
 		"debian": {"libsodium-dev": "*"},
+		"rhel":   {"libsodium-devel": "*"},
 	},
 	"sockets": {
 		"alpine": {"openssl-dev": "*"},
 		"debian": {"libssl-dev": "*", "openssl": "*"},
+		"rhel":   {"openssl-devel": "*"},
 	},
 	"tidy": {
 		"alpine": {"tidyhtml-dev": "*"},
 		"debian": {"libtidy-dev": "*"},
+		"rhel":   {"libtidy-devel": "*"},
 	},
 	"wddx": { // @TODO: removed from 7.4
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"xml": {
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"xmlreader": {
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"xmlrpc": {
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"xmlwriter": {
 		"alpine": {"libxml2-dev": "*"},
 		"debian": {"libxml2-dev": "*"},
+		"rhel":   {"libxml2-devel": "*"},
 	},
 	"xsl": {
 		"alpine": {"libxslt-dev": "*"},
 		"debian": {"libxslt1-dev": "*"},
+		"rhel":   {"libxslt-devel": "*"},
 	},
 	"zip": {
 		"alpine": {"libzip-dev": "*"},
 		"debian": {"libzip-dev": "*", "zlib1g-dev": "*"},
+		"rhel":   {"libzip-devel": "*", "zlib-devel": "*"},
 	},
 
 	// PECL Extensions
 	"imagick": {
 		"alpine": {"imagemagick6-dev": "*"},
 		"debian": {"libmagick++-6.q16-dev": "*"},
+		"rhel":   {"ImageMagick-devel": "*"},
 	},
 	"redis": {
 		// This ext needs no deps
 		"alpine": {},
 		"debian": {},
+		"rhel":   {},
 	},
 	"memcache": {
 		"alpine": {"zlib-dev": "*"},
 		"debian": {"zlib1g-dev": "*"},
+		"rhel":   {"zlib-devel": "*"},
 	},
 	"memcached": {
 		"alpine": {"libmemcached-dev": "*", "zlib-dev": "*"},
 		"debian": {"libmemcached-dev": "*", "zlib1g-dev": "*"},
+		"rhel":   {"libmemcached-devel": "*", "zlib-devel": "*"},
 	},
 	"mongodb": {
 		// This ext needs no deps
 		"alpine": {},
 		"debian": {},
+		"rhel":   {},
 	},
 	"amqp": {
 		"alpine": {"rabbitmq-c-dev": "*"},
 		"debian": {"librabbitmq-dev": "*"},
+		"rhel":   {"librabbitmq-devel": "*"},
 	},
 	"couchbase": {
 		"alpine": {"libcouchbase-dev": "*"},
 		"debian": {}, // @TODO: no libcouchbase available
+		"rhel":   {"libcouchbase-devel": "*"},
 	},
 	"rdkafka": {
 		"alpine": {"librdkafka-dev": "*"},
 		"debian": {"librdkafka-dev": "*"},
+		"rhel":   {"librdkafka-devel": "*"},
 	},
 	"zookeeper": {
 		"alpine": {}, // libzookeeper-dev is not available on Alpine.
 		"debian": {"libzookeeper-mt-dev": "*"},
+		"rhel":   {}, // @TODO: no zookeeper devel package in RHEL repos
 	},
 }
 
@@ -402,6 +455,12 @@ func InstallExtensions(
 		runOpts = append(runOpts, peclExtRunOpts...)
 	}
 
+	if stageDef.DefLocks.OSRelease.Family() == builddef.DistroFamilyRHEL {
+		var phpizeRunOpts []llb.RunOption
+		cmds, phpizeRunOpts = withPhpizeDepsFromDNF(cmds, buildOpts)
+		runOpts = append(runOpts, phpizeRunOpts...)
+	}
+
 	runOpts = append(runOpts, llbutils.Shell(cmds...))
 	if buildOpts.IgnoreLayerCache {
 		runOpts = append(runOpts, llb.IgnoreCache)
@@ -433,10 +492,14 @@ func installPeclExtensions(
 	peclExtensions map[string]string,
 	buildOpts builddef.BuildOpts,
 ) ([]string, []llb.RunOption) {
+	notpecl := lockedArtefact(stageDef.DefLocks, artefactNotpecl)
 	cmds := []string{
-		// @TODO: change this URL once notpecl v0.1 has been released.
-		"curl -f -o /usr/local/sbin/notpecl https://storage.googleapis.com/notpecl/notpecl",
-		"chmod +x /usr/local/sbin/notpecl"}
+		fmt.Sprintf("curl -f -o /usr/local/sbin/notpecl %s", notpecl.URL)}
+	if notpecl.Checksum != "" {
+		cmds = append(cmds, fmt.Sprintf("echo \"%s  /usr/local/sbin/notpecl\" | sha256sum -c -",
+			strings.TrimPrefix(notpecl.Checksum, "sha256:")))
+	}
+	cmds = append(cmds, "chmod +x /usr/local/sbin/notpecl")
 	runOpts := []llb.RunOption{}
 	notpeclArgs := []string{}
 
@@ -455,7 +518,7 @@ func installPeclExtensions(
 		"notpecl install "+strings.Join(notpeclArgs, " "),
 		"docker-php-ext-enable "+strings.Join(peclExtensionNames, " "))
 
-	if stageDef.DefLocks.OSRelease.Name == "alpine" {
+	if stageDef.DefLocks.OSRelease.Family() == builddef.DistroFamilyAlpine {
 		apkArgs := []string{"--virtual=.phpize", "$PHPIZE_DEPS"}
 
 		if buildOpts.WithCacheMounts {
@@ -474,6 +537,37 @@ func installPeclExtensions(
 	return cmds, runOpts
 }
 
+// rhelPhpizeDeps lists the packages needed by phpize to build extensions on
+// RHEL-based images, as there's no official PHP image (and thus no
+// $PHPIZE_DEPS) for these distros.
+const rhelPhpizeDeps = "autoconf file gcc gcc-c++ make pkgconf re2c"
+
+// withPhpizeDepsFromDNF wraps the given commands such that phpize deps are
+// installed with dnf before building core and PECL extensions. They're
+// removed afterwards by undoing the dnf transaction that installed them, such
+// that system packages installed beforehand are left untouched.
+func withPhpizeDepsFromDNF(
+	cmds []string,
+	buildOpts builddef.BuildOpts,
+) ([]string, []llb.RunOption) {
+	installCmd := "dnf install -y --setopt=install_weak_deps=False "
+	runOpts := []llb.RunOption{}
+
+	if buildOpts.WithCacheMounts {
+		installCmd += "--setopt=keepcache=True "
+		runOpts = append(runOpts,
+			llbutils.CacheMountOpt("/var/cache/dnf", buildOpts.CacheIDNamespace, "0"))
+	}
+
+	wrapped := append([]string{installCmd + rhelPhpizeDeps}, cmds...)
+	wrapped = append(wrapped, "dnf history undo -y last")
+	if !buildOpts.WithCacheMounts {
+		wrapped = append(wrapped, "dnf clean all", "rm -rf /var/cache/dnf")
+	}
+
+	return wrapped, runOpts
+}
+
 // This holds the list of flags to pass to docker-php-ext-configure. Note
 // that gd has multiple entries, each alias can be specified in zbuildfiles
 // to enable a specific part of gd (each having a specific set of configure
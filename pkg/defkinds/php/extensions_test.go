@@ -67,6 +67,26 @@ func initInstallPeclExtensionsOnAlpineTC(t *testing.T) installExtensionsTC {
 	}
 }
 
+func initInstallExtensionsOnRHELTC(t *testing.T) installExtensionsTC {
+	return installExtensionsTC{
+		expected: "testdata/extensions/extensions-for-rhel.json",
+		stageDef: php.StageDefinition{
+			MajMinVersion: "7.4",
+			DefLocks: php.DefinitionLocks{
+				OSRelease: builddef.OSRelease{
+					Name: "rhel",
+				},
+			},
+			StageLocks: php.StageLocks{
+				Extensions: map[string]string{
+					"intl":      "*",
+					"memcached": "*",
+				},
+			},
+		},
+	}
+}
+
 func initStateDontChangeWhenNoExtToInstallTC(t *testing.T) installExtensionsTC {
 	return installExtensionsTC{
 		expected: "testdata/extensions/skip-install.json",
@@ -86,6 +106,7 @@ func TestInstallExtensions(t *testing.T) {
 		"install gd extension with all supported formats":       initInstallGDWithAllFormatsTC,
 		"install pecl extensions":                               initInstallPeclExtensionsTC,
 		"install pecl extensions on alpine":                     initInstallPeclExtensionsOnAlpineTC,
+		"install core and pecl extensions on rhel":              initInstallExtensionsOnRHELTC,
 		"llb.State don't change when there's no ext to install": initStateDontChangeWhenNoExtToInstallTC,
 	}
 
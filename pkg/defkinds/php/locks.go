@@ -3,11 +3,14 @@ package php
 import (
 	"context"
 	"strings"
+	"sync"
 
 	"github.com/NiR-/notpecl/peclapi"
 	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/statesolver"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 )
 
@@ -19,20 +22,37 @@ type DefinitionLocks struct {
 	ExtensionDir  string                `mapstructure:"extension_dir"`
 	Stages        map[string]StageLocks `mapstructure:"stages"`
 	SourceContext *builddef.Context     `mapstructure:"source_context"`
+	// ComposerImage is the digest-pinned reference of the image the composer
+	// binary is copied from.
+	ComposerImage string `mapstructure:"composer_image"`
+	// Artefacts is a map of the files implicitly downloaded by this builder
+	// (e.g. blackfire probe, notpecl, ...) associated to their locks.
+	Artefacts map[string]ArtefactLocks `mapstructure:"artefacts"`
+	// DebianSnapshot is the timestamp of the Debian archive snapshot system
+	// packages are installed from (only for Debian-based images).
+	DebianSnapshot string `mapstructure:"debian_snapshot"`
 }
 
 func (l DefinitionLocks) RawLocks() map[string]interface{} {
 	lockdata := map[string]interface{}{
-		"base_image":     l.BaseImage,
-		"extension_dir":  l.ExtensionDir,
-		"osrelease":      l.OSRelease,
-		"source_context": nil,
+		"base_image":      l.BaseImage,
+		"extension_dir":   l.ExtensionDir,
+		"osrelease":       l.OSRelease,
+		"source_context":  nil,
+		"composer_image":  l.ComposerImage,
+		"debian_snapshot": l.DebianSnapshot,
 	}
 
 	if l.SourceContext != nil {
 		lockdata["source_context"] = l.SourceContext.RawLocks()
 	}
 
+	artefacts := map[string]interface{}{}
+	for name, artefact := range l.Artefacts {
+		artefacts[name] = artefact.RawLocks()
+	}
+	lockdata["artefacts"] = artefacts
+
 	stages := map[string]interface{}{}
 	for name, stage := range l.Stages {
 		stages[name] = stage.RawLocks()
@@ -47,12 +67,30 @@ func (l DefinitionLocks) RawLocks() map[string]interface{} {
 type StageLocks struct {
 	SystemPackages map[string]string `mapstructure:"system_packages"`
 	Extensions     map[string]string `mapstructure:"extensions"`
+	// ExternalFiles is a map of external file URLs associated to the
+	// checksum of their content.
+	ExternalFiles map[string]string `mapstructure:"external_files"`
 }
 
 func (l StageLocks) RawLocks() map[string]interface{} {
 	return map[string]interface{}{
 		"system_packages": l.SystemPackages,
 		"extensions":      l.Extensions,
+		"external_files":  l.ExternalFiles,
+	}
+}
+
+// ArtefactLocks represents the immutable URL and the checksum of a file
+// implicitly downloaded by this builder.
+type ArtefactLocks struct {
+	URL      string `mapstructure:"url"`
+	Checksum string `mapstructure:"checksum"`
+}
+
+func (l ArtefactLocks) RawLocks() map[string]interface{} {
+	return map[string]interface{}{
+		"url":      l.URL,
+		"checksum": l.Checksum,
 	}
 }
 
@@ -66,41 +104,31 @@ func (h *PHPHandler) UpdateLocks(
 		return nil, err
 	}
 
-	if opts.UpdateImageRef {
-		def.Locks.BaseImage, err = h.solver.ResolveImageRef(ctx, def.BaseImage)
-		if err != nil {
-			return nil, xerrors.Errorf("could not resolve image %q: %w",
-				def.BaseImage, err)
-		}
-
-		osrelease, err := statesolver.ResolveImageOS(ctx, h.solver, def.Locks.BaseImage)
-		if err != nil {
-			return nil, xerrors.Errorf("could not resolve OS details from base image: %w", err)
-		}
-		def.Locks.OSRelease = osrelease
-
-		def.Locks.ExtensionDir, err = h.resolveExtensionDir(ctx, def.Locks.BaseImage)
-		if err != nil {
-			return nil, err
-		}
+	if err := h.lockImagesAndContext(ctx, &def, opts); err != nil {
+		return nil, err
 	}
 
-	def.Locks.SourceContext, err = h.lockSourceContext(ctx, def.SourceContext)
+	pkgSolverType, _, err := pkgsolver.ResolvePackageManager(def.Locks.OSRelease)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to lock source context: %w", err)
+		return nil, err
 	}
 
-	var pkgSolverType pkgsolver.SolverType
-	if def.Locks.OSRelease.Name == "debian" {
-		pkgSolverType = pkgsolver.APT
-	} else if def.Locks.OSRelease.Name == "alpine" {
-		pkgSolverType = pkgsolver.APK
-	} else {
-		return nil, xerrors.Errorf("unsupported OS %q: only debian-based and alpine-based base images are supported", def.Locks.OSRelease.Name)
+	composerLockLoader := h.composerLockCacheLoader(ctx, opts.BuildContext)
+	if opts.UpdateExternalFiles {
+		def.Locks.Artefacts, err = h.lockArtefacts(ctx, def, composerLockLoader)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to lock artefacts: %w", err)
+		}
 	}
 
 	pkgSolver := pkgSolvers.New(pkgSolverType, h.solver)
-	def.Locks.Stages, err = h.updateStagesLocks(ctx, pkgSolver, def, opts)
+	if opts.UpdateSystemPackages {
+		def.Locks.DebianSnapshot = pkgsolver.LockDebianSnapshot(pkgSolver,
+			def.Locks.OSRelease, opts)
+	}
+
+	def.Locks.Stages, err = h.updateStagesLocks(ctx, pkgSolver, def,
+		composerLockLoader, opts)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to update stages locks: %w", err)
 	}
@@ -108,10 +136,67 @@ func (h *PHPHandler) UpdateLocks(
 	return def.Locks, err
 }
 
+// lockImagesAndContext concurrently resolves the base image (and the OS
+// details and extension dir it provides), the composer image and the source
+// context, as none of them depend on each other.
+func (h *PHPHandler) lockImagesAndContext(
+	ctx context.Context,
+	def *Definition,
+	opts builddef.UpdateLocksOpts,
+) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	if opts.UpdateImageRef {
+		eg.Go(func() error {
+			baseImage, err := h.solver.ResolveImageRef(ctx, def.BaseImage)
+			if err != nil {
+				return xerrors.Errorf("could not resolve image %q: %w",
+					def.BaseImage, err)
+			}
+			def.Locks.BaseImage = baseImage
+
+			osrelease, err := statesolver.ResolveImageOS(ctx, h.solver, baseImage)
+			if err != nil {
+				return xerrors.Errorf("could not resolve OS details from base image: %w", err)
+			}
+			def.Locks.OSRelease = osrelease
+
+			def.Locks.ExtensionDir, err = h.resolveExtensionDir(ctx, baseImage)
+			return err
+		})
+
+		eg.Go(func() error {
+			composerImage, err := h.solver.ResolveImageRef(ctx, defaultComposerImageTag)
+			if err != nil {
+				return xerrors.Errorf("could not resolve image %q: %w",
+					defaultComposerImageTag, err)
+			}
+			def.Locks.ComposerImage = composerImage
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		sourceContext, err := h.lockSourceContext(ctx, def.SourceContext)
+		if err != nil {
+			return xerrors.Errorf("failed to lock source context: %w", err)
+		}
+		def.Locks.SourceContext = sourceContext
+		return nil
+	})
+
+	return eg.Wait()
+}
+
 func (h *PHPHandler) resolveExtensionDir(ctx context.Context, image string) (string, error) {
 	buf, err := h.solver.ExecImage(ctx, image, []string{
 		"/usr/bin/env php -r \"echo ini_get('extension_dir');\"",
 	})
+	// env exits with code 127 when the command isn't found.
+	var execErr statesolver.ExecError
+	if xerrors.As(err, &execErr) && execErr.ExitCode == 127 {
+		return "", xerrors.Errorf("fail to resolve extension dir: php isn't available in base image %s", image)
+	}
 	if err != nil {
 		return "", xerrors.Errorf("fail to resolve extension dir from base image: %w", err)
 	}
@@ -123,34 +208,65 @@ func (h *PHPHandler) updateStagesLocks(
 	ctx context.Context,
 	pkgSolver pkgsolver.PackageSolver,
 	def Definition,
+	composerLockLoader func(*StageDefinition) error,
 	opts builddef.UpdateLocksOpts,
 ) (map[string]StageLocks, error) {
-	locks := map[string]StageLocks{}
-	composerLockLoader := h.composerLockCacheLoader(ctx, opts.BuildContext)
-
+	stages := make(map[string]StageDefinition, len(def.Stages))
 	for name := range def.Stages {
 		stage, err := def.ResolveStageDefinition(name, composerLockLoader, false)
 		if err != nil {
 			return nil, xerrors.Errorf("could not resolve stage %q: %w", name, err)
 		}
+		stages[name] = stage
+	}
+
+	// System packages of all stages are looked up at once as each lookup
+	// might need to run a container. Each stage is still resolved on its
+	// own, with its own constraints.
+	var systemPackages map[string]map[string]string
+	if opts.UpdateSystemPackages {
+		stagesPkgs := make(map[string]map[string]string, len(stages))
+		for name, stage := range stages {
+			stagesPkgs[name] = stage.SystemPackages.Map()
+		}
 
+		var err error
+		systemPackages, err = pkgsolver.ResolveStages(ctx, pkgSolver,
+			def.Locks.BaseImage, stagesPkgs, opts)
+		if err != nil {
+			return nil, xerrors.Errorf("could not resolve systems package versions: %w", err)
+		}
+	}
+
+	var extensions map[string]map[string]string
+	if opts.UpdatePHPExtensions {
+		var err error
+		extensions, err = h.lockExtensions(ctx, stages)
+		if err != nil {
+			return nil, xerrors.Errorf("could not resolve php extension versions: %w", err)
+		}
+	}
+
+	locks := map[string]StageLocks{}
+	for name, stage := range stages {
 		stageLocks, ok := def.Locks.Stages[name]
 		if !ok {
 			stageLocks = StageLocks{}
 		}
 
 		if opts.UpdateSystemPackages {
-			stageLocks.SystemPackages, err = pkgSolver.ResolveVersions(ctx,
-				def.Locks.BaseImage, stage.SystemPackages.Map())
-			if err != nil {
-				return nil, xerrors.Errorf("could not resolve systems package versions: %w", err)
-			}
+			stageLocks.SystemPackages = systemPackages[name]
 		}
-
 		if opts.UpdatePHPExtensions {
-			stageLocks.Extensions, err = h.lockExtensions(stage.Extensions)
+			stageLocks.Extensions = extensions[name]
+		}
+
+		if opts.UpdateExternalFiles {
+			var err error
+			stageLocks.ExternalFiles, err = llbutils.LockExternalFiles(ctx,
+				h.httpClient, stage.ExternalFiles)
 			if err != nil {
-				return nil, xerrors.Errorf("could not resolve php extension versions: %w", err)
+				return nil, xerrors.Errorf("could not lock external files: %w", err)
 			}
 		}
 
@@ -162,36 +278,105 @@ func (h *PHPHandler) updateStagesLocks(
 	return locks, nil
 }
 
-func (h *PHPHandler) lockExtensions(extensions *builddef.VersionMap) (map[string]string, error) {
-	resolved := map[string]string{}
-	ctx := context.Background()
+// lockArtefacts resolves the immutable URL and the checksum of the artefacts
+// needed by at least one stage.
+func (h *PHPHandler) lockArtefacts(
+	ctx context.Context,
+	def Definition,
+	composerLockLoader func(*StageDefinition) error,
+) (map[string]ArtefactLocks, error) {
+	locks := map[string]ArtefactLocks{}
 
-	// Remove extensions installed by default as this would result in a build
-	// error otherwise.
-	for _, name := range extensions.Names() {
-		if _, ok := preinstalledExtensions[name]; ok {
-			extensions.Remove(name)
+	for name := range def.Stages {
+		stage, err := def.ResolveStageDefinition(name, composerLockLoader, false)
+		if err != nil {
+			return nil, xerrors.Errorf("could not resolve stage %q: %w", name, err)
 		}
-	}
 
-	for extName, constraint := range extensions.Map() {
-		if isCoreExtension(extName) {
-			resolved[extName] = constraint
-			continue
+		for _, artefact := range stageArtefacts(stage) {
+			if _, ok := locks[artefact]; ok {
+				continue
+			}
+
+			url, checksum, err := llbutils.LockURL(ctx, h.httpClient, artefactURLs[artefact])
+			if err != nil {
+				return nil, err
+			}
+			locks[artefact] = ArtefactLocks{URL: url, Checksum: checksum}
 		}
+	}
 
-		segments := strings.SplitN(constraint, "@", 2)
-		stability := peclapi.Stable
-		if len(segments) == 2 {
-			stability = peclapi.StabilityFromString(segments[1])
+	return locks, nil
+}
+
+// lockExtensions resolves the version of the PHP extensions used by each
+// stage. Each distinct extension constraint is resolved only once and all
+// of them are resolved concurrently.
+func (h *PHPHandler) lockExtensions(
+	ctx context.Context,
+	stages map[string]StageDefinition,
+) (map[string]map[string]string, error) {
+	type extConstraint struct {
+		name       string
+		constraint string
+	}
+
+	toResolve := map[extConstraint]struct{}{}
+	for _, stage := range stages {
+		// Remove extensions installed by default as this would result in a build
+		// error otherwise.
+		for _, name := range stage.Extensions.Names() {
+			if _, ok := preinstalledExtensions[name]; ok {
+				stage.Extensions.Remove(name)
+			}
 		}
 
-		extVer, err := h.pecl.ResolveConstraint(ctx, extName, segments[0], stability)
-		if err != nil {
-			return resolved, err
+		for extName, constraint := range stage.Extensions.Map() {
+			if !isCoreExtension(extName) {
+				toResolve[extConstraint{extName, constraint}] = struct{}{}
+			}
 		}
+	}
 
-		resolved[extName] = extVer
+	var mu sync.Mutex
+	versions := make(map[extConstraint]string, len(toResolve))
+	eg, ctx := errgroup.WithContext(ctx)
+
+	for ext := range toResolve {
+		ext := ext
+		eg.Go(func() error {
+			segments := strings.SplitN(ext.constraint, "@", 2)
+			stability := peclapi.Stable
+			if len(segments) == 2 {
+				stability = peclapi.StabilityFromString(segments[1])
+			}
+
+			extVer, err := h.pecl.ResolveConstraint(ctx, ext.name, segments[0], stability)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			versions[ext] = extVer
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[string]map[string]string, len(stages))
+	for name, stage := range stages {
+		resolved[name] = map[string]string{}
+		for extName, constraint := range stage.Extensions.Map() {
+			if isCoreExtension(extName) {
+				resolved[name][extName] = constraint
+				continue
+			}
+			resolved[name][extName] = versions[extConstraint{extName, constraint}]
+		}
 	}
 
 	return resolved, nil
@@ -1,7 +1,6 @@
 package php_test
 
 import (
-	"bytes"
 	"context"
 	"io/ioutil"
 	"testing"
@@ -10,10 +9,12 @@ import (
 	"github.com/NiR-/notpecl/pecltest"
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/defkinds/php"
+	"github.com/NiR-/zbuild/pkg/llbtest"
 	"github.com/NiR-/zbuild/pkg/mocks"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/golang/mock/gomock"
+	"golang.org/x/xerrors"
 	"gopkg.in/yaml.v2"
 )
 
@@ -26,42 +27,11 @@ type updateLocksTC struct {
 	expectedErr error
 }
 
-var rawDebianOSRelease = []byte(`PRETTY_NAME="Debian GNU/Linux 10 (buster)"
-NAME="Debian GNU/Linux"
-VERSION_ID="10"
-VERSION="10 (buster)"
-VERSION_CODENAME=buster
-ID=debian
-HOME_URL="https://www.debian.org/"
-SUPPORT_URL="https://www.debian.org/support"
-BUG_REPORT_URL="https://bugs.debian.org/"`)
-
 func initUpdateLocksWithDebianBaseImageTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-	solver.EXPECT().ResolveImageRef(
-		gomock.Any(), "docker.io/library/php:7.3-fpm-buster",
-	).Return("docker.io/library/php:7.3-fpm-buster@sha256", nil)
-
-	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/php:7.3-fpm-buster@sha256", []string{
-		"/usr/bin/env php -r \"echo ini_get('extension_dir');\"",
-	}).Return(bytes.NewBufferString("/some/path"), nil)
-
-	solver.EXPECT().FromImage("docker.io/library/php:7.3-fpm-buster@sha256").Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(),
-		"/etc/os-release",
-		gomock.Any(),
-	).Return(rawDebianOSRelease, nil)
-
-	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(), "composer.lock", gomock.Any(),
-	).AnyTimes().Return([]byte{}, statesolver.FileNotFound)
-
 	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
 	pkgSolver.EXPECT().ResolveVersions(
 		gomock.Any(),
-		"docker.io/library/php:7.3-fpm-buster@sha256",
+		llbtest.ImageRef("docker.io/library/php:7.3-fpm-buster"),
 		map[string]string{
 			"git":         "*",
 			"libicu-dev":  "*",
@@ -99,7 +69,7 @@ func initUpdateLocksWithDebianBaseImageTC(t *testing.T, mockCtrl *gomock.Control
 
 	h := php.NewPHPHandler()
 	h.WithPeclBackend(pb)
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/debian.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -120,40 +90,11 @@ func initUpdateLocksWithDebianBaseImageTC(t *testing.T, mockCtrl *gomock.Control
 	}
 }
 
-var rawAlpine3103OSRelease = []byte(`NAME="Alpine Linux"
-ID=alpine
-VERSION_ID=3.10.3
-PRETTY_NAME="Alpine Linux v3.10"
-HOME_URL="https://alpinelinux.org/"
-BUG_REPORT_URL="https://bugs.alpinelinux.org/"
-`)
-
 func initUpdateLocksWithAlpineBaseImageTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-	solver.EXPECT().ResolveImageRef(
-		gomock.Any(), "docker.io/library/php:7.3-fpm-alpine",
-	).Return("docker.io/library/php:7.3-fpm-alpine@sha256", nil)
-
-	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/php:7.3-fpm-alpine@sha256", []string{
-		"/usr/bin/env php -r \"echo ini_get('extension_dir');\"",
-	}).Return(bytes.NewBufferString("/some/path"), nil)
-
-	solver.EXPECT().FromImage("docker.io/library/php:7.3-fpm-alpine@sha256").Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(),
-		"/etc/os-release",
-		gomock.Any(),
-	).Return(rawAlpine3103OSRelease, nil)
-
-	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(), "composer.lock", gomock.Any(),
-	).AnyTimes().Return([]byte{}, statesolver.FileNotFound)
-
 	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
 	pkgSolver.EXPECT().ResolveVersions(
 		gomock.Any(),
-		"docker.io/library/php:7.3-fpm-alpine@sha256",
+		llbtest.ImageRef("docker.io/library/php:7.3-fpm-alpine"),
 		map[string]string{
 			"git":         "*",
 			"icu-dev":     "*",
@@ -187,7 +128,7 @@ func initUpdateLocksWithAlpineBaseImageTC(t *testing.T, mockCtrl *gomock.Control
 
 	h := php.NewPHPHandler()
 	h.WithPeclBackend(pb)
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/alpine.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -208,38 +149,9 @@ func initUpdateLocksWithAlpineBaseImageTC(t *testing.T, mockCtrl *gomock.Control
 	}
 }
 
-var rawAlpine3112OSRelease = []byte(`NAME="Alpine Linux"
-ID=alpine
-VERSION_ID=3.11.2
-PRETTY_NAME="Alpine Linux v3.11"
-HOME_URL="https://alpinelinux.org/"
-BUG_REPORT_URL="https://bugs.alpinelinux.org/"
-`)
-
 func initUpdateImageRefOnlyTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-	solver.EXPECT().ResolveImageRef(
-		gomock.Any(), "docker.io/library/php:7.3-fpm-alpine",
-	).Return("docker.io/library/php:7.3-fpm-alpine@some-updated-sha256", nil)
-
-	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/php:7.3-fpm-alpine@some-updated-sha256", []string{
-		"/usr/bin/env php -r \"echo ini_get('extension_dir');\"",
-	}).Return(bytes.NewBufferString("/some/updated/path"), nil)
-
-	solver.EXPECT().FromImage("docker.io/library/php:7.3-fpm-alpine@some-updated-sha256").Times(1)
-	solver.EXPECT().ReadFile(
-		gomock.Any(),
-		"/etc/os-release",
-		gomock.Any(),
-	).Return(rawAlpine3112OSRelease, nil)
-
-	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
-	solver.EXPECT().ReadFile(
-		gomock.Any(), "composer.lock", gomock.Any(),
-	).AnyTimes().Return([]byte{}, statesolver.FileNotFound)
-
 	h := php.NewPHPHandler()
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/update-image-ref-only.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -260,18 +172,89 @@ func initUpdateImageRefOnlyTC(t *testing.T, mockCtrl *gomock.Controller) updateL
 	}
 }
 
-func initUpdateSystemPackagesOnlyTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
+func initFailWhenPHPIsNotAvailableTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
+	h := php.NewPHPHandler()
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/php-not-available.fixtures.json"))
 
-	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
-	solver.EXPECT().ReadFile(
-		gomock.Any(), "composer.lock", gomock.Any(),
-	).AnyTimes().Return([]byte{}, statesolver.FileNotFound)
+	return updateLocksTC{
+		opts: builddef.UpdateLocksOpts{
+			BuildOpts: &builddef.BuildOpts{
+				Def: loadBuildDefWithLocks(t, "testdata/locks/alpine.yml"),
+			},
+			UpdateImageRef: true,
+		},
+		handler: h,
+		pkgSolvers: pkgsolver.PackageSolversMap{
+			pkgsolver.APK: func(statesolver.StateSolver) pkgsolver.PackageSolver {
+				return mocks.NewMockPackageSolver(mockCtrl)
+			},
+		},
+		expectedErr: xerrors.New("fail to resolve extension dir: php isn't available in base image docker.io/library/alpine:3.11@sha256"),
+	}
+}
 
+func initUpdateLocksWithUBIBaseImageTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
 	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
 	pkgSolver.EXPECT().ResolveVersions(
 		gomock.Any(),
-		"docker.io/library/php:7.3-fpm-alpine@sha256",
+		llbtest.ImageRef("registry.access.redhat.com/ubi8/php-74"),
+		map[string]string{
+			"git":           "*",
+			"libicu-devel":  "*",
+			"libxml2-devel": "*",
+			"libzip-devel":  "*",
+			"openssl-devel": "*",
+			"unzip":         "*",
+			"zlib-devel":    "*",
+		},
+	).AnyTimes().Return(map[string]string{
+		"git":           "2.27.0-1.el8",
+		"libicu-devel":  "60.3-2.el8_1",
+		"libxml2-devel": "2.9.7-9.el8",
+		"libzip-devel":  "1.5.1-2.module+el8.1.0+3202+af5476b9",
+		"openssl-devel": "1:1.1.1g-15.el8_3",
+		"unzip":         "6.0-43.el8",
+		"zlib-devel":    "1.2.11-16.el8_2",
+	}, nil)
+
+	pb := pecltest.NewMockBackend(mockCtrl)
+	pb.EXPECT().
+		ResolveConstraint(gomock.Any(), "apcu", "*", peclapi.Stable).
+		AnyTimes().
+		Return("5.1.18", nil)
+	pb.EXPECT().
+		ResolveConstraint(gomock.Any(), "redis", "~5.1.0", peclapi.Stable).
+		AnyTimes().
+		Return("5.1.0", nil)
+
+	h := php.NewPHPHandler()
+	h.WithPeclBackend(pb)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/ubi.fixtures.json"))
+
+	return updateLocksTC{
+		opts: builddef.UpdateLocksOpts{
+			BuildOpts: &builddef.BuildOpts{
+				Def: loadBuildDef(t, "testdata/locks/ubi.yml"),
+			},
+			UpdateImageRef:       true,
+			UpdateSystemPackages: true,
+			UpdatePHPExtensions:  true,
+		},
+		handler: h,
+		pkgSolvers: pkgsolver.PackageSolversMap{
+			pkgsolver.DNF: func(statesolver.StateSolver) pkgsolver.PackageSolver {
+				return pkgSolver
+			},
+		},
+		expected: "testdata/locks/ubi.lock",
+	}
+}
+
+func initUpdateSystemPackagesOnlyTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
+	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
+	pkgSolver.EXPECT().ResolveVersions(
+		gomock.Any(),
+		llbtest.ImageRef("docker.io/library/php:7.3-fpm-alpine"),
 		map[string]string{
 			"git":         "*",
 			"icu-dev":     "*",
@@ -290,7 +273,7 @@ func initUpdateSystemPackagesOnlyTC(t *testing.T, mockCtrl *gomock.Controller) u
 	}, nil)
 
 	h := php.NewPHPHandler()
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/no-composer-lock.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -312,13 +295,6 @@ func initUpdateSystemPackagesOnlyTC(t *testing.T, mockCtrl *gomock.Controller) u
 }
 
 func initUpdatePHPExtensionsOnlyTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
-	solver := mocks.NewMockStateSolver(mockCtrl)
-
-	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any())
-	solver.EXPECT().ReadFile(
-		gomock.Any(), "composer.lock", gomock.Any(),
-	).AnyTimes().Return([]byte{}, statesolver.FileNotFound)
-
 	pb := pecltest.NewMockBackend(mockCtrl)
 	pb.EXPECT().
 		ResolveConstraint(gomock.Any(), "yaml", "~1.0", peclapi.Beta).
@@ -335,7 +311,7 @@ func initUpdatePHPExtensionsOnlyTC(t *testing.T, mockCtrl *gomock.Controller) up
 
 	h := php.NewPHPHandler()
 	h.WithPeclBackend(pb)
-	h.WithSolver(solver)
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/no-composer-lock.fixtures.json"))
 
 	return updateLocksTC{
 		opts: builddef.UpdateLocksOpts{
@@ -356,13 +332,44 @@ func initUpdatePHPExtensionsOnlyTC(t *testing.T, mockCtrl *gomock.Controller) up
 	}
 }
 
+func initUpdateExternalFilesOnlyTC(t *testing.T, mockCtrl *gomock.Controller) updateLocksTC {
+	h := php.NewPHPHandler()
+	h.WithSolver(llbtest.LoadFixtures(t, "testdata/locks/no-composer-lock.fixtures.json"))
+	h.WithHTTPClient(llbtest.NewHTTPClientWithRedirects(t, map[string]string{
+		"https://packages.blackfire.io/binaries/blackfire-php/1.31.0/blackfire-php-linux_amd64-php-72.tar.gz": "blackfire-probe",
+		"https://github.com/NiR-/fcgi-client/releases/download/v0.1.0/fcgi-client.phar":                       "fcgi-client",
+		"https://storage.googleapis.com/notpecl/notpecl":                                                      "notpecl",
+	}, map[string]string{
+		"https://blackfire.io/api/v1/releases/probe/php/linux/amd64/72": "https://packages.blackfire.io/binaries/blackfire-php/1.31.0/blackfire-php-linux_amd64-php-72.tar.gz",
+	}))
+
+	return updateLocksTC{
+		opts: builddef.UpdateLocksOpts{
+			BuildOpts: &builddef.BuildOpts{
+				Def: loadBuildDefWithLocks(t, "testdata/locks/debian.yml"),
+			},
+			UpdateExternalFiles: true,
+		},
+		handler: h,
+		pkgSolvers: pkgsolver.PackageSolversMap{
+			pkgsolver.APT: func(statesolver.StateSolver) pkgsolver.PackageSolver {
+				return mocks.NewMockPackageSolver(mockCtrl)
+			},
+		},
+		expected: "testdata/locks/update-external-files-only.lock",
+	}
+}
+
 func TestUpdateLocks(t *testing.T) {
 	testcases := map[string]func(*testing.T, *gomock.Controller) updateLocksTC{
-		"with an alpine base image": initUpdateLocksWithAlpineBaseImageTC,
-		"with a debian base image":  initUpdateLocksWithDebianBaseImageTC,
-		"only image ref":            initUpdateImageRefOnlyTC,
-		"only system packages":      initUpdateSystemPackagesOnlyTC,
-		"only PHP extensions":       initUpdatePHPExtensionsOnlyTC,
+		"with an alpine base image":                        initUpdateLocksWithAlpineBaseImageTC,
+		"with a debian base image":                         initUpdateLocksWithDebianBaseImageTC,
+		"only image ref":                                   initUpdateImageRefOnlyTC,
+		"only system packages":                             initUpdateSystemPackagesOnlyTC,
+		"only PHP extensions":                              initUpdatePHPExtensionsOnlyTC,
+		"only external files":                              initUpdateExternalFilesOnlyTC,
+		"fail when php is not available in the base image": initFailWhenPHPIsNotAvailableTC,
+		"update locks with a UBI base image":               initUpdateLocksWithUBIBaseImageTC,
 	}
 
 	for tcname := range testcases {
@@ -0,0 +1,64 @@
+package php
+
+import (
+	"context"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"golang.org/x/xerrors"
+)
+
+// SBOM returns the packages installed in the given stage: its base image,
+// the composer image, its system packages, its PHP extensions, its external
+// files and, except for dev stages, the non-dev packages locked in
+// composer.lock.
+func (h *PHPHandler) SBOM(
+	ctx context.Context,
+	buildOpts builddef.BuildOpts,
+) (sbom.BOM, error) {
+	stageDef, err := h.loadDefs(ctx, buildOpts)
+	if err != nil {
+		return sbom.BOM{}, err
+	}
+
+	srcContext := resolveSourceContext(stageDef, buildOpts)
+	bom := sbom.New(buildOpts, srcContext)
+
+	composerImage := stageDef.DefLocks.ComposerImage
+	if composerImage == "" {
+		composerImage = defaultComposerImageTag
+	}
+	for _, ref := range []string{stageDef.DefLocks.BaseImage, composerImage} {
+		pkg, err := sbom.BaseImage(ref)
+		if err != nil {
+			return bom, err
+		}
+		bom.Add(pkg)
+	}
+
+	bom.Add(sbom.SystemPackages(stageDef.DefLocks.OSRelease,
+		stageDef.StageLocks.SystemPackages)...)
+
+	extensions := map[string]string{}
+	for name, version := range stageDef.StageLocks.Extensions {
+		// Core extensions are compiled from the PHP sources of the base
+		// image, so they're already covered by it.
+		if version != "*" {
+			extensions[name] = version
+		}
+	}
+	bom.Add(sbom.Packages(sbom.TypePECL, extensions)...)
+
+	bom.Add(sbom.LockedExternalFiles(stageDef.ExternalFiles,
+		stageDef.StageLocks.ExternalFiles)...)
+
+	err = bom.AddSourcePackages(stageDef.Dev, func() ([]sbom.Package, error) {
+		composerLock, err := LoadComposerLock(ctx, h.solver, srcContext)
+		if err != nil {
+			return nil, xerrors.Errorf("could not list composer packages: %w", err)
+		}
+		return sbom.Packages(sbom.TypeComposer, composerLock.Packages.Map()), nil
+	})
+
+	return bom, err
+}
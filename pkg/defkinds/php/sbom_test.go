@@ -0,0 +1,107 @@
+package php_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/defkinds/php"
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"github.com/golang/mock/gomock"
+)
+
+type sbomTC struct {
+	handler   *php.PHPHandler
+	buildOpts builddef.BuildOpts
+	format    string
+	expected  string
+}
+
+func initSBOMTC(
+	t *testing.T,
+	mockCtrl *gomock.Controller,
+	stage string,
+	composerLockReads int,
+	format string,
+	expected string,
+) sbomTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+
+	raw := loadRawTestdata(t, "testdata/debug-config/composer.lock")
+	solver.EXPECT().FromContext(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(composerLockReads)
+	solver.EXPECT().ReadFile(
+		gomock.Any(), "composer.lock", gomock.Any(),
+	).Return(raw, nil).Times(composerLockReads)
+
+	h := php.NewPHPHandler()
+	h.WithSolver(solver)
+
+	genericDef := loadBuildDefWithLocks(t, "testdata/debug-config/zbuild.yml")
+	sourceDate := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+	return sbomTC{
+		handler: h,
+		buildOpts: builddef.BuildOpts{
+			Def:             genericDef,
+			Stage:           stage,
+			SourceDateEpoch: &sourceDate,
+			BuildContext: &builddef.Context{
+				Type:   builddef.ContextTypeLocal,
+				Source: "context",
+			},
+		},
+		format:   format,
+		expected: expected,
+	}
+}
+
+func TestSBOM(t *testing.T) {
+	testcases := map[string]func(*testing.T, *gomock.Controller) sbomTC{
+		"SPDX SBOM of the dev stage": func(t *testing.T, mockCtrl *gomock.Controller) sbomTC {
+			return initSBOMTC(t, mockCtrl, "dev", 1, sbom.FormatSPDX, "testdata/sbom/dev.spdx.json")
+		},
+		"CycloneDX SBOM of the prod stage": func(t *testing.T, mockCtrl *gomock.Controller) sbomTC {
+			// composer.lock is loaded once to infer the extensions and once
+			// to list the composer packages.
+			return initSBOMTC(t, mockCtrl, "prod", 2, sbom.FormatCycloneDX, "testdata/sbom/prod.cdx.json")
+		},
+	}
+
+	for tcname := range testcases {
+		tcinit := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			tc := tcinit(t, mockCtrl)
+
+			bom, err := tc.handler.SBOM(context.TODO(), tc.buildOpts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			raw, err := sbom.Marshal(bom, tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *flagTestdata {
+				writeTestdata(t, tc.expected, string(raw))
+				return
+			}
+
+			expected := loadTestdata(t, tc.expected)
+			if expected != string(raw) {
+				tempfile := newTempFile(t)
+				writeTestdata(t, tempfile, string(raw))
+
+				t.Fatalf("Expected: <%s>\nGot: <%s>", tc.expected, tempfile)
+			}
+		})
+	}
+}
@@ -3,17 +3,19 @@ package webserver
 import (
 	"context"
 	"path"
-	"time"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/image"
 	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/registry"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/moby/buildkit/client/llb"
 	"golang.org/x/xerrors"
 )
 
+// fileOwner is the owner of the assets copied into the image when no user is
+// specified by the definition.
 var fileOwner = "nginx"
 var SharedKeys = struct {
 	ConfigFiles string
@@ -52,6 +54,9 @@ func (h *WebserverHandler) Build(
 	}
 
 	state = llbutils.ImageSource(def.Locks.BaseImage, true)
+	if sourceDate, ok := buildOpts.SourceDate(buildOpts.BuildContext); ok {
+		state = llbutils.WithCreatedTime(state, sourceDate)
+	}
 	baseImg, err := image.LoadMeta(ctx, def.Locks.BaseImage)
 	if err != nil {
 		return state, img, xerrors.Errorf("failed to load %q metadata: %w", def.Locks.BaseImage, err)
@@ -64,34 +69,54 @@ func (h *WebserverHandler) Build(
 		return state, img, xerrors.New("no source state to copy assets from has been provided")
 	}
 
-	pkgManager := llbutils.APT
-	if def.Locks.OSRelease.Name == "alpine" {
-		pkgManager = llbutils.APK
+	_, pkgManager, err := pkgsolver.ResolvePackageManager(def.Locks.OSRelease)
+	if err != nil {
+		return state, img, err
 	}
 
 	if buildOpts.WithCacheMounts && len(def.Locks.SystemPackages) > 0 {
 		state = llbutils.SetupSystemPackagesCache(state, pkgManager)
 	}
 
+	pkgOpts := llbutils.NewCachingStrategyFromBuildOpts(buildOpts)
+	pkgOpts.DebianSnapshot = llbutils.LockedDebianSnapshot(buildOpts,
+		def.Locks.OSRelease, def.Locks.DebianSnapshot)
+
 	state, err = llbutils.InstallSystemPackages(state, pkgManager,
-		def.Locks.SystemPackages,
-		llbutils.NewCachingStrategyFromBuildOpts(buildOpts))
+		def.Locks.SystemPackages, pkgOpts)
 	if err != nil {
 		return state, img, xerrors.Errorf("failed to add \"install system pacakges\" steps: %w", err)
 	}
 
+	state, err = llbutils.CreateUser(state, pkgManager, def.User,
+		buildOpts.IgnoreLayerCache)
+	if err != nil {
+		return state, img, xerrors.Errorf("failed to add \"create user\" step: %w", err)
+	}
+
 	workingDir := img.Config.WorkingDir
 	state, err = h.copyConfigFiles(def, state, workingDir, buildOpts)
 	if err != nil {
 		return state, img, err
 	}
 
+	assetsOwner := fileOwner
+	if def.User != nil {
+		assetsOwner = def.User.Owner()
+	}
 	for _, asset := range def.Assets {
 		state = llbutils.Copy(
-			*buildOpts.SourceState, asset.From, state, asset.To, fileOwner, buildOpts.IgnoreLayerCache)
+			*buildOpts.SourceState, asset.From, state, asset.To, assetsOwner, buildOpts.IgnoreLayerCache)
 	}
 
-	setImageMetadata(def, state, img)
+	if err := setImageMetadata(def, state, img); err != nil {
+		return state, img, err
+	}
+	// Labels are set after the metadata, as the creation date of the image
+	// is used.
+	labels := builddef.ImageLabels(buildOpts, def.Locks.BaseImage,
+		buildOpts.BuildContext, *img.Created)
+	labels.Merge(def.Labels).ApplyTo(img)
 
 	return state, img, nil
 }
@@ -131,7 +156,7 @@ func (h *WebserverHandler) copyConfigFiles(
 	// if the cache is fresh (when using a local context). As such, we can't
 	// just copy the whole source state to the dest state.
 	state = llbutils.CopyAll(
-		srcState, state, interpolated, "1000:1000", buildOpts.IgnoreLayerCache)
+		srcState, state, interpolated, def.User.Owner(), buildOpts.IgnoreLayerCache)
 
 	return state, nil
 }
@@ -148,15 +173,25 @@ func setImageMetadata(
 	def Definition,
 	state llb.State,
 	img *image.Image,
-) {
+) error {
 	if def.Healthcheck.IsEnabled() {
 		img.Config.Healthcheck = def.Healthcheck.ToImageConfig()
 	}
 
 	// Use SIGSTOP to gracefully stop nginx
 	img.Config.StopSignal = "SIGSTOP"
-	now := time.Now()
-	img.Created = &now
+
+	// nginx master process runs as root, unless a user is specified.
+	if def.User != nil {
+		img.Config.User = def.User.UserID()
+	}
+
+	// The image config from the definition takes precedence over the one above.
+	if err := def.Image.ApplyTo(img); err != nil {
+		return err
+	}
+
+	return llbutils.SetImageCreated(state, img)
 }
 
 func (h *WebserverHandler) WithSolver(solver statesolver.StateSolver) {
@@ -1,7 +1,9 @@
 package webserver_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"testing"
@@ -76,8 +78,9 @@ func initBuildLLBTC(t *testing.T, mockCtrl *gomock.Controller) buildTC {
 						"80/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild":  "true",
-						"maintainer": "NGINX Docker Maintainers <docker-maint@nginx.com>",
+						builddef.LabelBaseDigest: "sha256:8aa7f6a9585d908a63e5e418dc5d14ae7467d2e36e1ab4f0d8f9d059a3d071ce",
+						"io.zbuild":              "true",
+						"maintainer":             "NGINX Docker Maintainers <docker-maint@nginx.com>",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -137,8 +140,10 @@ func initBuildLLBFromGitContextTC(t *testing.T, mockCtrl *gomock.Controller) bui
 						"80/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild":  "true",
-						"maintainer": "NGINX Docker Maintainers <docker-maint@nginx.com>",
+						builddef.LabelBaseDigest: "sha256:8aa7f6a9585d908a63e5e418dc5d14ae7467d2e36e1ab4f0d8f9d059a3d071ce",
+						builddef.LabelSource:     "git://github.com/some/repo",
+						"io.zbuild":              "true",
+						"maintainer":             "NGINX Docker Maintainers <docker-maint@nginx.com>",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -224,8 +229,9 @@ func initBuildLLBForAlpineBasedBaseImgeTC(t *testing.T, mockCtrl *gomock.Control
 						"80/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild":  "true",
-						"maintainer": "NGINX Docker Maintainers <docker-maint@nginx.com>",
+						builddef.LabelBaseDigest: "sha256:08a230429c2d27b8a5668163f3c20e73e6bba6aad4796aaea90372fbaebca122",
+						"io.zbuild":              "true",
+						"maintainer":             "NGINX Docker Maintainers <docker-maint@nginx.com>",
 					},
 				},
 			},
@@ -281,8 +287,9 @@ func initBuildLLBWithCacheMountsTC(t *testing.T, mockCtrl *gomock.Controller) bu
 						"80/tcp": {},
 					},
 					Labels: map[string]string{
-						"io.zbuild":  "true",
-						"maintainer": "NGINX Docker Maintainers <docker-maint@nginx.com>",
+						builddef.LabelBaseDigest: "sha256:8aa7f6a9585d908a63e5e418dc5d14ae7467d2e36e1ab4f0d8f9d059a3d071ce",
+						"io.zbuild":              "true",
+						"maintainer":             "NGINX Docker Maintainers <docker-maint@nginx.com>",
 					},
 				},
 				Healthcheck: &image.HealthConfig{
@@ -346,6 +353,7 @@ func TestBuild(t *testing.T) {
 			}
 
 			img.Created = nil
+			delete(img.Config.Labels, builddef.LabelCreated)
 			img.History = nil
 			img.RootFS.DiffIDs = nil
 			if diff := deep.Equal(img, tc.expectedImage); diff != nil {
@@ -370,3 +378,97 @@ func newTempFile(t *testing.T) string {
 	defer file.Close()
 	return file.Name()
 }
+
+// newBaseImage returns the config of an nginx base image, as served by
+// llbtest.NewImageRegistry.
+func newBaseImage() specs.Image {
+	created := time.Date(2020, time.January, 21, 0, 0, 0, 0, time.UTC)
+	return specs.Image{
+		Created:      &created,
+		Architecture: "amd64",
+		OS:           "linux",
+		Config: specs.ImageConfig{
+			Env: []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			Cmd: []string{"nginx", "-g", "daemon off;"},
+		},
+		RootFS: specs.RootFS{Type: "layers"},
+		History: []specs.History{
+			{Created: &created, CreatedBy: "/bin/sh -c #(nop) CMD [\"nginx\" \"-g\" \"daemon off;\"]", EmptyLayer: true},
+		},
+	}
+}
+
+func TestBuildWithSourceDateEpochIsReproducible(t *testing.T) {
+	if *flagTestdata {
+		return
+	}
+
+	baseImage := llbtest.NewImageRegistry(t, "library/nginx", newBaseImage())
+
+	genericDef := loadGenericDef(t, "testdata/build/zbuild.yml")
+	genericDef.RawLocks = loadDefLocks(t, "testdata/build/alpine.lock")
+	genericDef.RawLocks.Raw["base_image"] = baseImage
+
+	sourceDate := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	buildOpts := builddef.BuildOpts{
+		Def:             &genericDef,
+		SessionID:       "<SESSION-ID>",
+		LocalUniqueID:   "x1htr02606a9rk8b0daewh9es",
+		SourceDateEpoch: &sourceDate,
+		BuildContext: &builddef.Context{
+			Source: "context",
+			Type:   builddef.ContextTypeLocal,
+		},
+	}
+
+	build := func() (string, []byte) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		handler := webserver.WebserverHandler{}
+		handler.WithSolver(mocks.NewMockStateSolver(mockCtrl))
+
+		state, img, err := handler.Build(context.Background(), buildOpts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		imgConfig, err := json.Marshal(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return llbtest.StateToJSON(t, state), imgConfig
+	}
+
+	firstState, firstConfig := build()
+	// Ensure the current time changes between the two builds.
+	time.Sleep(10 * time.Millisecond)
+	secondState, secondConfig := build()
+
+	if firstState != secondState {
+		t.Fatalf("Expected LLB states to be identical:\n%s\n%s", firstState, secondState)
+	}
+	if !bytes.Equal(firstConfig, secondConfig) {
+		t.Fatalf("Expected image configs to be identical:\n%s\n%s", firstConfig, secondConfig)
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(firstConfig, &img); err != nil {
+		t.Fatal(err)
+	}
+	if !img.Created.Equal(sourceDate) {
+		t.Fatalf("Expected image to be created at %v, got %v.", sourceDate, img.Created)
+	}
+	if created := img.Config.Labels[builddef.LabelCreated]; created != "2020-03-01T10:00:00Z" {
+		t.Fatalf("Unexpected %s label: %q", builddef.LabelCreated, created)
+	}
+	// The base image has a single history entry, followed by the entries of
+	// the layers added by zbuild.
+	if len(img.History) < 2 {
+		t.Fatalf("Expected new history entries, got: %v", img.History)
+	}
+	for _, h := range img.History[1:] {
+		if !h.Created.Equal(sourceDate) {
+			t.Errorf("Expected history entry to be created at %v, got %v.", sourceDate, h.Created)
+		}
+	}
+}
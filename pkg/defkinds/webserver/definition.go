@@ -101,6 +101,9 @@ type Definition struct {
 	ConfigFiles    builddef.PathsMap           `mapstructure:"config_files"`
 	Healthcheck    *builddef.HealthcheckConfig `mapstructure:"healthcheck"`
 	Assets         []AssetToCopy               `mapstructure:"assets"`
+	Labels         builddef.Labels             `mapstructure:"labels"`
+	Image          builddef.ImageConfig        `mapstructure:"image"`
+	User           *builddef.UserConfig        `mapstructure:"user"`
 
 	Locks DefinitionLocks `mapstructure:"-"`
 }
@@ -115,6 +118,14 @@ func (def Definition) IsValid() error {
 			def.Healthcheck.Type)
 	}
 
+	if err := def.Image.IsValid(); err != nil {
+		return xerrors.Errorf("invalid image config: %w", err)
+	}
+
+	if err := def.User.IsValid(); err != nil {
+		return xerrors.Errorf("invalid user: %w", err)
+	}
+
 	return nil
 }
 
@@ -126,6 +137,9 @@ func (def Definition) Copy() Definition {
 		SystemPackages: def.SystemPackages.Copy(),
 		Assets:         def.Assets,
 		ConfigFiles:    def.ConfigFiles.Copy(),
+		Labels:         def.Labels.Copy(),
+		Image:          def.Image.Copy(),
+		User:           def.User.Copy(),
 	}
 
 	if def.Healthcheck != nil {
@@ -142,6 +156,8 @@ func (base Definition) Merge(overriding Definition) Definition {
 	new.Alpine = overriding.Alpine
 	new.Assets = append(new.Assets, overriding.Assets...)
 	new.ConfigFiles = new.ConfigFiles.Merge(overriding.ConfigFiles)
+	new.Labels = new.Labels.Merge(overriding.Labels)
+	new.Image = new.Image.Merge(overriding.Image)
 	new.SystemPackages.Merge(overriding.SystemPackages)
 
 	if !overriding.Type.IsEmpty() {
@@ -151,6 +167,9 @@ func (base Definition) Merge(overriding Definition) Definition {
 		healthcheck := *overriding.Healthcheck
 		new.Healthcheck = &healthcheck
 	}
+	if overriding.User != nil {
+		new.User = overriding.User.Copy()
+	}
 
 	return new
 }
@@ -247,6 +247,79 @@ func TestDefinitionMerge(t *testing.T) {
 				}
 			},
 		},
+		"merge labels with base": {
+			base: func() webserver.Definition {
+				return webserver.Definition{
+					Labels: builddef.Labels{
+						"com.example.team": "api",
+					},
+				}
+			},
+			overriding: func() webserver.Definition {
+				return webserver.Definition{
+					Labels: builddef.Labels{
+						"com.example.team":                "frontend",
+						"org.opencontainers.image.vendor": "Example",
+					},
+				}
+			},
+			expected: func() webserver.Definition {
+				return webserver.Definition{
+					ConfigFiles:    builddef.PathsMap{},
+					SystemPackages: &builddef.VersionMap{},
+					Labels: builddef.Labels{
+						"com.example.team":                "frontend",
+						"org.opencontainers.image.vendor": "Example",
+					},
+				}
+			},
+		},
+		"merge image config with base": {
+			base: func() webserver.Definition {
+				return webserver.Definition{
+					Image: builddef.ImageConfig{
+						Ports: []string{"80"},
+					},
+				}
+			},
+			overriding: func() webserver.Definition {
+				return webserver.Definition{
+					Image: builddef.ImageConfig{
+						Ports:      []string{"443"},
+						StopSignal: "SIGQUIT",
+					},
+				}
+			},
+			expected: func() webserver.Definition {
+				return webserver.Definition{
+					ConfigFiles:    builddef.PathsMap{},
+					SystemPackages: &builddef.VersionMap{},
+					Image: builddef.ImageConfig{
+						Ports:      []string{"80", "443"},
+						StopSignal: "SIGQUIT",
+					},
+				}
+			},
+		},
+		"merge user with base": {
+			base: func() webserver.Definition {
+				return webserver.Definition{}
+			},
+			overriding: func() webserver.Definition {
+				uid := 101
+				return webserver.Definition{
+					User: &builddef.UserConfig{UID: &uid, Name: "nginx"},
+				}
+			},
+			expected: func() webserver.Definition {
+				uid := 101
+				return webserver.Definition{
+					ConfigFiles:    builddef.PathsMap{},
+					SystemPackages: &builddef.VersionMap{},
+					User:           &builddef.UserConfig{UID: &uid, Name: "nginx"},
+				}
+			},
+		},
 		"merge config files with base": {
 			base: func() webserver.Definition {
 				return webserver.Definition{
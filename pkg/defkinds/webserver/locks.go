@@ -13,6 +13,9 @@ type DefinitionLocks struct {
 	BaseImage      string             `mapstructure:"base_image"`
 	OSRelease      builddef.OSRelease `mapstructure:"osrelease"`
 	SystemPackages map[string]string  `mapstructure:"system_packages"`
+	// DebianSnapshot is the timestamp of the Debian archive snapshot system
+	// packages are installed from (only for Debian-based images).
+	DebianSnapshot string `mapstructure:"debian_snapshot"`
 }
 
 func (l DefinitionLocks) RawLocks() map[string]interface{} {
@@ -20,6 +23,7 @@ func (l DefinitionLocks) RawLocks() map[string]interface{} {
 		"base_image":      l.BaseImage,
 		"osrelease":       l.OSRelease,
 		"system_packages": l.SystemPackages,
+		"debian_snapshot": l.DebianSnapshot,
 	}
 }
 
@@ -48,19 +52,17 @@ func (h *WebserverHandler) UpdateLocks(
 		def.Locks.OSRelease = osrelease
 	}
 
-	var pkgSolverType pkgsolver.SolverType
-	if def.Locks.OSRelease.Name == "debian" {
-		pkgSolverType = pkgsolver.APT
-	} else if def.Locks.OSRelease.Name == "alpine" {
-		pkgSolverType = pkgsolver.APK
-	} else {
-		return nil, xerrors.Errorf("unsupported OS %s: only debian-based and alpine-based base images are supported", def.Locks.OSRelease.Name)
+	pkgSolverType, _, err := pkgsolver.ResolvePackageManager(def.Locks.OSRelease)
+	if err != nil {
+		return nil, err
 	}
 
 	if opts.UpdateSystemPackages {
 		pkgSolver := pkgSolvers.New(pkgSolverType, h.solver)
-		def.Locks.SystemPackages, err = pkgSolver.ResolveVersions(ctx,
-			def.Locks.BaseImage, def.SystemPackages.Map())
+		def.Locks.DebianSnapshot = pkgsolver.LockDebianSnapshot(pkgSolver,
+			def.Locks.OSRelease, opts)
+		def.Locks.SystemPackages, err = pkgsolver.Resolve(ctx, pkgSolver,
+			def.Locks.BaseImage, def.SystemPackages.Map(), opts)
 		if err != nil {
 			return nil, xerrors.Errorf("could not resolve system packages: %w", err)
 		}
@@ -0,0 +1,31 @@
+package webserver
+
+import (
+	"context"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/sbom"
+)
+
+// SBOM returns the packages installed in the webserver image: its base image
+// and its system packages. Assets copied from other stages aren't listed.
+func (h *WebserverHandler) SBOM(
+	ctx context.Context,
+	buildOpts builddef.BuildOpts,
+) (sbom.BOM, error) {
+	def, err := NewKind(buildOpts.Def)
+	if err != nil {
+		return sbom.BOM{}, err
+	}
+
+	bom := sbom.New(buildOpts, buildOpts.BuildContext)
+
+	baseImage, err := sbom.BaseImage(def.Locks.BaseImage)
+	if err != nil {
+		return bom, err
+	}
+	bom.Add(baseImage)
+	bom.Add(sbom.SystemPackages(def.Locks.OSRelease, def.Locks.SystemPackages)...)
+
+	return bom, nil
+}
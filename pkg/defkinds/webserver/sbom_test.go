@@ -0,0 +1,66 @@
+package webserver_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/defkinds/webserver"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"github.com/go-test/deep"
+)
+
+func TestSBOM(t *testing.T) {
+	if *flagTestdata {
+		return
+	}
+
+	genericDef := loadGenericDef(t, "testdata/sbom/zbuild.yml")
+	genericDef.RawLocks = loadDefLocks(t, "testdata/sbom/zbuild.lock")
+	sourceDate := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+	h := webserver.WebserverHandler{}
+	bom, err := h.SBOM(context.TODO(), builddef.BuildOpts{
+		Def:             &genericDef,
+		Stage:           "webserver-prod",
+		SourceDateEpoch: &sourceDate,
+		BuildContext: &builddef.Context{
+			Source: "context",
+			Type:   builddef.ContextTypeLocal,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := sbom.BOM{
+		Name:    "webserver-prod",
+		Created: sourceDate,
+		Packages: []sbom.Package{
+			{
+				Type:      sbom.TypeDocker,
+				Namespace: "library",
+				Name:      "nginx",
+				Version:   "sha256:08a230429c2d27b8a5668163f3c20e73e6bba6aad4796aaea90372fbaebca122",
+				Qualifiers: map[string]string{
+					"repository_url": "docker.io",
+					"tag":            "1.17.7-alpine",
+				},
+				Checksum: "sha256:08a230429c2d27b8a5668163f3c20e73e6bba6aad4796aaea90372fbaebca122",
+			},
+			{
+				Type:      sbom.TypeAPK,
+				Namespace: "alpine",
+				Name:      "curl",
+				Version:   "7.66.0-r0",
+				Qualifiers: map[string]string{
+					"distro": "alpine-3.10.3",
+				},
+			},
+		},
+	}
+	if diff := deep.Equal(bom, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
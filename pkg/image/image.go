@@ -80,3 +80,18 @@ func CloneMeta(src *Image) *Image {
 
 	return img
 }
+
+// SetCreated sets the creation time of the image and adds a history entry,
+// created at the same time, for each of the given number of layers added on
+// top of the base image. Otherwise, buildkit adds these entries itself with
+// the current time when it exports the image.
+func (img *Image) SetCreated(created time.Time, layers int, createdBy string) {
+	img.Created = &created
+	for i := 0; i < layers; i++ {
+		img.History = append(img.History, specs.History{
+			Created:   &created,
+			CreatedBy: createdBy,
+			Comment:   "zbuild",
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package llbtest
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/docker/client"
+	"github.com/golang/mock/gomock"
+)
+
+var flagRecord = flag.Bool("record", false, "Use this flag to (re)record the fixtures of state solvers with Docker")
+
+// LoadFixtures returns a StateSolver replaying the calls recorded in the
+// given fixture file (see statesolver.Recorder). The test fails when some
+// fixtures haven't been used once it ends, such that fixture files don't
+// keep stale calls.
+//
+// With the -record flag, calls are made with Docker instead (the build
+// context being the directory of the fixture file) and the fixture file is
+// replaced by the calls recorded once the test ends.
+func LoadFixtures(t *testing.T, path string) statesolver.StateSolver {
+	if *flagRecord {
+		return recordFixtures(t, path)
+	}
+
+	replayer, err := statesolver.NewReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if unused := replayer.Unused(); len(unused) > 0 {
+			t.Errorf("Unused fixtures in %s: %v", path, unused)
+		}
+	})
+
+	return replayer
+}
+
+func recordFixtures(t *testing.T, path string) statesolver.StateSolver {
+	c, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NegotiateAPIVersion(context.TODO())
+
+	recorder := statesolver.NewRecorder(statesolver.LocalSolver{
+		Client:        c,
+		Labels:        map[string]string{},
+		RootDir:       filepath.Dir(path),
+		ImageResolver: docker.NewResolver(docker.ResolverOptions{}),
+	})
+	t.Cleanup(func() {
+		if err := recorder.Save(path); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return recorder
+}
+
+// ImageRef returns a gomock.Matcher matching the given image ref pinned to
+// any sha256 digest, such that expectations still hold once fixtures are
+// re-recorded.
+func ImageRef(ref string) gomock.Matcher {
+	return imageRefMatcher(ref)
+}
+
+type imageRefMatcher string
+
+func (m imageRefMatcher) Matches(x interface{}) bool {
+	ref, ok := x.(string)
+	return ok && strings.HasPrefix(ref, string(m)+"@sha256")
+}
+
+func (m imageRefMatcher) String() string {
+	return fmt.Sprintf("is %s pinned to a digest", string(m))
+}
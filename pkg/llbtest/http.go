@@ -0,0 +1,75 @@
+package llbtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// NewHTTPClient starts a local HTTP server serving the given files (a map of
+// URLs associated to their content) and returns a client sending all its
+// requests to that server, whatever the host of the requested URL is. URLs
+// not in the map get a 404 response. The server is closed when the test ends.
+func NewHTTPClient(t *testing.T, files map[string]string) *http.Client {
+	return NewHTTPClientWithRedirects(t, files, nil)
+}
+
+// NewHTTPClientWithRedirects works like NewHTTPClient but also redirects
+// requests made to the URLs in redirects keys to their associated URL.
+func NewHTTPClientWithRedirects(
+	t *testing.T,
+	files map[string]string,
+	redirects map[string]string,
+) *http.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originalURL := r.Header.Get(originalURLHeader)
+		if location, ok := redirects[originalURL]; ok {
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+
+		content, ok := files[originalURL]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content)) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{
+		Transport: rewriteTransport{
+			target: srvURL,
+			next:   srv.Client().Transport,
+		},
+	}
+}
+
+const originalURLHeader = "X-Original-URL"
+
+// rewriteTransport is a http.RoundTripper redirecting all the requests to the
+// target URL while preserving the original URL in a dedicated header.
+type rewriteTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rewritten := req.Clone(req.Context())
+	rewritten.Header.Set(originalURLHeader, req.URL.String())
+	rewritten.URL.Scheme = t.target.Scheme
+	rewritten.URL.Host = t.target.Host
+	rewritten.Host = t.target.Host
+
+	resp, err := t.next.RoundTrip(rewritten)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
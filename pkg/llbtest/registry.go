@@ -0,0 +1,66 @@
+package llbtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewImageRegistry starts a local registry serving a single image with the
+// given config, such that its metadata can be loaded without network access.
+// It returns the reference of the image in the given repository (e.g.
+// library/nginx), pinned to its digest. The registry is closed when the test
+// ends.
+func NewImageRegistry(t *testing.T, repo string, img specs.Image) string {
+	config, err := json.Marshal(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := specs.Manifest{
+		Config: specs.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2Config,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+	}
+	manifest.SchemaVersion = 2
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(rawManifest)
+
+	blobs := map[string][]byte{
+		"/v2/" + repo + "/manifests/" + manifestDigest.String():     rawManifest,
+		"/v2/" + repo + "/blobs/" + manifest.Config.Digest.String(): config,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		blob, ok := blobs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", images.MediaTypeDockerSchema2Manifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(blob).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		if r.Method == http.MethodGet {
+			w.Write(blob) //nolint:errcheck
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	return host + "/" + repo + ":latest@" + manifestDigest.String()
+}
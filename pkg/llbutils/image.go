@@ -0,0 +1,108 @@
+package llbutils
+
+import (
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/image"
+	"github.com/gogo/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/xerrors"
+)
+
+// SetImageCreated sets the creation time of the given image built from the
+// given state. When a creation time is attached to the state (see
+// WithCreatedTime), it's used for the image and for the history entries of
+// its layers. The current time is used otherwise.
+func SetImageCreated(state llb.State, img *image.Image) error {
+	created, ok := CreatedTime(state)
+	if !ok {
+		now := time.Now()
+		img.Created = &now
+		return nil
+	}
+
+	layers, err := CountLayers(state)
+	if err != nil {
+		return xerrors.Errorf("failed to count image layers: %w", err)
+	}
+
+	img.SetCreated(created, layers, "zbuild")
+	return nil
+}
+
+// CountLayers returns the number of layers buildkit adds on top of the base
+// image (or the first source) of the given state when exporting it. It
+// follows the chain of ops the final snapshot is made of: each exec and file
+// op of this chain produces a layer.
+func CountLayers(state llb.State) (int, error) {
+	def, err := state.Marshal(llb.LinuxAmd64)
+	if err != nil {
+		return 0, err
+	}
+
+	ops := make(map[digest.Digest]*pb.Op, len(def.Def))
+	var last *pb.Op
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := proto.Unmarshal(dt, &op); err != nil {
+			return 0, err
+		}
+		ops[digest.FromBytes(dt)] = &op
+		last = &op
+	}
+
+	// The last op has no output, it only points to the output of the state.
+	if last == nil || len(last.Inputs) == 0 {
+		return 0, nil
+	}
+
+	var layers int
+	input := last.Inputs[0]
+	for {
+		op, ok := ops[input.Digest]
+		if !ok {
+			return 0, xerrors.Errorf("op %s not found", input.Digest)
+		}
+
+		parent, ok := parentInput(op, input.Index)
+		if !ok {
+			return layers, nil
+		}
+		layers++
+		input = op.Inputs[parent]
+	}
+}
+
+// parentInput returns the index of the input the given output of the given
+// op is built on top of. It returns false when the output isn't built on top
+// of any input (e.g. source ops or scratch states).
+func parentInput(op *pb.Op, output pb.OutputIndex) (int, bool) {
+	switch o := op.Op.(type) {
+	case *pb.Op_Exec:
+		for _, m := range o.Exec.Mounts {
+			if m.Output == output && m.Input != pb.Empty {
+				return int(m.Input), true
+			}
+		}
+	case *pb.Op_File:
+		// Actions can be chained: inputs greater than the number of op inputs
+		// refer to the output of previous actions.
+		actions := o.File.Actions
+		var action *pb.FileAction
+		for _, a := range actions {
+			if a.Output == output {
+				action = a
+			}
+		}
+		for action != nil && action.Input != pb.Empty {
+			if int(action.Input) < len(op.Inputs) {
+				return int(action.Input), true
+			}
+			action = actions[int(action.Input)-len(op.Inputs)]
+		}
+	}
+
+	return 0, false
+}
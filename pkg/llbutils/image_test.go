@@ -0,0 +1,116 @@
+package llbutils_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/image"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/gogo/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+func TestCountLayers(t *testing.T) {
+	base := llbutils.ImageSource("docker.io/library/debian:buster-slim", false)
+	src := llb.Local("context")
+
+	testcases := map[string]struct {
+		state    llb.State
+		expected int
+	}{
+		"no layers on top of the base image": {
+			state:    base,
+			expected: 0,
+		},
+		"count exec and file ops": {
+			state: llbutils.Copy(src, "/src", base.Run(
+				llbutils.Shell("apt-get update")).Root(), "/app", "", false),
+			expected: 2,
+		},
+		"ignore ops the copied files come from": {
+			state: llbutils.Copy(
+				llbutils.Mkdir(llb.Scratch(), "1000:1000", "/a", "/b"),
+				"/a", base, "/a", "", false),
+			expected: 1,
+		},
+		"count each file op of a chain": {
+			state:    llbutils.Mkdir(base, "1000:1000", "/a", "/b", "/c"),
+			expected: 3,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			layers, err := llbutils.CountLayers(tc.state)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if layers != tc.expected {
+				t.Fatalf("Expected: %d\nGot: %d", tc.expected, layers)
+			}
+		})
+	}
+}
+
+func TestWithCreatedTime(t *testing.T) {
+	created := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	base := llbutils.ImageSource("docker.io/library/debian:buster-slim", false)
+	base = llbutils.WithCreatedTime(base, created)
+
+	state := llbutils.Mkdir(base, "1000:1000", "/app")
+	state = state.Run(llbutils.Shell("apt-get update")).Root()
+	state = llbutils.Copy(llb.Local("context"), "/src", state, "/app", "", false)
+
+	def, err := state.Marshal(llb.LinuxAmd64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var timestamps []int64
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := proto.Unmarshal(dt, &op); err != nil {
+			t.Fatal(err)
+		}
+		fileOp, ok := op.Op.(*pb.Op_File)
+		if !ok {
+			continue
+		}
+		for _, action := range fileOp.File.Actions {
+			switch a := action.Action.(type) {
+			case *pb.FileAction_Mkdir:
+				timestamps = append(timestamps, a.Mkdir.Timestamp)
+			case *pb.FileAction_Copy:
+				timestamps = append(timestamps, a.Copy.Timestamp)
+			}
+		}
+	}
+
+	if len(timestamps) != 2 {
+		t.Fatalf("Expected 2 file actions, got %d.", len(timestamps))
+	}
+	for _, ts := range timestamps {
+		if ts != created.UnixNano() {
+			t.Errorf("Expected timestamp %d, got %d.", created.UnixNano(), ts)
+		}
+	}
+
+	img := &image.Image{}
+	if err := llbutils.SetImageCreated(state, img); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if img.Created == nil || !img.Created.Equal(created) {
+		t.Fatalf("Expected image to be created at %v, got %v.", created, img.Created)
+	}
+	if len(img.History) != 3 {
+		t.Fatalf("Expected 3 history entries, got %d.", len(img.History))
+	}
+	for _, h := range img.History {
+		if !h.Created.Equal(created) {
+			t.Errorf("Expected history entry to be created at %v, got %v.", created, h.Created)
+		}
+	}
+}
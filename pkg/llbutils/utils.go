@@ -2,16 +2,22 @@ package llbutils
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/client/llb/imagemetaresolver"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/apicaps"
 	digest "github.com/opencontainers/go-digest"
 	"golang.org/x/xerrors"
 )
@@ -20,6 +26,7 @@ const (
 	// APT is the const used to install apt packages with InstallSystemPackages.
 	APT = "apt"
 	APK = "apk"
+	DNF = "dnf"
 )
 
 var (
@@ -81,6 +88,24 @@ func ImageSource(imageRef string, withMeta bool) llb.State {
 	return llb.Image(imageRef, opts...)
 }
 
+type createdTimeKey struct{}
+
+// WithCreatedTime returns a copy of the given state with a creation time
+// attached. The files copied and the dirs created on top of this state with
+// this package have this time instead of the current time, in order to make
+// builds reproducible. It's also used as the creation time of images (see
+// SetImageCreated).
+func WithCreatedTime(state llb.State, t time.Time) llb.State {
+	return state.WithValue(createdTimeKey{}, t)
+}
+
+// CreatedTime returns the creation time attached to the given state with
+// WithCreatedTime, if any.
+func CreatedTime(state llb.State) (time.Time, bool) {
+	t, ok := state.Value(createdTimeKey{}).(time.Time)
+	return t, ok
+}
+
 func Copy(src llb.State, srcPath string, dest llb.State, destPath string, owner string, ignoreCache bool) llb.State {
 	copyOpts := []llb.CopyOption{
 		&llb.CopyInfo{
@@ -93,6 +118,9 @@ func Copy(src llb.State, srcPath string, dest llb.State, destPath string, owner
 	if owner != "" {
 		copyOpts = append(copyOpts, llb.WithUser(owner))
 	}
+	if t, ok := CreatedTime(dest); ok {
+		copyOpts = append(copyOpts, llb.WithCreatedTime(t))
+	}
 
 	fileOpts := []llb.ConstraintsOpt{
 		llb.WithCustomName(fmt.Sprintf("Copy %s", srcPath))}
@@ -129,10 +157,16 @@ func Shell(cmds ...string) llb.RunOption {
 }
 
 func Mkdir(state llb.State, owner string, dirs ...string) llb.State {
+	mkdirOpts := []llb.MkdirOption{
+		llb.WithParents(true),
+		llb.WithUser(owner),
+	}
+	if t, ok := CreatedTime(state); ok {
+		mkdirOpts = append(mkdirOpts, llb.WithCreatedTime(t))
+	}
+
 	for _, dir := range dirs {
-		action := llb.Mkdir(dir, 0750,
-			llb.WithParents(true),
-			llb.WithUser(owner))
+		action := llb.Mkdir(dir, 0750, mkdirOpts...)
 		state = state.File(action,
 			llb.WithCustomName("Mkdir "+dir))
 	}
@@ -146,6 +180,10 @@ type SystemPackagesCaching struct {
 	IgnoreLayerCache bool
 	WithCacheMounts  bool
 	CacheIDNamespace string
+	// DebianSnapshot is the Debian archive snapshot packages are installed
+	// from when using APT. Packages are installed from the sources configured
+	// in the image when it's nil.
+	DebianSnapshot *DebianSnapshot
 }
 
 func NewCachingStrategyFromBuildOpts(
@@ -158,6 +196,102 @@ func NewCachingStrategyFromBuildOpts(
 	}
 }
 
+const (
+	// DefaultDebianSnapshotURL is the base URL of the official Debian
+	// snapshot archive.
+	DefaultDebianSnapshotURL = "https://snapshot.debian.org"
+	// DebianSnapshotTimestampFormat is the layout of the timestamps used by
+	// snapshot.debian.org.
+	DebianSnapshotTimestampFormat = "20060102T150405Z"
+
+	debianSnapshotSourcesList = "/etc/apt/zbuild-snapshot.list"
+)
+
+// DebianSnapshot represents the state of Debian archives at a given point in
+// time, as served by snapshot.debian.org (or any mirror with the same layout).
+type DebianSnapshot struct {
+	// BaseURL is the URL of the snapshot archive. DefaultDebianSnapshotURL is
+	// used when it's empty.
+	BaseURL string
+	// Timestamp is formatted with DebianSnapshotTimestampFormat.
+	Timestamp string
+	// Suite is the codename of the Debian release (e.g. buster).
+	Suite string
+}
+
+// NewDebianSnapshot returns a DebianSnapshot for the given time.
+func NewDebianSnapshot(baseURL string, t time.Time, suite string) DebianSnapshot {
+	return DebianSnapshot{
+		BaseURL:   baseURL,
+		Timestamp: t.UTC().Format(DebianSnapshotTimestampFormat),
+		Suite:     suite,
+	}
+}
+
+// LockedDebianSnapshot returns the DebianSnapshot matching the given locked
+// timestamp, or nil if no snapshot was locked.
+func LockedDebianSnapshot(
+	buildOpts builddef.BuildOpts,
+	osrelease builddef.OSRelease,
+	timestamp string,
+) *DebianSnapshot {
+	if timestamp == "" {
+		return nil
+	}
+
+	return &DebianSnapshot{
+		BaseURL:   buildOpts.DebianSnapshotURL,
+		Timestamp: timestamp,
+		Suite:     osrelease.VersionName,
+	}
+}
+
+// SourcesList returns the APT sources pointing to this snapshot.
+func (s DebianSnapshot) SourcesList() []string {
+	baseURL := strings.TrimRight(s.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultDebianSnapshotURL
+	}
+
+	// Debian 11 (bullseye) renamed the security suite.
+	securitySuite := s.Suite + "-security"
+	switch s.Suite {
+	case "jessie", "stretch", "buster":
+		securitySuite = s.Suite + "/updates"
+	}
+
+	archive := fmt.Sprintf("%s/archive/debian/%s/", baseURL, s.Timestamp)
+	security := fmt.Sprintf("%s/archive/debian-security/%s/", baseURL, s.Timestamp)
+
+	return []string{
+		fmt.Sprintf("deb [check-valid-until=no] %s %s main", archive, s.Suite),
+		fmt.Sprintf("deb [check-valid-until=no] %s %s-updates main", archive, s.Suite),
+		fmt.Sprintf("deb [check-valid-until=no] %s %s main", security, securitySuite),
+	}
+}
+
+// WriteSourcesListCmd returns a shell command writing the sources list of
+// this snapshot to a dedicated file. This file is used instead of the
+// sources configured in the image when APTOptions are passed to apt-get.
+func (s DebianSnapshot) WriteSourcesListCmd() string {
+	cmds := []string{}
+	redirect := ">"
+	for _, source := range s.SourcesList() {
+		cmds = append(cmds, fmt.Sprintf("echo '%s' %s %s",
+			source, redirect, debianSnapshotSourcesList))
+		redirect = ">>"
+	}
+
+	return strings.Join(cmds, " && ")
+}
+
+// APTOptions returns the apt-get options needed to use the sources list
+// written by WriteSourcesListCmd.
+func (s DebianSnapshot) APTOptions() string {
+	return "-o Dir::Etc::SourceList=" + debianSnapshotSourcesList +
+		" -o Dir::Etc::SourceParts=/dev/null"
+}
+
 // InstallSystemPackages installs the given packages with the given package
 // manager. Packages map have to be a set of package names associated to their
 // respective version.
@@ -179,9 +313,15 @@ func InstallSystemPackages(
 	}
 	sort.Strings(pkgNames)
 
+	// dnf expects package specs formatted as name-[epoch:]version-release.
+	separator := "="
+	if pkgMgr == DNF {
+		separator = "-"
+	}
+
 	packageSpecs := make([]string, 0, len(pkgNames))
 	for _, pkgName := range pkgNames {
-		packageSpecs = append(packageSpecs, pkgName+"="+locks[pkgName])
+		packageSpecs = append(packageSpecs, pkgName+separator+locks[pkgName])
 	}
 
 	switch pkgMgr {
@@ -189,6 +329,8 @@ func InstallSystemPackages(
 		return InstallPackagesWithAPT(state, packageSpecs, opts)
 	case APK:
 		return InstallPackagesWithAPK(state, packageSpecs, opts)
+	case DNF:
+		return InstallPackagesWithDNF(state, packageSpecs, opts)
 	default:
 		return llb.State{}, UnsupportedPackageManager
 	}
@@ -205,6 +347,16 @@ func InstallPackagesWithAPT(
 		"apt-get install -y --no-install-recommends " + strings.Join(packageSpecs, " "),
 	}
 
+	if opts.DebianSnapshot != nil {
+		aptOpts := opts.DebianSnapshot.APTOptions()
+		cmds = []string{
+			opts.DebianSnapshot.WriteSourcesListCmd(),
+			"apt-get " + aptOpts + " update",
+			"apt-get " + aptOpts + " install -y --no-install-recommends " + strings.Join(packageSpecs, " "),
+			"rm " + debianSnapshotSourcesList,
+		}
+	}
+
 	if opts.WithCacheMounts {
 		cmds = append(cmds, "apt-get autoclean")
 		runOpts = append(runOpts,
@@ -255,6 +407,85 @@ func InstallPackagesWithAPK(
 	return state.Run(runOpts...).Root(), nil
 }
 
+func InstallPackagesWithDNF(
+	state llb.State,
+	packageSpecs []string,
+	opts SystemPackagesCaching,
+) (llb.State, error) {
+	runOpts := []llb.RunOption{}
+	installCmd := "dnf install -y --setopt=install_weak_deps=False "
+	cmds := []string{}
+
+	if opts.WithCacheMounts {
+		cmds = append(cmds,
+			installCmd+"--setopt=keepcache=True "+strings.Join(packageSpecs, " "))
+		runOpts = append(runOpts,
+			CacheMountOpt("/var/cache/dnf", opts.CacheIDNamespace, "0"))
+	} else {
+		cmds = append(cmds,
+			installCmd+strings.Join(packageSpecs, " "),
+			"dnf clean all",
+			"rm -rf /var/cache/dnf")
+	}
+
+	stepName := fmt.Sprintf("Install system packages (%s)", strings.Join(packageSpecs, ", "))
+	runOpts = append(runOpts,
+		Shell(cmds...),
+		llb.WithCustomName(stepName))
+
+	if opts.IgnoreLayerCache {
+		runOpts = append(runOpts, llb.IgnoreCache)
+	}
+
+	return state.Run(runOpts...).Root(), nil
+}
+
+// CreateUser adds a Run operation creating the given user and its group with
+// the tools available on the distros using the given package manager
+// (adduser/addgroup for apk, useradd/groupadd otherwise). Users and groups
+// that already exist with the same IDs are left untouched. It does nothing
+// when the user has no name.
+func CreateUser(
+	state llb.State,
+	pkgMgr string,
+	user *builddef.UserConfig,
+	ignoreCache bool,
+) (llb.State, error) {
+	if user == nil || user.Name == "" {
+		return state, nil
+	}
+
+	uid := user.UserID()
+	gid := user.GroupID()
+	groupName := fmt.Sprintf("$(getent group %s | cut -d: -f1)", gid)
+
+	var cmds []string
+	switch pkgMgr {
+	case APK:
+		cmds = []string{
+			fmt.Sprintf("getent group %s >/dev/null || addgroup -S -g %s %s", gid, gid, user.Name),
+			fmt.Sprintf("getent passwd %s >/dev/null || adduser -S -D -u %s -G %s %s", uid, uid, groupName, user.Name),
+		}
+	case APT, DNF:
+		cmds = []string{
+			fmt.Sprintf("getent group %s >/dev/null || groupadd -g %s %s", gid, gid, user.Name),
+			fmt.Sprintf("getent passwd %s >/dev/null || useradd -m -u %s -g %s %s", uid, uid, gid, user.Name),
+		}
+	default:
+		return llb.State{}, UnsupportedPackageManager
+	}
+
+	runOpts := []llb.RunOption{
+		Shell(cmds...),
+		llb.WithCustomNamef("Create user %s (%s)", user.Name, user.Owner()),
+	}
+	if ignoreCache {
+		runOpts = append(runOpts, llb.IgnoreCache)
+	}
+
+	return state.Run(runOpts...).Root(), nil
+}
+
 // CacheMountOpt is used to consistently mount cache folders used when executing
 // commands (eg. to cache downloads of apt, apk or language-specific package
 // managers).
@@ -270,7 +501,7 @@ func SetupSystemPackagesCache(state llb.State, pkgMgr string) llb.State {
 	switch pkgMgr {
 	case APT:
 		return SetupAPTCache(state)
-	case APK:
+	case APK, DNF:
 		return state
 	}
 
@@ -302,6 +533,120 @@ type ExternalFile struct {
 	Owner       string
 }
 
+// LockExternalFiles downloads each of the given ExternalFiles through the
+// given HTTP client (or http.DefaultClient if nil) and computes their sha256
+// digest. It returns a map of URLs associated to their digest, which can be
+// stored in stage locks. Files with a user-provided checksum aren't downloaded
+// and their checksum is used as is.
+func LockExternalFiles(
+	ctx context.Context,
+	c *http.Client,
+	externalFiles []ExternalFile,
+) (map[string]string, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	locks := map[string]string{}
+	for _, externalFile := range externalFiles {
+		if _, ok := locks[externalFile.URL]; ok {
+			continue
+		}
+		if externalFile.Checksum != "" {
+			locks[externalFile.URL] = externalFile.Checksum
+			continue
+		}
+
+		_, checksum, err := fetchChecksum(ctx, c, externalFile.URL)
+		if err != nil {
+			return locks, xerrors.Errorf("could not compute checksum of %s: %w",
+				externalFile.URL, err)
+		}
+		locks[externalFile.URL] = checksum
+	}
+
+	return locks, nil
+}
+
+// LockURL downloads the file at the given URL and returns the URL it has
+// been fetched from once redirects have been followed, along with the
+// checksum of its content. This is used to turn moving URLs (e.g. "latest"
+// release URLs) into immutable ones. A nil http.Client is replaced by
+// http.DefaultClient.
+func LockURL(ctx context.Context, c *http.Client, url string) (string, string, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	lockedURL, checksum, err := fetchChecksum(ctx, c, url)
+	if err != nil {
+		return "", "", xerrors.Errorf("could not compute checksum of %s: %w", url, err)
+	}
+
+	return lockedURL, checksum, nil
+}
+
+func fetchChecksum(ctx context.Context, c *http.Client, url string) (string, string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", xerrors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", "", err
+	}
+
+	return resp.Request.URL.String(), digest.NewDigest(digest.SHA256, h).String(), nil
+}
+
+// WithLockedChecksums returns a copy of the given ExternalFiles where files
+// with no explicit checksum get the one found in locks (a map of URLs
+// associated to their locked checksum).
+func WithLockedChecksums(
+	externalFiles []ExternalFile,
+	locks map[string]string,
+) []ExternalFile {
+	locked := make([]ExternalFile, len(externalFiles))
+	for i, externalFile := range externalFiles {
+		if externalFile.Checksum == "" {
+			externalFile.Checksum = locks[externalFile.URL]
+		}
+		locked[i] = externalFile
+	}
+
+	return locked
+}
+
+// CheckExternalFilesChecksums returns an error listing the URLs of the given
+// ExternalFiles that have no checksum. This is used by specialized builders
+// in strict mode to ensure unverified files are never added to an image.
+func CheckExternalFilesChecksums(externalFiles []ExternalFile) error {
+	missing := []string{}
+	for _, externalFile := range externalFiles {
+		if externalFile.Checksum == "" {
+			missing = append(missing, externalFile.URL)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return xerrors.Errorf("external files %s have no locked checksum, please run `zbuild update`",
+		strings.Join(missing, ", "))
+}
+
 // CopyExternalFiles downloads the given list of ExternalFiles, each in their
 // own DAG tree root (thus they're going to be executed in parallel),
 // decompress and unpack them if required and finally copy them to the given
@@ -361,6 +706,9 @@ func CopyExternalFiles(state llb.State, externalFiles []ExternalFile) llb.State
 		if externalFile.Owner != "" {
 			copyOpts = append(copyOpts, llb.WithUser(externalFile.Owner))
 		}
+		if t, ok := CreatedTime(state); ok {
+			copyOpts = append(copyOpts, llb.WithCreatedTime(t))
+		}
 
 		state = state.File(
 			llb.Copy(src, srcPath, externalFile.Destination, copyOpts...),
@@ -376,10 +724,92 @@ func FromContext(
 ) llb.State {
 	switch context.Type {
 	case builddef.ContextTypeGit:
-		return llb.Git(context.Source, context.GitContext.Reference)
+		return gitSource(context)
 	case builddef.ContextTypeLocal:
 		return llb.Local(context.Source, opts...)
+	case builddef.ContextTypeHTTP:
+		return fromHTTPContext(context)
+	case builddef.ContextTypeImage:
+		return llb.Image(context.Source)
 	}
 
 	panic(fmt.Sprintf("Unsupported context type %q", string(context.Type)))
 }
+
+// attrGitAuthTokenSecret is the source attribute used by recent versions of
+// BuildKit to find the secret containing the token used to fetch git repos
+// over HTTPS, and capSourceGitHTTPAuth (pb.CapSourceGitHTTPAuth upstream) is
+// the capability of the daemons supporting it. They're not exposed by the
+// version of BuildKit zbuild depends on. Older daemons would silently ignore
+// the attribute, so the capability is required such that they fail instead.
+const (
+	attrGitAuthTokenSecret               = "git.authtokensecret"
+	capSourceGitHTTPAuth   apicaps.CapID = "source.git.httpauth"
+)
+
+// gitSource returns a git source for the given context. It's built like
+// llb.Git() does, with support for auth secrets in addition. Note that
+// BuildKit always fetches the submodules of git sources, that's why contexts
+// can't disable them (see builddef.Context.IsValid).
+func gitSource(context *builddef.Context) llb.State {
+	remote := context.Source
+	url := ""
+	for _, prefix := range []string{
+		"http://", "https://", "git://", "git@",
+	} {
+		if strings.HasPrefix(remote, prefix) {
+			url = strings.Split(remote, "#")[0]
+			remote = strings.TrimPrefix(remote, prefix)
+		}
+	}
+
+	id := remote
+	if context.Reference != "" {
+		id += "#" + context.Reference
+	}
+
+	var constraints llb.Constraints
+	addCap := func(id apicaps.CapID) {
+		if constraints.Metadata.Caps == nil {
+			constraints.Metadata.Caps = make(map[apicaps.CapID]bool)
+		}
+		constraints.Metadata.Caps[id] = true
+	}
+
+	attrs := map[string]string{}
+	if context.KeepGitDir {
+		attrs[pb.AttrKeepGitDir] = "true"
+		addCap(pb.CapSourceGitKeepDir)
+	}
+	if url != "" {
+		attrs[pb.AttrFullRemoteURL] = url
+		addCap(pb.CapSourceGitFullURL)
+	}
+	if context.AuthSecret != "" {
+		attrs[attrGitAuthTokenSecret] = context.AuthSecret
+		addCap(capSourceGitHTTPAuth)
+	}
+	addCap(pb.CapSourceGit)
+
+	source := llb.NewSource("git://"+id, attrs, constraints)
+	return llb.NewState(source.Output())
+}
+
+// fromHTTPContext downloads the tarball of the given context and unpacks it at
+// the root of a new state.
+func fromHTTPContext(context *builddef.Context) llb.State {
+	httpOpts := []llb.HTTPOption{
+		llb.Filename("/context"),
+		llb.WithCustomName("Download " + context.Source),
+	}
+	if context.Checksum != "" {
+		httpOpts = append(httpOpts, llb.Checksum(digest.Digest(context.Checksum)))
+	}
+
+	unpackOpts := []llb.CopyOption{&llb.CopyInfo{
+		AttemptUnpack: true,
+	}}
+	return llb.Scratch().File(
+		llb.Copy(llb.HTTP(context.Source, httpOpts...), "/context", "/", unpackOpts...),
+		llb.WithCustomName("Unpack "+context.Source))
+}
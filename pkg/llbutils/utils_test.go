@@ -227,6 +227,32 @@ func TestStateHelpers(t *testing.T) {
 					src, "/etc/passwd", dest, "/etc/passwd2", "1000:1000", true)
 			},
 		},
+		"CreateUser with APT": {
+			testdata: "testdata/create-user-with-apt.json",
+			init: func(t *testing.T) llb.State {
+				state := llbutils.ImageSource("php:7.2", false)
+				uid, gid := 1500, 0
+				user := &builddef.UserConfig{UID: &uid, GID: &gid, Name: "app"}
+				state, err := llbutils.CreateUser(state, llbutils.APT, user, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return state
+			},
+		},
+		"CreateUser with APK": {
+			testdata: "testdata/create-user-with-apk.json",
+			init: func(t *testing.T) llb.State {
+				state := llbutils.ImageSource("php:7.2-alpine", false)
+				uid := 1500
+				user := &builddef.UserConfig{UID: &uid, Name: "app"}
+				state, err := llbutils.CreateUser(state, llbutils.APK, user, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return state
+			},
+		},
 		"InstallSystemPackages with APT and no cache mounts": {
 			testdata: "testdata/install-apt-packages-with-no-cache-mounts.json",
 			init: func(t *testing.T) llb.State {
@@ -266,6 +292,29 @@ func TestStateHelpers(t *testing.T) {
 				return state
 			},
 		},
+		"InstallSystemPackages with APT from a Debian snapshot": {
+			testdata: "testdata/install-apt-packages-from-debian-snapshot.json",
+			init: func(t *testing.T) llb.State {
+				dest := llbutils.ImageSource("php:7.2", false)
+				locks := map[string]string{
+					"curl":            "curl-version",
+					"ca-certficiates": "ca-certificates-version",
+					"zlib1g-dev":      "zlib1g-dev-version",
+				}
+				caching := llbutils.SystemPackagesCaching{
+					DebianSnapshot: &llbutils.DebianSnapshot{
+						BaseURL:   "http://snapshot.local/",
+						Timestamp: "20200509T083854Z",
+						Suite:     "buster",
+					},
+				}
+				state, err := llbutils.InstallSystemPackages(dest, llbutils.APT, locks, caching)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return state
+			},
+		},
 		"InstallSystemPackages with APK and no cache mounts": {
 			testdata: "testdata/install-apk-packages-with-no-cache-mounts.json",
 			init: func(t *testing.T) llb.State {
@@ -304,6 +353,43 @@ func TestStateHelpers(t *testing.T) {
 				return state
 			},
 		},
+		"InstallSystemPackages with DNF and no cache mounts": {
+			testdata: "testdata/install-dnf-packages-with-no-cache-mounts.json",
+			init: func(t *testing.T) llb.State {
+				dest := llbutils.ImageSource("registry.access.redhat.com/ubi8/ubi:8.2", false)
+				locks := map[string]string{
+					"curl":            "7.61.1-12.el8",
+					"ca-certificates": "2019.2.32-80.0.el8_1",
+					"zlib-devel":      "1.2.11-16.el8_2",
+				}
+				caching := llbutils.SystemPackagesCaching{}
+				state, err := llbutils.InstallSystemPackages(dest, llbutils.DNF, locks, caching)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return state
+			},
+		},
+		"InstallSystemPackages with DNF and cache mounts": {
+			testdata: "testdata/install-dnf-packages-with-cache-mounts.json",
+			init: func(t *testing.T) llb.State {
+				dest := llbutils.ImageSource("registry.access.redhat.com/ubi8/ubi:8.2", false)
+				locks := map[string]string{
+					"curl":            "7.61.1-12.el8",
+					"ca-certificates": "2019.2.32-80.0.el8_1",
+					"zlib-devel":      "1.2.11-16.el8_2",
+				}
+				caching := llbutils.SystemPackagesCaching{
+					WithCacheMounts:  true,
+					CacheIDNamespace: "cache-ns",
+				}
+				state, err := llbutils.InstallSystemPackages(dest, llbutils.DNF, locks, caching)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return state
+			},
+		},
 		"CopyExternalFiles": {
 			testdata: "testdata/copy-external-files.json",
 			init: func(_ *testing.T) llb.State {
@@ -352,6 +438,54 @@ func TestStateHelpers(t *testing.T) {
 					llb.WithCustomName("load some file"))
 			},
 		},
+		"FromContext_from_git_context_with_options": {
+			testdata: "testdata/git-context-with-options.json",
+			init: func(_ *testing.T) llb.State {
+				submodules := true
+				context := &builddef.Context{
+					Source: "https://github.com/NiR-/zbuild.git",
+					Type:   builddef.ContextTypeGit,
+					GitContext: builddef.GitContext{
+						Reference:  "89c0c9507d725b35522426c294249ee3b4566dcd",
+						Submodules: &submodules,
+						KeepGitDir: true,
+						AuthSecret: "GIT_AUTH_TOKEN",
+					},
+				}
+
+				return llbutils.FromContext(context,
+					llb.SessionID("<SESSION-ID>"))
+			},
+		},
+		"FromContext_from_http_context": {
+			testdata: "testdata/http-context.json",
+			init: func(_ *testing.T) llb.State {
+				context := &builddef.Context{
+					Source: "https://github.com/NiR-/zbuild/archive/v0.1.tar.gz",
+					Type:   builddef.ContextTypeHTTP,
+					HTTPContext: builddef.HTTPContext{
+						Checksum: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+					},
+				}
+
+				return llbutils.FromContext(context,
+					llb.IncludePatterns([]string{"some", "file"}),
+					llb.SessionID("<SESSION-ID>"))
+			},
+		},
+		"FromContext_from_image_context": {
+			testdata: "testdata/image-context.json",
+			init: func(_ *testing.T) llb.State {
+				context := &builddef.Context{
+					Source: "docker.io/library/alpine:3.11@sha256:ab00606a42621fb68f2ed6ad3c88be54397f981a7b70a79db3d1172b11c4367d",
+					Type:   builddef.ContextTypeImage,
+				}
+
+				return llbutils.FromContext(context,
+					llb.IncludePatterns([]string{"some", "file"}),
+					llb.SessionID("<SESSION-ID>"))
+			},
+		},
 		"BuildContext_from_local_context": {
 			testdata: "testdata/local-context.json",
 			init: func(_ *testing.T) llb.State {
@@ -418,3 +552,146 @@ func loadTestdata(t *testing.T, filepath string) string {
 	}
 	return string(out)
 }
+
+func TestLockExternalFiles(t *testing.T) {
+	if *flagTestdata {
+		return
+	}
+
+	testcases := map[string]struct {
+		files       []llbutils.ExternalFile
+		expected    map[string]string
+		expectedErr error
+	}{
+		"successfully computes checksums of external files": {
+			files: []llbutils.ExternalFile{
+				{URL: "https://example.org/foo.tar.gz", Destination: "/foo.tar.gz"},
+				{URL: "https://example.org/bar", Destination: "/bar", Checksum: "sha256:explicit"},
+			},
+			expected: map[string]string{
+				"https://example.org/foo.tar.gz": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+				"https://example.org/bar":        "sha256:explicit",
+			},
+		},
+		"fails when an external file can't be downloaded": {
+			files: []llbutils.ExternalFile{
+				{URL: "https://example.org/missing", Destination: "/missing"},
+			},
+			expectedErr: errors.New("could not compute checksum of https://example.org/missing: unexpected status code 404"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			c := llbtest.NewHTTPClient(t, map[string]string{
+				"https://example.org/foo.tar.gz": "foo",
+			})
+
+			ctx := context.TODO()
+			locks, err := llbutils.LockExternalFiles(ctx, c, tc.files)
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := deep.Equal(locks, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestCheckExternalFilesChecksums(t *testing.T) {
+	files := []llbutils.ExternalFile{
+		{URL: "https://example.org/foo", Destination: "/foo"},
+		{URL: "https://example.org/bar", Destination: "/bar"},
+	}
+	locks := map[string]string{
+		"https://example.org/foo": "sha256:foo",
+	}
+
+	err := llbutils.CheckExternalFilesChecksums(llbutils.WithLockedChecksums(files, locks))
+	expectedErr := "external files https://example.org/bar have no locked checksum, please run `zbuild update`"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected: %s\nGot: %v", expectedErr, err)
+	}
+
+	locks["https://example.org/bar"] = "sha256:bar"
+	if err := llbutils.CheckExternalFilesChecksums(llbutils.WithLockedChecksums(files, locks)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockURL(t *testing.T) {
+	c := llbtest.NewHTTPClientWithRedirects(t, map[string]string{
+		"https://example.org/releases/v1.0.0/foo": "foo",
+	}, map[string]string{
+		"https://example.org/releases/latest/foo": "https://example.org/releases/v1.0.0/foo",
+	})
+
+	ctx := context.TODO()
+	url, checksum, err := llbutils.LockURL(ctx, c, "https://example.org/releases/latest/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url != "https://example.org/releases/v1.0.0/foo" {
+		t.Fatalf("Expected URL: https://example.org/releases/v1.0.0/foo\nGot: %s", url)
+	}
+	expectedChecksum := "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if checksum != expectedChecksum {
+		t.Fatalf("Expected checksum: %s\nGot: %s", expectedChecksum, checksum)
+	}
+}
+
+func TestDebianSnapshotSourcesList(t *testing.T) {
+	testcases := map[string]struct {
+		snapshot llbutils.DebianSnapshot
+		expected []string
+	}{
+		"with default base URL": {
+			snapshot: llbutils.DebianSnapshot{
+				Timestamp: "20200509T083854Z",
+				Suite:     "buster",
+			},
+			expected: []string{
+				"deb [check-valid-until=no] https://snapshot.debian.org/archive/debian/20200509T083854Z/ buster main",
+				"deb [check-valid-until=no] https://snapshot.debian.org/archive/debian/20200509T083854Z/ buster-updates main",
+				"deb [check-valid-until=no] https://snapshot.debian.org/archive/debian-security/20200509T083854Z/ buster/updates main",
+			},
+		},
+		"with custom base URL and newer security suite": {
+			snapshot: llbutils.DebianSnapshot{
+				BaseURL:   "http://snapshot.local/",
+				Timestamp: "20211020T000000Z",
+				Suite:     "bullseye",
+			},
+			expected: []string{
+				"deb [check-valid-until=no] http://snapshot.local/archive/debian/20211020T000000Z/ bullseye main",
+				"deb [check-valid-until=no] http://snapshot.local/archive/debian/20211020T000000Z/ bullseye-updates main",
+				"deb [check-valid-until=no] http://snapshot.local/archive/debian-security/20211020T000000Z/ bullseye-security main",
+			},
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			if diff := deep.Equal(tc.snapshot.SourcesList(), tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
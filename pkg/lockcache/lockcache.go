@@ -0,0 +1,138 @@
+// Package lockcache implements a persistent on-disk cache used by zbuild CLI
+// to reuse the results of lock resolutions (e.g. image references, files read
+// from images, package versions, ...) across zbuild update runs.
+package lockcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTTL is how long cached results are reused when Cache.TTL isn't set.
+const DefaultTTL = 24 * time.Hour
+
+// DefaultDir returns the directory used to cache lock resolutions by default,
+// or an empty string if the user cache dir can't be determined.
+func DefaultDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "zbuild", "locks")
+}
+
+// Cache stores JSON-encoded values in files named after the hash of their
+// key. A nil *Cache or a Cache with an empty Dir caches nothing.
+type Cache struct {
+	// Dir is the directory where cached values are stored.
+	Dir string
+	// TTL is how long cached values are reused. DefaultTTL is used when it's
+	// zero.
+	TTL time.Duration
+	// Refresh makes Get always miss, such that values are resolved again and
+	// the cache is refreshed with the new values.
+	Refresh bool
+}
+
+// Key builds a cache key from the given parts.
+func Key(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+// Get decodes the value cached for the given key into v. It returns false
+// when there's no such value, when it has expired or when it can't be
+// decoded.
+func (c *Cache) Get(key string, v interface{}) bool {
+	if c == nil || c.Dir == "" || c.Refresh {
+		return false
+	}
+
+	path := c.path(key)
+	stat, err := os.Stat(path)
+	if err != nil || time.Since(stat.ModTime()) >= c.ttl() {
+		return false
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		logrus.Debugf("Ignoring invalid lock cache entry %s: %v", path, err)
+		return false
+	}
+
+	return true
+}
+
+// Set stores the given value for the given key.
+func (c *Cache) Set(key string, v interface{}) error {
+	if c == nil || c.Dir == "" {
+		return nil
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(c.path(key), func(w io.Writer) error {
+		_, err := w.Write(raw)
+		return err
+	})
+}
+
+// Clear removes every value stored in the cache.
+func (c *Cache) Clear() error {
+	if c == nil || c.Dir == "" {
+		return nil
+	}
+	return os.RemoveAll(c.Dir)
+}
+
+func (c *Cache) ttl() time.Duration {
+	if c.TTL == 0 {
+		return DefaultTTL
+	}
+	return c.TTL
+}
+
+func (c *Cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:]))
+}
+
+// WriteFileAtomic creates or replaces the file at the given path with the
+// content written by write. The content is written to a temporary file
+// first, such that concurrent runs never read partially written files. The
+// file is left untouched when write fails.
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	err = write(tmpfile)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), path)
+}
@@ -0,0 +1,109 @@
+package lockcache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/go-test/deep"
+)
+
+func newCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "zbuild-lockcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCache(t *testing.T) {
+	testcases := map[string]struct {
+		cache    func(dir string) *lockcache.Cache
+		expected bool
+	}{
+		"reuse values stored within the TTL": {
+			cache: func(dir string) *lockcache.Cache {
+				return &lockcache.Cache{Dir: dir}
+			},
+			expected: true,
+		},
+		"ignore expired values": {
+			cache: func(dir string) *lockcache.Cache {
+				return &lockcache.Cache{Dir: dir, TTL: time.Nanosecond}
+			},
+			expected: false,
+		},
+		"ignore stored values when refreshing": {
+			cache: func(dir string) *lockcache.Cache {
+				return &lockcache.Cache{Dir: dir, Refresh: true}
+			},
+			expected: false,
+		},
+		"cache nothing without a dir": {
+			cache: func(dir string) *lockcache.Cache {
+				return &lockcache.Cache{}
+			},
+			expected: false,
+		},
+		"cache nothing with a nil cache": {
+			cache: func(dir string) *lockcache.Cache {
+				return nil
+			},
+			expected: false,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			dir := newCacheDir(t)
+			defer os.RemoveAll(dir)
+
+			cache := tc.cache(dir)
+			key := lockcache.Key("image-ref", "debian:buster")
+			value := map[string]string{"curl": "7.64.0-4+deb10u1"}
+
+			if err := cache.Set(key, value); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var cached map[string]string
+			found := cache.Get(key, &cached)
+			if found != tc.expected {
+				t.Fatalf("Expected found: %t\nGot: %t", tc.expected, found)
+			}
+			if !found {
+				return
+			}
+
+			if diff := deep.Equal(cached, value); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	dir := newCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := &lockcache.Cache{Dir: dir}
+	key := lockcache.Key("image-ref", "debian:buster")
+
+	if err := cache.Set(key, "docker.io/library/debian:buster@sha256:4ab3309ba955211d1db92f405be609942b595a720de789286376f030502977d6"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := cache.Clear(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var cached string
+	if cache.Get(key, &cached) {
+		t.Fatalf("Expected %q to be cleared from the cache.", key)
+	}
+}
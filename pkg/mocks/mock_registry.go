@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/NiR-/zbuild/pkg/registry (interfaces: KindHandler)
+// Source: github.com/NiR-/zbuild/pkg/registry (interfaces: KindHandler,SBOMHandler)
 
 // Package mocks is a generated GoMock package.
 package mocks
@@ -9,6 +9,7 @@ import (
 	builddef "github.com/NiR-/zbuild/pkg/builddef"
 	image "github.com/NiR-/zbuild/pkg/image"
 	pkgsolver "github.com/NiR-/zbuild/pkg/pkgsolver"
+	sbom "github.com/NiR-/zbuild/pkg/sbom"
 	statesolver "github.com/NiR-/zbuild/pkg/statesolver"
 	gomock "github.com/golang/mock/gomock"
 	llb "github.com/moby/buildkit/client/llb"
@@ -95,3 +96,41 @@ func (mr *MockKindHandlerMockRecorder) WithSolver(arg0 interface{}) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithSolver", reflect.TypeOf((*MockKindHandler)(nil).WithSolver), arg0)
 }
+
+// MockSBOMHandler is a mock of SBOMHandler interface
+type MockSBOMHandler struct {
+	ctrl     *gomock.Controller
+	recorder *MockSBOMHandlerMockRecorder
+}
+
+// MockSBOMHandlerMockRecorder is the mock recorder for MockSBOMHandler
+type MockSBOMHandlerMockRecorder struct {
+	mock *MockSBOMHandler
+}
+
+// NewMockSBOMHandler creates a new mock instance
+func NewMockSBOMHandler(ctrl *gomock.Controller) *MockSBOMHandler {
+	mock := &MockSBOMHandler{ctrl: ctrl}
+	mock.recorder = &MockSBOMHandlerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSBOMHandler) EXPECT() *MockSBOMHandlerMockRecorder {
+	return m.recorder
+}
+
+// SBOM mocks base method
+func (m *MockSBOMHandler) SBOM(arg0 context.Context, arg1 builddef.BuildOpts) (sbom.BOM, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SBOM", arg0, arg1)
+	ret0, _ := ret[0].(sbom.BOM)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SBOM indicates an expected call of SBOM
+func (mr *MockSBOMHandlerMockRecorder) SBOM(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SBOM", reflect.TypeOf((*MockSBOMHandler)(nil).SBOM), arg0, arg1)
+}
@@ -129,3 +129,18 @@ func (mr *MockStateSolverMockRecorder) ResolveImageRef(arg0, arg1 interface{}) *
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveImageRef", reflect.TypeOf((*MockStateSolver)(nil).ResolveImageRef), arg0, arg1)
 }
+
+// Stat mocks base method
+func (m *MockStateSolver) Stat(arg0 context.Context, arg1 string, arg2 statesolver.FileSource) (statesolver.FileInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stat", arg0, arg1, arg2)
+	ret0, _ := ret[0].(statesolver.FileInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stat indicates an expected call of Stat
+func (mr *MockStateSolverMockRecorder) Stat(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stat", reflect.TypeOf((*MockStateSolver)(nil).Stat), arg0, arg1, arg2)
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/NiR-/zbuild/pkg/statesolver"
+	"golang.org/x/xerrors"
 )
 
 type APKSolver struct {
@@ -24,48 +25,82 @@ func (s *APKSolver) ResolveVersions(
 	imageRef string,
 	pkgs map[string]string,
 ) (map[string]string, error) {
-	resolved := map[string]string{}
-	toResolve := make([]string, 0, len(pkgs))
-
-	for name, version := range pkgs {
-		if version != "" && version != "*" {
-			// @TODO: check if the given version is valid
-			resolved[name] = version
-		}
-		toResolve = append(toResolve, name)
+	resolved, err := s.ResolveStagesVersions(ctx, imageRef, map[string]map[string]string{"": pkgs})
+	if err != nil {
+		return map[string]string{}, err
 	}
+	return resolved[""], nil
+}
 
-	if len(toResolve) == 0 {
-		return resolved, nil
-	}
+// ResolveStagesVersions lists the versions available for the packages of all
+// the given stages with a single apk command and then resolves each stage on
+// its own.
+func (s *APKSolver) ResolveStagesVersions(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return resolveStagesFromCandidates(stages, func(names []string) (map[string][]string, error) {
+		cmd := make([]string, 4, len(names)+4)
+		cmd[0] = "apk"
+		cmd[1] = "--no-cache"
+		cmd[2] = "info"
+		cmd[3] = "--description"
+		cmd = append(cmd, names...)
 
-	cmd := make([]string, 4, len(pkgs)+4)
-	cmd[0] = "apk"
-	cmd[1] = "--no-cache"
-	cmd[2] = "info"
-	cmd[3] = "--description"
-	cmd = append(cmd, toResolve...)
+		outbuf, err := s.solver.ExecImage(ctx, imageRef, []string{
+			strings.Join(cmd, " "),
+		})
+		// Unfortunately APK returns exit code 1 when a package is not found but
+		// it doesn't provide any error message at all. The packages found are
+		// still listed on stdout.
+		var execErr statesolver.ExecError
+		if xerrors.As(err, &execErr) && execErr.ExitCode == 1 {
+			outbuf = bytes.NewBufferString(execErr.Stdout)
+		} else if err != nil {
+			return nil, err
+		}
 
-	outbuf, err := s.solver.ExecImage(ctx, imageRef, []string{
-		strings.Join(cmd, " "),
-	})
-	// Unfortunately APK returns exit code 1 when a package is not found but
-	// it doesn't provide any error message at all.
-	if err != nil && !strings.Contains(err.Error(), "exited with code 1") {
-		return resolved, err
-	}
+		return parseAPKInfo(outbuf, names), nil
+	}, compareAlpineVersions)
+}
+
+// ResolveDependencies simulates the installation of the packages of each
+// stage (associated to their exact version) to find the exact version of
+// every package that would be installed along with them.
+func (s *APKSolver) ResolveDependencies(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return resolveClosures(ctx, s.solver, imageRef, stages, nil, func(specs []string) string {
+		return "apk --no-cache add --simulate " + strings.Join(specs, " ")
+	}, parseAPKSimulation)
+}
 
-	resolved = parseAPKInfo(outbuf, toResolve, resolved)
-	err = checkMissingPackages(pkgs, resolved)
+var apkSimulationExp = regexp.MustCompile(`(?m)^\(\d+/\d+\) (?:Installing (\S+) \((\S+)\)|Upgrading (\S+) \(\S+ -> (\S+)\))`)
 
-	return resolved, err
+// parseAPKSimulation returns the packages (and their version) that would be
+// installed or upgraded according to the output of apk add --simulate.
+func parseAPKSimulation(buf *bytes.Buffer) map[string]string {
+	res := map[string]string{}
+	for _, submatches := range apkSimulationExp.FindAllStringSubmatch(buf.String(), -1) {
+		if submatches[1] != "" {
+			res[submatches[1]] = submatches[2]
+		} else {
+			res[submatches[3]] = submatches[4]
+		}
+	}
+	return res
 }
 
+// parseAPKInfo returns the list of versions available for each package
+// listed in the output of apk info.
 func parseAPKInfo(
 	buf *bytes.Buffer,
 	pkgNames []string,
-	res map[string]string,
-) map[string]string {
+) map[string][]string {
+	res := map[string][]string{}
 	expstr := "(" + strings.Join(pkgNames, "|") + ")-([^ ]+) description:"
 	exp, err := regexp.Compile(expstr)
 	if err != nil {
@@ -80,7 +115,7 @@ func parseAPKInfo(
 
 		name := string(submatches[1])
 		version := string(submatches[2])
-		res[name] = version
+		res[name] = append(res[name], version)
 	}
 
 	return res
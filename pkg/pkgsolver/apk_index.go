@@ -0,0 +1,173 @@
+package pkgsolver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"golang.org/x/xerrors"
+)
+
+// defaultAlpineArch is the architecture used when /etc/apk/arch can't be
+// found in the image.
+const defaultAlpineArch = "x86_64"
+
+// APKIndexSolver resolves versions of Alpine packages by downloading and
+// parsing the APKINDEX of the repositories configured in the image.
+type APKIndexSolver struct {
+	solver  statesolver.StateSolver
+	fetcher indexFetcher
+}
+
+func NewAPKIndexSolver(solver statesolver.StateSolver, opts IndexOpts) *APKIndexSolver {
+	return &APKIndexSolver{
+		solver:  solver,
+		fetcher: newIndexFetcher(opts),
+	}
+}
+
+func (s *APKIndexSolver) ResolveVersions(
+	ctx context.Context,
+	imageRef string,
+	pkgs map[string]string,
+) (map[string]string, error) {
+	resolved, err := s.ResolveStagesVersions(ctx, imageRef, map[string]map[string]string{"": pkgs})
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return resolved[""], nil
+}
+
+// ResolveStagesVersions reads the APKINDEX once for the packages of all the
+// given stages and then resolves each stage on its own.
+func (s *APKIndexSolver) ResolveStagesVersions(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return resolveStagesFromCandidates(stages, func(names []string) (map[string][]string, error) {
+		return s.listCandidates(ctx, imageRef, names)
+	}, compareAlpineVersions)
+}
+
+// listCandidates returns the versions of the given packages available in
+// the APKINDEX of the repositories configured in the image.
+func (s *APKIndexSolver) listCandidates(
+	ctx context.Context,
+	imageRef string,
+	names []string,
+) (map[string][]string, error) {
+	rawRepos, err := readImageFile(ctx, s.solver, imageRef, "/etc/apk/repositories")
+	if err != nil {
+		return nil, err
+	}
+	repos := parseAPKRepositories(rawRepos)
+	if len(repos) == 0 {
+		return nil, xerrors.Errorf("no APK repositories found in %s", imageRef)
+	}
+
+	rawArch, err := readImageFile(ctx, s.solver, imageRef, "/etc/apk/arch")
+	if err != nil {
+		return nil, err
+	}
+	arch := strings.TrimSpace(string(rawArch))
+	if arch == "" {
+		arch = defaultAlpineArch
+	}
+
+	wanted := packageSet(names)
+	candidates := map[string][]string{}
+	for _, repo := range repos {
+		repoURL, err := s.fetcher.repositoryURL(repo)
+		if err != nil {
+			return nil, err
+		}
+
+		indexURL := repoURL + "/" + arch + "/APKINDEX.tar.gz"
+		raw, err := s.fetcher.fetch(ctx, indexURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseAPKIndex(raw, wanted, candidates); err != nil {
+			return nil, xerrors.Errorf("could not parse %s: %w", indexURL, err)
+		}
+	}
+
+	return candidates, nil
+}
+
+// parseAPKRepositories parses /etc/apk/repositories. Tagged repositories
+// (e.g. "@edge https://...") are ignored as their packages are installed
+// only when explicitly requested.
+func parseAPKRepositories(raw []byte) []string {
+	repos := []string{}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		repos = append(repos, line)
+	}
+
+	return repos
+}
+
+// parseAPKIndex extracts the APKINDEX file from a gzipped APKINDEX archive
+// and adds the versions of the given packages to candidates.
+func parseAPKIndex(
+	raw []byte,
+	pkgs map[string]struct{},
+	candidates map[string][]string,
+) error {
+	// APKINDEX archives are made of several concatenated gzip streams, which
+	// gzip.Reader reads as a single one.
+	gzr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return xerrors.New("APKINDEX file not found")
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Name == "APKINDEX" {
+			break
+		}
+	}
+
+	var name, version string
+	addCandidate := func() {
+		if _, ok := pkgs[name]; ok && version != "" {
+			candidates[name] = appendVersion(candidates[name], version)
+		}
+		name, version = "", ""
+	}
+
+	scanner := bufio.NewScanner(tr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			addCandidate()
+		case strings.HasPrefix(line, "P:"):
+			name = line[2:]
+		case strings.HasPrefix(line, "V:"):
+			version = line[2:]
+		}
+	}
+	addCandidate()
+
+	return scanner.Err()
+}
@@ -0,0 +1,97 @@
+package pkgsolver_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+)
+
+const alpineRepositories = `http://dl-cdn.alpinelinux.org/alpine/v3.12/main
+http://dl-cdn.alpinelinux.org/alpine/v3.12/community
+@edge http://dl-cdn.alpinelinux.org/alpine/edge/main
+`
+
+func TestAPKIndexSolver(t *testing.T) {
+	testcases := map[string]struct {
+		files       map[string]string
+		pkgs        map[string]string
+		expected    map[string]string
+		expectedErr error
+	}{
+		"resolve versions from all repositories": {
+			files: map[string]string{
+				"/etc/apk/repositories": alpineRepositories,
+				"/etc/apk/arch":         "x86_64\n",
+			},
+			pkgs: map[string]string{
+				"curl":    "*",
+				"openssl": "<1.1.1",
+				"git":     "~2.26",
+			},
+			expected: map[string]string{
+				"curl":    "7.69.1-r1",
+				"openssl": "1.1.1_rc2-r0",
+				"git":     "2.26.2-r0",
+			},
+		},
+		"fail to resolve version of unknown package": {
+			files: map[string]string{
+				"/etc/apk/repositories": alpineRepositories,
+			},
+			pkgs:        map[string]string{"yolo": "*"},
+			expectedErr: errors.New("packages yolo not found"),
+		},
+		"fail when a pinned version is not available anymore": {
+			files: map[string]string{
+				"/etc/apk/repositories": alpineRepositories,
+			},
+			pkgs:        map[string]string{"curl": "7.67.0-r0"},
+			expectedErr: errors.New("version 7.67.0-r0 of package curl is not available (available versions: 7.69.1-r0, 7.69.1-r1)"),
+		},
+		"fail when the image has no APK repositories": {
+			files:       map[string]string{},
+			pkgs:        map[string]string{"curl": "*"},
+			expectedErr: errors.New("no APK repositories found in docker.io/library/alpine:3.12"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			srv, _ := newIndexServer(t)
+			imageRef := "docker.io/library/alpine:3.12"
+			solver := newImageFilesSolver(mockCtrl, imageRef, tc.files)
+
+			pkgSolver := pkgsolver.NewAPKIndexSolver(solver, pkgsolver.IndexOpts{
+				BaseURL: srv.URL,
+			})
+
+			ctx := context.Background()
+			resolved, err := pkgSolver.ResolveVersions(ctx, imageRef, tc.pkgs)
+
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if diff := deep.Equal(resolved, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
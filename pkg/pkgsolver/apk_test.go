@@ -1,32 +1,41 @@
 package pkgsolver_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"testing"
 
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbtest"
+	"github.com/NiR-/zbuild/pkg/mocks"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
 	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+	"golang.org/x/xerrors"
 )
 
 func TestAPKResolveVersions(t *testing.T) {
 	testcases := map[string]struct {
 		imageRef    string
 		toResolve   map[string]string
+		expected    map[string]string
 		expectedErr error
 	}{
 		"successfully resolve package versions": {
-			imageRef:  "docker.io/library/alpine:latest",
+			imageRef:  "docker.io/library/alpine:3.19",
 			toResolve: map[string]string{"curl": "*"},
+			expected:  map[string]string{"curl": "8.5.0-r0"},
 		},
 		"fail to resolve version of unknown package": {
-			imageRef:    "docker.io/library/alpine:latest",
+			imageRef:    "docker.io/library/alpine:3.19",
 			toResolve:   map[string]string{"yolo": "*"},
 			expectedErr: errors.New("packages yolo not found"),
 		},
 	}
 
-	c := newDockerClient(t)
+	solver := llbtest.LoadFixtures(t, "testdata/apk.fixtures.json")
 
 	for tcname := range testcases {
 		tc := testcases[tcname]
@@ -35,13 +44,105 @@ func TestAPKResolveVersions(t *testing.T) {
 			t.Parallel()
 
 			ctx := context.Background()
-			solver := statesolver.LocalSolver{
-				Client:  c,
-				Labels:  map[string]string{},
-				RootDir: "testdata",
+			pkgSolver := pkgsolver.NewAPKSolver(solver)
+			resolved, err := pkgSolver.ResolveVersions(ctx, tc.imageRef, tc.toResolve)
+
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
 			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if diff := deep.Equal(resolved, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+const rawAPKInfo = `openssl-1.1.1g-r0 description:
+Toolkit for Transport Layer Security (TLS)
+
+openssl-1.1.1d-r3 description:
+Toolkit for Transport Layer Security (TLS)
+
+openssl-1.1.1_rc2-r0 description:
+Toolkit for Transport Layer Security (TLS)
+
+openssl-1.1.1-r1 description:
+Toolkit for Transport Layer Security (TLS)
+
+sqlite-3.32.1-r0 description:
+C library that implements an SQL database engine
+
+sqlite-3.30.1_p1-r0 description:
+C library that implements an SQL database engine
+
+sqlite-3.30.1-r2 description:
+C library that implements an SQL database engine
+
+`
+
+func TestAPKResolveVersionConstraints(t *testing.T) {
+	testcases := map[string]struct {
+		constraints map[string]string
+		expected    map[string]string
+		expectedErr error
+	}{
+		"resolve wildcard constraints": {
+			constraints: map[string]string{"openssl": "*", "sqlite": "*"},
+			expected: map[string]string{
+				"openssl": "1.1.1g-r0",
+				"sqlite":  "3.32.1-r0",
+			},
+		},
+		"resolve range constraints": {
+			constraints: map[string]string{"openssl": "<1.1.1e", "sqlite": ">=3.30 <3.31"},
+			expected: map[string]string{
+				"openssl": "1.1.1d-r3",
+				"sqlite":  "3.30.1_p1-r0",
+			},
+		},
+		"resolve prefix and tilde constraints": {
+			constraints: map[string]string{"openssl": "1.1.*", "sqlite": "~3.30.0"},
+			expected: map[string]string{
+				"openssl": "1.1.1g-r0",
+				"sqlite":  "3.30.1_p1-r0",
+			},
+		},
+		"resolve pinned versions": {
+			constraints: map[string]string{"openssl": "1.1.1_rc2-r0", "sqlite": "3.30.1-r2"},
+			expected: map[string]string{
+				"openssl": "1.1.1_rc2-r0",
+				"sqlite":  "3.30.1-r2",
+			},
+		},
+		"fail when a pinned version is not available anymore": {
+			constraints: map[string]string{"openssl": "1.1.1c-r0", "sqlite": "*"},
+			expectedErr: errors.New("version 1.1.1c-r0 of package openssl is not available (available versions: 1.1.1g-r0, 1.1.1d-r3, 1.1.1_rc2-r0, 1.1.1-r1)"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			solver := mocks.NewMockStateSolver(mockCtrl)
+			solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/alpine:3.12", []string{
+				"apk --no-cache info --description openssl sqlite",
+			}).Return(bytes.NewBufferString(rawAPKInfo), nil)
+
+			ctx := context.Background()
 			pkgSolver := pkgsolver.NewAPKSolver(solver)
-			_, err := pkgSolver.ResolveVersions(ctx, tc.imageRef, tc.toResolve)
+			resolved, err := pkgSolver.ResolveVersions(ctx, "docker.io/library/alpine:3.12", tc.constraints)
 
 			if tc.expectedErr != nil {
 				if err == nil || err.Error() != tc.expectedErr.Error() {
@@ -52,6 +153,82 @@ func TestAPKResolveVersions(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Unexpected error: %v", err)
 			}
+
+			if diff := deep.Equal(resolved, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
 		})
 	}
 }
+
+func TestAPKReportsMissingPackages(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cmd := []string{"apk --no-cache info --description openssl pecl-xdebug"}
+	execErr := xerrors.Errorf("failed to execute cmd: %w", statesolver.ExecError{
+		Cmd:      cmd,
+		ExitCode: 1,
+		Stdout:   rawAPKInfo,
+	})
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/alpine:3.12", cmd).
+		Return(bytes.NewBufferString(rawAPKInfo), execErr)
+
+	ctx := context.Background()
+	pkgSolver := pkgsolver.NewAPKSolver(solver)
+	_, err := pkgSolver.ResolveVersions(ctx, "docker.io/library/alpine:3.12", map[string]string{
+		"openssl":     "*",
+		"pecl-xdebug": "*",
+	})
+
+	expectedErr := "packages pecl-xdebug not found"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected: %v\nGot: %v", expectedErr, err)
+	}
+}
+
+func TestAPKResolveClosure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	gomock.InOrder(
+		solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/alpine:3.12", []string{
+			"apk --no-cache info --description openssl sqlite",
+		}).Return(bytes.NewBufferString(rawAPKInfo), nil),
+		solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/alpine:3.12", []string{
+			"echo '### zbuild closure'",
+			"apk --no-cache add --simulate openssl=1.1.1g-r0 sqlite=3.32.1-r0",
+		}).Return(bytes.NewBufferString(`### zbuild closure
+fetch http://dl-cdn.alpinelinux.org/alpine/v3.12/main/x86_64/APKINDEX.tar.gz
+(1/5) Upgrading libcrypto1.1 (1.1.1f-r0 -> 1.1.1g-r0)
+(2/5) Upgrading libssl1.1 (1.1.1f-r0 -> 1.1.1g-r0)
+(3/5) Installing openssl (1.1.1g-r0)
+(4/5) Installing readline (8.0.4-r0)
+(5/5) Installing sqlite (3.32.1-r0)
+OK: 8 MiB in 19 packages
+`), nil),
+	)
+
+	ctx := context.Background()
+	pkgSolver := pkgsolver.NewAPKSolver(solver)
+	resolved, err := pkgsolver.Resolve(ctx, pkgSolver, "docker.io/library/alpine:3.12",
+		map[string]string{"openssl": "*", "sqlite": "*"},
+		builddef.UpdateLocksOpts{LockPackageDependencies: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"libcrypto1.1": "1.1.1g-r0",
+		"libssl1.1":    "1.1.1g-r0",
+		"openssl":      "1.1.1g-r0",
+		"readline":     "8.0.4-r0",
+		"sqlite":       "3.32.1-r0",
+	}
+	if diff := deep.Equal(resolved, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
@@ -3,13 +3,16 @@ package pkgsolver
 import (
 	"bytes"
 	"context"
+	"regexp"
 	"strings"
 
+	"github.com/NiR-/zbuild/pkg/llbutils"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 )
 
 type APTSolver struct {
-	solver statesolver.StateSolver
+	solver   statesolver.StateSolver
+	snapshot *llbutils.DebianSnapshot
 }
 
 func NewAPTSolver(solver statesolver.StateSolver) *APTSolver {
@@ -18,48 +21,101 @@ func NewAPTSolver(solver statesolver.StateSolver) *APTSolver {
 	}
 }
 
+// WithSnapshot makes this solver resolve package versions from the given
+// Debian archive snapshot instead of the sources configured in the image. It
+// returns the given snapshot.
+func (s *APTSolver) WithSnapshot(snapshot llbutils.DebianSnapshot) llbutils.DebianSnapshot {
+	s.snapshot = &snapshot
+	return snapshot
+}
+
 func (s *APTSolver) ResolveVersions(
 	ctx context.Context,
 	imageRef string,
 	pkgs map[string]string,
 ) (map[string]string, error) {
-	resolved := map[string]string{}
-	cmd := make([]string, 2, len(pkgs)+2)
-	cmd[0] = "apt-cache"
-	cmd[1] = "madison"
-
-	for pkg, ver := range pkgs {
-		if ver != "" && ver != "*" {
-			// @TODO: check if the given version is valid
-			resolved[pkg] = ver
-			continue
-		}
-		cmd = append(cmd, pkg)
+	resolved, err := s.ResolveStagesVersions(ctx, imageRef, map[string]map[string]string{"": pkgs})
+	if err != nil {
+		return map[string]string{}, err
 	}
+	return resolved[""], nil
+}
 
-	if len(cmd) == 2 {
-		return resolved, nil
-	}
+// ResolveStagesVersions lists the versions available for the packages of all
+// the given stages with a single apt-cache command and then resolves each
+// stage on its own.
+func (s *APTSolver) ResolveStagesVersions(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return resolveStagesFromCandidates(stages, func(names []string) (map[string][]string, error) {
+		outbuf, err := s.solver.ExecImage(ctx, imageRef,
+			s.commands("apt-cache", "madison "+strings.Join(names, " ")))
+		if err != nil {
+			return nil, err
+		}
+		return parseAPTCacheMadison(outbuf), nil
+	}, compareDebianVersions)
+}
+
+// ResolveDependencies simulates the installation of the packages of each
+// stage (associated to their exact version) to find the exact version of
+// every package that would be installed along with them. Package lists are
+// updated once for all the stages.
+func (s *APTSolver) ResolveDependencies(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return resolveClosures(ctx, s.solver, imageRef, stages, s.updateCommands(), func(specs []string) string {
+		return "apt-get" + s.aptOptions() + " install --simulate --no-install-recommends " + strings.Join(specs, " ")
+	}, parseAPTSimulation)
+}
 
-	cmd = []string{
-		"apt-get update 1>/dev/null 2>&1",
-		strings.Join(cmd, " "),
+// commands returns the commands to run to update the package lists and then
+// run the given apt command (either apt-get or apt-cache) with the given
+// args.
+func (s *APTSolver) commands(aptCmd string, args string) []string {
+	return append(s.updateCommands(), aptCmd+s.aptOptions()+" "+args)
+}
+
+// updateCommands returns the commands to run to update the package lists.
+func (s *APTSolver) updateCommands() []string {
+	cmds := []string{}
+	if s.snapshot != nil {
+		cmds = append(cmds, s.snapshot.WriteSourcesListCmd())
 	}
-	outbuf, err := s.solver.ExecImage(ctx, imageRef, cmd)
-	if err != nil {
-		return resolved, err
+	return append(cmds, "apt-get"+s.aptOptions()+" update 1>/dev/null 2>&1")
+}
+
+// aptOptions returns the options to pass to apt commands, prefixed with a
+// space, if any.
+func (s *APTSolver) aptOptions() string {
+	if s.snapshot == nil {
+		return ""
 	}
+	return " " + s.snapshot.APTOptions()
+}
 
-	resolved = parseAPTCacheMadison(outbuf, resolved)
-	err = checkMissingPackages(pkgs, resolved)
+var aptSimulationExp = regexp.MustCompile(`(?m)^Inst (\S+) (?:\[\S+\] )?\((\S+) `)
 
-	return resolved, err
+// parseAPTSimulation returns the packages (and their version) that would be
+// installed or upgraded according to the output of apt-get install
+// --simulate.
+func parseAPTSimulation(buf *bytes.Buffer) map[string]string {
+	res := map[string]string{}
+	for _, submatches := range aptSimulationExp.FindAllStringSubmatch(buf.String(), -1) {
+		res[submatches[1]] = submatches[2]
+	}
+	return res
 }
 
-func parseAPTCacheMadison(
-	buf *bytes.Buffer,
-	res map[string]string,
-) map[string]string {
+// parseAPTCacheMadison returns the list of versions available for each
+// package listed in the output of apt-cache madison.
+func parseAPTCacheMadison(buf *bytes.Buffer) map[string][]string {
+	res := map[string][]string{}
+
 	for {
 		line, err := buf.ReadString('\n')
 		if err != nil {
@@ -73,9 +129,7 @@ func parseAPTCacheMadison(
 
 		pkgName := strings.Trim(parts[0], " ")
 		pkgVersion := strings.Trim(parts[1], " ")
-		if _, ok := res[pkgName]; !ok {
-			res[pkgName] = pkgVersion
-		}
+		res[pkgName] = append(res[pkgName], pkgVersion)
 	}
 
 	return res
@@ -0,0 +1,317 @@
+package pkgsolver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"path"
+	"strings"
+
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"golang.org/x/xerrors"
+)
+
+// debianIndexArch is the architecture of the Debian indexes used to resolve
+// package versions.
+const debianIndexArch = "amd64"
+
+// APTIndexSolver resolves versions of Debian packages by downloading and
+// parsing the Packages indexes of the APT repositories configured in the
+// image (or of the Debian snapshot set with WithSnapshot).
+type APTIndexSolver struct {
+	solver   statesolver.StateSolver
+	fetcher  indexFetcher
+	snapshot *llbutils.DebianSnapshot
+}
+
+func NewAPTIndexSolver(solver statesolver.StateSolver, opts IndexOpts) *APTIndexSolver {
+	return &APTIndexSolver{
+		solver:  solver,
+		fetcher: newIndexFetcher(opts),
+	}
+}
+
+// WithSnapshot makes this solver resolve package versions from the given
+// Debian archive snapshot instead of the sources configured in the image. It
+// returns the given snapshot.
+func (s *APTIndexSolver) WithSnapshot(snapshot llbutils.DebianSnapshot) llbutils.DebianSnapshot {
+	s.snapshot = &snapshot
+	return snapshot
+}
+
+func (s *APTIndexSolver) ResolveVersions(
+	ctx context.Context,
+	imageRef string,
+	pkgs map[string]string,
+) (map[string]string, error) {
+	resolved, err := s.ResolveStagesVersions(ctx, imageRef, map[string]map[string]string{"": pkgs})
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return resolved[""], nil
+}
+
+// ResolveStagesVersions reads the Packages indexes once for the packages of
+// all the given stages and then resolves each stage on its own.
+func (s *APTIndexSolver) ResolveStagesVersions(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return resolveStagesFromCandidates(stages, func(names []string) (map[string][]string, error) {
+		return s.listCandidates(ctx, imageRef, names)
+	}, compareDebianVersions)
+}
+
+// listCandidates returns the versions of the given packages available in
+// the Packages indexes of the repositories configured in the image.
+func (s *APTIndexSolver) listCandidates(
+	ctx context.Context,
+	imageRef string,
+	names []string,
+) (map[string][]string, error) {
+	sources, err := s.sources(ctx, imageRef)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, xerrors.Errorf("no APT repositories found in %s", imageRef)
+	}
+
+	wanted := packageSet(names)
+	candidates := map[string][]string{}
+	for _, source := range sources {
+		repoURL, err := s.fetcher.repositoryURL(source.uri)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, indexPath := range source.indexPaths(debianIndexArch) {
+			raw, err := s.fetcher.fetch(ctx, repoURL+"/"+indexPath)
+			if err != nil {
+				return nil, err
+			}
+			if err := parseDebianPackagesIndex(raw, wanted, candidates); err != nil {
+				return nil, xerrors.Errorf("could not parse %s/%s: %w",
+					repoURL, indexPath, err)
+			}
+		}
+	}
+
+	return candidates, nil
+}
+
+// aptSourcesDir is the dir where additional APT sources are configured,
+// either in one-line-style format (.list files) or, since Debian 12
+// (bookworm), in deb822 format (.sources files).
+const aptSourcesDir = "/etc/apt/sources.list.d"
+
+// sources returns the sources configured in /etc/apt/sources.list and in every
+// .list and .sources file of /etc/apt/sources.list.d, like apt-get does.
+func (s *APTIndexSolver) sources(ctx context.Context, imageRef string) ([]aptSource, error) {
+	if s.snapshot != nil {
+		return parseSourcesList([]byte(strings.Join(s.snapshot.SourcesList(), "\n"))), nil
+	}
+
+	sourcesList, err := readImageFile(ctx, s.solver, imageRef, "/etc/apt/sources.list")
+	if err != nil {
+		return nil, err
+	}
+	sources := parseSourcesList(sourcesList)
+
+	names, err := statesolver.ReadImageDir(ctx, s.solver, imageRef, aptSourcesDir)
+	if xerrors.Is(err, statesolver.FileNotFound) {
+		return sources, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		ext := path.Ext(name)
+		if ext != ".list" && ext != ".sources" {
+			continue
+		}
+
+		raw, err := readImageFile(ctx, s.solver, imageRef, path.Join(aptSourcesDir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if ext == ".list" {
+			sources = append(sources, parseSourcesList(raw)...)
+		} else {
+			sources = append(sources, parseDeb822Sources(raw)...)
+		}
+	}
+
+	return sources, nil
+}
+
+type aptSource struct {
+	uri        string
+	suite      string
+	components []string
+}
+
+// indexPaths returns the paths of the Packages indexes of this source,
+// relative to its URI.
+func (s aptSource) indexPaths(arch string) []string {
+	// Flat repositories have no components and their suite is an exact path.
+	if strings.HasSuffix(s.suite, "/") {
+		return []string{s.suite + "Packages.gz"}
+	}
+
+	paths := make([]string, 0, len(s.components))
+	for _, component := range s.components {
+		paths = append(paths, "dists/"+s.suite+"/"+component+"/binary-"+arch+"/Packages.gz")
+	}
+	return paths
+}
+
+// parseSourcesList parses the one-line-style format of sources.list and
+// returns binary package sources.
+func parseSourcesList(raw []byte) []aptSource {
+	sources := []aptSource{}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		// Options between brackets are ignored.
+		if start := strings.Index(line, "["); start >= 0 {
+			if end := strings.Index(line, "]"); end > start {
+				line = line[:start] + line[end+1:]
+			}
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "deb" {
+			continue
+		}
+
+		sources = append(sources, aptSource{
+			uri:        fields[1],
+			suite:      fields[2],
+			components: fields[3:],
+		})
+	}
+
+	return sources
+}
+
+// parseDeb822Sources parses the deb822-style format of .sources files and
+// returns binary package sources.
+func parseDeb822Sources(raw []byte) []aptSource {
+	sources := []aptSource{}
+
+	for _, stanza := range parseDeb822Stanzas(raw) {
+		if !containsField(stanza["Types"], "deb") || stanza["Enabled"] == "no" {
+			continue
+		}
+
+		for _, uri := range strings.Fields(stanza["URIs"]) {
+			for _, suite := range strings.Fields(stanza["Suites"]) {
+				sources = append(sources, aptSource{
+					uri:        uri,
+					suite:      suite,
+					components: strings.Fields(stanza["Components"]),
+				})
+			}
+		}
+	}
+
+	return sources
+}
+
+func containsField(value, field string) bool {
+	for _, f := range strings.Fields(value) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDeb822Stanzas parses the single-line fields of the stanzas of a
+// deb822 document. Continuation lines are ignored.
+func parseDeb822Stanzas(raw []byte) []map[string]string {
+	stanzas := []map[string]string{}
+	stanza := map[string]string{}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(stanza) > 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = map[string]string{}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		stanza[parts[0]] = strings.TrimSpace(parts[1])
+	}
+
+	if len(stanza) > 0 {
+		stanzas = append(stanzas, stanza)
+	}
+
+	return stanzas
+}
+
+// parseDebianPackagesIndex parses a gzipped Packages index and adds the
+// versions of the given packages to candidates.
+func parseDebianPackagesIndex(
+	raw []byte,
+	pkgs map[string]struct{},
+	candidates map[string][]string,
+) error {
+	r, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var name, version string
+	addCandidate := func() {
+		if _, ok := pkgs[name]; ok && version != "" {
+			candidates[name] = appendVersion(candidates[name], version)
+		}
+		name, version = "", ""
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			addCandidate()
+		case strings.HasPrefix(line, "Package:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "Package:"))
+		case strings.HasPrefix(line, "Version:"):
+			version = strings.TrimSpace(strings.TrimPrefix(line, "Version:"))
+		}
+	}
+	addCandidate()
+
+	return scanner.Err()
+}
+
+// appendVersion appends version to versions unless it's already there (e.g.
+// when the same version is available from several repositories).
+func appendVersion(versions []string, version string) []string {
+	for _, v := range versions {
+		if v == version {
+			return versions
+		}
+	}
+	return append(versions, version)
+}
@@ -0,0 +1,181 @@
+package pkgsolver_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+)
+
+const busterSourcesList = `# deb http://snapshot.debian.org/archive/debian/20200422T000000Z buster main
+deb http://deb.debian.org/debian buster main
+# deb http://snapshot.debian.org/archive/debian-security/20200422T000000Z buster/updates main
+deb http://security.debian.org/debian-security buster/updates main
+deb [arch=amd64] http://deb.debian.org/debian buster-updates main
+deb-src http://deb.debian.org/debian buster main
+`
+
+const bookwormDebianSources = `Types: deb
+# http://snapshot.debian.org/archive/debian/20230612T000000Z
+URIs: http://deb.debian.org/debian
+Suites: bookworm bookworm-updates
+Components: main
+Signed-By: /usr/share/keyrings/debian-archive-keyring.gpg
+
+Types: deb
+# http://snapshot.debian.org/archive/debian-security/20230612T000000Z
+URIs: http://deb.debian.org/debian-security
+Suites: bookworm-security
+Components: main
+Signed-By: /usr/share/keyrings/debian-archive-keyring.gpg
+`
+
+const pgdgSourcesList = `deb [signed-by=/usr/share/keyrings/pgdg.gpg] http://apt.postgresql.org/pub/repos/apt bookworm-pgdg main
+`
+
+func TestAPTIndexSolver(t *testing.T) {
+	testcases := map[string]struct {
+		files       map[string]string
+		snapshot    *llbutils.DebianSnapshot
+		pkgs        map[string]string
+		expected    map[string]string
+		expectedErr error
+	}{
+		"resolve versions from sources.list": {
+			files: map[string]string{
+				"/etc/apt/sources.list": busterSourcesList,
+			},
+			pkgs: map[string]string{
+				"curl":  "*",
+				"git":   "<1:2.20.1-2+deb10u3",
+				"unzip": "6.0-23+deb10u1",
+			},
+			expected: map[string]string{
+				"curl":  "7.64.0-4+deb10u1",
+				"git":   "1:2.20.1-2+deb10u1",
+				"unzip": "6.0-23+deb10u1",
+			},
+		},
+		"resolve versions from deb822 sources": {
+			files: map[string]string{
+				"/etc/apt/sources.list.d/debian.sources": bookwormDebianSources,
+			},
+			pkgs: map[string]string{
+				"curl": "*",
+				"git":  "1:2.*",
+			},
+			expected: map[string]string{
+				"curl": "7.88.1-10+deb12u4",
+				"git":  "1:2.39.2-1.1",
+			},
+		},
+		"resolve versions from every file in sources.list.d": {
+			files: map[string]string{
+				"/etc/apt/sources.list.d/debian.sources": bookwormDebianSources,
+				"/etc/apt/sources.list.d/pgdg.list":      pgdgSourcesList,
+				// Files without the .list or .sources extension are ignored by APT.
+				"/etc/apt/sources.list.d/pgdg-testing.list.disabled": "deb http://apt.postgresql.org/pub/repos/apt bookworm-pgdg-testing main\n",
+			},
+			pkgs: map[string]string{
+				"curl":                 "*",
+				"postgresql-client-16": "*",
+			},
+			expected: map[string]string{
+				"curl":                 "7.88.1-10+deb12u4",
+				"postgresql-client-16": "16.2-1.pgdg120+2",
+			},
+		},
+		"resolve versions from a Debian snapshot": {
+			files: map[string]string{
+				"/etc/apt/sources.list": busterSourcesList,
+			},
+			snapshot: &llbutils.DebianSnapshot{
+				Timestamp: "20200509T083854Z",
+				Suite:     "buster",
+			},
+			pkgs: map[string]string{
+				"curl": "*",
+				"git":  "*",
+			},
+			expected: map[string]string{
+				"curl": "7.64.0-4+deb10u1",
+				"git":  "1:2.20.1-2",
+			},
+		},
+		"fail to resolve version of unknown package": {
+			files: map[string]string{
+				"/etc/apt/sources.list": busterSourcesList,
+			},
+			pkgs:        map[string]string{"yolo": "*"},
+			expectedErr: errors.New("packages yolo not found"),
+		},
+		"fail when the image has no APT repositories": {
+			files:       map[string]string{},
+			pkgs:        map[string]string{"curl": "*"},
+			expectedErr: errors.New("no APT repositories found in docker.io/library/debian:buster"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			srv, _ := newIndexServer(t)
+			imageRef := "docker.io/library/debian:buster"
+			solver := newImageFilesSolver(mockCtrl, imageRef, tc.files)
+
+			pkgSolver := pkgsolver.NewAPTIndexSolver(solver, pkgsolver.IndexOpts{
+				BaseURL: srv.URL,
+			})
+			if tc.snapshot != nil {
+				pkgSolver.WithSnapshot(*tc.snapshot)
+			}
+
+			ctx := context.Background()
+			resolved, err := pkgSolver.ResolveVersions(ctx, imageRef, tc.pkgs)
+
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if diff := deep.Equal(resolved, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestAPTIndexSolverDoesNotLockDependencies(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	pkgSolver := pkgsolver.NewAPTIndexSolver(solver, pkgsolver.IndexOpts{})
+
+	ctx := context.Background()
+	_, err := pkgsolver.Resolve(ctx, pkgSolver, "docker.io/library/debian:buster",
+		map[string]string{"curl": "*"},
+		builddef.UpdateLocksOpts{LockPackageDependencies: true})
+
+	expectedErr := "package solver *pkgsolver.APTIndexSolver doesn't support locking package dependencies"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected: %v\nGot: %v", expectedErr, err)
+	}
+}
@@ -1,33 +1,47 @@
 package pkgsolver_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbtest"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/mocks"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
-	"github.com/NiR-/zbuild/pkg/statesolver"
-	"github.com/docker/docker/client"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
 )
 
 func TestAPTResolveVersions(t *testing.T) {
 	testcases := map[string]struct {
 		imageRef    string
 		toResolve   map[string]string
+		expected    map[string]string
 		expectedErr error
 	}{
 		"successfully resolve package versions": {
-			imageRef:  "docker.io/library/debian:latest",
+			imageRef:  "docker.io/library/debian:bookworm-20240211",
 			toResolve: map[string]string{"curl": "*"},
+			expected:  map[string]string{"curl": "7.88.1-10+deb12u5"},
 		},
 		"fail to resolve version of unknown package": {
-			imageRef:    "docker.io/library/debian:latest",
+			imageRef:    "docker.io/library/debian:bookworm-20240211",
 			toResolve:   map[string]string{"yolo": "*"},
 			expectedErr: errors.New("packages yolo not found"),
 		},
 	}
 
-	c := newDockerClient(t)
+	solver := llbtest.LoadFixtures(t, "testdata/apt.fixtures.json")
+	// Package lists are fetched from a snapshot such that fixtures recorded
+	// at different times resolve the same versions.
+	snapshot := llbutils.DebianSnapshot{
+		Timestamp: "20240211T000000Z",
+		Suite:     "bookworm",
+	}
 
 	for tcname := range testcases {
 		tc := testcases[tcname]
@@ -36,13 +50,186 @@ func TestAPTResolveVersions(t *testing.T) {
 			t.Parallel()
 
 			ctx := context.Background()
-			solver := statesolver.LocalSolver{
-				Client:  c,
-				Labels:  map[string]string{},
-				RootDir: "testdata",
+			pkgSolver := pkgsolver.NewAPTSolver(solver)
+			pkgSolver.WithSnapshot(snapshot)
+			resolved, err := pkgSolver.ResolveVersions(ctx, tc.imageRef, tc.toResolve)
+
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if diff := deep.Equal(resolved, tc.expected); diff != nil {
+				t.Fatal(diff)
 			}
+		})
+	}
+}
+
+func TestAPTResolveVersionsFromDebianSnapshot(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	snapshot := llbutils.DebianSnapshot{
+		BaseURL:   "http://snapshot.local",
+		Timestamp: "20200509T083854Z",
+		Suite:     "buster",
+	}
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/debian:buster", []string{
+		snapshot.WriteSourcesListCmd(),
+		"apt-get " + snapshot.APTOptions() + " update 1>/dev/null 2>&1",
+		"apt-cache " + snapshot.APTOptions() + " madison curl git unzip",
+	}).Return(bytes.NewBufferString(
+		"      curl | 7.64.0-4+deb10u1 | http://snapshot.local/archive/debian/20200509T083854Z buster/main amd64 Packages\n"+
+			"       git | 1:2.20.1-2+deb10u3 | http://snapshot.local/archive/debian/20200509T083854Z buster/main amd64 Packages\n"+
+			"     unzip | 6.0-23+deb10u1 | http://snapshot.local/archive/debian/20200509T083854Z buster/main amd64 Packages\n",
+	), nil)
+
+	pkgSolver := pkgsolver.NewAPTSolver(solver)
+	pkgSolver.WithSnapshot(snapshot)
+
+	ctx := context.Background()
+	resolved, err := pkgSolver.ResolveVersions(ctx, "docker.io/library/debian:buster",
+		map[string]string{"curl": "*", "git": "*", "unzip": "6.0-23+deb10u1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"curl":  "7.64.0-4+deb10u1",
+		"git":   "1:2.20.1-2+deb10u3",
+		"unzip": "6.0-23+deb10u1",
+	}
+	if diff := deep.Equal(resolved, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestLockDebianSnapshot(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	debian := builddef.OSRelease{Name: "debian", VersionName: "buster", VersionID: "10"}
+	alpine := builddef.OSRelease{Name: "alpine", VersionID: "3.11.2"}
+	opts := builddef.UpdateLocksOpts{
+		BuildOpts:    &builddef.BuildOpts{},
+		SnapshotTime: time.Date(2020, 5, 9, 10, 38, 54, 0, time.FixedZone("CEST", 2*3600)),
+	}
+
+	aptSolver := pkgsolver.NewAPTSolver(mocks.NewMockStateSolver(mockCtrl))
+	if timestamp := pkgsolver.LockDebianSnapshot(aptSolver, debian, opts); timestamp != "20200509T083854Z" {
+		t.Fatalf("Expected timestamp: 20200509T083854Z\nGot: %s", timestamp)
+	}
+
+	if timestamp := pkgsolver.LockDebianSnapshot(aptSolver, alpine, opts); timestamp != "" {
+		t.Fatalf("Expected no timestamp for alpine\nGot: %s", timestamp)
+	}
+
+	mockSolver := mocks.NewMockPackageSolver(mockCtrl)
+	if timestamp := pkgsolver.LockDebianSnapshot(mockSolver, debian, opts); timestamp != "" {
+		t.Fatalf("Expected no timestamp for solvers not supporting snapshots\nGot: %s", timestamp)
+	}
+}
+
+const rawAPTCacheMadison = `      curl | 7.74.0-1.3+deb11u1 | http://deb.debian.org/debian bullseye/main amd64 Packages
+      curl | 7.68.0-1 | http://deb.debian.org/debian bullseye/main amd64 Packages
+      curl | 7.68.0~rc1-1 | http://deb.debian.org/debian bullseye/main amd64 Packages
+      curl | 7.64.0-4+deb10u1 | http://deb.debian.org/debian buster/main amd64 Packages
+      curl | 7.64.0-4 | http://deb.debian.org/debian buster/main amd64 Packages
+       git | 1:2.20.1-2+deb10u3 | http://deb.debian.org/debian buster/main amd64 Packages
+       git | 1:2.11.0-3+deb9u7 | http://deb.debian.org/debian stretch/main amd64 Packages
+`
+
+func TestAPTResolveVersionConstraints(t *testing.T) {
+	testcases := map[string]struct {
+		constraints map[string]string
+		expected    map[string]string
+		expectedErr error
+	}{
+		"resolve wildcard constraints": {
+			constraints: map[string]string{"curl": "*", "git": ""},
+			expected: map[string]string{
+				"curl": "7.74.0-1.3+deb11u1",
+				"git":  "1:2.20.1-2+deb10u3",
+			},
+		},
+		"resolve range constraints": {
+			constraints: map[string]string{"curl": ">=7.64 <7.70", "git": "<1:2.20"},
+			expected: map[string]string{
+				"curl": "7.68.0-1",
+				"git":  "1:2.11.0-3+deb9u7",
+			},
+		},
+		"resolve tilde constraints": {
+			constraints: map[string]string{"curl": "~7.64.0", "git": "~1:2.11"},
+			expected: map[string]string{
+				"curl": "7.64.0-4+deb10u1",
+				"git":  "1:2.20.1-2+deb10u3",
+			},
+		},
+		"resolve prefix constraints": {
+			constraints: map[string]string{"curl": "7.68.*", "git": "1:2.*"},
+			expected: map[string]string{
+				"curl": "7.68.0-1",
+				"git":  "1:2.20.1-2+deb10u3",
+			},
+		},
+		"resolve prefix constraints with epochs": {
+			constraints: map[string]string{"curl": "0:7.64.*", "git": "1:2.11.*"},
+			expected: map[string]string{
+				"curl": "7.64.0-4+deb10u1",
+				"git":  "1:2.11.0-3+deb9u7",
+			},
+		},
+		"fail when the epoch of a prefix constraint doesn't match": {
+			constraints: map[string]string{"curl": "*", "git": "2.*"},
+			expectedErr: errors.New("no version of package git matches \"2.*\" (available versions: 1:2.20.1-2+deb10u3, 1:2.11.0-3+deb9u7)"),
+		},
+		"resolve pinned versions": {
+			constraints: map[string]string{"curl": "7.68.0~rc1-1", "git": "=1:2.11.0-3+deb9u7"},
+			expected: map[string]string{
+				"curl": "7.68.0~rc1-1",
+				"git":  "1:2.11.0-3+deb9u7",
+			},
+		},
+		"fail when a pinned version is not available anymore": {
+			constraints: map[string]string{"curl": "7.52.1-5+deb9u9", "git": "*"},
+			expectedErr: errors.New("version 7.52.1-5+deb9u9 of package curl is not available (available versions: 7.74.0-1.3+deb11u1, 7.68.0-1, 7.68.0~rc1-1, 7.64.0-4+deb10u1, 7.64.0-4)"),
+		},
+		"fail when no version matches a constraint": {
+			constraints: map[string]string{"curl": "*", "git": ">=1:3"},
+			expectedErr: errors.New("no version of package git matches \">=1:3\" (available versions: 1:2.20.1-2+deb10u3, 1:2.11.0-3+deb9u7)"),
+		},
+		"fail when a constraint is invalid": {
+			constraints: map[string]string{"curl": "~foo", "git": "*"},
+			expectedErr: errors.New("invalid version constraint \"~foo\" for package curl: unsupported tilde constraint ~foo"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			solver := mocks.NewMockStateSolver(mockCtrl)
+			solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/debian:bullseye", []string{
+				"apt-get update 1>/dev/null 2>&1",
+				"apt-cache madison curl git",
+			}).Return(bytes.NewBufferString(rawAPTCacheMadison), nil)
+
+			ctx := context.Background()
 			pkgSolver := pkgsolver.NewAPTSolver(solver)
-			_, err := pkgSolver.ResolveVersions(ctx, tc.imageRef, tc.toResolve)
+			resolved, err := pkgSolver.ResolveVersions(ctx, "docker.io/library/debian:bullseye", tc.constraints)
 
 			if tc.expectedErr != nil {
 				if err == nil || err.Error() != tc.expectedErr.Error() {
@@ -53,16 +240,63 @@ func TestAPTResolveVersions(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Unexpected error: %v", err)
 			}
+
+			if diff := deep.Equal(resolved, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
 		})
 	}
 }
 
-func newDockerClient(t *testing.T) *client.Client {
-	c, err := client.NewClientWithOpts(client.FromEnv)
+func TestAPTResolveClosure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	gomock.InOrder(
+		solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/debian:bullseye", []string{
+			"apt-get update 1>/dev/null 2>&1",
+			"apt-cache madison curl git",
+		}).Return(bytes.NewBufferString(rawAPTCacheMadison), nil),
+		solver.EXPECT().ExecImage(gomock.Any(), "docker.io/library/debian:bullseye", []string{
+			"apt-get update 1>/dev/null 2>&1",
+			"echo '### zbuild closure'",
+			"apt-get install --simulate --no-install-recommends curl=7.68.0-1 git=1:2.20.1-2+deb10u3",
+		}).Return(bytes.NewBufferString(`### zbuild closure
+Reading package lists...
+Building dependency tree...
+The following NEW packages will be installed:
+  curl git git-man libcurl4 libssl1.1
+Inst libssl1.1 [1.1.1d-0+deb10u2] (1.1.1d-0+deb10u3 Debian:10.4/stable [amd64])
+Inst libcurl4 (7.68.0-1 Debian:10.4/stable [amd64])
+Inst curl (7.68.0-1 Debian:10.4/stable [amd64])
+Inst git-man (1:2.20.1-2+deb10u3 Debian-Security:10/stable [all])
+Inst git (1:2.20.1-2+deb10u3 Debian-Security:10/stable [amd64])
+Conf libssl1.1 (1.1.1d-0+deb10u3 Debian:10.4/stable [amd64])
+Conf libcurl4 (7.68.0-1 Debian:10.4/stable [amd64])
+Conf curl (7.68.0-1 Debian:10.4/stable [amd64])
+Conf git-man (1:2.20.1-2+deb10u3 Debian-Security:10/stable [all])
+Conf git (1:2.20.1-2+deb10u3 Debian-Security:10/stable [amd64])
+`), nil),
+	)
+
+	ctx := context.Background()
+	pkgSolver := pkgsolver.NewAPTSolver(solver)
+	resolved, err := pkgsolver.Resolve(ctx, pkgSolver, "docker.io/library/debian:bullseye",
+		map[string]string{"curl": "7.68.*", "git": "*"},
+		builddef.UpdateLocksOpts{LockPackageDependencies: true})
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	c.NegotiateAPIVersion(context.TODO())
-	return c
+	expected := map[string]string{
+		"curl":      "7.68.0-1",
+		"git":       "1:2.20.1-2+deb10u3",
+		"git-man":   "1:2.20.1-2+deb10u3",
+		"libcurl4":  "7.68.0-1",
+		"libssl1.1": "1.1.1d-0+deb10u3",
+	}
+	if diff := deep.Equal(resolved, expected); diff != nil {
+		t.Fatal(diff)
+	}
 }
@@ -0,0 +1,167 @@
+package pkgsolver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// CachingPackageSolversMap returns a PackageSolversMap wrapping the
+// PackageSolvers created by pkgSolvers with a CachingSolver.
+func CachingPackageSolversMap(pkgSolvers PackageSolversMap, cache *lockcache.Cache) PackageSolversMap {
+	caching := make(PackageSolversMap, len(pkgSolvers))
+	for solverType, factory := range pkgSolvers {
+		factory := factory
+		caching[solverType] = func(solver statesolver.StateSolver) PackageSolver {
+			return NewCachingSolver(factory(solver), cache)
+		}
+	}
+	return caching
+}
+
+// CachingSolver is a PackageSolver storing the versions resolved by the
+// wrapped PackageSolver in a lockcache.Cache, such that they're reused
+// across zbuild update runs. Cached versions are keyed by the image
+// reference and the packages (and their constraint) to resolve.
+//
+// When a Debian snapshot is used, its timestamp is part of the cache key. As
+// zbuild update uses the current time by default, the timestamp of the first
+// snapshot used is cached too and reused by subsequent runs, until the cache
+// TTL expires. That way, cached versions are locked along with the snapshot
+// they were resolved from.
+type CachingSolver struct {
+	solver   PackageSolver
+	cache    *lockcache.Cache
+	snapshot *llbutils.DebianSnapshot
+}
+
+// NewCachingSolver returns a CachingSolver wrapping the given PackageSolver.
+func NewCachingSolver(solver PackageSolver, cache *lockcache.Cache) *CachingSolver {
+	return &CachingSolver{
+		solver: solver,
+		cache:  cache,
+	}
+}
+
+// WithSnapshot configures the wrapped PackageSolver to use the given Debian
+// snapshot, if it supports snapshots. When a snapshot of the same archive
+// and suite older than the given one has been cached, that cached snapshot
+// is used instead. It returns the snapshot used.
+func (s *CachingSolver) WithSnapshot(snapshot llbutils.DebianSnapshot) llbutils.DebianSnapshot {
+	snapshotSolver, ok := s.solver.(SnapshotSolver)
+	if !ok {
+		return snapshot
+	}
+
+	key := lockcache.Key("debian-snapshot", snapshot.BaseURL, snapshot.Suite)
+	var cached string
+	if s.cache.Get(key, &cached) && cached < snapshot.Timestamp {
+		logrus.Debugf("Using cached Debian snapshot %s.", cached)
+		snapshot.Timestamp = cached
+	} else if err := s.cache.Set(key, snapshot.Timestamp); err != nil {
+		logrus.Warnf("Could not write to lock cache: %v", err)
+	}
+
+	snapshot = snapshotSolver.WithSnapshot(snapshot)
+	s.snapshot = &snapshot
+	return snapshot
+}
+
+func (s *CachingSolver) ResolveVersions(
+	ctx context.Context,
+	imageRef string,
+	pkgs map[string]string,
+) (map[string]string, error) {
+	resolved, err := s.ResolveStagesVersions(ctx, imageRef, map[string]map[string]string{"": pkgs})
+	if err != nil {
+		return nil, err
+	}
+	return resolved[""], nil
+}
+
+// ResolveStagesVersions resolves the packages of the given stages from the
+// cache when possible. The other stages are resolved at once with the
+// wrapped PackageSolver (see ResolveStages).
+func (s *CachingSolver) ResolveStagesVersions(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return s.resolve(ctx, "versions", imageRef, stages, func(
+		ctx context.Context,
+		imageRef string,
+		stages map[string]map[string]string,
+	) (map[string]map[string]string, error) {
+		if stagesSolver, ok := s.solver.(StagesSolver); ok {
+			return stagesSolver.ResolveStagesVersions(ctx, imageRef, stages)
+		}
+		return resolveEachStage(ctx, s.solver, imageRef, stages)
+	})
+}
+
+// ResolveDependencies resolves the dependency closure of the packages of the
+// given stages with the wrapped PackageSolver, unless they're cached. It
+// returns an error if the wrapped PackageSolver doesn't support it.
+func (s *CachingSolver) ResolveDependencies(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	closureSolver, ok := s.solver.(ClosureSolver)
+	if !ok {
+		return nil, xerrors.Errorf("package solver %T doesn't support locking package dependencies", s.solver)
+	}
+	return s.resolve(ctx, "dependencies", imageRef, stages, closureSolver.ResolveDependencies)
+}
+
+// resolve reads the packages resolved for each of the given stages from the
+// cache. The stages not cached yet are resolved with a single call to
+// resolveFn, and then cached.
+func (s *CachingSolver) resolve(
+	ctx context.Context,
+	query string,
+	imageRef string,
+	stages map[string]map[string]string,
+	resolveFn func(context.Context, string, map[string]map[string]string) (map[string]map[string]string, error),
+) (map[string]map[string]string, error) {
+	res := make(map[string]map[string]string, len(stages))
+	missing := map[string]map[string]string{}
+	for stage, pkgs := range stages {
+		var resolved map[string]string
+		if s.cache.Get(s.cacheKey(query, imageRef, pkgs), &resolved) {
+			logrus.Debugf("Using cached package %s resolved in %q.", query, imageRef)
+			res[stage] = resolved
+			continue
+		}
+		missing[stage] = pkgs
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	resolved, err := resolveFn(ctx, imageRef, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for stage, pkgs := range missing {
+		res[stage] = resolved[stage]
+		if err := s.cache.Set(s.cacheKey(query, imageRef, pkgs), resolved[stage]); err != nil {
+			logrus.Warnf("Could not write to lock cache: %v", err)
+		}
+	}
+	return res, nil
+}
+
+func (s *CachingSolver) cacheKey(query, imageRef string, pkgs map[string]string) string {
+	parts := []string{"packages", query, fmt.Sprintf("%T", s.solver), imageRef}
+	if s.snapshot != nil {
+		parts = append(parts, s.snapshot.BaseURL, s.snapshot.Suite, s.snapshot.Timestamp)
+	}
+	return lockcache.Key(append(parts, packageSpecs(pkgs)...)...)
+}
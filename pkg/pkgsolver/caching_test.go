@@ -0,0 +1,221 @@
+package pkgsolver_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+)
+
+func TestCachingSolver(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dir, err := ioutil.TempDir("", "zbuild-lockcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imageRef := "docker.io/library/debian:buster@sha256:4ab3309ba955211d1db92f405be609942b595a720de789286376f030502977d6"
+	inner := mocks.NewMockPackageSolver(mockCtrl)
+	inner.EXPECT().ResolveVersions(gomock.Any(), imageRef, map[string]string{
+		"curl": "*",
+	}).Times(1).Return(map[string]string{
+		"curl": "7.64.0-4+deb10u1",
+	}, nil)
+	inner.EXPECT().ResolveVersions(gomock.Any(), imageRef, map[string]string{
+		"curl": "7.64.*",
+	}).Times(1).Return(map[string]string{
+		"curl": "7.64.0-4+deb10u1",
+	}, nil)
+
+	pkgSolvers := pkgsolver.CachingPackageSolversMap(pkgsolver.PackageSolversMap{
+		pkgsolver.APT: func(_ statesolver.StateSolver) pkgsolver.PackageSolver {
+			return inner
+		},
+	}, &lockcache.Cache{Dir: dir})
+
+	ctx := context.Background()
+	expected := map[string]string{"curl": "7.64.0-4+deb10u1"}
+
+	for _, constraint := range []string{"*", "*", "7.64.*", "7.64.*"} {
+		// A new PackageSolver is created for each run, like zbuild update
+		// does, to ensure cached versions are read back from the disk.
+		pkgSolver := pkgSolvers.New(pkgsolver.APT, nil)
+		resolved, err := pkgsolver.Resolve(ctx, pkgSolver, imageRef,
+			map[string]string{"curl": constraint}, builddef.UpdateLocksOpts{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if diff := deep.Equal(resolved, expected); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+}
+
+func TestCachingSolverResolvesUncachedStagesAtOnce(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dir, err := ioutil.TempDir("", "zbuild-lockcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imageRef := "docker.io/library/alpine:3.12"
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	gomock.InOrder(
+		solver.EXPECT().ExecImage(gomock.Any(), imageRef, []string{
+			"apk --no-cache info --description openssl",
+		}).Times(1).Return(bytes.NewBufferString(rawAPKInfo), nil),
+		solver.EXPECT().ExecImage(gomock.Any(), imageRef, []string{
+			"apk --no-cache info --description openssl sqlite",
+		}).Times(1).Return(bytes.NewBufferString(rawAPKInfo), nil),
+	)
+
+	cache := &lockcache.Cache{Dir: dir}
+	ctx := context.Background()
+	_, err = pkgsolver.ResolveStages(ctx,
+		pkgsolver.NewCachingSolver(pkgsolver.NewAPKSolver(solver), cache), imageRef,
+		map[string]map[string]string{
+			"dev": {"openssl": "<1.1.1e"},
+		}, builddef.UpdateLocksOpts{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Only the stages that aren't cached are resolved by the wrapped solver.
+	resolved, err := pkgsolver.ResolveStages(ctx,
+		pkgsolver.NewCachingSolver(pkgsolver.NewAPKSolver(solver), cache), imageRef,
+		map[string]map[string]string{
+			"dev":  {"openssl": "<1.1.1e"},
+			"prod": {"openssl": ">=1.1.1e"},
+			"test": {"sqlite": "*"},
+		}, builddef.UpdateLocksOpts{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]map[string]string{
+		"dev":  {"openssl": "1.1.1d-r3"},
+		"prod": {"openssl": "1.1.1g-r0"},
+		"test": {"sqlite": "3.32.1-r0"},
+	}
+	if diff := deep.Equal(resolved, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestCachingSolverDoesNotLockDependenciesWhenUnsupported(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	pkgSolver := pkgsolver.NewCachingSolver(
+		pkgsolver.NewAPTIndexSolver(solver, pkgsolver.IndexOpts{}), nil)
+
+	ctx := context.Background()
+	_, err := pkgSolver.ResolveDependencies(ctx, "docker.io/library/debian:buster",
+		map[string]map[string]string{"": {"curl": "7.64.0-4+deb10u1"}})
+
+	expectedErr := "package solver *pkgsolver.APTIndexSolver doesn't support locking package dependencies"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected: %v\nGot: %v", expectedErr, err)
+	}
+}
+
+// snapshotPackageSolver is a PackageSolver supporting Debian snapshots, which
+// records the snapshot used.
+type snapshotPackageSolver struct {
+	*mocks.MockPackageSolver
+	snapshot llbutils.DebianSnapshot
+}
+
+func (s *snapshotPackageSolver) WithSnapshot(snapshot llbutils.DebianSnapshot) llbutils.DebianSnapshot {
+	s.snapshot = snapshot
+	return snapshot
+}
+
+func TestCachingSolverLocksCachedSnapshot(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dir, err := ioutil.TempDir("", "zbuild-lockcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imageRef := "docker.io/library/debian:buster"
+	debian := builddef.OSRelease{Name: "debian", VersionName: "buster", VersionID: "10"}
+	inner := &snapshotPackageSolver{MockPackageSolver: mocks.NewMockPackageSolver(mockCtrl)}
+	inner.EXPECT().ResolveVersions(gomock.Any(), imageRef, map[string]string{
+		"curl": "*",
+	}).Times(2).Return(map[string]string{
+		"curl": "7.64.0-4+deb10u1",
+	}, nil)
+
+	pkgSolvers := pkgsolver.CachingPackageSolversMap(pkgsolver.PackageSolversMap{
+		pkgsolver.APT: func(_ statesolver.StateSolver) pkgsolver.PackageSolver {
+			return inner
+		},
+	}, &lockcache.Cache{Dir: dir})
+
+	testcases := []struct {
+		snapshotTime      time.Time
+		expectedTimestamp string
+	}{
+		{
+			snapshotTime:      time.Date(2020, 5, 9, 10, 0, 0, 0, time.UTC),
+			expectedTimestamp: "20200509T100000Z",
+		},
+		// A more recent snapshot time reuses the cached snapshot and the
+		// versions resolved from it.
+		{
+			snapshotTime:      time.Date(2020, 5, 10, 10, 0, 0, 0, time.UTC),
+			expectedTimestamp: "20200509T100000Z",
+		},
+		// An older snapshot time isn't replaced, so versions are resolved
+		// again from that snapshot.
+		{
+			snapshotTime:      time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+			expectedTimestamp: "20200501T100000Z",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tc := range testcases {
+		pkgSolver := pkgSolvers.New(pkgsolver.APT, nil)
+		opts := builddef.UpdateLocksOpts{
+			BuildOpts:    &builddef.BuildOpts{},
+			SnapshotTime: tc.snapshotTime,
+		}
+
+		timestamp := pkgsolver.LockDebianSnapshot(pkgSolver, debian, opts)
+		if timestamp != tc.expectedTimestamp {
+			t.Fatalf("Expected timestamp: %s\nGot: %s", tc.expectedTimestamp, timestamp)
+		}
+		if inner.snapshot.Timestamp != tc.expectedTimestamp {
+			t.Fatalf("Expected inner solver to use snapshot %s\nGot: %s",
+				tc.expectedTimestamp, inner.snapshot.Timestamp)
+		}
+
+		if _, err := pkgsolver.Resolve(ctx, pkgSolver, imageRef,
+			map[string]string{"curl": "*"}, opts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
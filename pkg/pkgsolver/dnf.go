@@ -0,0 +1,67 @@
+package pkgsolver
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/NiR-/zbuild/pkg/statesolver"
+)
+
+type DNFSolver struct {
+	solver statesolver.StateSolver
+}
+
+func NewDNFSolver(solver statesolver.StateSolver) PackageSolver {
+	return &DNFSolver{
+		solver: solver,
+	}
+}
+
+func (s *DNFSolver) ResolveVersions(
+	ctx context.Context,
+	imageRef string,
+	pkgs map[string]string,
+) (map[string]string, error) {
+	resolved, err := s.ResolveStagesVersions(ctx, imageRef, map[string]map[string]string{"": pkgs})
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return resolved[""], nil
+}
+
+// ResolveStagesVersions lists the versions available for the packages of all
+// the given stages with a single dnf command and then resolves each stage on
+// its own.
+func (s *DNFSolver) ResolveStagesVersions(
+	ctx context.Context,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	return resolveStagesFromCandidates(stages, func(names []string) (map[string][]string, error) {
+		outbuf, err := s.solver.ExecImage(ctx, imageRef, []string{
+			"dnf repoquery --quiet --available --showduplicates --queryformat '%{name} %{evr}' " +
+				strings.Join(names, " "),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return parseDNFRepoquery(outbuf), nil
+	}, compareRPMVersions)
+}
+
+// parseDNFRepoquery returns the list of versions available for each package
+// listed in the output of dnf repoquery (formatted as "<name> <evr>").
+func parseDNFRepoquery(buf *bytes.Buffer) map[string][]string {
+	res := map[string][]string{}
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		res[fields[0]] = appendVersion(res[fields[0]], fields[1])
+	}
+
+	return res
+}
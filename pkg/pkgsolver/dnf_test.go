@@ -0,0 +1,96 @@
+package pkgsolver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+)
+
+const rawDNFRepoquery = `curl 7.61.1-8.el8
+curl 7.61.1-11.el8
+curl 7.61.1-12.el8
+curl 7.61.1-12.el8
+git 2.18.2-2.el8_1
+git 2.18.4-2.el8_2
+git 2.27.0-1.el8
+tzdata 2020a-1.el8
+tzdata 2020d-1.el8
+`
+
+func TestDNFResolveVersions(t *testing.T) {
+	testcases := map[string]struct {
+		constraints map[string]string
+		expected    map[string]string
+		expectedErr error
+	}{
+		"resolve wildcard constraints": {
+			constraints: map[string]string{"curl": "*", "git": "*", "tzdata": "*"},
+			expected: map[string]string{
+				"curl":   "7.61.1-12.el8",
+				"git":    "2.27.0-1.el8",
+				"tzdata": "2020d-1.el8",
+			},
+		},
+		"resolve range constraints": {
+			constraints: map[string]string{"curl": "<7.61.1-12", "git": "~2.18.0", "tzdata": "2020a-1.el8"},
+			expected: map[string]string{
+				"curl":   "7.61.1-11.el8",
+				"git":    "2.18.4-2.el8_2",
+				"tzdata": "2020a-1.el8",
+			},
+		},
+		"fail when a pinned version is not available anymore": {
+			constraints: map[string]string{"curl": "7.61.1-5.el8", "git": "*", "tzdata": "*"},
+			expectedErr: errors.New("version 7.61.1-5.el8 of package curl is not available (available versions: 7.61.1-8.el8, 7.61.1-11.el8, 7.61.1-12.el8)"),
+		},
+		"fail to resolve version of unknown package": {
+			constraints: map[string]string{"curl": "*", "git": "*", "yolo": "*"},
+			expectedErr: errors.New("packages yolo not found"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			pkgNames := "curl git tzdata"
+			if _, ok := tc.constraints["yolo"]; ok {
+				pkgNames = "curl git yolo"
+			}
+
+			solver := mocks.NewMockStateSolver(mockCtrl)
+			solver.EXPECT().ExecImage(gomock.Any(), "registry.access.redhat.com/ubi8/ubi:8.2", []string{
+				"dnf repoquery --quiet --available --showduplicates --queryformat '%{name} %{evr}' " + pkgNames,
+			}).Return(bytes.NewBufferString(rawDNFRepoquery), nil)
+
+			ctx := context.Background()
+			pkgSolver := pkgsolver.NewDNFSolver(solver)
+			resolved, err := pkgSolver.ResolveVersions(ctx, "registry.access.redhat.com/ubi8/ubi:8.2", tc.constraints)
+
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if diff := deep.Equal(resolved, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
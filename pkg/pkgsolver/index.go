@@ -0,0 +1,181 @@
+package pkgsolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"golang.org/x/xerrors"
+)
+
+// DefaultIndexCacheTTL is how long downloaded repository indexes are reused
+// when IndexOpts.CacheTTL isn't set.
+const DefaultIndexCacheTTL = time.Hour
+
+// IndexOpts configures PackageSolvers resolving package versions from the
+// indexes of the repositories configured in images (see NewAPTIndexSolver
+// and NewAPKIndexSolver).
+type IndexOpts struct {
+	// HTTPClient is used to download indexes. http.DefaultClient is used
+	// when it's nil.
+	HTTPClient *http.Client
+	// BaseURL replaces the scheme and the host of the repositories
+	// configured in images (e.g. to use a local mirror). Repository paths are
+	// kept as is.
+	BaseURL string
+	// CacheDir is the directory where downloaded indexes are stored. Indexes
+	// aren't cached when it's empty.
+	CacheDir string
+	// CacheTTL is how long cached indexes are reused. DefaultIndexCacheTTL is
+	// used when it's zero.
+	CacheTTL time.Duration
+	// Refresh indicates whether indexes should be downloaded again instead
+	// of reusing cached ones. Downloaded indexes are still cached.
+	Refresh bool
+}
+
+// DefaultIndexCacheDir returns the directory used to cache repository
+// indexes by default, or an empty string if the user cache dir can't be
+// determined.
+func DefaultIndexCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "zbuild", "indexes")
+}
+
+// IndexPackageSolversMap returns a PackageSolversMap of PackageSolvers
+// resolving package versions from repository indexes instead of running
+// containers.
+func IndexPackageSolversMap(opts IndexOpts) PackageSolversMap {
+	return PackageSolversMap{
+		APT: func(solver statesolver.StateSolver) PackageSolver {
+			return NewAPTIndexSolver(solver, opts)
+		},
+		APK: func(solver statesolver.StateSolver) PackageSolver {
+			return NewAPKIndexSolver(solver, opts)
+		},
+		// Indexes of RPM repositories aren't supported yet.
+		DNF: DefaultPackageSolversMap[DNF],
+	}
+}
+
+type indexFetcher struct {
+	client   *http.Client
+	baseURL  string
+	cacheDir string
+	cacheTTL time.Duration
+	refresh  bool
+}
+
+func newIndexFetcher(opts IndexOpts) indexFetcher {
+	f := indexFetcher{
+		client:   opts.HTTPClient,
+		baseURL:  strings.TrimSuffix(opts.BaseURL, "/"),
+		cacheDir: opts.CacheDir,
+		cacheTTL: opts.CacheTTL,
+		refresh:  opts.Refresh,
+	}
+	if f.client == nil {
+		f.client = http.DefaultClient
+	}
+	if f.cacheTTL == 0 {
+		f.cacheTTL = DefaultIndexCacheTTL
+	}
+	return f
+}
+
+// repositoryURL returns the URL of the given repository, rewritten to use
+// the configured base URL if any.
+func (f indexFetcher) repositoryURL(repo string) (string, error) {
+	repo = strings.TrimSuffix(repo, "/")
+	if f.baseURL == "" {
+		return repo, nil
+	}
+
+	u, err := url.Parse(repo)
+	if err != nil {
+		return "", xerrors.Errorf("invalid repository URL %q: %w", repo, err)
+	}
+	return f.baseURL + u.Path, nil
+}
+
+// fetch downloads the given URL or returns its cached content if it has
+// been downloaded for less than the cache TTL, unless refresh is set.
+func (f indexFetcher) fetch(ctx context.Context, url string) ([]byte, error) {
+	cachePath := f.cachePath(url)
+	if cachePath != "" && !f.refresh {
+		if stat, err := os.Stat(cachePath); err == nil && time.Since(stat.ModTime()) < f.cacheTTL {
+			return ioutil.ReadFile(cachePath)
+		}
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, xerrors.Errorf("could not download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("could not download %s: unexpected status code %d",
+			url, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("could not download %s: %w", url, err)
+	}
+
+	if cachePath != "" {
+		err := lockcache.WriteFileAtomic(cachePath, func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("could not cache %s: %w", url, err)
+		}
+	}
+
+	return content, nil
+}
+
+func (f indexFetcher) cachePath(url string) string {
+	if f.cacheDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(f.cacheDir, hex.EncodeToString(sum[:]))
+}
+
+// readImageFile reads the given file from an image. It returns a nil slice
+// and no error when the file doesn't exist.
+func readImageFile(
+	ctx context.Context,
+	solver statesolver.StateSolver,
+	imageRef string,
+	path string,
+) ([]byte, error) {
+	raw, err := solver.ReadFile(ctx, path, solver.FromImage(imageRef))
+	if xerrors.Is(err, statesolver.FileNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, xerrors.Errorf("could not read %s from %s: %w", path, imageRef, err)
+	}
+	return raw, nil
+}
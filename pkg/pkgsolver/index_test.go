@@ -0,0 +1,196 @@
+package pkgsolver_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+)
+
+// newIndexServer starts an HTTP server serving the repository indexes found
+// in testdata/indexes. Indexes are stored uncompressed and get compressed on
+// the fly. It returns the server and a pointer to the number of requests it
+// handled.
+func newIndexServer(t *testing.T) (*httptest.Server, *int32) {
+	var hits int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		fpath := path.Join("testdata/indexes", strings.TrimSuffix(r.URL.Path, ".gz"))
+		if strings.HasSuffix(fpath, "APKINDEX.tar") {
+			fpath = strings.TrimSuffix(fpath, ".tar")
+		}
+
+		raw, err := ioutil.ReadFile(fpath)
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		gzw := gzip.NewWriter(w)
+		defer gzw.Close()
+
+		if !strings.HasSuffix(r.URL.Path, "APKINDEX.tar.gz") {
+			gzw.Write(raw) //nolint:errcheck
+			return
+		}
+
+		tw := tar.NewWriter(gzw)
+		defer tw.Close()
+
+		tw.WriteHeader(&tar.Header{ //nolint:errcheck
+			Name: "APKINDEX",
+			Mode: 0644,
+			Size: int64(len(raw)),
+		})
+		tw.Write(raw) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &hits
+}
+
+// imageFilesSolver is a StateSolver serving the given files from an image.
+type imageFilesSolver struct {
+	*mocks.MockStateSolver
+	files map[string]string
+}
+
+func newImageFilesSolver(
+	mockCtrl *gomock.Controller,
+	imageRef string,
+	files map[string]string,
+) imageFilesSolver {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().FromImage(imageRef).AnyTimes()
+	solver.EXPECT().ReadFile(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, filepath string, _ statesolver.ReadFileOpt) ([]byte, error) {
+			content, ok := files[filepath]
+			if !ok {
+				return nil, statesolver.FileNotFound
+			}
+			return []byte(content), nil
+		}).AnyTimes()
+
+	return imageFilesSolver{
+		MockStateSolver: solver,
+		files:           files,
+	}
+}
+
+// ReadImageDir implements statesolver.ImageDirSolver.
+func (s imageFilesSolver) ReadImageDir(_ context.Context, _, dirpath string) ([]string, error) {
+	names := []string{}
+	for filepath := range s.files {
+		if path.Dir(filepath) == dirpath {
+			names = append(names, path.Base(filepath))
+		}
+	}
+	if len(names) == 0 {
+		return nil, statesolver.FileNotFound
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func TestIndexSolverCachesIndexes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	srv, hits := newIndexServer(t)
+	solver := newImageFilesSolver(mockCtrl, "docker.io/library/alpine:3.12", map[string]string{
+		"/etc/apk/repositories": "http://dl-cdn.alpinelinux.org/alpine/v3.12/main\n",
+	})
+
+	cacheDir, err := ioutil.TempDir("", "zbuild-indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	opts := pkgsolver.IndexOpts{
+		BaseURL:  srv.URL,
+		CacheDir: cacheDir,
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		pkgSolver := pkgsolver.NewAPKIndexSolver(solver, opts)
+		resolved, err := pkgSolver.ResolveVersions(ctx, "docker.io/library/alpine:3.12",
+			map[string]string{"curl": "*"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if diff := deep.Equal(resolved, map[string]string{"curl": "7.69.1-r1"}); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+
+	if *hits != 1 {
+		t.Fatalf("Expected the index to be downloaded once, got %d downloads.", *hits)
+	}
+
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 1 {
+		t.Fatalf("Expected 1 cached index, got: %v", cached)
+	}
+}
+
+func TestIndexSolverRefreshesCachedIndexes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	srv, hits := newIndexServer(t)
+	solver := newImageFilesSolver(mockCtrl, "docker.io/library/alpine:3.12", map[string]string{
+		"/etc/apk/repositories": "http://dl-cdn.alpinelinux.org/alpine/v3.12/main\n",
+	})
+
+	cacheDir, err := ioutil.TempDir("", "zbuild-indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+	for _, refresh := range []bool{false, true} {
+		pkgSolver := pkgsolver.NewAPKIndexSolver(solver, pkgsolver.IndexOpts{
+			BaseURL:  srv.URL,
+			CacheDir: cacheDir,
+			Refresh:  refresh,
+		})
+		_, err := pkgSolver.ResolveVersions(ctx, "docker.io/library/alpine:3.12",
+			map[string]string{"curl": "*"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if *hits != 2 {
+		t.Fatalf("Expected the index to be downloaded again, got %d downloads.", *hits)
+	}
+}
@@ -1,10 +1,15 @@
 package pkgsolver
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"golang.org/x/xerrors"
 )
@@ -27,11 +32,328 @@ type PackageSolver interface {
 	ResolveVersions(ctx context.Context, imageRef string, pkgs map[string]string) (map[string]string, error)
 }
 
+// StagesSolver is implemented by PackageSolvers able to resolve the packages
+// of several stages at once, such that the versions available are looked up
+// only once for all the stages.
+type StagesSolver interface {
+	PackageSolver
+	// ResolveStagesVersions takes a map of stage names associated to their
+	// packages and version constraints. It returns the packages of each
+	// stage associated with their resolved version. Each stage is resolved
+	// on its own, such that stages with different constraints for a package
+	// might get different versions of it.
+	ResolveStagesVersions(ctx context.Context, imageRef string, stages map[string]map[string]string) (map[string]map[string]string, error)
+}
+
+// ClosureSolver is implemented by PackageSolvers able to resolve the full
+// dependency closure of a set of packages.
+type ClosureSolver interface {
+	PackageSolver
+	// ResolveDependencies takes a map of stage names associated to their
+	// packages and exact versions (as returned by ResolveVersions). It
+	// returns, for each stage, the same packages plus the exact version of
+	// every package that would be installed along with them (e.g. their
+	// dependencies not installed in the image yet). The closures of all the
+	// stages are resolved at once.
+	ResolveDependencies(ctx context.Context, imageRef string, stages map[string]map[string]string) (map[string]map[string]string, error)
+}
+
+// Resolve resolves the versions of the given packages with pkgSolver. When
+// opts.LockPackageDependencies is true, it resolves their whole dependency
+// closure instead and returns an error if pkgSolver doesn't support it.
+func Resolve(
+	ctx context.Context,
+	pkgSolver PackageSolver,
+	imageRef string,
+	pkgs map[string]string,
+	opts builddef.UpdateLocksOpts,
+) (map[string]string, error) {
+	resolved, err := ResolveStages(ctx, pkgSolver, imageRef,
+		map[string]map[string]string{"": pkgs}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return resolved[""], nil
+}
+
+// ResolveStages resolves the packages of several stages (a map of stage
+// names associated to their packages and version constraints). Each stage is
+// resolved on its own, but when pkgSolver is a StagesSolver, the versions
+// available are looked up only once for all the stages. Other PackageSolvers
+// are called once with the packages of all the stages when stages have the
+// same constraint for every package they share, or once per stage otherwise.
+//
+// When opts.LockPackageDependencies is true, the dependency closure of each
+// stage is resolved too. It returns an error if pkgSolver doesn't support it.
+func ResolveStages(
+	ctx context.Context,
+	pkgSolver PackageSolver,
+	imageRef string,
+	stages map[string]map[string]string,
+	opts builddef.UpdateLocksOpts,
+) (map[string]map[string]string, error) {
+	var closureSolver ClosureSolver
+	if opts.LockPackageDependencies {
+		var ok bool
+		closureSolver, ok = pkgSolver.(ClosureSolver)
+		if !ok {
+			return nil, xerrors.Errorf("package solver %T doesn't support locking package dependencies", pkgSolver)
+		}
+	}
+
+	var resolved map[string]map[string]string
+	var err error
+	if stagesSolver, ok := pkgSolver.(StagesSolver); ok {
+		resolved, err = stagesSolver.ResolveStagesVersions(ctx, imageRef, stages)
+	} else {
+		resolved, err = resolveEachStage(ctx, pkgSolver, imageRef, stages)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if closureSolver != nil {
+		return closureSolver.ResolveDependencies(ctx, imageRef, resolved)
+	}
+	return resolved, nil
+}
+
+// resolveEachStage resolves the packages of the given stages with
+// PackageSolvers that don't implement StagesSolver. Stages are resolved with
+// a single call when all of them have the same constraint for every package
+// they share, or with a call per stage otherwise.
+func resolveEachStage(
+	ctx context.Context,
+	pkgSolver PackageSolver,
+	imageRef string,
+	stages map[string]map[string]string,
+) (map[string]map[string]string, error) {
+	res := make(map[string]map[string]string, len(stages))
+
+	if union, ok := unionOfStages(stages); ok {
+		resolved, err := pkgSolver.ResolveVersions(ctx, imageRef, union)
+		if err != nil {
+			return nil, err
+		}
+		for stage, pkgs := range stages {
+			res[stage] = make(map[string]string, len(pkgs))
+			for name := range pkgs {
+				res[stage][name] = resolved[name]
+			}
+		}
+		return res, nil
+	}
+
+	for _, stage := range stageNames(stages) {
+		resolved, err := pkgSolver.ResolveVersions(ctx, imageRef, stages[stage])
+		if err != nil {
+			return nil, err
+		}
+		res[stage] = resolved
+	}
+	return res, nil
+}
+
+// unionOfStages returns the packages of all the given stages, along with
+// their constraint. It returns false when stages have different constraints
+// for the same package.
+func unionOfStages(stages map[string]map[string]string) (map[string]string, bool) {
+	union := map[string]string{}
+	for _, pkgs := range stages {
+		for name, constraint := range pkgs {
+			constraint = strings.TrimSpace(constraint)
+			if prev, ok := union[name]; ok && prev != constraint {
+				return nil, false
+			}
+			union[name] = constraint
+		}
+	}
+	return union, true
+}
+
+// resolveStagesFromCandidates resolves the packages of each of the given
+// stages from the versions available for all of them. listCandidates is
+// called once with the names of the packages of all the stages and returns
+// their available versions. Stages are resolved in the order of their name,
+// such that errors are reported consistently.
+func resolveStagesFromCandidates(
+	stages map[string]map[string]string,
+	listCandidates func(names []string) (map[string][]string, error),
+	compare compareFunc,
+) (map[string]map[string]string, error) {
+	union := map[string]string{}
+	for _, pkgs := range stages {
+		for name := range pkgs {
+			union[name] = ""
+		}
+	}
+
+	candidates := map[string][]string{}
+	if len(union) > 0 {
+		var err error
+		candidates, err = listCandidates(packageNames(union))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make(map[string]map[string]string, len(stages))
+	for _, stage := range stageNames(stages) {
+		resolved, err := resolveConstraints(stages[stage], candidates, compare)
+		if err != nil {
+			return nil, err
+		}
+		res[stage] = resolved
+	}
+	return res, nil
+}
+
+// closureMarker is printed before the simulation of each set of packages run
+// by resolveClosures, in order to split their output.
+const closureMarker = "### zbuild closure"
+
+// resolveClosures resolves the dependency closure of each of the given stages
+// with a single command run in the given image. The command is made of the
+// setup commands followed by the command returned by simulate for each
+// distinct set of packages (formatted as name=version). parse returns the
+// packages that would be installed according to the output of a simulation.
+func resolveClosures(
+	ctx context.Context,
+	solver statesolver.StateSolver,
+	imageRef string,
+	stages map[string]map[string]string,
+	setup []string,
+	simulate func(specs []string) string,
+	parse func(buf *bytes.Buffer) map[string]string,
+) (map[string]map[string]string, error) {
+	// Stages with the same packages (e.g. a stage and its parent) have the
+	// same closure, so they're simulated once.
+	setIndexes := map[string]int{}
+	cmds := append([]string{}, setup...)
+	for _, stage := range stageNames(stages) {
+		if len(stages[stage]) == 0 {
+			continue
+		}
+		specs := strings.Join(packageSpecs(stages[stage]), " ")
+		if _, ok := setIndexes[specs]; ok {
+			continue
+		}
+		setIndexes[specs] = len(setIndexes)
+		cmds = append(cmds,
+			"echo '"+closureMarker+"'",
+			simulate(packageSpecs(stages[stage])))
+	}
+
+	var outputs []string
+	if len(setIndexes) > 0 {
+		outbuf, err := solver.ExecImage(ctx, imageRef, cmds)
+		if err != nil {
+			return nil, err
+		}
+
+		outputs = strings.Split(outbuf.String(), closureMarker+"\n")[1:]
+		if len(outputs) != len(setIndexes) {
+			return nil, xerrors.Errorf("failed to resolve dependencies in %s: expected the output of %d simulations, got %d",
+				imageRef, len(setIndexes), len(outputs))
+		}
+	}
+
+	res := make(map[string]map[string]string, len(stages))
+	for stage, pkgs := range stages {
+		closure := make(map[string]string, len(pkgs))
+		for name, version := range pkgs {
+			closure[name] = version
+		}
+		if len(pkgs) > 0 {
+			idx := setIndexes[strings.Join(packageSpecs(pkgs), " ")]
+			for name, version := range parse(bytes.NewBufferString(outputs[idx])) {
+				closure[name] = version
+			}
+		}
+		res[stage] = closure
+	}
+	return res, nil
+}
+
+// stageNames returns the names of the given stages, sorted.
+func stageNames(stages map[string]map[string]string) []string {
+	names := make([]string, 0, len(stages))
+	for stage := range stages {
+		names = append(names, stage)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packageNames returns the names of the given packages, sorted.
+func packageNames(pkgs map[string]string) []string {
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SnapshotSolver is implemented by PackageSolvers able to resolve package
+// versions from a snapshot of Debian archives.
+type SnapshotSolver interface {
+	PackageSolver
+	// WithSnapshot configures the solver to use the given snapshot. It
+	// returns the snapshot actually used, which might differ (e.g. when a
+	// previous snapshot has been cached).
+	WithSnapshot(snapshot llbutils.DebianSnapshot) llbutils.DebianSnapshot
+}
+
+// LockDebianSnapshot configures the given PackageSolver to resolve package
+// versions from a snapshot of Debian archives taken at opts.SnapshotTime (or
+// now if it's zero) and returns the timestamp of the snapshot used (see
+// CachingSolver). It returns an empty string and leaves the PackageSolver
+// untouched when the OS isn't Debian or when the PackageSolver doesn't
+// support snapshots.
+func LockDebianSnapshot(
+	pkgSolver PackageSolver,
+	osrelease builddef.OSRelease,
+	opts builddef.UpdateLocksOpts,
+) string {
+	snapshotSolver, ok := pkgSolver.(SnapshotSolver)
+	if osrelease.Name != "debian" || !ok {
+		return ""
+	}
+
+	snapshotTime := opts.SnapshotTime
+	if snapshotTime.IsZero() {
+		snapshotTime = time.Now()
+	}
+
+	snapshot := llbutils.NewDebianSnapshot(opts.DebianSnapshotURL,
+		snapshotTime, osrelease.VersionName)
+	return snapshotSolver.WithSnapshot(snapshot).Timestamp
+}
+
 type SolverType string
 
+// ResolvePackageManager returns the SolverType and the llbutils package
+// manager to use for the given OS, based on its distribution family. It
+// returns an error if that family isn't supported.
+func ResolvePackageManager(osrelease builddef.OSRelease) (SolverType, string, error) {
+	switch osrelease.Family() {
+	case builddef.DistroFamilyDebian:
+		return APT, llbutils.APT, nil
+	case builddef.DistroFamilyAlpine:
+		return APK, llbutils.APK, nil
+	case builddef.DistroFamilyRHEL:
+		return DNF, llbutils.DNF, nil
+	}
+
+	return "", "", xerrors.Errorf("unsupported OS %q: only debian-based, alpine-based and rhel-based base images are supported",
+		osrelease.Name)
+}
+
 const (
 	APT SolverType = "apt"
 	APK SolverType = "apk"
+	DNF SolverType = "dnf"
 )
 
 // PackageSolversMap is a list of SolverType associated to matching factories
@@ -63,6 +385,29 @@ var DefaultPackageSolversMap = PackageSolversMap{
 	APK: func(solver statesolver.StateSolver) PackageSolver {
 		return NewAPKSolver(solver)
 	},
+	DNF: func(solver statesolver.StateSolver) PackageSolver {
+		return NewDNFSolver(solver)
+	},
+}
+
+// packageSet returns the given package names as a set.
+func packageSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return set
+}
+
+// packageSpecs returns the given packages formatted as name=version and
+// sorted by name.
+func packageSpecs(pkgs map[string]string) []string {
+	specs := make([]string, 0, len(pkgs))
+	for name, version := range pkgs {
+		specs = append(specs, name+"="+version)
+	}
+	sort.Strings(specs)
+	return specs
 }
 
 func checkMissingPackages(packages, resolved map[string]string) error {
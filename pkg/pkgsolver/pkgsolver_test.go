@@ -0,0 +1,234 @@
+package pkgsolver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+)
+
+func TestResolvePackageManager(t *testing.T) {
+	testcases := map[string]struct {
+		osrelease          builddef.OSRelease
+		expectedSolverType pkgsolver.SolverType
+		expectedPkgManager string
+		expectedErr        error
+	}{
+		"debian": {
+			osrelease:          builddef.OSRelease{Name: "debian"},
+			expectedSolverType: pkgsolver.APT,
+			expectedPkgManager: llbutils.APT,
+		},
+		"ubuntu": {
+			osrelease:          builddef.OSRelease{Name: "ubuntu", IDLike: []string{"debian"}},
+			expectedSolverType: pkgsolver.APT,
+			expectedPkgManager: llbutils.APT,
+		},
+		"devuan": {
+			osrelease:          builddef.OSRelease{Name: "devuan", IDLike: []string{"debian"}},
+			expectedSolverType: pkgsolver.APT,
+			expectedPkgManager: llbutils.APT,
+		},
+		"alpine": {
+			osrelease:          builddef.OSRelease{Name: "alpine"},
+			expectedSolverType: pkgsolver.APK,
+			expectedPkgManager: llbutils.APK,
+		},
+		"wolfi": {
+			osrelease:          builddef.OSRelease{Name: "wolfi"},
+			expectedSolverType: pkgsolver.APK,
+			expectedPkgManager: llbutils.APK,
+		},
+		"rocky": {
+			osrelease:          builddef.OSRelease{Name: "rocky", IDLike: []string{"rhel", "centos", "fedora"}},
+			expectedSolverType: pkgsolver.DNF,
+			expectedPkgManager: llbutils.DNF,
+		},
+		"unsupported distro": {
+			osrelease:   builddef.OSRelease{Name: "arch"},
+			expectedErr: errors.New(`unsupported OS "arch": only debian-based, alpine-based and rhel-based base images are supported`),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			solverType, pkgManager, err := pkgsolver.ResolvePackageManager(tc.osrelease)
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if solverType != tc.expectedSolverType {
+				t.Fatalf("Expected solver type: %s\nGot: %s", tc.expectedSolverType, solverType)
+			}
+			if pkgManager != tc.expectedPkgManager {
+				t.Fatalf("Expected package manager: %s\nGot: %s", tc.expectedPkgManager, pkgManager)
+			}
+		})
+	}
+}
+
+func TestResolveStages(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
+	pkgSolver.EXPECT().ResolveVersions(gomock.Any(), "docker.io/library/debian:buster", map[string]string{
+		"curl":  "7.64.*",
+		"git":   "*",
+		"unzip": "*",
+	}).Times(1).Return(map[string]string{
+		"curl":  "7.64.0-4+deb10u1",
+		"git":   "1:2.20.1-2+deb10u3",
+		"unzip": "6.0-23+deb10u1",
+	}, nil)
+
+	ctx := context.Background()
+	resolved, err := pkgsolver.ResolveStages(ctx, pkgSolver, "docker.io/library/debian:buster",
+		map[string]map[string]string{
+			"base": {"curl": "7.64.*", "unzip": "*"},
+			"dev":  {"curl": "7.64.*", "git": "*", "unzip": "*"},
+			"prod": {},
+		},
+		builddef.UpdateLocksOpts{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]map[string]string{
+		"base": {
+			"curl":  "7.64.0-4+deb10u1",
+			"unzip": "6.0-23+deb10u1",
+		},
+		"dev": {
+			"curl":  "7.64.0-4+deb10u1",
+			"git":   "1:2.20.1-2+deb10u3",
+			"unzip": "6.0-23+deb10u1",
+		},
+		"prod": {},
+	}
+	if diff := deep.Equal(resolved, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestResolveStagesWithDifferentConstraints(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	imageRef := "docker.io/library/debian:buster"
+	pkgSolver := mocks.NewMockPackageSolver(mockCtrl)
+	pkgSolver.EXPECT().ResolveVersions(gomock.Any(), imageRef, map[string]string{
+		"curl": "<7.64.0-4+deb10u1",
+		"git":  "*",
+	}).Times(1).Return(map[string]string{
+		"curl": "7.64.0-4",
+		"git":  "1:2.20.1-2+deb10u3",
+	}, nil)
+	pkgSolver.EXPECT().ResolveVersions(gomock.Any(), imageRef, map[string]string{
+		"curl": ">=7.64.0-4+deb10u1",
+	}).Times(1).Return(map[string]string{
+		"curl": "7.64.0-4+deb10u1",
+	}, nil)
+
+	ctx := context.Background()
+	resolved, err := pkgsolver.ResolveStages(ctx, pkgSolver, imageRef,
+		map[string]map[string]string{
+			"dev":  {"curl": "<7.64.0-4+deb10u1", "git": "*"},
+			"prod": {"curl": ">=7.64.0-4+deb10u1"},
+		},
+		builddef.UpdateLocksOpts{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]map[string]string{
+		"dev": {
+			"curl": "7.64.0-4",
+			"git":  "1:2.20.1-2+deb10u3",
+		},
+		"prod": {
+			"curl": "7.64.0-4+deb10u1",
+		},
+	}
+	if diff := deep.Equal(resolved, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestResolveStagesLooksUpPackagesOnce(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	imageRef := "docker.io/library/alpine:3.12"
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	gomock.InOrder(
+		solver.EXPECT().ExecImage(gomock.Any(), imageRef, []string{
+			"apk --no-cache info --description openssl sqlite",
+		}).Times(1).Return(bytes.NewBufferString(rawAPKInfo), nil),
+		solver.EXPECT().ExecImage(gomock.Any(), imageRef, []string{
+			"echo '### zbuild closure'",
+			"apk --no-cache add --simulate openssl=1.1.1d-r3",
+			"echo '### zbuild closure'",
+			"apk --no-cache add --simulate openssl=1.1.1g-r0 sqlite=3.32.1-r0",
+		}).Times(1).Return(bytes.NewBufferString(`### zbuild closure
+(1/2) Installing libcrypto1.1 (1.1.1d-r3)
+(2/2) Installing openssl (1.1.1d-r3)
+OK: 8 MiB in 16 packages
+### zbuild closure
+(1/3) Upgrading libcrypto1.1 (1.1.1f-r0 -> 1.1.1g-r0)
+(2/3) Installing openssl (1.1.1g-r0)
+(3/3) Installing sqlite (3.32.1-r0)
+OK: 9 MiB in 17 packages
+`), nil),
+	)
+
+	// Stages with disjoint constraints for the same package are resolved on
+	// their own.
+	ctx := context.Background()
+	resolved, err := pkgsolver.ResolveStages(ctx, pkgsolver.NewAPKSolver(solver), imageRef,
+		map[string]map[string]string{
+			"base": {"openssl": "<1.1.1e"},
+			"dev":  {"openssl": "<1.1.1e"},
+			"prod": {"openssl": ">=1.1.1e", "sqlite": "*"},
+		},
+		builddef.UpdateLocksOpts{LockPackageDependencies: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]map[string]string{
+		"base": {
+			"libcrypto1.1": "1.1.1d-r3",
+			"openssl":      "1.1.1d-r3",
+		},
+		"dev": {
+			"libcrypto1.1": "1.1.1d-r3",
+			"openssl":      "1.1.1d-r3",
+		},
+		"prod": {
+			"libcrypto1.1": "1.1.1g-r0",
+			"openssl":      "1.1.1g-r0",
+			"sqlite":       "3.32.1-r0",
+		},
+	}
+	if diff := deep.Equal(resolved, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
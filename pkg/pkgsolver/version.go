@@ -0,0 +1,578 @@
+package pkgsolver
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// compareFunc compares two versions. It returns a negative number when a is
+// lower than b, a positive number when a is greater than b and 0 when both
+// are equal.
+type compareFunc func(a, b string) int
+
+// versionConstraint is a set of terms a version has to satisfy. Terms are
+// separated by spaces and are all required to match (e.g. ">=7.68 <8").
+type versionConstraint struct {
+	raw   string
+	terms []constraintTerm
+}
+
+type constraintTerm struct {
+	op      string
+	version string
+}
+
+// isPin returns true when the constraint is an exact version.
+func (c versionConstraint) isPin() bool {
+	return len(c.terms) == 1 && c.terms[0].op == "="
+}
+
+func (c versionConstraint) matches(version string, compare compareFunc) bool {
+	for _, term := range c.terms {
+		if !term.matches(version, compare) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t constraintTerm) matches(version string, compare compareFunc) bool {
+	switch t.op {
+	case "*":
+		return true
+	case ".*":
+		if !sameEpoch(version, t.version) {
+			return false
+		}
+		v, prefix := stripEpoch(version), stripEpoch(t.version)
+		return v == prefix || strings.HasPrefix(v, prefix+".")
+	case "=":
+		return compare(version, t.version) == 0
+	case "!=":
+		return compare(version, t.version) != 0
+	case ">=":
+		return compare(version, t.version) >= 0
+	case ">":
+		return compare(version, t.version) > 0
+	case "<=":
+		return compare(version, t.version) <= 0
+	case "<":
+		return compare(version, t.version) < 0
+	}
+	return false
+}
+
+// parseConstraint parses a version constraint as found in system_packages.
+// Supported formats are:
+//
+//   - "" or "*": any version ;
+//   - "1.2.3": this exact version ;
+//   - ">=1.2", ">1.2", "<=1.2", "<1.2", "=1.2", "!=1.2": comparison operators ;
+//   - "~1.2": at least 1.2 but lower than 2 (and "~1.2.3" means at least
+//     1.2.3 but lower than 1.3) ;
+//   - "1.*": any version starting with 1. and without an epoch (or "1:2.*"
+//     for versions with an epoch of 1) ;
+//
+// Multiple space-separated terms can be combined (e.g. ">=7.68 <8").
+func parseConstraint(raw string) (versionConstraint, error) {
+	c := versionConstraint{raw: raw}
+
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		c.terms = []constraintTerm{{op: "*"}}
+		return c, nil
+	}
+
+	for _, field := range fields {
+		terms, err := parseConstraintTerm(field)
+		if err != nil {
+			return c, err
+		}
+		c.terms = append(c.terms, terms...)
+	}
+
+	return c, nil
+}
+
+func parseConstraintTerm(field string) ([]constraintTerm, error) {
+	if field == "*" {
+		return []constraintTerm{{op: "*"}}, nil
+	}
+
+	if strings.HasPrefix(field, "~") {
+		lower := field[1:]
+		upper, err := tildeUpperBound(lower)
+		if err != nil {
+			return nil, err
+		}
+		return []constraintTerm{
+			{op: ">=", version: lower},
+			{op: "<", version: upper},
+		}, nil
+	}
+
+	if strings.HasSuffix(field, ".*") {
+		return []constraintTerm{{op: ".*", version: strings.TrimSuffix(field, ".*")}}, nil
+	}
+
+	for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+		if strings.HasPrefix(field, op) {
+			version := field[len(op):]
+			if version == "" {
+				return nil, xerrors.Errorf("no version after operator %q", op)
+			}
+			return []constraintTerm{{op: op, version: version}}, nil
+		}
+	}
+
+	if strings.ContainsAny(field, "*<>=!") {
+		return nil, xerrors.Errorf("unsupported constraint %q", field)
+	}
+
+	return []constraintTerm{{op: "=", version: field}}, nil
+}
+
+// tildeUpperBound returns the exclusive upper bound of a tilde constraint:
+// the last significant segment is dropped and the previous one is
+// incremented (or the only one when there's a single segment).
+func tildeUpperBound(version string) (string, error) {
+	segments := strings.Split(stripEpoch(version), ".")
+	if len(segments) > 1 {
+		segments = segments[:len(segments)-1]
+	}
+
+	last := len(segments) - 1
+	n, err := strconv.Atoi(segments[last])
+	if err != nil {
+		return "", xerrors.Errorf("unsupported tilde constraint ~%s", version)
+	}
+	segments[last] = strconv.Itoa(n + 1)
+
+	upper := strings.Join(segments, ".")
+	if epoch := epochOf(version); epoch != "" {
+		upper = epoch + ":" + upper
+	}
+
+	return upper, nil
+}
+
+func stripEpoch(version string) string {
+	if i := strings.Index(version, ":"); i >= 0 {
+		return version[i+1:]
+	}
+	return version
+}
+
+func epochOf(version string) string {
+	if i := strings.Index(version, ":"); i >= 0 {
+		return version[:i]
+	}
+	return ""
+}
+
+// sameEpoch returns true when both versions have the same epoch. Versions
+// without an epoch have an epoch of 0.
+func sameEpoch(a, b string) bool {
+	epochA, _ := strconv.Atoi(epochOf(a))
+	epochB, _ := strconv.Atoi(epochOf(b))
+	return epochA == epochB
+}
+
+// resolveConstraints picks, for each package, the highest candidate version
+// matching its constraint. It returns an error when a package has no
+// candidates at all, when its constraint is invalid or when none of its
+// candidates match.
+func resolveConstraints(
+	pkgs map[string]string,
+	candidates map[string][]string,
+	compare compareFunc,
+) (map[string]string, error) {
+	resolved := map[string]string{}
+
+	found := map[string]string{}
+	for name := range candidates {
+		found[name] = ""
+	}
+	if err := checkMissingPackages(pkgs, found); err != nil {
+		return resolved, err
+	}
+
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		constraint, err := parseConstraint(pkgs[name])
+		if err != nil {
+			return resolved, xerrors.Errorf("invalid version constraint %q for package %s: %w",
+				pkgs[name], name, err)
+		}
+
+		var best string
+		for _, version := range candidates[name] {
+			if !constraint.matches(version, compare) {
+				continue
+			}
+			if best == "" || compare(version, best) > 0 {
+				best = version
+			}
+		}
+
+		if best == "" && constraint.isPin() {
+			return resolved, xerrors.Errorf("version %s of package %s is not available (available versions: %s)",
+				constraint.terms[0].version, name, strings.Join(candidates[name], ", "))
+		}
+		if best == "" {
+			return resolved, xerrors.Errorf("no version of package %s matches %q (available versions: %s)",
+				name, constraint.raw, strings.Join(candidates[name], ", "))
+		}
+
+		resolved[name] = best
+	}
+
+	return resolved, nil
+}
+
+// compareDebianVersions compares two Debian package versions using the same
+// ordering rules as dpkg: epochs are compared numerically first, then
+// upstream versions and finally Debian revisions.
+func compareDebianVersions(a, b string) int {
+	epochA, upstreamA, revisionA := splitDebianVersion(a)
+	epochB, upstreamB, revisionB := splitDebianVersion(b)
+
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+
+	if res := compareDebianVersionPart(upstreamA, upstreamB); res != 0 {
+		return res
+	}
+	return compareDebianVersionPart(revisionA, revisionB)
+}
+
+func splitDebianVersion(version string) (int, string, string) {
+	var epoch int
+	if i := strings.Index(version, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+
+	revision := ""
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		revision = version[i+1:]
+		version = version[:i]
+	}
+
+	return epoch, version, revision
+}
+
+// debianCharOrder gives the weight of a non-digit char: tildes sort before
+// anything (even the end of the string), then letters and finally other chars.
+func debianCharOrder(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+
+	c := s[i]
+	switch {
+	case c == '~':
+		return -1
+	case isDigit(c):
+		return 0
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+// compareDebianVersionPart implements dpkg's verrevcmp algorithm.
+func compareDebianVersionPart(a, b string) int {
+	i, j := 0, 0
+
+	for i < len(a) || j < len(b) {
+		firstDiff := 0
+
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac := debianCharOrder(a, i)
+			bc := debianCharOrder(b, j)
+			if ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+
+	return 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// alpineSuffixes lists the version suffixes supported by apk, in ascending
+// order. An empty suffix sorts between pre-release suffixes and post-release
+// ones.
+var alpineSuffixes = []string{"alpha", "beta", "pre", "rc", "", "cvs", "svn", "git", "hg", "p"}
+
+type alpineVersion struct {
+	numbers  []int
+	letter   byte
+	suffixes []alpineSuffix
+	revision int
+}
+
+type alpineSuffix struct {
+	rank   int
+	number int
+}
+
+func parseAlpineVersion(version string) alpineVersion {
+	var v alpineVersion
+
+	if i := strings.LastIndex(version, "-r"); i >= 0 {
+		v.revision, _ = strconv.Atoi(version[i+2:])
+		version = version[:i]
+	}
+
+	parts := strings.Split(version, "_")
+	for _, suffix := range parts[1:] {
+		s := alpineSuffix{rank: -1}
+		for rank, name := range alpineSuffixes {
+			if name != "" && strings.HasPrefix(suffix, name) {
+				s.rank = rank
+				s.number, _ = strconv.Atoi(suffix[len(name):])
+				break
+			}
+		}
+		v.suffixes = append(v.suffixes, s)
+	}
+
+	for _, segment := range strings.Split(parts[0], ".") {
+		if segment != "" && !isDigit(segment[len(segment)-1]) {
+			v.letter = segment[len(segment)-1]
+			segment = segment[:len(segment)-1]
+		}
+		n, _ := strconv.Atoi(segment)
+		v.numbers = append(v.numbers, n)
+	}
+
+	return v
+}
+
+// compareAlpineVersions compares two Alpine package versions using apk
+// ordering rules: numeric segments first, then the optional letter, the
+// suffixes (e.g. _rc1, _p2) and finally the package revision (e.g. -r1).
+func compareAlpineVersions(a, b string) int {
+	va := parseAlpineVersion(a)
+	vb := parseAlpineVersion(b)
+
+	for i := 0; i < len(va.numbers) && i < len(vb.numbers); i++ {
+		if va.numbers[i] != vb.numbers[i] {
+			return va.numbers[i] - vb.numbers[i]
+		}
+	}
+	if len(va.numbers) != len(vb.numbers) {
+		return len(va.numbers) - len(vb.numbers)
+	}
+
+	if va.letter != vb.letter {
+		return int(va.letter) - int(vb.letter)
+	}
+
+	// Versions without suffix are ranked as the empty suffix.
+	noSuffix := alpineSuffix{rank: 4}
+	for i := 0; i < len(va.suffixes) || i < len(vb.suffixes); i++ {
+		sa, sb := noSuffix, noSuffix
+		if i < len(va.suffixes) {
+			sa = va.suffixes[i]
+		}
+		if i < len(vb.suffixes) {
+			sb = vb.suffixes[i]
+		}
+
+		if sa.rank != sb.rank {
+			return sa.rank - sb.rank
+		}
+		if sa.number != sb.number {
+			return sa.number - sb.number
+		}
+	}
+
+	return va.revision - vb.revision
+}
+
+// compareRPMVersions compares two RPM package versions (formatted as
+// [epoch:]version-release) using the same ordering rules as rpm: epochs are
+// compared numerically first, then versions and finally releases.
+func compareRPMVersions(a, b string) int {
+	epochA, versionA, releaseA := splitRPMVersion(a)
+	epochB, versionB, releaseB := splitRPMVersion(b)
+
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+
+	if res := rpmvercmp(versionA, versionB); res != 0 {
+		return res
+	}
+	return rpmvercmp(releaseA, releaseB)
+}
+
+func splitRPMVersion(version string) (int, string, string) {
+	var epoch int
+	if i := strings.Index(version, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+
+	release := ""
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		release = version[i+1:]
+		version = version[:i]
+	}
+
+	return epoch, version, release
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// rpmvercmp implements the algorithm of the function of the same name in
+// librpm: versions are split into alternating numeric and alphabetic
+// segments compared one by one. Numeric segments are always newer than
+// alphabetic ones, tildes sort before anything and carets sort after the
+// end of the version but before anything else.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && !isAlnum(a[i]) && a[i] != '~' && a[i] != '^' {
+			i++
+		}
+		for j < len(b) && !isAlnum(b[j]) && b[j] != '~' && b[j] != '^' {
+			j++
+		}
+
+		if (i < len(a) && a[i] == '~') || (j < len(b) && b[j] == '~') {
+			if i >= len(a) || a[i] != '~' {
+				return 1
+			}
+			if j >= len(b) || b[j] != '~' {
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+
+		if (i < len(a) && a[i] == '^') || (j < len(b) && b[j] == '^') {
+			if i >= len(a) {
+				return -1
+			}
+			if j >= len(b) {
+				return 1
+			}
+			if a[i] != '^' {
+				return 1
+			}
+			if b[j] != '^' {
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+
+		if i >= len(a) || j >= len(b) {
+			break
+		}
+
+		startA, startB := i, j
+		numeric := isDigit(a[i])
+		if numeric {
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+		} else {
+			for i < len(a) && isAlnum(a[i]) && !isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isAlnum(b[j]) && !isDigit(b[j]) {
+				j++
+			}
+		}
+
+		segA, segB := a[startA:i], b[startB:j]
+		// Segments of different types: numeric ones are newer.
+		if segB == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				return len(segA) - len(segB)
+			}
+		}
+		if res := strings.Compare(segA, segB); res != 0 {
+			return res
+		}
+	}
+
+	if i >= len(a) && j >= len(b) {
+		return 0
+	}
+	if i >= len(a) {
+		return -1
+	}
+	return 1
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/image"
 	"github.com/NiR-/zbuild/pkg/pkgsolver"
+	"github.com/NiR-/zbuild/pkg/sbom"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/moby/buildkit/client/llb"
 	"golang.org/x/xerrors"
@@ -32,6 +33,16 @@ type KindHandler interface {
 	DebugConfig(builddef.BuildOpts) (interface{}, error)
 }
 
+// SBOMHandler is implemented by KindHandlers able to list the packages
+// installed in the images they build.
+type SBOMHandler interface {
+	// SBOM loads its kind definition based on parameters in the BuildOpts,
+	// like Build() method does, and returns the packages installed in the
+	// stage built, as found in its locks and in the lockfiles of its source
+	// context.
+	SBOM(context.Context, builddef.BuildOpts) (sbom.BOM, error)
+}
+
 // KindRegistry associates kinds with their respective handler.
 type KindRegistry struct {
 	kinds            map[string]KindHandler
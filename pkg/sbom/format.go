@@ -0,0 +1,249 @@
+package sbom
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// These are the formats supported by Marshal.
+const (
+	FormatSPDX      = "spdx"
+	FormatCycloneDX = "cyclonedx"
+)
+
+// Marshal encodes the given BOM into a JSON SBOM of the given format.
+// Packages are sorted by package URL, such that the same BOM always produces
+// the same SBOM.
+func Marshal(bom BOM, format string) ([]byte, error) {
+	var doc interface{}
+	switch format {
+	case FormatSPDX:
+		doc = newSPDXDocument(bom)
+	case FormatCycloneDX:
+		doc = newCycloneDXDocument(bom)
+	default:
+		return nil, xerrors.Errorf("unsupported SBOM format %q (expected %s or %s)",
+			format, FormatSPDX, FormatCycloneDX)
+	}
+
+	// Package URLs contain ampersands, which shouldn't be escaped.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, xerrors.Errorf("could not marshal %s SBOM: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// splitChecksum splits checksums formatted like digests (e.g. sha256:...) into
+// their algorithm and their hex-encoded value.
+func splitChecksum(checksum string) (string, string, bool) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func bomName(bom BOM) string {
+	if bom.Name == "" {
+		return "zbuild-image"
+	}
+	return bom.Name
+}
+
+type spdxDocument struct {
+	SPDXVersion       string         `json:"spdxVersion"`
+	DataLicense       string         `json:"dataLicense"`
+	SPDXID            string         `json:"SPDXID"`
+	Name              string         `json:"name"`
+	DocumentNamespace string         `json:"documentNamespace"`
+	CreationInfo      spdxCreation   `json:"creationInfo"`
+	Packages          []spdxPackage  `json:"packages"`
+	Relationships     []spdxRelation `json:"relationships"`
+}
+
+type spdxCreation struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	ExternalRefs     []spdxRef      `json:"externalRefs"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelation struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+func newSPDXDocument(bom BOM) spdxDocument {
+	pkgs := bom.sortedPackages()
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.2",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        bomName(bom),
+		CreationInfo: spdxCreation{
+			Created:  bom.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: zbuild"},
+		},
+		Packages:      make([]spdxPackage, 0, len(pkgs)),
+		Relationships: make([]spdxRelation, 0, len(pkgs)),
+	}
+
+	// The namespace of the document has to be unique, so it's derived from
+	// its content instead of being random to keep SBOMs stable.
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", doc.Name, doc.CreationInfo.Created)
+
+	for i, pkg := range pkgs {
+		purl := pkg.PURL()
+		fmt.Fprintln(h, purl)
+
+		spdxPkg := spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d", i+1),
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs: []spdxRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  purl,
+			}},
+		}
+		if pkg.DownloadURL != "" {
+			spdxPkg.DownloadLocation = pkg.DownloadURL
+		}
+		if algo, value, ok := splitChecksum(pkg.Checksum); ok {
+			spdxPkg.Checksums = []spdxChecksum{{
+				Algorithm:     strings.ToUpper(algo),
+				ChecksumValue: value,
+			}}
+		}
+
+		doc.Packages = append(doc.Packages, spdxPkg)
+		doc.Relationships = append(doc.Relationships, spdxRelation{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: spdxPkg.SPDXID,
+		})
+	}
+
+	doc.DocumentNamespace = fmt.Sprintf("https://zbuild.io/spdxdocs/%s-%x", doc.Name, h.Sum(nil))
+	return doc
+}
+
+type cdxDocument struct {
+	BOMFormat   string         `json:"bomFormat"`
+	SpecVersion string         `json:"specVersion"`
+	Version     int            `json:"version"`
+	Metadata    cdxMetadata    `json:"metadata"`
+	Components  []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	BOMRef  string    `json:"bom-ref,omitempty"`
+	Type    string    `json:"type"`
+	Group   string    `json:"group,omitempty"`
+	Name    string    `json:"name"`
+	Version string    `json:"version,omitempty"`
+	PURL    string    `json:"purl,omitempty"`
+	Hashes  []cdxHash `json:"hashes,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// cdxAlgorithms maps the algorithms of checksums to the names used by
+// CycloneDX.
+var cdxAlgorithms = map[string]string{
+	"md5":    "MD5",
+	"sha1":   "SHA-1",
+	"sha256": "SHA-256",
+	"sha384": "SHA-384",
+	"sha512": "SHA-512",
+}
+
+func newCycloneDXDocument(bom BOM) cdxDocument {
+	pkgs := bom.sortedPackages()
+	doc := cdxDocument{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cdxMetadata{
+			Timestamp: bom.Created.UTC().Format(time.RFC3339),
+			Tools:     []cdxTool{{Name: "zbuild"}},
+			Component: cdxComponent{
+				Type: "container",
+				Name: bomName(bom),
+			},
+		},
+		Components: make([]cdxComponent, 0, len(pkgs)),
+	}
+
+	for _, pkg := range pkgs {
+		purl := pkg.PURL()
+		component := cdxComponent{
+			BOMRef:  purl,
+			Type:    "library",
+			Group:   pkg.Namespace,
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    purl,
+		}
+		switch pkg.Type {
+		case TypeDocker:
+			component.Type = "container"
+		case TypeGeneric:
+			component.Type = "file"
+		}
+		if algo, value, ok := splitChecksum(pkg.Checksum); ok {
+			if alg, ok := cdxAlgorithms[algo]; ok {
+				component.Hashes = []cdxHash{{Alg: alg, Content: value}}
+			}
+		}
+
+		doc.Components = append(doc.Components, component)
+	}
+
+	return doc
+}
@@ -0,0 +1,290 @@
+// Package sbom generates Software Bills of Materials (SBOMs) for the images
+// built by zbuild. SBOMs are made from the locks of the images: their base
+// image, system packages, external files, and the packages listed in the
+// lockfiles of the language package managers (e.g. composer.lock).
+package sbom
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/docker/distribution/reference"
+	"golang.org/x/xerrors"
+)
+
+// These are the types of the packages listed in SBOMs. They're the types
+// used in package URLs (see https://github.com/package-url/purl-spec).
+const (
+	TypeDocker   = "docker"
+	TypeDeb      = "deb"
+	TypeAPK      = "apk"
+	TypeRPM      = "rpm"
+	TypeComposer = "composer"
+	TypeNPM      = "npm"
+	TypePECL     = "pecl"
+	TypeGeneric  = "generic"
+)
+
+// Package is a package installed in an image.
+type Package struct {
+	Type      string
+	Namespace string
+	Name      string
+	Version   string
+	// Qualifiers are extra data about the package (e.g. the distro of system
+	// packages), added to its package URL.
+	Qualifiers map[string]string
+	// Checksum is the digest of the package (e.g. sha256:...), if it's known.
+	Checksum string
+	// DownloadURL is the URL the package has been downloaded from, if it's
+	// known.
+	DownloadURL string
+}
+
+// PURL returns the package URL of the package.
+func (pkg Package) PURL() string {
+	var b strings.Builder
+	b.WriteString("pkg:" + pkg.Type + "/")
+	if pkg.Namespace != "" {
+		for _, segment := range strings.Split(pkg.Namespace, "/") {
+			b.WriteString(escape(segment) + "/")
+		}
+	}
+	b.WriteString(escape(pkg.Name))
+	if pkg.Version != "" {
+		b.WriteString("@" + escape(pkg.Version))
+	}
+
+	keys := make([]string, 0, len(pkg.Qualifiers))
+	for key := range pkg.Qualifiers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		sep := "&"
+		if i == 0 {
+			sep = "?"
+		}
+		b.WriteString(sep + key + "=" + escape(pkg.Qualifiers[key]))
+	}
+
+	return b.String()
+}
+
+// escape percent-encodes all but the unreserved characters of the given
+// string, as required for the components of package URLs.
+func escape(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
+
+// BOM is the list of packages installed in an image.
+type BOM struct {
+	// Name is the name of the image described by the BOM (e.g. the name of
+	// the stage built).
+	Name string
+	// Created is the creation time of the BOM. It has to be stable across
+	// builds, as the digest of the SBOM is used to label images.
+	Created  time.Time
+	Packages []Package
+}
+
+// New returns an empty BOM describing the stage built with the given
+// BuildOpts. It's created at the source date of the build (see
+// builddef.BuildOpts.SourceDate), or at the Unix epoch when there's none, such
+// that the SBOM exported with the zbuild-sbom-<stage> target always matches
+// the digest labelled on the image.
+func New(buildOpts builddef.BuildOpts, srcContext *builddef.Context) BOM {
+	bom := BOM{
+		Name:    buildOpts.Stage,
+		Created: time.Unix(0, 0).UTC(),
+	}
+	if sourceDate, ok := buildOpts.SourceDate(srcContext); ok {
+		bom.Created = sourceDate
+	}
+	return bom
+}
+
+// Add adds the given packages to the BOM.
+func (bom *BOM) Add(pkgs ...Package) {
+	bom.Packages = append(bom.Packages, pkgs...)
+}
+
+// AddSourcePackages adds the packages returned by list, which are installed
+// from the lockfiles of the source context (e.g. composer.lock). They aren't
+// installed in dev stages, as the source context is mounted at runtime
+// instead, so list isn't called for these stages.
+func (bom *BOM) AddSourcePackages(dev bool, list func() ([]Package, error)) error {
+	if dev {
+		return nil
+	}
+
+	pkgs, err := list()
+	if err != nil {
+		return err
+	}
+	bom.Add(pkgs...)
+	return nil
+}
+
+// sortedPackages returns the packages of the BOM sorted by package URL, with
+// duplicates removed, such that SBOMs are stable.
+func (bom BOM) sortedPackages() []Package {
+	byPURL := make(map[string]Package, len(bom.Packages))
+	purls := make([]string, 0, len(bom.Packages))
+	for _, pkg := range bom.Packages {
+		purl := pkg.PURL()
+		if _, ok := byPURL[purl]; !ok {
+			purls = append(purls, purl)
+		}
+		byPURL[purl] = pkg
+	}
+	sort.Strings(purls)
+
+	pkgs := make([]Package, 0, len(purls))
+	for _, purl := range purls {
+		pkgs = append(pkgs, byPURL[purl])
+	}
+	return pkgs
+}
+
+// BaseImage returns the package of the given base image reference. It's
+// identified by its digest when it's pinned.
+func BaseImage(ref string) (Package, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return Package{}, xerrors.Errorf("could not parse image reference %q: %w", ref, err)
+	}
+
+	imgPath := reference.Path(named)
+	pkg := Package{
+		Type: TypeDocker,
+		Name: path.Base(imgPath),
+		Qualifiers: map[string]string{
+			"repository_url": reference.Domain(named),
+		},
+	}
+	if ns := path.Dir(imgPath); ns != "." {
+		pkg.Namespace = ns
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		pkg.Version = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		if pkg.Version != "" {
+			pkg.Qualifiers["tag"] = pkg.Version
+		}
+		pkg.Version = digested.Digest().String()
+		pkg.Checksum = digested.Digest().String()
+	}
+
+	return pkg, nil
+}
+
+// SystemPackages returns the packages of the given locked system packages,
+// installed with the package manager of the given OS.
+func SystemPackages(osrelease builddef.OSRelease, locks map[string]string) []Package {
+	var pkgType string
+	switch osrelease.Family() {
+	case builddef.DistroFamilyDebian:
+		pkgType = TypeDeb
+	case builddef.DistroFamilyAlpine:
+		pkgType = TypeAPK
+	case builddef.DistroFamilyRHEL:
+		pkgType = TypeRPM
+	default:
+		pkgType = TypeGeneric
+	}
+
+	qualifiers := map[string]string{}
+	if osrelease.Name != "" {
+		qualifiers["distro"] = osrelease.Name
+		if osrelease.VersionID != "" {
+			qualifiers["distro"] += "-" + osrelease.VersionID
+		}
+	}
+
+	pkgs := make([]Package, 0, len(locks))
+	for name, version := range locks {
+		pkgs = append(pkgs, Package{
+			Type:       pkgType,
+			Namespace:  osrelease.Name,
+			Name:       name,
+			Version:    version,
+			Qualifiers: qualifiers,
+		})
+	}
+	return pkgs
+}
+
+// ExternalFiles returns the packages of the given external files, indexed
+// by their URL and associated to their locked checksum.
+func ExternalFiles(locks map[string]string) []Package {
+	pkgs := make([]Package, 0, len(locks))
+	for url, checksum := range locks {
+		pkgs = append(pkgs, Package{
+			Type: TypeGeneric,
+			Name: path.Base(url),
+			Qualifiers: map[string]string{
+				"download_url": url,
+			},
+			Checksum:    checksum,
+			DownloadURL: url,
+		})
+	}
+	return pkgs
+}
+
+// LockedExternalFiles returns the packages of the given external files. Files
+// with no explicit checksum get the one found in locks (see
+// llbutils.WithLockedChecksums).
+func LockedExternalFiles(externalFiles []llbutils.ExternalFile, locks map[string]string) []Package {
+	checksums := map[string]string{}
+	for _, externalFile := range llbutils.WithLockedChecksums(externalFiles, locks) {
+		checksums[externalFile.URL] = externalFile.Checksum
+	}
+	return ExternalFiles(checksums)
+}
+
+// Packages returns the packages of the given type, indexed by their name and
+// associated to their version. Names with a namespace (e.g. symfony/console
+// or @babel/core) are split at their last slash.
+func Packages(pkgType string, versions map[string]string) []Package {
+	pkgs := make([]Package, 0, len(versions))
+	for name, version := range versions {
+		pkgs = append(pkgs, NamedPackage(pkgType, name, version))
+	}
+	return pkgs
+}
+
+// NamedPackage returns the package of the given type, name and version. The
+// name is split at its last slash into a namespace and a name.
+func NamedPackage(pkgType, name, version string) Package {
+	pkg := Package{
+		Type:    pkgType,
+		Name:    name,
+		Version: version,
+	}
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		pkg.Namespace = name[:i]
+		pkg.Name = name[i+1:]
+	}
+	return pkg
+}
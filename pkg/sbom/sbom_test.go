@@ -0,0 +1,261 @@
+package sbom_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/NiR-/zbuild/pkg/sbom"
+	"github.com/go-test/deep"
+	"golang.org/x/xerrors"
+)
+
+var flagTestdata = flag.Bool("testdata", false, "Use this flag to (re)generate testdata (SBOMs)")
+
+func TestPackagePURL(t *testing.T) {
+	testcases := map[string]struct {
+		pkg      sbom.Package
+		expected string
+	}{
+		"with a namespace and qualifiers": {
+			pkg: sbom.Package{
+				Type:      sbom.TypeDeb,
+				Namespace: "debian",
+				Name:      "libssl1.1",
+				Version:   "1.1.1d-0+deb10u3",
+				Qualifiers: map[string]string{
+					"distro": "debian-10",
+					"arch":   "amd64",
+				},
+			},
+			expected: "pkg:deb/debian/libssl1.1@1.1.1d-0%2Bdeb10u3?arch=amd64&distro=debian-10",
+		},
+		"with a scoped npm package": {
+			pkg: sbom.Package{
+				Type:      sbom.TypeNPM,
+				Namespace: "@babel",
+				Name:      "core",
+				Version:   "7.9.0",
+			},
+			expected: "pkg:npm/%40babel/core@7.9.0",
+		},
+		"without version": {
+			pkg: sbom.Package{
+				Type: sbom.TypeGeneric,
+				Name: "some-file",
+			},
+			expected: "pkg:generic/some-file",
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			if purl := tc.pkg.PURL(); purl != tc.expected {
+				t.Fatalf("Expected: %s\nGot: %s", tc.expected, purl)
+			}
+		})
+	}
+}
+
+func TestBaseImage(t *testing.T) {
+	testcases := map[string]struct {
+		ref         string
+		expected    sbom.Package
+		expectedErr error
+	}{
+		"with a pinned image": {
+			ref: "docker.io/library/php:7.4-fpm-buster@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			expected: sbom.Package{
+				Type:      sbom.TypeDocker,
+				Namespace: "library",
+				Name:      "php",
+				Version:   "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+				Qualifiers: map[string]string{
+					"repository_url": "docker.io",
+					"tag":            "7.4-fpm-buster",
+				},
+				Checksum: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			},
+		},
+		"with an unpinned image": {
+			ref: "quay.io/some-image:v1",
+			expected: sbom.Package{
+				Type:    sbom.TypeDocker,
+				Name:    "some-image",
+				Version: "v1",
+				Qualifiers: map[string]string{
+					"repository_url": "quay.io",
+				},
+			},
+		},
+		"fail with an invalid reference": {
+			ref:         "Invalid:Ref",
+			expectedErr: xerrors.New(`could not parse image reference "Invalid:Ref": invalid reference format: repository name must be lowercase`),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			pkg, err := sbom.BaseImage(tc.ref)
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected error: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if diff := deep.Equal(pkg, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestLockedExternalFiles(t *testing.T) {
+	externalFiles := []llbutils.ExternalFile{
+		{URL: "https://example.org/locked.phar"},
+		{URL: "https://example.org/explicit.phar", Checksum: "sha256:explicit"},
+	}
+	pkgs := sbom.LockedExternalFiles(externalFiles, map[string]string{
+		"https://example.org/locked.phar":   "sha256:locked",
+		"https://example.org/explicit.phar": "sha256:ignored",
+	})
+
+	checksums := map[string]string{}
+	for _, pkg := range pkgs {
+		checksums[pkg.DownloadURL] = pkg.Checksum
+	}
+	expected := map[string]string{
+		"https://example.org/locked.phar":   "sha256:locked",
+		"https://example.org/explicit.phar": "sha256:explicit",
+	}
+	if diff := deep.Equal(checksums, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestAddSourcePackages(t *testing.T) {
+	list := func() ([]sbom.Package, error) {
+		return []sbom.Package{sbom.NamedPackage(sbom.TypeComposer, "symfony/console", "v4.4.0")}, nil
+	}
+
+	var bom sbom.BOM
+	if err := bom.AddSourcePackages(true, list); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(bom.Packages) != 0 {
+		t.Fatalf("Expected no packages for dev stages, got: %v", bom.Packages)
+	}
+
+	if err := bom.AddSourcePackages(false, list); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(bom.Packages) != 1 {
+		t.Fatalf("Expected a single package, got: %v", bom.Packages)
+	}
+
+	expectedErr := "could not read composer.lock"
+	err := bom.AddSourcePackages(false, func() ([]sbom.Package, error) {
+		return nil, xerrors.New(expectedErr)
+	})
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected error: %s\nGot: %v", expectedErr, err)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	osrelease := builddef.OSRelease{
+		Name:        "debian",
+		VersionName: "buster",
+		VersionID:   "10",
+	}
+	baseImage, err := sbom.BaseImage("docker.io/library/php:7.4-fpm-buster@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bom := sbom.BOM{
+		Name:    "prod",
+		Created: time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC),
+	}
+	bom.Add(baseImage)
+	bom.Add(sbom.SystemPackages(osrelease, map[string]string{
+		"libicu63": "63.1-6+deb10u1",
+		"git":      "1:2.20.1-2+deb10u1",
+	})...)
+	bom.Add(sbom.ExternalFiles(map[string]string{
+		"https://github.com/some/tool/releases/download/v1.0.0/tool": "sha256:0b2ab22e4e1ed5a6bb6bd20a5a4b0ba0a33d6a6a3ac3c0e7f8d6b2fc2f1b9c43",
+	})...)
+	bom.Add(sbom.Package{
+		Type:      sbom.TypeComposer,
+		Namespace: "symfony",
+		Name:      "console",
+		Version:   "v5.0.5",
+	}, sbom.Package{
+		// Duplicated packages are listed only once.
+		Type:      sbom.TypeComposer,
+		Namespace: "symfony",
+		Name:      "console",
+		Version:   "v5.0.5",
+	})
+
+	testcases := map[string]struct {
+		format      string
+		testdata    string
+		expectedErr error
+	}{
+		"SPDX": {
+			format:   sbom.FormatSPDX,
+			testdata: "testdata/sbom.spdx.json",
+		},
+		"CycloneDX": {
+			format:   sbom.FormatCycloneDX,
+			testdata: "testdata/sbom.cdx.json",
+		},
+		"fail with an unsupported format": {
+			format:      "swid",
+			expectedErr: xerrors.New(`unsupported SBOM format "swid" (expected spdx or cyclonedx)`),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			out, err := sbom.Marshal(bom, tc.format)
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected error: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if *flagTestdata {
+				if err := ioutil.WriteFile(tc.testdata, out, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			expected, err := ioutil.ReadFile(tc.testdata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != string(expected) {
+				t.Fatalf("Expected: %s\nGot: %s", expected, out)
+			}
+		})
+	}
+}
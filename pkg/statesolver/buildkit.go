@@ -3,12 +3,18 @@ package statesolver
 import (
 	"bytes"
 	"context"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/llbutils"
+	"github.com/docker/distribution/reference"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	fstypes "github.com/tonistiigi/fsutil/types"
 	"golang.org/x/xerrors"
 )
 
@@ -17,11 +23,16 @@ const (
 	keyContext       = "context"
 )
 
+// defaultContextName is the name of the local source serving the build
+// context, unless the frontend opts tell otherwise. It's also the name used
+// by BuildkitSession.
+const defaultContextName = "context"
+
 func NewBuildkitSolver(c client.Client) BuildkitSolver {
 	sessionID := c.BuildOpts().SessionID
 	opts := c.BuildOpts().Opts
 
-	contextName := "context"
+	contextName := defaultContextName
 	if v, ok := opts[keyDockerContext]; ok {
 		contextName = v
 	} else if v, ok := opts[keyContext]; ok {
@@ -46,10 +57,17 @@ func (s BuildkitSolver) ExecImage(
 	imageRef string,
 	cmd []string,
 ) (*bytes.Buffer, error) {
-	escapedCmd := strings.Replace(strings.Join(cmd, "; "), "\"", "\\\"", -1)
+	strcmd := strings.Join(cmd, "; ")
 	src := llbutils.ImageSource(imageRef, false)
-	run := src.Run(
-		llb.Shlex("/bin/sh -o errexit -c \"" + escapedCmd + "\" > /tmp/result"))
+	// The command is wrapped such that the LLB op never fails, in order to
+	// get its exit code and its stderr. It's passed as $0 to the wrapper to
+	// avoid escaping it. Commands are used to resolve package versions and
+	// git refs, so their output shouldn't come from the layer cache.
+	run := src.Run(llb.Args([]string{
+		"/bin/sh", "-c",
+		"/bin/sh -o errexit -c \"$0\" >/tmp/result 2>/tmp/stderr; echo $? >/tmp/exitcode",
+		strcmd,
+	}), llb.IgnoreCache)
 
 	_, ref, err := llbutils.SolveState(ctx, s.client, run.Root())
 	if err != nil {
@@ -59,22 +77,43 @@ func (s BuildkitSolver) ExecImage(
 	raw, ok, err := llbutils.ReadFile(ctx, ref, "/tmp/result")
 	buf := bytes.NewBuffer(raw)
 	if err != nil {
-		err = xerrors.Errorf("failed to execute %q in %q: %w", escapedCmd, imageRef, err)
+		err = xerrors.Errorf("failed to execute %q in %q: %w", strcmd, imageRef, err)
 		return buf, err
 	} else if !ok {
-		err = xerrors.Errorf("failed to execute %q in %q", escapedCmd, imageRef)
+		err = xerrors.Errorf("failed to execute %q in %q", strcmd, imageRef)
 		return buf, err
 	}
 
-	return buf, nil
+	rawExitCode, _, err := llbutils.ReadFile(ctx, ref, "/tmp/exitcode")
+	if err != nil {
+		return buf, xerrors.Errorf("failed to execute %q in %q: %w", strcmd, imageRef, err)
+	}
+	exitCode, err := strconv.Atoi(strings.TrimSpace(string(rawExitCode)))
+	if err != nil {
+		return buf, xerrors.Errorf("failed to execute %q in %q: invalid exit code: %w", strcmd, imageRef, err)
+	}
+	if exitCode == 0 {
+		return buf, nil
+	}
+
+	stderr, _, err := llbutils.ReadFile(ctx, ref, "/tmp/stderr")
+	if err != nil {
+		return buf, xerrors.Errorf("failed to execute %q in %q: %w", strcmd, imageRef, err)
+	}
+
+	return buf, xerrors.Errorf("failed to execute %q in %q: %w", strcmd, imageRef, ExecError{
+		Cmd:      cmd,
+		ExitCode: exitCode,
+		Stdout:   buf.String(),
+		Stderr:   string(stderr),
+	})
 }
 
 func (s BuildkitSolver) FromContext(
 	source *builddef.Context,
 	opts ...llb.LocalOption,
 ) ReadFileOpt {
-	opts = append(opts, llb.SessionID(s.sessionID))
-	src := llbutils.FromContext(source, opts...)
+	src := s.fromContext(source, opts...)
 
 	return func(ctx context.Context, filepath string) ([]byte, error) {
 		raw, err := s.readFromLLB(ctx, src, filepath)
@@ -86,6 +125,20 @@ func (s BuildkitSolver) FromContext(
 	}
 }
 
+// fromContext returns the LLB state of the given build context. Local
+// contexts are read from the local source of the build context, whatever
+// their source is: it's a dir when zbuild CLI uses a BuildkitSession.
+func (s BuildkitSolver) fromContext(source *builddef.Context, opts ...llb.LocalOption) llb.State {
+	if source.IsLocalContext() {
+		local := *source
+		local.Source = s.contextName
+		source = &local
+	}
+
+	opts = append(opts, llb.SessionID(s.sessionID))
+	return llbutils.FromContext(source, opts...)
+}
+
 func (s BuildkitSolver) FromImage(image string) ReadFileOpt {
 	return func(ctx context.Context, filepath string) ([]byte, error) {
 		src := llbutils.ImageSource(image, false)
@@ -122,27 +175,111 @@ func (s BuildkitSolver) FileExists(
 	filepath string,
 	source *builddef.Context,
 ) (bool, error) {
-	src := llbutils.FromContext(source,
-		llb.IncludePatterns([]string{filepath}),
-		llb.SessionID(s.sessionID))
+	return fileExists(ctx, s, filepath, source)
+}
+
+func (s BuildkitSolver) Stat(
+	ctx context.Context,
+	filepath string,
+	source FileSource,
+) (FileInfo, error) {
+	if source.Image == "" && source.Context == nil {
+		return FileInfo{}, FileNotFound
+	}
+
+	target := path.Clean("/" + filepath)
+	for hops := 0; hops <= maxSymlinks; hops++ {
+		var src llb.State
+		if source.Image != "" {
+			src = llbutils.ImageSource(source.Image, false)
+		} else {
+			// fsutil matches include patterns against relative paths.
+			src = s.fromContext(source.Context,
+				llb.IncludePatterns([]string{strings.TrimPrefix(target, "/")}))
+		}
+
+		stat, err := s.statFromLLB(ctx, src, target)
+		if err != nil {
+			return FileInfo{}, xerrors.Errorf("failed to stat %s: %w", filepath, err)
+		}
+
+		mode := os.FileMode(stat.Mode)
+		if mode&os.ModeSymlink == 0 {
+			return newFileInfo(stat.Size_, mode), nil
+		}
+		target = resolveLink(target, stat.Linkname)
+	}
+
+	return FileInfo{}, xerrors.Errorf("failed to stat %s: too many levels of symbolic links", filepath)
+}
+
+func (s BuildkitSolver) statFromLLB(
+	ctx context.Context,
+	src llb.State,
+	filepath string,
+) (*fstypes.Stat, error) {
 	_, srcRef, err := llbutils.SolveState(ctx, s.client, src)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	_, err = srcRef.StatFile(ctx, client.StatRequest{
+	stat, err := srcRef.StatFile(ctx, client.StatRequest{
 		Path: filepath,
 	})
-	if strings.Contains(err.Error(), "no such file or directory") {
-		return false, nil
+	if err != nil && strings.Contains(err.Error(), "no such file or directory") {
+		return nil, FileNotFound
 	}
-	return true, err
+	return stat, err
 }
 
 func (s BuildkitSolver) ReadFile(ctx context.Context, filepath string, opt ReadFileOpt) ([]byte, error) {
 	return opt(ctx, filepath)
 }
 
+// ReadImageDir implements ImageDirSolver.
+func (s BuildkitSolver) ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error) {
+	_, srcRef, err := llbutils.SolveState(ctx, s.client, llbutils.ImageSource(image, false))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, err)
+	}
+
+	stats, err := srcRef.ReadDir(ctx, client.ReadDirRequest{Path: dirpath})
+	if err != nil && strings.Contains(err.Error(), "no such file or directory") {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, FileNotFound)
+	} else if err != nil {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, err)
+	}
+
+	names := make([]string, 0, len(stats))
+	for _, stat := range stats {
+		names = append(names, path.Base(stat.Path))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// ResolveImageRef resolves the digest of the given image reference through
+// the ImageSource of Buildkit, unless the reference already has one.
 func (s BuildkitSolver) ResolveImageRef(ctx context.Context, imageRef string) (string, error) {
-	return "", xerrors.Errorf("ResolveImageRef is not supported by BuildkitSolver")
+	normalized, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	if canonical, ok := normalized.(reference.Canonical); ok {
+		return canonical.String(), nil
+	}
+
+	dgst, _, err := s.client.ResolveImageConfig(ctx, normalized.String(), llb.ResolveImageConfigOpt{})
+	if err != nil {
+		return "", xerrors.Errorf("failed to resolve %s: %w", imageRef, err)
+	}
+
+	resolved, err := reference.WithDigest(normalized, dgst)
+	if err != nil {
+		return "", err
+	}
+
+	return resolved.String(), nil
 }
@@ -3,13 +3,20 @@ package statesolver_test
 import (
 	"context"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/llbtest"
 	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-test/deep"
 	"github.com/golang/mock/gomock"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	fstypes "github.com/tonistiigi/fsutil/types"
 	"golang.org/x/xerrors"
 )
 
@@ -299,6 +306,9 @@ func initBuildkitExecuteCommadOnImageTC(mockCtrl *gomock.Controller) buildkitExe
 	srcRef.EXPECT().ReadFile(gomock.Any(), client.ReadRequest{
 		Filename: "/tmp/result",
 	}).Times(1).Return([]byte("foobar"), nil)
+	srcRef.EXPECT().ReadFile(gomock.Any(), client.ReadRequest{
+		Filename: "/tmp/exitcode",
+	}).Times(1).Return([]byte("0\n"), nil)
 
 	return buildkitExecImageTC{
 		solver:   statesolver.NewBuildkitSolver(c),
@@ -308,6 +318,50 @@ func initBuildkitExecuteCommadOnImageTC(mockCtrl *gomock.Controller) buildkitExe
 	}
 }
 
+func initBuildkitReportExecErrorTC(mockCtrl *gomock.Controller) buildkitExecImageTC {
+	srcRef := llbtest.NewMockReference(mockCtrl)
+	solved := &client.Result{
+		Refs: map[string]client.Reference{
+			"linux/amd64": srcRef,
+		},
+		Ref: srcRef,
+	}
+
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts: map[string]string{
+			"contextkey": "some-context",
+		},
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).
+		Times(1).
+		Return(solved, nil)
+
+	srcRef.EXPECT().ReadFile(gomock.Any(), client.ReadRequest{
+		Filename: "/tmp/result",
+	}).Times(1).Return([]byte("foo"), nil)
+	srcRef.EXPECT().ReadFile(gomock.Any(), client.ReadRequest{
+		Filename: "/tmp/exitcode",
+	}).Times(1).Return([]byte("2\n"), nil)
+	srcRef.EXPECT().ReadFile(gomock.Any(), client.ReadRequest{
+		Filename: "/tmp/stderr",
+	}).Times(1).Return([]byte("bar: not found\n"), nil)
+
+	return buildkitExecImageTC{
+		solver:   statesolver.NewBuildkitSolver(c),
+		imageRef: "debian:buster-20191014-slim",
+		command:  "echo -n foo; bar",
+		expected: "foo",
+		expectedErr: statesolver.ExecError{
+			Cmd:      []string{"echo -n foo; bar"},
+			ExitCode: 2,
+			Stdout:   "foo",
+			Stderr:   "bar: not found\n",
+		},
+	}
+}
+
 func initBuildkitReportErrorWhenResultFileDoesntExistTC(mockCtrl *gomock.Controller) buildkitExecImageTC {
 	srcRef := llbtest.NewMockReference(mockCtrl)
 	solved := &client.Result{
@@ -345,6 +399,7 @@ func TestBuildkitExecImage(t *testing.T) {
 	testcases := map[string]func(mockCtrl *gomock.Controller) buildkitExecImageTC{
 		"successfully execute command on image":          initBuildkitExecuteCommadOnImageTC,
 		"return an error when result file doesn't exist": initBuildkitReportErrorWhenResultFileDoesntExistTC,
+		"return an ExecError when the command fails":     initBuildkitReportExecErrorTC,
 	}
 
 	for tcname := range testcases {
@@ -359,6 +414,20 @@ func TestBuildkitExecImage(t *testing.T) {
 			tc := tcinit(mockCtrl)
 			ctx := context.Background()
 			out, err := tc.solver.ExecImage(ctx, tc.imageRef, []string{tc.command})
+			if execErr, ok := tc.expectedErr.(statesolver.ExecError); ok {
+				var actual statesolver.ExecError
+				if !xerrors.As(err, &actual) {
+					t.Fatalf("Expected an ExecError, got: %v", err)
+				}
+				if diff := deep.Equal(actual, execErr); diff != nil {
+					t.Fatal(diff)
+				}
+				// The stdout of failed commands is returned too.
+				if out.String() != tc.expected {
+					t.Fatalf("Expected: %s\nGot: %s", tc.expected, out.String())
+				}
+				return
+			}
 			if tc.expectedErr != nil {
 				if err == nil || err.Error() != tc.expectedErr.Error() {
 					t.Fatalf("Expected error: %v\nGot: %v", tc.expectedErr, err)
@@ -375,3 +444,162 @@ func TestBuildkitExecImage(t *testing.T) {
 		})
 	}
 }
+
+// TestBuildkitExecImageIgnoresCache checks that commands aren't run from the
+// layer cache, as they're used to resolve versions that change over time.
+func TestBuildkitExecImageIgnoresCache(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	srcRef := llbtest.NewMockReference(mockCtrl)
+	srcRef.EXPECT().ReadFile(gomock.Any(), client.ReadRequest{
+		Filename: "/tmp/result",
+	}).Return([]byte("foobar"), nil)
+	srcRef.EXPECT().ReadFile(gomock.Any(), client.ReadRequest{
+		Filename: "/tmp/exitcode",
+	}).Return([]byte("0\n"), nil)
+
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req client.SolveRequest) (*client.Result, error) {
+			var execs int
+			for _, raw := range req.Definition.Def {
+				var op pb.Op
+				if err := op.Unmarshal(raw); err != nil {
+					t.Fatal(err)
+				}
+				if op.GetExec() == nil {
+					continue
+				}
+				execs++
+				if !req.Definition.Metadata[digest.FromBytes(raw)].IgnoreCache {
+					t.Errorf("Expected exec op to ignore the cache.")
+				}
+			}
+			if execs != 1 {
+				t.Errorf("Expected 1 exec op, got %d.", execs)
+			}
+			return &client.Result{Ref: srcRef}, nil
+		})
+
+	solver := statesolver.NewBuildkitSolver(c)
+	_, err := solver.ExecImage(context.Background(), "debian:buster-20191014-slim",
+		[]string{"apt-cache madison curl"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestBuildkitReadImageDir(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	srcRef := llbtest.NewMockReference(mockCtrl)
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts:      map[string]string{},
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).Return(&client.Result{Ref: srcRef}, nil)
+
+	srcRef.EXPECT().ReadDir(gomock.Any(), client.ReadDirRequest{
+		Path: "/etc/apt/sources.list.d",
+	}).Return([]*fstypes.Stat{
+		{Path: "pgdg.list"},
+		{Path: "debian.sources"},
+	}, nil)
+
+	solver := statesolver.NewBuildkitSolver(c)
+	ctx := context.Background()
+	names, err := solver.ReadImageDir(ctx, "docker.io/library/debian:bookworm", "/etc/apt/sources.list.d")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if diff := deep.Equal(names, []string{"debian.sources", "pgdg.list"}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildkitResolveImageRef(t *testing.T) {
+	testcases := map[string]struct {
+		imageRef    string
+		resolved    string
+		resolveErr  error
+		expected    string
+		expectedErr error
+	}{
+		"resolve the digest of an image reference": {
+			imageRef: "debian:buster-slim",
+			resolved: "docker.io/library/debian:buster-slim",
+			expected: "docker.io/library/debian:buster-slim@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		},
+		"keep the digest of canonical references": {
+			imageRef: "docker.io/library/debian@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			expected: "docker.io/library/debian@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		},
+		"fail when the image can't be resolved": {
+			imageRef:    "debian:buster-slim",
+			resolved:    "docker.io/library/debian:buster-slim",
+			resolveErr:  xerrors.New("pull access denied"),
+			expectedErr: xerrors.New("failed to resolve debian:buster-slim: pull access denied"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			c := llbtest.NewMockClient(mockCtrl)
+			c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+				SessionID: "<SESSION-ID>",
+				Opts:      map[string]string{},
+			})
+			if tc.resolved != "" {
+				dgst := digest.Digest("sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")
+				c.EXPECT().ResolveImageConfig(gomock.Any(), tc.resolved, gomock.Any()).
+					Return(dgst, []byte("{}"), tc.resolveErr)
+			}
+
+			solver := statesolver.NewBuildkitSolver(c)
+			resolved, err := solver.ResolveImageRef(context.Background(), tc.imageRef)
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Fatalf("Expected error: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resolved != tc.expected {
+				t.Fatalf("Expected: %s\nGot: %s", tc.expected, resolved)
+			}
+		})
+	}
+}
+
+func TestNewBuildkitSessionFailsWithoutDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zbuild-buildkit-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := "unix://" + filepath.Join(dir, "buildkitd.sock")
+	_, err = statesolver.NewBuildkitSession(context.Background(), addr, dir)
+
+	expectedErr := "could not start a build session with buildkitd at " + addr
+	if err == nil || !strings.HasPrefix(err.Error(), expectedErr) {
+		t.Fatalf("Expected: %s\nGot: %v", expectedErr, err)
+	}
+}
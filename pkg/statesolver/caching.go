@@ -0,0 +1,223 @@
+package statesolver
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// CachingSolver is a StateSolver storing the results of the wrapped solver
+// in a lockcache.Cache, such that they're reused across zbuild update runs.
+//
+// Image references are cached until the cache TTL expires. Commands executed
+// and files read from images are cached only for digest-pinned images, as
+// their output can't change otherwise. Files read from build contexts are
+// never cached.
+type CachingSolver struct {
+	Solver StateSolver
+	Cache  *lockcache.Cache
+}
+
+// NewCachingSolver returns a CachingSolver wrapping the given solver.
+func NewCachingSolver(solver StateSolver, cache *lockcache.Cache) CachingSolver {
+	return CachingSolver{
+		Solver: solver,
+		Cache:  cache,
+	}
+}
+
+func (s CachingSolver) ResolveImageRef(ctx context.Context, imageRef string) (string, error) {
+	key := lockcache.Key("image-ref", imageRef)
+
+	var resolved string
+	if s.Cache.Get(key, &resolved) {
+		logrus.Debugf("Using cached reference for image %q.", imageRef)
+		return resolved, nil
+	}
+
+	resolved, err := s.Solver.ResolveImageRef(ctx, imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	s.store(key, resolved)
+	return resolved, nil
+}
+
+func (s CachingSolver) ExecImage(
+	ctx context.Context,
+	imageRef string,
+	cmd []string,
+) (*bytes.Buffer, error) {
+	if !isDigestPinned(imageRef) {
+		return s.Solver.ExecImage(ctx, imageRef, cmd)
+	}
+
+	key := lockcache.Key(append([]string{"exec", imageRef}, cmd...)...)
+
+	var stdout []byte
+	if s.Cache.Get(key, &stdout) {
+		logrus.Debugf("Using cached output of %q in %q.", cmd, imageRef)
+		return bytes.NewBuffer(stdout), nil
+	}
+
+	outbuf, err := s.Solver.ExecImage(ctx, imageRef, cmd)
+	if err != nil {
+		return outbuf, err
+	}
+
+	s.store(key, outbuf.Bytes())
+	return outbuf, nil
+}
+
+// ResolveGitRef implements GitSolver. Git references aren't cached as
+// branches can move anytime.
+func (s CachingSolver) ResolveGitRef(ctx context.Context, c *builddef.Context) (string, error) {
+	return resolveGitRef(ctx, s.Solver, c)
+}
+
+// ResolveGitSubmodules implements GitSolver. Submodules aren't cached either,
+// although they can't change for a given commit, as they're resolved along
+// with git references.
+func (s CachingSolver) ResolveGitSubmodules(ctx context.Context, c *builddef.Context) (map[string]string, error) {
+	return resolveGitSubmodules(ctx, s.Solver, c)
+}
+
+// ResolveGitCommitTime implements GitSolver. Commit times aren't cached
+// either, for the same reason.
+func (s CachingSolver) ResolveGitCommitTime(ctx context.Context, c *builddef.Context) (int64, error) {
+	return resolveGitCommitTime(ctx, s.Solver, c)
+}
+
+// LockHTTPContext implements HTTPSolver. Tarballs aren't cached, as the
+// content served at a given URL can change anytime.
+func (s CachingSolver) LockHTTPContext(ctx context.Context, c *builddef.Context) (string, string, error) {
+	return lockHTTPContextURL(ctx, s.Solver, c)
+}
+
+func (s CachingSolver) FileExists(
+	ctx context.Context,
+	filepath string,
+	source *builddef.Context,
+) (bool, error) {
+	return s.Solver.FileExists(ctx, filepath, source)
+}
+
+func (s CachingSolver) Stat(
+	ctx context.Context,
+	filepath string,
+	source FileSource,
+) (FileInfo, error) {
+	return s.Solver.Stat(ctx, filepath, source)
+}
+
+func (s CachingSolver) ReadFile(
+	ctx context.Context,
+	filepath string,
+	opt ReadFileOpt,
+) ([]byte, error) {
+	return opt(ctx, filepath)
+}
+
+func (s CachingSolver) FromContext(
+	source *builddef.Context,
+	opts ...llb.LocalOption,
+) ReadFileOpt {
+	return s.Solver.FromContext(source, opts...)
+}
+
+type cachedFile struct {
+	Content  []byte
+	NotFound bool
+}
+
+func (s CachingSolver) FromImage(image string) ReadFileOpt {
+	readFile := s.Solver.FromImage(image)
+	if !isDigestPinned(image) {
+		return readFile
+	}
+
+	return func(ctx context.Context, filepath string) ([]byte, error) {
+		key := lockcache.Key("file", image, filepath)
+
+		var cached cachedFile
+		if s.Cache.Get(key, &cached) {
+			logrus.Debugf("Using cached content of %s from %s.", filepath, image)
+			if cached.NotFound {
+				return nil, xerrors.Errorf("failed to read %s from %s: %w",
+					filepath, image, FileNotFound)
+			}
+			return cached.Content, nil
+		}
+
+		content, err := readFile(ctx, filepath)
+		if xerrors.Is(err, FileNotFound) {
+			s.store(key, cachedFile{NotFound: true})
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
+
+		s.store(key, cachedFile{Content: content})
+		return content, nil
+	}
+}
+
+type cachedDir struct {
+	Names    []string
+	NotFound bool
+}
+
+// ReadImageDir implements ImageDirSolver. Like files, dirs are cached only
+// for digest-pinned images.
+func (s CachingSolver) ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error) {
+	if !isDigestPinned(image) {
+		return ReadImageDir(ctx, s.Solver, image, dirpath)
+	}
+
+	key := lockcache.Key("dir", image, dirpath)
+
+	var cached cachedDir
+	if s.Cache.Get(key, &cached) {
+		logrus.Debugf("Using cached entries of %s from %s.", dirpath, image)
+		if cached.NotFound {
+			return nil, xerrors.Errorf("failed to read dir %s from %s: %w",
+				dirpath, image, FileNotFound)
+		}
+		return cached.Names, nil
+	}
+
+	names, err := ReadImageDir(ctx, s.Solver, image, dirpath)
+	if xerrors.Is(err, FileNotFound) {
+		s.store(key, cachedDir{NotFound: true})
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.store(key, cachedDir{Names: names})
+	return names, nil
+}
+
+// store saves the given value in the cache. Failing to do so isn't fatal as
+// the value has been resolved anyway.
+func (s CachingSolver) store(key string, v interface{}) {
+	if err := s.Cache.Set(key, v); err != nil {
+		logrus.Warnf("Could not write to lock cache: %v", err)
+	}
+}
+
+func isDigestPinned(imageRef string) bool {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return false
+	}
+	_, ok := named.(reference.Digested)
+	return ok
+}
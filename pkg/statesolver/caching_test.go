@@ -0,0 +1,197 @@
+package statesolver_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+	"golang.org/x/xerrors"
+)
+
+const pinnedDebianImage = "docker.io/library/debian:buster@sha256:4ab3309ba955211d1db92f405be609942b595a720de789286376f030502977d6"
+
+func newLockCache(t *testing.T) *lockcache.Cache {
+	dir, err := ioutil.TempDir("", "zbuild-lockcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lockcache.Cache{Dir: dir}
+}
+
+func TestCachingSolverResolveImageRef(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	inner := mocks.NewMockStateSolver(mockCtrl)
+	inner.EXPECT().ResolveImageRef(gomock.Any(), "debian:buster").
+		Times(1).Return(pinnedDebianImage, nil)
+
+	cache := newLockCache(t)
+	defer os.RemoveAll(cache.Dir)
+
+	solver := statesolver.NewCachingSolver(inner, cache)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		resolved, err := solver.ResolveImageRef(ctx, "debian:buster")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resolved != pinnedDebianImage {
+			t.Fatalf("Expected: %s\nGot: %s", pinnedDebianImage, resolved)
+		}
+	}
+}
+
+func TestCachingSolverExecImage(t *testing.T) {
+	testcases := map[string]struct {
+		imageRef      string
+		expectedCalls int
+	}{
+		"cache the output of commands executed in digest-pinned images": {
+			imageRef:      pinnedDebianImage,
+			expectedCalls: 1,
+		},
+		"do not cache the output of commands executed in tagged images": {
+			imageRef:      "debian:buster",
+			expectedCalls: 2,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			cmd := []string{"/usr/bin/env php -r \"echo ini_get('extension_dir');\""}
+			inner := mocks.NewMockStateSolver(mockCtrl)
+			inner.EXPECT().ExecImage(gomock.Any(), tc.imageRef, cmd).
+				Times(tc.expectedCalls).
+				DoAndReturn(func(_ context.Context, _ string, _ []string) (*bytes.Buffer, error) {
+					return bytes.NewBufferString("/usr/local/lib/php/extensions/no-debug-non-zts-20190902"), nil
+				})
+
+			cache := newLockCache(t)
+			defer os.RemoveAll(cache.Dir)
+
+			solver := statesolver.NewCachingSolver(inner, cache)
+			ctx := context.Background()
+
+			for i := 0; i < 2; i++ {
+				outbuf, err := solver.ExecImage(ctx, tc.imageRef, cmd)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if outbuf.String() != "/usr/local/lib/php/extensions/no-debug-non-zts-20190902" {
+					t.Fatalf("Unexpected output: %s", outbuf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestCachingSolverReadFileFromImage(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	readCalls := map[string]int{}
+	inner := mocks.NewMockStateSolver(mockCtrl)
+	inner.EXPECT().FromImage(pinnedDebianImage).AnyTimes().Return(
+		func(_ context.Context, filepath string) ([]byte, error) {
+			readCalls[filepath]++
+			if filepath == "/etc/os-release" {
+				return []byte("ID=debian"), nil
+			}
+			return nil, statesolver.FileNotFound
+		})
+
+	cache := newLockCache(t)
+	defer os.RemoveAll(cache.Dir)
+
+	solver := statesolver.NewCachingSolver(inner, cache)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		content, err := solver.ReadFile(ctx, "/etc/os-release", solver.FromImage(pinnedDebianImage))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(content) != "ID=debian" {
+			t.Fatalf("Unexpected content: %s", content)
+		}
+
+		_, err = solver.ReadFile(ctx, "/etc/apk/repositories", solver.FromImage(pinnedDebianImage))
+		if !xerrors.Is(err, statesolver.FileNotFound) {
+			t.Fatalf("Expected a FileNotFound error, got: %v", err)
+		}
+	}
+
+	for filepath, calls := range readCalls {
+		if calls != 1 {
+			t.Errorf("Expected %s to be read once, but it has been read %d times.", filepath, calls)
+		}
+	}
+}
+
+// dirStateSolver is a StateSolver implementing ImageDirSolver, counting the
+// dirs it lists.
+type dirStateSolver struct {
+	*mocks.MockStateSolver
+	readCalls map[string]int
+}
+
+func (s dirStateSolver) ReadImageDir(_ context.Context, _, dirpath string) ([]string, error) {
+	s.readCalls[dirpath]++
+	if dirpath == "/etc/apt/sources.list.d" {
+		return []string{"debian.sources"}, nil
+	}
+	return nil, statesolver.FileNotFound
+}
+
+func TestCachingSolverReadImageDir(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	inner := dirStateSolver{
+		MockStateSolver: mocks.NewMockStateSolver(mockCtrl),
+		readCalls:       map[string]int{},
+	}
+
+	cache := newLockCache(t)
+	defer os.RemoveAll(cache.Dir)
+
+	solver := statesolver.NewCachingSolver(inner, cache)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		names, err := solver.ReadImageDir(ctx, pinnedDebianImage, "/etc/apt/sources.list.d")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if diff := deep.Equal(names, []string{"debian.sources"}); diff != nil {
+			t.Fatal(diff)
+		}
+
+		_, err = solver.ReadImageDir(ctx, pinnedDebianImage, "/etc/apk/keys")
+		if !xerrors.Is(err, statesolver.FileNotFound) {
+			t.Fatalf("Expected a FileNotFound error, got: %v", err)
+		}
+	}
+
+	for dirpath, calls := range inner.readCalls {
+		if calls != 1 {
+			t.Errorf("Expected %s to be listed once, but it has been listed %d times.", dirpath, calls)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package statesolver
+
+import (
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// keepAliveCmd is the entrypoint of pooled containers. It keeps them running
+// until they're removed, such that commands can be executed in them.
+var keepAliveCmd = []string{"/bin/sh", "-c", "while :; do sleep 3600; done"}
+
+// ContainerPool keeps containers for the lifetime of a LocalSolver, such
+// that files are read and commands are executed without creating (and
+// pulling) a new container each time. Each image has two containers: files
+// are read from a container that is never started, such that reads don't
+// depend on the commands executed in the container used by ExecImage.
+// Containers are removed by LocalSolver.Close.
+type ContainerPool struct {
+	mu         sync.Mutex
+	containers map[containerKey]*pooledContainer
+	closed     bool
+	metrics    ContainerPoolMetrics
+}
+
+// ContainerPoolMetrics counts how containers of a ContainerPool are used.
+type ContainerPoolMetrics struct {
+	// Created is the number of containers created by the pool.
+	Created int
+	// Reused is the number of times a container has been reused instead of
+	// creating a new one.
+	Reused int
+	// Execs is the number of commands executed in pooled containers.
+	Execs int
+}
+
+// containerKey identifies a pooled container. exec indicates whether the
+// container is used to execute commands or to read files.
+type containerKey struct {
+	image string
+	exec  bool
+}
+
+type pooledContainer struct {
+	once sync.Once
+	id   string
+	err  error
+
+	// mu serialises commands executed in the container, as they might
+	// concurrently change its filesystem (e.g. apt-get update).
+	mu      sync.Mutex
+	started bool
+}
+
+func NewContainerPool() *ContainerPool {
+	return &ContainerPool{
+		containers: map[containerKey]*pooledContainer{},
+	}
+}
+
+// container returns the container with the given key, or creates it with the
+// given func. Concurrent calls for the same key wait for the container
+// created by the first one. Failed creations are retried by next calls.
+func (p *ContainerPool) container(
+	key containerKey,
+	create func() (string, error),
+) (*pooledContainer, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, xerrors.New("container pool is closed")
+	}
+
+	c, ok := p.containers[key]
+	if ok {
+		p.metrics.Reused++
+	} else {
+		c = &pooledContainer{}
+		p.containers[key] = c
+	}
+	p.mu.Unlock()
+
+	c.once.Do(func() {
+		id, err := create()
+
+		// The ID is set with the pool lock held, as close might read it
+		// concurrently.
+		p.mu.Lock()
+		c.id, c.err = id, err
+		if err == nil {
+			p.metrics.Created++
+		}
+		p.mu.Unlock()
+	})
+	if c.err != nil {
+		p.mu.Lock()
+		if p.containers[key] == c {
+			delete(p.containers, key)
+		}
+		p.mu.Unlock()
+		return nil, c.err
+	}
+
+	return c, nil
+}
+
+func (p *ContainerPool) recordExec() {
+	p.mu.Lock()
+	p.metrics.Execs++
+	p.mu.Unlock()
+}
+
+// close marks the pool as closed and returns the IDs of its containers.
+func (p *ContainerPool) close() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	ids := make([]string, 0, len(p.containers))
+	for _, c := range p.containers {
+		if c.id != "" {
+			ids = append(ids, c.id)
+		}
+	}
+	p.containers = map[containerKey]*pooledContainer{}
+
+	return ids
+}
+
+// Metrics returns the usage metrics of the pool.
+func (p *ContainerPool) Metrics() ContainerPoolMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.metrics
+}
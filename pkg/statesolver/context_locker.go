@@ -3,9 +3,12 @@ package statesolver
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbutils"
+	"golang.org/x/xerrors"
 )
 
 var (
@@ -17,9 +20,79 @@ func LockContext(ctx context.Context, solver StateSolver, c *builddef.Context) (
 		return nil, nil
 	}
 
-	// Only git contexts can be locked to a precise version.
-	if !c.IsGitContext() {
-		return c, nil
+	switch c.Type {
+	case builddef.ContextTypeGit:
+		ref, err := resolveGitRef(ctx, solver, c)
+		if err != nil {
+			return c, err
+		}
+
+		locked := c.Copy()
+		locked.Reference = ref
+
+		if c.SubmodulesEnabled() {
+			commits, err := resolveGitSubmodules(ctx, solver, locked)
+			if err != nil {
+				return c, xerrors.Errorf("could not resolve submodules of %s: %w", c.Source, err)
+			}
+			locked.SubmoduleCommits = nil
+			if len(commits) > 0 {
+				locked.SubmoduleCommits = commits
+			}
+		}
+
+		locked.CommitTime, err = resolveGitCommitTime(ctx, solver, locked)
+		if err != nil {
+			return c, xerrors.Errorf("could not resolve commit time of %s: %w", c.Source, err)
+		}
+
+		return locked, nil
+	case builddef.ContextTypeHTTP:
+		// Tarballs with a user-provided checksum aren't downloaded.
+		if c.Checksum != "" {
+			return c, nil
+		}
+
+		lockedURL, checksum, err := lockHTTPContextURL(ctx, solver, c)
+		if err != nil {
+			return c, err
+		}
+
+		locked := c.Copy()
+		locked.Source = lockedURL
+		locked.Checksum = checksum
+		return locked, nil
+	case builddef.ContextTypeImage:
+		ref, err := solver.ResolveImageRef(ctx, c.Source)
+		if err != nil {
+			return c, xerrors.Errorf("could not resolve image context %s: %w", c.Source, err)
+		}
+
+		locked := c.Copy()
+		locked.Source = ref
+		return locked, nil
+	}
+
+	// Local contexts can't be locked to a precise version.
+	return c, nil
+}
+
+// lockHTTPContextURL returns the URL and the checksum of the tarball of the
+// given HTTP context, downloaded by the given solver if it implements
+// HTTPSolver, or with the default HTTP client otherwise.
+func lockHTTPContextURL(ctx context.Context, solver StateSolver, c *builddef.Context) (string, string, error) {
+	if httpSolver, ok := solver.(HTTPSolver); ok {
+		return httpSolver.LockHTTPContext(ctx, c)
+	}
+	return llbutils.LockURL(ctx, nil, c.Source)
+}
+
+// resolveGitRef resolves the reference of the given git context with the
+// given solver if it implements GitSolver, or by running git in a container
+// otherwise.
+func resolveGitRef(ctx context.Context, solver StateSolver, c *builddef.Context) (string, error) {
+	if gitSolver, ok := solver.(GitSolver); ok {
+		return gitSolver.ResolveGitRef(ctx, c)
 	}
 
 	repoURI := normalizeRepoURI(c)
@@ -31,17 +104,65 @@ func LockContext(ctx context.Context, solver StateSolver, c *builddef.Context) (
 		fmt.Sprintf("git rev-parse -q --verify '%s'", sourceRef)}
 	out, err := solver.ExecImage(ctx, imageGit, cmd)
 	if err != nil {
-		return c, err
+		return "", err
+	}
+
+	return strings.Trim(out.String(), "\n"), nil
+}
+
+// resolveGitSubmodules returns the commits of the submodules of the given git
+// context with the given solver if it implements GitSolver, or by running
+// git in a container otherwise.
+func resolveGitSubmodules(ctx context.Context, solver StateSolver, c *builddef.Context) (map[string]string, error) {
+	if gitSolver, ok := solver.(GitSolver); ok {
+		return gitSolver.ResolveGitSubmodules(ctx, c)
+	}
+
+	cmd := []string{
+		fmt.Sprintf("git clone --quiet %s /tmp/repo 1>/dev/null 2>&1", normalizeRepoURI(c)),
+		"cd /tmp/repo",
+		fmt.Sprintf("git ls-tree -r '%s'", sourceRefOrHead(c))}
+	out, err := solver.ExecImage(ctx, imageGit, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each line has the following format: <mode> <type> <hash>\t<path>
+	commits := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		fields := strings.Fields(parts[0])
+		if len(parts) == 2 && len(fields) == 3 && fields[1] == "commit" {
+			commits[parts[1]] = fields[2]
+		}
+	}
+	return commits, nil
+}
+
+// resolveGitCommitTime returns the commit time of the given git context with
+// the given solver if it implements GitSolver, or by running git in a
+// container otherwise.
+func resolveGitCommitTime(ctx context.Context, solver StateSolver, c *builddef.Context) (int64, error) {
+	if gitSolver, ok := solver.(GitSolver); ok {
+		return gitSolver.ResolveGitCommitTime(ctx, c)
+	}
+
+	cmd := []string{
+		fmt.Sprintf("git clone --quiet %s /tmp/repo 1>/dev/null 2>&1", normalizeRepoURI(c)),
+		"cd /tmp/repo",
+		fmt.Sprintf("git log -1 --format=%%ct '%s'", sourceRefOrHead(c))}
+	out, err := solver.ExecImage(ctx, imageGit, cmd)
+	if err != nil {
+		return 0, err
 	}
 
-	locked := c.Copy()
-	locked.Reference = strings.Trim(out.String(), "\n")
-	return locked, nil
+	return strconv.ParseInt(strings.TrimSpace(out.String()), 10, 64)
 }
 
 func normalizeRepoURI(c *builddef.Context) string {
 	repoURI := c.Source
-	if !strings.HasPrefix(repoURI, "git://") {
+	// Sources without a scheme use the git protocol.
+	if !strings.Contains(repoURI, "://") {
 		repoURI = "git://" + repoURI
 	}
 	return repoURI
@@ -3,6 +3,9 @@ package statesolver_test
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
@@ -10,6 +13,7 @@ import (
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/go-test/deep"
 	"github.com/golang/mock/gomock"
+	"github.com/opencontainers/go-digest"
 )
 
 type lockContextTC struct {
@@ -27,6 +31,18 @@ func initLockGitBranchToASpecificReferenceTC(t *testing.T, mockCtrl *gomock.Cont
 		"git clone --quiet git://github.com/NiR-/zbuild-testrepo /tmp/repo 1>/dev/null 2>&1",
 		"cd /tmp/repo",
 		"git rev-parse -q --verify 'some-branch'"}).Return(outbuf, nil)
+	// Submodules are looked up even when the option isn't set, as BuildKit
+	// always fetches them.
+	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/akerouanton/zbuild-git:v0.1", []string{
+		"git clone --quiet git://github.com/NiR-/zbuild-testrepo /tmp/repo 1>/dev/null 2>&1",
+		"cd /tmp/repo",
+		"git ls-tree -r '6efe5ec4eeefbb601c31ff2b1f976e379500068a'"}).Return(
+		bytes.NewBufferString("100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391\tREADME\n"), nil)
+	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/akerouanton/zbuild-git:v0.1", []string{
+		"git clone --quiet git://github.com/NiR-/zbuild-testrepo /tmp/repo 1>/dev/null 2>&1",
+		"cd /tmp/repo",
+		"git log -1 --format=%ct '6efe5ec4eeefbb601c31ff2b1f976e379500068a'"}).Return(
+		bytes.NewBufferString("1588291200\n"), nil)
 
 	return lockContextTC{
 		context: builddef.Context{
@@ -41,15 +57,100 @@ func initLockGitBranchToASpecificReferenceTC(t *testing.T, mockCtrl *gomock.Cont
 			Source: "git://github.com/NiR-/zbuild-testrepo",
 			Type:   builddef.ContextTypeGit,
 			GitContext: builddef.GitContext{
-				Reference: "6efe5ec4eeefbb601c31ff2b1f976e379500068a",
+				Reference:  "6efe5ec4eeefbb601c31ff2b1f976e379500068a",
+				CommitTime: 1588291200,
 			},
 		},
 	}
 }
 
+func initLockGitSubmodulesTC(t *testing.T, mockCtrl *gomock.Controller) lockContextTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/akerouanton/zbuild-git:v0.1", []string{
+		"git clone --quiet git://github.com/NiR-/zbuild-testrepo /tmp/repo 1>/dev/null 2>&1",
+		"cd /tmp/repo",
+		"git rev-parse -q --verify 'some-branch'"}).Return(
+		bytes.NewBufferString("6efe5ec4eeefbb601c31ff2b1f976e379500068a\n"), nil)
+	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/akerouanton/zbuild-git:v0.1", []string{
+		"git clone --quiet git://github.com/NiR-/zbuild-testrepo /tmp/repo 1>/dev/null 2>&1",
+		"cd /tmp/repo",
+		"git ls-tree -r '6efe5ec4eeefbb601c31ff2b1f976e379500068a'"}).Return(
+		bytes.NewBufferString(
+			"100644 blob 8b137891791fe96927ad78e64b0aad7bded08bdc\t.gitmodules\n"+
+				"160000 commit 0aecc9fd6b1e9b0e3bc7e9d6dbb1d5b1e0f9d9a1\tvendor/some lib\n"+
+				"100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391\tREADME\n"), nil)
+	solver.EXPECT().ExecImage(gomock.Any(), "docker.io/akerouanton/zbuild-git:v0.1", []string{
+		"git clone --quiet git://github.com/NiR-/zbuild-testrepo /tmp/repo 1>/dev/null 2>&1",
+		"cd /tmp/repo",
+		"git log -1 --format=%ct '6efe5ec4eeefbb601c31ff2b1f976e379500068a'"}).Return(
+		bytes.NewBufferString("1588291200\n"), nil)
+
+	return lockContextTC{
+		context: builddef.Context{
+			Type:   builddef.ContextTypeGit,
+			Source: "git://github.com/NiR-/zbuild-testrepo",
+			GitContext: builddef.GitContext{
+				Reference:  "some-branch",
+				Submodules: &withSubmodules,
+			},
+		},
+		solver: solver,
+		expected: builddef.Context{
+			Source: "git://github.com/NiR-/zbuild-testrepo",
+			Type:   builddef.ContextTypeGit,
+			GitContext: builddef.GitContext{
+				Reference:  "6efe5ec4eeefbb601c31ff2b1f976e379500068a",
+				Submodules: &withSubmodules,
+				SubmoduleCommits: map[string]string{
+					"vendor/some lib": "0aecc9fd6b1e9b0e3bc7e9d6dbb1d5b1e0f9d9a1",
+				},
+				CommitTime: 1588291200,
+			},
+		},
+	}
+}
+
+func initLockImageContextTC(t *testing.T, mockCtrl *gomock.Controller) lockContextTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().ResolveImageRef(gomock.Any(), "registry.example.org/artefacts/api:v1").Return(
+		"registry.example.org/artefacts/api:v1@sha256:ab00606a42621fb68f2ed6ad3c88be54397f981a7b70a79db3d1172b11c4367d", nil)
+
+	return lockContextTC{
+		context: builddef.Context{
+			Type:   builddef.ContextTypeImage,
+			Source: "registry.example.org/artefacts/api:v1",
+		},
+		solver: solver,
+		expected: builddef.Context{
+			Type:   builddef.ContextTypeImage,
+			Source: "registry.example.org/artefacts/api:v1@sha256:ab00606a42621fb68f2ed6ad3c88be54397f981a7b70a79db3d1172b11c4367d",
+		},
+	}
+}
+
+func initLockHTTPContextWithChecksumTC(t *testing.T, mockCtrl *gomock.Controller) lockContextTC {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	c := builddef.Context{
+		Type:   builddef.ContextTypeHTTP,
+		Source: "https://example.org/src.tar.gz",
+		HTTPContext: builddef.HTTPContext{
+			Checksum: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		},
+	}
+
+	return lockContextTC{
+		context:  c,
+		solver:   solver,
+		expected: c,
+	}
+}
+
 func TestLockContext(t *testing.T) {
 	testcases := map[string]func(t *testing.T, mockCtrl *gomock.Controller) lockContextTC{
-		"lock git branch to a specific reference": initLockGitBranchToASpecificReferenceTC,
+		"lock git branch to a specific reference":     initLockGitBranchToASpecificReferenceTC,
+		"lock git submodules to specific commits":     initLockGitSubmodulesTC,
+		"lock image context to a digest":              initLockImageContextTC,
+		"keep the checksum provided for HTTP context": initLockHTTPContextWithChecksumTC,
 	}
 
 	for tcname := range testcases {
@@ -81,3 +182,49 @@ func TestLockContext(t *testing.T) {
 		})
 	}
 }
+
+func TestLockHTTPContext(t *testing.T) {
+	tarball := buildLayer(conformanceFiles)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest.tar.gz" {
+			http.Redirect(w, r, "/v1.tar.gz", http.StatusFound)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	ctx := context.Background()
+	locked, err := statesolver.LockContext(ctx, solver, &builddef.Context{
+		Type:   builddef.ContextTypeHTTP,
+		Source: srv.URL + "/latest.tar.gz",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := builddef.Context{
+		Type:   builddef.ContextTypeHTTP,
+		Source: srv.URL + "/v1.tar.gz",
+		HTTPContext: builddef.HTTPContext{
+			Checksum: digest.FromBytes(tarball).String(),
+		},
+	}
+	if diff := deep.Equal(*locked, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// The locked checksum is verified when reading files from the context.
+	locked.Checksum = digest.FromString("yolo").String()
+	_, err = statesolver.LocalSolver{}.ReadFile(ctx, "/composer.json",
+		statesolver.LocalSolver{}.FromContext(locked))
+	expectedErr := fmt.Sprintf("failed to read /composer.json from %s: checksum of %s doesn't match: expected %s, got %s",
+		locked.Source, locked.Source, locked.Checksum, expected.Checksum)
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected error: %v\nGot: %v", expectedErr, err)
+	}
+}
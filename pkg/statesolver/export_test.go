@@ -0,0 +1,4 @@
+package statesolver
+
+// ResolveSubmoduleURL is exported for tests only.
+var ResolveSubmoduleURL = resolveSubmoduleURL
@@ -0,0 +1,598 @@
+package statesolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// DefaultGitCacheDir returns the directory used by LocalSolver to cache git
+// repositories by default, or an empty string if the user cache dir can't be
+// determined.
+func DefaultGitCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "zbuild", "git")
+}
+
+// GitSolver is implemented by StateSolvers able to resolve git references
+// by themselves, instead of running git in a container.
+type GitSolver interface {
+	// ResolveGitRef returns the hash of the commit (or annotated tag) the
+	// reference of the given git context points to.
+	ResolveGitRef(ctx context.Context, c *builddef.Context) (string, error)
+	// ResolveGitSubmodules returns the commits of the submodules of the
+	// given git context, indexed by their path. The context reference has
+	// to be resolved already.
+	ResolveGitSubmodules(ctx context.Context, c *builddef.Context) (map[string]string, error)
+	// ResolveGitCommitTime returns the commit time of the given git context,
+	// in seconds since the Unix epoch. The context reference has to be
+	// resolved already.
+	ResolveGitCommitTime(ctx context.Context, c *builddef.Context) (int64, error)
+}
+
+// gitRemote implements the git operations needed by LocalSolver with
+// go-git. Repositories are fetched once per source and commit and cached in
+// cacheDir, or kept in memory when cacheDir is empty.
+type gitRemote struct {
+	url      string
+	cacheDir string
+	auth     transport.AuthMethod
+	// submodules indicates whether paths in submodules should be looked up
+	// in the repositories of the submodules.
+	submodules bool
+}
+
+// newGitRemote returns a gitRemote for the given context. lookupSecret is
+// used to find the token of contexts with an auth secret.
+func newGitRemote(
+	c *builddef.Context,
+	cacheDir string,
+	lookupSecret func(name string) (string, bool),
+) (gitRemote, error) {
+	remote := gitRemote{
+		url:        normalizeRepoURI(c),
+		cacheDir:   cacheDir,
+		submodules: c.SubmodulesEnabled(),
+	}
+
+	if c.AuthSecret != "" {
+		var token string
+		var ok bool
+		if lookupSecret != nil {
+			token, ok = lookupSecret(c.AuthSecret)
+		}
+		if !ok {
+			return remote, xerrors.Errorf("auth secret %q is not available", c.AuthSecret)
+		}
+		// This is the username used by BuildKit for auth tokens.
+		remote.auth = &githttp.BasicAuth{
+			Username: "x-access-token",
+			Password: token,
+		}
+	}
+
+	return remote, nil
+}
+
+// resolveRef finds the given reference (either HEAD, a branch, a tag, a full
+// reference name or a commit hash) in the remote repository. It returns the
+// hash it points to and the name of the matching reference, which is empty
+// when ref is a commit hash.
+func (r gitRemote) resolveRef(ref string) (plumbing.Hash, plumbing.ReferenceName, error) {
+	if plumbing.IsHash(ref) {
+		return plumbing.NewHash(ref), "", nil
+	}
+
+	refs, err := r.listRefs()
+	if err != nil {
+		return plumbing.ZeroHash, "", xerrors.Errorf("could not list references of %s: %w", r.url, err)
+	}
+
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+
+	candidates := []plumbing.ReferenceName{
+		plumbing.ReferenceName(ref),
+		plumbing.NewBranchReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
+	}
+	for _, name := range candidates {
+		found, ok := byName[name]
+		if !ok {
+			continue
+		}
+		// HEAD is usually a symbolic reference to the default branch.
+		if found.Type() == plumbing.SymbolicReference {
+			if found, ok = byName[found.Target()]; !ok {
+				continue
+			}
+		}
+		return found.Hash(), found.Name(), nil
+	}
+
+	return plumbing.ZeroHash, "", xerrors.Errorf("reference %q not found in %s", ref, r.url)
+}
+
+func (r gitRemote) listRefs() ([]*plumbing.Reference, error) {
+	if localPath := r.localPath(); localPath != "" {
+		repo, err := git.PlainOpen(localPath)
+		if err != nil {
+			return nil, err
+		}
+		iter, err := repo.Storer.IterReferences()
+		if err != nil {
+			return nil, err
+		}
+
+		var refs []*plumbing.Reference
+		err = iter.ForEach(func(ref *plumbing.Reference) error {
+			refs = append(refs, ref)
+			return nil
+		})
+		return refs, err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{r.url},
+	})
+	return remote.List(&git.ListOptions{Auth: r.auth})
+}
+
+// localPath returns the path of file:// repositories, or an empty string
+// for other repositories. Local repositories are opened in place, such that
+// reading them doesn't need git.
+func (r gitRemote) localPath() string {
+	if !strings.HasPrefix(r.url, "file://") {
+		return ""
+	}
+	return strings.TrimPrefix(r.url, "file://")
+}
+
+// open returns the repository fetched at the given reference, or at the
+// given commit when refName is empty (see fetch).
+func (r gitRemote) open(
+	ctx context.Context,
+	hash plumbing.Hash,
+	refName plumbing.ReferenceName,
+) (*git.Repository, error) {
+	if localPath := r.localPath(); localPath != "" {
+		return git.PlainOpen(localPath)
+	}
+
+	if r.cacheDir == "" {
+		logrus.Debugf("Fetching %s at %s", r.url, hash)
+
+		return r.fetchCommit(ctx, func() (*git.Repository, error) {
+			return git.Init(memory.NewStorage(), nil)
+		}, hash, refName)
+	}
+
+	sum := sha256.Sum256([]byte(r.url + "\x00" + hash.String()))
+	repoDir := filepath.Join(r.cacheDir, hex.EncodeToString(sum[:]))
+	if repo, err := git.PlainOpen(repoDir); err == nil {
+		return repo, nil
+	}
+
+	logrus.Debugf("Fetching %s at %s into %s", r.url, hash, repoDir)
+
+	if err := os.MkdirAll(r.cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	// The repository is fetched in a temporary dir first, such that
+	// concurrent runs never open partially fetched repositories.
+	tmpdir, err := ioutil.TempDir(r.cacheDir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	_, err = r.fetchCommit(ctx, func() (*git.Repository, error) {
+		if err := os.RemoveAll(tmpdir); err != nil {
+			return nil, err
+		}
+		return git.PlainInit(tmpdir, true)
+	}, hash, refName)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpdir, repoDir); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	return git.PlainOpen(repoDir)
+}
+
+// fetchCommit fetches the given commit through refName, or by its hash when
+// refName is empty, into the repository returned by newRepo. The reference
+// might have moved since it got resolved. In such case, the commit is
+// fetched by its hash into a new repository, as the remote wouldn't send
+// the parents of commits already fetched. This ensures a moved reference
+// never ends up cached under the hash it was resolved to.
+func (r gitRemote) fetchCommit(
+	ctx context.Context,
+	newRepo func() (*git.Repository, error),
+	hash plumbing.Hash,
+	refName plumbing.ReferenceName,
+) (*git.Repository, error) {
+	repo, err := newRepo()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.fetch(ctx, repo, hash, refName); err != nil {
+		return nil, err
+	}
+
+	_, err = gitCommit(repo, hash)
+	if err != nil && refName != "" {
+		logrus.Debugf("%s moved since it got resolved, fetching %s by its hash", refName, hash)
+		return r.fetchCommit(ctx, newRepo, hash, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// fetchedRef is the reference commits fetched by their hash are stored to.
+const fetchedRef = "refs/zbuild/fetched"
+
+// fetch fetches the given reference, or the given commit when refName is
+// empty, into repo with a depth of 1. Remotes that don't allow fetching
+// commits by their hash are fully fetched instead.
+func (r gitRemote) fetch(
+	ctx context.Context,
+	repo *git.Repository,
+	hash plumbing.Hash,
+	refName plumbing.ReferenceName,
+) error {
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{r.url},
+	})
+	if err != nil {
+		return err
+	}
+
+	opts := &git.FetchOptions{
+		Auth:  r.auth,
+		Depth: 1,
+		Tags:  git.NoTags,
+	}
+	if refName != "" {
+		opts.RefSpecs = []config.RefSpec{
+			config.RefSpec(fmt.Sprintf("+%s:%s", refName, refName)),
+		}
+	} else {
+		opts.RefSpecs = []config.RefSpec{
+			config.RefSpec(fmt.Sprintf("%s:%s", hash, fetchedRef)),
+		}
+	}
+
+	err = remote.FetchContext(ctx, opts)
+	if refName == "" && xerrors.Is(err, git.ErrExactSHA1NotSupported) {
+		logrus.Debugf("%s doesn't allow fetching commits by hash, fetching the whole repository", r.url)
+		// Locked annotated tags aren't reachable from any branch, so tags
+		// have to be fetched too.
+		opts.Depth = 0
+		opts.Tags = git.AllTags
+		opts.RefSpecs = []config.RefSpec{
+			config.RefSpec(fmt.Sprintf(config.DefaultFetchRefSpec, git.DefaultRemoteName)),
+		}
+		err = remote.FetchContext(ctx, opts)
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	return nil
+}
+
+// gitCommit returns the given commit, or the commit the given annotated tag
+// points to.
+func gitCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	commit, err := repo.CommitObject(hash)
+	if xerrors.Is(err, plumbing.ErrObjectNotFound) {
+		var tag *object.Tag
+		if tag, err = repo.TagObject(hash); err == nil {
+			commit, err = tag.Commit()
+		}
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("could not find commit %s: %w", hash, err)
+	}
+
+	return commit, nil
+}
+
+// gitTree returns the tree of the given commit (or annotated tag).
+func gitTree(repo *git.Repository, hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := gitCommit(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return commit.Tree()
+}
+
+// gitEntry is a path found in the tree of a commit, or in the tree of the
+// commit of one of its submodules.
+type gitEntry struct {
+	repo *git.Repository
+	// entry is nil for the root dir of the tree.
+	entry *object.TreeEntry
+}
+
+// findEntry finds the given path in the tree of the given commit (or
+// annotated tag), following symlinks. When submodules are enabled, paths in
+// submodules are looked up in their own repository. It returns a
+// FileNotFound error if there's no such path.
+func (r gitRemote) findEntry(
+	ctx context.Context,
+	repo *git.Repository,
+	hash plumbing.Hash,
+	fpath string,
+) (gitEntry, error) {
+	tree, err := gitTree(repo, hash)
+	if err != nil {
+		return gitEntry{}, err
+	}
+
+	for i := 0; i <= maxSymlinks; i++ {
+		fpath = strings.Trim(path.Clean("/"+fpath), "/")
+		if fpath == "" {
+			return gitEntry{repo: repo}, nil
+		}
+
+		entry, err := tree.FindEntry(fpath)
+		// Looking up a path below a file or a submodule fails with
+		// ErrObjectNotFound, as there's no tree object to look into.
+		if xerrors.Is(err, object.ErrEntryNotFound) ||
+			xerrors.Is(err, object.ErrDirectoryNotFound) ||
+			xerrors.Is(err, plumbing.ErrObjectNotFound) {
+			if r.submodules {
+				return r.findSubmoduleEntry(ctx, tree, fpath)
+			}
+			return gitEntry{}, FileNotFound
+		} else if err != nil {
+			return gitEntry{}, err
+		}
+		if entry.Mode != filemode.Symlink {
+			return gitEntry{repo: repo, entry: entry}, nil
+		}
+
+		blob, err := repo.BlobObject(entry.Hash)
+		if err != nil {
+			return gitEntry{}, err
+		}
+		target, err := readBlob(blob)
+		if err != nil {
+			return gitEntry{}, err
+		}
+		if !path.IsAbs(string(target)) {
+			target = []byte(path.Join(path.Dir(fpath), string(target)))
+		}
+		fpath = string(target)
+	}
+
+	return gitEntry{}, xerrors.Errorf("too many levels of symbolic links")
+}
+
+// findSubmoduleEntry looks for a submodule in the parent dirs of the given
+// path, and finds the rest of the path in the repository of the submodule.
+func (r gitRemote) findSubmoduleEntry(
+	ctx context.Context,
+	tree *object.Tree,
+	fpath string,
+) (gitEntry, error) {
+	segments := strings.Split(fpath, "/")
+	for i := 1; i < len(segments); i++ {
+		subpath := strings.Join(segments[:i], "/")
+		entry, err := tree.FindEntry(subpath)
+		if err != nil {
+			break
+		}
+		if entry.Mode != filemode.Submodule {
+			continue
+		}
+
+		sub, err := r.submodule(tree, subpath)
+		if err != nil {
+			return gitEntry{}, err
+		}
+		subRepo, err := sub.open(ctx, entry.Hash, "")
+		if err != nil {
+			return gitEntry{}, xerrors.Errorf("could not fetch submodule %s from %s: %w", subpath, sub.url, err)
+		}
+		return sub.findEntry(ctx, subRepo, entry.Hash, strings.Join(segments[i:], "/"))
+	}
+
+	return gitEntry{}, FileNotFound
+}
+
+// submodule returns the remote of the submodule at the given path, as
+// declared in the .gitmodules file of the given tree. Relative URLs are
+// resolved against the URL of r.
+func (r gitRemote) submodule(tree *object.Tree, subpath string) (gitRemote, error) {
+	file, err := tree.File(".gitmodules")
+	if err != nil {
+		return gitRemote{}, xerrors.Errorf("could not read .gitmodules: %w", err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return gitRemote{}, xerrors.Errorf("could not read .gitmodules: %w", err)
+	}
+
+	modules := config.NewModules()
+	if err := modules.Unmarshal([]byte(content)); err != nil {
+		return gitRemote{}, xerrors.Errorf("could not parse .gitmodules: %w", err)
+	}
+
+	for _, module := range modules.Submodules {
+		if path.Clean(module.Path) != subpath {
+			continue
+		}
+
+		sub := r
+		subURL, err := resolveSubmoduleURL(r.url, module.URL)
+		if err != nil {
+			return gitRemote{}, xerrors.Errorf("invalid URL for submodule %s: %w", subpath, err)
+		}
+		sub.url = subURL
+		// Submodules might be hosted by third parties, so the credentials of
+		// the parent repository are only sent to its own host.
+		if !sameGitHost(r.url, sub.url) {
+			sub.auth = nil
+		}
+		return sub, nil
+	}
+
+	return gitRemote{}, xerrors.Errorf("submodule %s not found in .gitmodules", subpath)
+}
+
+// resolveSubmoduleURL returns the URL of a submodule declared with the given
+// URL in the .gitmodules file of the repository at parentURL. Relative URLs
+// are resolved against the parent URL, which might be scp-like (e.g.
+// git@github.com:org/repo.git).
+func resolveSubmoduleURL(parentURL, submoduleURL string) (string, error) {
+	if !strings.HasPrefix(submoduleURL, "./") && !strings.HasPrefix(submoduleURL, "../") {
+		return submoduleURL, nil
+	}
+
+	ep, err := transport.NewEndpoint(parentURL)
+	if err != nil {
+		return "", err
+	}
+	ep.Path = path.Join(ep.Path, submoduleURL)
+	return ep.String(), nil
+}
+
+// sameGitHost checks whether both repository URLs (including scp-like ones)
+// point to the same host and port.
+func sameGitHost(a, b string) bool {
+	epA, err := transport.NewEndpoint(a)
+	if err != nil {
+		return false
+	}
+	epB, err := transport.NewEndpoint(b)
+	if err != nil {
+		return false
+	}
+	return epA.Host == epB.Host && epA.Port == epB.Port
+}
+
+// submoduleCommits returns the commits of the submodules found in the tree of
+// the given commit, indexed by their path. Nested submodules aren't listed.
+func submoduleCommits(repo *git.Repository, hash plumbing.Hash) (map[string]string, error) {
+	tree, err := gitTree(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := map[string]string{}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if entry.Mode == filemode.Submodule {
+			commits[name] = entry.Hash.String()
+		}
+	}
+
+	return commits, nil
+}
+
+// readFile reads the given file from the tree of the given commit (or
+// annotated tag). It returns a FileNotFound error if there's no such file.
+func (r gitRemote) readFile(
+	ctx context.Context,
+	repo *git.Repository,
+	hash plumbing.Hash,
+	fpath string,
+) ([]byte, error) {
+	found, err := r.findEntry(ctx, repo, hash, fpath)
+	if err != nil {
+		return nil, err
+	}
+	if found.entry == nil || !found.entry.Mode.IsFile() {
+		return nil, xerrors.Errorf("could not fetch path %q, it's not a regular file", fpath)
+	}
+
+	blob, err := found.repo.BlobObject(found.entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return readBlob(blob)
+}
+
+// stat stats the given path from the tree of the given commit (or annotated
+// tag). It returns a FileNotFound error if there's no such path.
+func (r gitRemote) stat(
+	ctx context.Context,
+	repo *git.Repository,
+	hash plumbing.Hash,
+	fpath string,
+) (FileInfo, error) {
+	found, err := r.findEntry(ctx, repo, hash, fpath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if found.entry == nil {
+		return newFileInfo(0, os.ModeDir|0755), nil
+	}
+
+	mode, err := found.entry.Mode.ToOSFileMode()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !mode.IsRegular() {
+		return newFileInfo(0, mode), nil
+	}
+
+	blob, err := found.repo.BlobObject(found.entry.Hash)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return newFileInfo(blob.Size, mode), nil
+}
+
+func readBlob(blob *object.Blob) ([]byte, error) {
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,771 @@
+package statesolver_test
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-test/deep"
+	"golang.org/x/xerrors"
+)
+
+// withSubmodules is used to enable submodules of git contexts.
+var withSubmodules = true
+
+type testRepo struct {
+	dir     string
+	commits map[string]string
+}
+
+// newTestRepo creates a git repository with two commits: the first one is
+// tagged v1.0 (with an annotated tag) and the second one is on the master
+// branch. A feature branch is also created from the first commit.
+func newTestRepo(t *testing.T) testRepo {
+	dir, err := ioutil.TempDir("", "zbuild-gitrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go-git doesn't write the config file of new repositories, but it's
+	// needed to serve them.
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	author := &object.Signature{
+		Name:  "zbuild",
+		Email: "zbuild@example.org",
+		When:  time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	commit := func(files map[string]string, msg string) plumbing.Hash {
+		for name, content := range files {
+			fullpath := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(fullpath, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, err := wt.Commit(msg, &git.CommitOptions{Author: author})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	first := commit(map[string]string{
+		"composer.json": `{"name": "zbuild/testrepo"}`,
+		"app/index.php": "<?php echo 'v1';",
+	}, "First commit")
+	tag, err := repo.CreateTag("v1.0", first, &git.CreateTagOptions{
+		Tagger:  author,
+		Message: "v1.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(
+		plumbing.NewBranchReferenceName("feature"), first)); err != nil {
+		t.Fatal(err)
+	}
+
+	second := commit(map[string]string{
+		"app/index.php": "<?php echo 'v2';",
+	}, "Second commit")
+
+	return testRepo{
+		dir: dir,
+		commits: map[string]string{
+			"first":  first.String(),
+			"tag":    tag.Hash().String(),
+			"second": second.String(),
+		},
+	}
+}
+
+func (r testRepo) context(ref string) *builddef.Context {
+	return &builddef.Context{
+		Type:   builddef.ContextTypeGit,
+		Source: "file://" + r.dir,
+		GitContext: builddef.GitContext{
+			Reference: ref,
+		},
+	}
+}
+
+func TestLocalSolverReadFileFromGitContext(t *testing.T) {
+	testcases := map[string]struct {
+		ref         string
+		filepath    string
+		expected    string
+		expectedErr error
+	}{
+		"read a file from HEAD": {
+			filepath: "/app/index.php",
+			expected: "<?php echo 'v2';",
+		},
+		"read a file from a branch": {
+			ref:      "feature",
+			filepath: "app/index.php",
+			expected: "<?php echo 'v1';",
+		},
+		"read a file from an annotated tag": {
+			ref:      "v1.0",
+			filepath: "/app/index.php",
+			expected: "<?php echo 'v1';",
+		},
+		"read a file from a commit": {
+			ref:      "first",
+			filepath: "/composer.json",
+			expected: `{"name": "zbuild/testrepo"}`,
+		},
+		"fail to read a nonexistent file": {
+			filepath:    "/composer.lock",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"fail to read a file from a nonexistent dir": {
+			filepath:    "/src/index.php",
+			expectedErr: statesolver.FileNotFound,
+		},
+	}
+
+	repo := newTestRepo(t)
+	defer os.RemoveAll(repo.dir)
+
+	cacheDir, err := ioutil.TempDir("", "zbuild-gitcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		// Subtests aren't run in parallel as the repository is removed once
+		// the parent test returns.
+		t.Run(tcname, func(t *testing.T) {
+			ref := tc.ref
+			if commit, ok := repo.commits[ref]; ok {
+				ref = commit
+			}
+
+			solver := statesolver.LocalSolver{GitCacheDir: cacheDir}
+			ctx := context.Background()
+			content, err := solver.ReadFile(ctx, tc.filepath,
+				solver.FromContext(repo.context(ref)))
+
+			if tc.expectedErr != nil {
+				if !xerrors.Is(err, tc.expectedErr) {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if string(content) != tc.expected {
+				t.Fatalf("Expected: %q\nGot: %q", tc.expected, string(content))
+			}
+		})
+	}
+}
+
+func TestLocalSolverFileExistsInGitContext(t *testing.T) {
+	repo := newTestRepo(t)
+	defer os.RemoveAll(repo.dir)
+
+	solver := statesolver.LocalSolver{}
+	ctx := context.Background()
+
+	for filepath, expected := range map[string]bool{
+		"/composer.json": true,
+		"/composer.lock": false,
+	} {
+		exists, err := solver.FileExists(ctx, filepath, repo.context(""))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if exists != expected {
+			t.Errorf("Expected FileExists(%q) to be %t, got %t.", filepath, expected, exists)
+		}
+	}
+}
+
+func TestLocalSolverLockGitContext(t *testing.T) {
+	repo := newTestRepo(t)
+	defer os.RemoveAll(repo.dir)
+
+	testcases := map[string]struct {
+		ref         string
+		expected    string
+		expectedErr string
+	}{
+		"lock HEAD": {
+			expected: repo.commits["second"],
+		},
+		"lock a branch": {
+			ref:      "feature",
+			expected: repo.commits["first"],
+		},
+		"lock an annotated tag": {
+			ref:      "v1.0",
+			expected: repo.commits["tag"],
+		},
+		"fail to lock a nonexistent reference": {
+			ref:         "yolo",
+			expectedErr: "reference \"yolo\" not found in file://" + repo.dir,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		t.Run(tcname, func(t *testing.T) {
+			solver := statesolver.LocalSolver{}
+			ctx := context.Background()
+			locked, err := statesolver.LockContext(ctx, solver, repo.context(tc.ref))
+
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			expected := repo.context(tc.expected)
+			// All the commits of the test repo are made at the same time.
+			expected.CommitTime = time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC).Unix()
+			if diff := deep.Equal(locked, expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+// newTestRepoWithSubmodule creates a repository with a lib submodule, pointing
+// to another repository through the given URL (e.g. a relative URL). It
+// returns the dir containing both repositories, and the commit of the
+// submodule.
+func newTestRepoWithSubmodule(t *testing.T, submoduleURL string) (string, string) {
+	dir, err := ioutil.TempDir("", "zbuild-gitrepos")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	author := &object.Signature{
+		Name:  "zbuild",
+		Email: "zbuild@example.org",
+		When:  time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	initRepo := func(name string, files map[string]string) (*git.Repository, *git.Worktree) {
+		repoDir := filepath.Join(dir, name)
+		repo, err := git.PlainInit(repoDir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := repo.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+		wt, err := repo.Worktree()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(repoDir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return repo, wt
+	}
+
+	_, libWt := initRepo("lib", map[string]string{
+		"README": "Some lib",
+	})
+	libCommit, err := libWt.Commit("Add README", &git.CommitOptions{Author: author})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, wt := initRepo("app", map[string]string{
+		"composer.json": `{"name": "zbuild/app"}`,
+		".gitmodules":   "[submodule \"lib\"]\n\tpath = lib\n\turl = " + submoduleURL + "\n",
+	})
+	// go-git can't add submodules, so the submodule entry is added to the
+	// index by hand.
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Entries = append(idx.Entries, &index.Entry{
+		Name: "lib",
+		Hash: libCommit,
+		Mode: filemode.Submodule,
+	})
+	if err := repo.Storer.SetIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Commit("Add lib submodule", &git.CommitOptions{Author: author}); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, libCommit.String()
+}
+
+func TestLocalSolverReadFileFromGitSubmodule(t *testing.T) {
+	testcases := map[string]struct {
+		submodules  bool
+		filepath    string
+		expected    string
+		expectedErr error
+	}{
+		"read a file from a submodule": {
+			submodules: true,
+			filepath:   "/lib/README",
+			expected:   "Some lib",
+		},
+		"read a file from the parent repository": {
+			submodules: true,
+			filepath:   "/composer.json",
+			expected:   `{"name": "zbuild/app"}`,
+		},
+		"fail to read a nonexistent file from a submodule": {
+			submodules:  true,
+			filepath:    "/lib/LICENSE",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"read a file from a submodule when the option isn't set": {
+			filepath: "/lib/README",
+			expected: "Some lib",
+		},
+	}
+
+	dir, _ := newTestRepoWithSubmodule(t, "../lib")
+	defer os.RemoveAll(dir)
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		// Subtests aren't run in parallel as the repositories are removed
+		// once the parent test returns.
+		t.Run(tcname, func(t *testing.T) {
+			solver := statesolver.LocalSolver{}
+			c := &builddef.Context{
+				Type:   builddef.ContextTypeGit,
+				Source: "file://" + filepath.Join(dir, "app"),
+			}
+			if tc.submodules {
+				c.Submodules = &withSubmodules
+			}
+
+			ctx := context.Background()
+			content, err := solver.ReadFile(ctx, tc.filepath, solver.FromContext(c))
+
+			if tc.expectedErr != nil {
+				if !xerrors.Is(err, tc.expectedErr) {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if string(content) != tc.expected {
+				t.Fatalf("Expected: %q\nGot: %q", tc.expected, string(content))
+			}
+		})
+	}
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	testcases := map[string]struct {
+		parentURL    string
+		submoduleURL string
+		expected     string
+	}{
+		"keep absolute URLs": {
+			parentURL:    "https://github.com/org/app.git",
+			submoduleURL: "https://gitlab.com/org/lib.git",
+			expected:     "https://gitlab.com/org/lib.git",
+		},
+		"resolve relative URLs against HTTPS URLs": {
+			parentURL:    "https://github.com/org/app.git",
+			submoduleURL: "../lib.git",
+			expected:     "https://github.com/org/lib.git",
+		},
+		"resolve relative URLs against scp-like URLs": {
+			parentURL:    "git@github.com:org/app.git",
+			submoduleURL: "../lib.git",
+			expected:     "ssh://git@github.com/org/lib.git",
+		},
+		"resolve relative URLs against file URLs": {
+			parentURL:    "file:///srv/git/app",
+			submoduleURL: "./lib",
+			expected:     "file:///srv/git/app/lib",
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			t.Parallel()
+
+			resolved, err := statesolver.ResolveSubmoduleURL(tc.parentURL, tc.submoduleURL)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resolved != tc.expected {
+				t.Fatalf("Expected: %s\nGot: %s", tc.expected, resolved)
+			}
+		})
+	}
+}
+
+func TestLocalSolverLockGitContextWithSubmodules(t *testing.T) {
+	dir, libCommit := newTestRepoWithSubmodule(t, "../lib")
+	defer os.RemoveAll(dir)
+
+	solver := statesolver.LocalSolver{}
+	ctx := context.Background()
+	locked, err := statesolver.LockContext(ctx, solver, &builddef.Context{
+		Type:   builddef.ContextTypeGit,
+		Source: "file://" + filepath.Join(dir, "app"),
+		GitContext: builddef.GitContext{
+			Submodules: &withSubmodules,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]string{"lib": libCommit}
+	if diff := deep.Equal(locked.SubmoduleCommits, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestLocalSolverGitAuthSecret(t *testing.T) {
+	var authHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	c := &builddef.Context{
+		Type:   builddef.ContextTypeGit,
+		Source: srv.URL + "/private/repo.git",
+		GitContext: builddef.GitContext{
+			AuthSecret: "GIT_AUTH_TOKEN",
+		},
+	}
+	ctx := context.Background()
+
+	solver := statesolver.LocalSolver{}
+	_, err := solver.ResolveGitRef(ctx, c)
+	expectedErr := "auth secret \"GIT_AUTH_TOKEN\" is not available"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected: %v\nGot: %v", expectedErr, err)
+	}
+
+	solver.LookupSecret = func(name string) (string, bool) {
+		return "some-token", name == "GIT_AUTH_TOKEN"
+	}
+	if _, err := solver.ResolveGitRef(ctx, c); err == nil {
+		t.Fatal("Expected an error as the repository doesn't exist.")
+	}
+
+	expectedHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:some-token"))
+	if authHeader != expectedHeader {
+		t.Fatalf("Expected: %q\nGot: %q", expectedHeader, authHeader)
+	}
+}
+
+func TestLocalSolverGitAuthSecretIsOnlySentToTheSameHost(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is needed to serve repositories over HTTP")
+	}
+
+	// Both servers serve the repositories from dir, which is known once the
+	// submodule URL is.
+	var dir string
+	newGitServer := func(authHeader *string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if header := r.Header.Get("Authorization"); header != "" {
+				*authHeader = header
+			}
+			handler := &cgi.Handler{
+				Path: gitBin,
+				Args: []string{"http-backend"},
+				Env: []string{
+					"GIT_PROJECT_ROOT=" + dir,
+					"GIT_HTTP_EXPORT_ALL=1",
+				},
+			}
+			handler.ServeHTTP(w, r)
+		}))
+	}
+
+	var appAuthHeader, libAuthHeader string
+	appSrv := newGitServer(&appAuthHeader)
+	defer appSrv.Close()
+	libSrv := newGitServer(&libAuthHeader)
+	defer libSrv.Close()
+
+	libURL := strings.Replace(libSrv.URL, "127.0.0.1", "localhost", 1) + "/lib"
+	dir, _ = newTestRepoWithSubmodule(t, libURL)
+	defer os.RemoveAll(dir)
+
+	cacheDir, err := ioutil.TempDir("", "zbuild-gitcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	solver := statesolver.LocalSolver{
+		GitCacheDir: cacheDir,
+		LookupSecret: func(name string) (string, bool) {
+			return "some-token", name == "GIT_AUTH_TOKEN"
+		},
+	}
+	c := &builddef.Context{
+		Type:   builddef.ContextTypeGit,
+		Source: appSrv.URL + "/app",
+		GitContext: builddef.GitContext{
+			AuthSecret: "GIT_AUTH_TOKEN",
+			Submodules: &withSubmodules,
+		},
+	}
+
+	content, err := solver.ReadFile(context.Background(), "/lib/README", solver.FromContext(c))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if string(content) != "Some lib" {
+		t.Fatalf("Unexpected content: %q", content)
+	}
+
+	expectedHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:some-token"))
+	if appAuthHeader != expectedHeader {
+		t.Fatalf("Expected: %q\nGot: %q", expectedHeader, appAuthHeader)
+	}
+	if libAuthHeader != "" {
+		t.Fatalf("Expected no credentials to be sent to the host of the submodule, got %q.", libAuthHeader)
+	}
+}
+
+func TestLocalSolverFetchGitCommit(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is needed to serve repositories over HTTP")
+	}
+
+	testcases := map[string]struct {
+		allowSHA1InWant bool
+		// expectShallow indicates whether only the locked commit should be
+		// fetched, without its parents.
+		expectShallow bool
+	}{
+		"fetch only the locked commit": {
+			allowSHA1InWant: true,
+			expectShallow:   true,
+		},
+		"fetch the whole repository when the server doesn't allow fetching commits": {
+			allowSHA1InWant: false,
+			expectShallow:   false,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			repo := newTestRepo(t)
+			defer os.RemoveAll(repo.dir)
+
+			cmd := exec.Command(gitBin, "-C", repo.dir, "config",
+				"uploadpack.allowReachableSHA1InWant", strconv.FormatBool(tc.allowSHA1InWant))
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+
+			srv := httptest.NewServer(&cgi.Handler{
+				Path: gitBin,
+				Args: []string{"http-backend"},
+				Env: []string{
+					"GIT_PROJECT_ROOT=" + filepath.Dir(repo.dir),
+					"GIT_HTTP_EXPORT_ALL=1",
+				},
+			})
+			defer srv.Close()
+
+			cacheDir, err := ioutil.TempDir("", "zbuild-gitcache")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(cacheDir)
+
+			c := &builddef.Context{
+				Type:   builddef.ContextTypeGit,
+				Source: srv.URL + "/" + filepath.Base(repo.dir),
+				GitContext: builddef.GitContext{
+					Reference: repo.commits["second"],
+				},
+			}
+			solver := statesolver.LocalSolver{GitCacheDir: cacheDir}
+
+			content, err := solver.ReadFile(context.Background(), "app/index.php", solver.FromContext(c))
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if string(content) != "<?php echo 'v2';" {
+				t.Fatalf("Unexpected content: %q", content)
+			}
+
+			dirs, err := ioutil.ReadDir(cacheDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dirs) != 1 {
+				t.Fatalf("Expected a single cached repository, got %d.", len(dirs))
+			}
+			fetched, err := git.PlainOpen(filepath.Join(cacheDir, dirs[0].Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = fetched.CommitObject(plumbing.NewHash(repo.commits["first"]))
+			if tc.expectShallow && !xerrors.Is(err, plumbing.ErrObjectNotFound) {
+				t.Fatalf("Expected the parent commit not to be fetched, got: %v", err)
+			}
+			if !tc.expectShallow && err != nil {
+				t.Fatalf("Expected the parent commit to be fetched, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalSolverFetchGitBranchMovedSinceResolved(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is needed to serve repositories over HTTP")
+	}
+
+	repo := newTestRepo(t)
+	defer os.RemoveAll(repo.dir)
+
+	cmd := exec.Command(gitBin, "-C", repo.dir, "config", "uploadpack.allowReachableSHA1InWant", "true")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	backend := &cgi.Handler{
+		Path: gitBin,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Dir(repo.dir),
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+	// The master branch is moved right after refs got listed the first
+	// time, that is after the solver resolved it but before it fetches it.
+	var listed bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backend.ServeHTTP(w, r)
+		if listed || !strings.HasSuffix(r.URL.Path, "/info/refs") {
+			return
+		}
+		listed = true
+
+		cmd := exec.Command(gitBin, "-C", repo.dir,
+			"-c", "user.name=zbuild", "-c", "user.email=zbuild@example.org",
+			"commit", "--allow-empty", "-m", "Third commit")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("%v: %s", err, out)
+		}
+	}))
+	defer srv.Close()
+
+	cacheDir, err := ioutil.TempDir("", "zbuild-gitcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	c := &builddef.Context{
+		Type:   builddef.ContextTypeGit,
+		Source: srv.URL + "/" + filepath.Base(repo.dir),
+		GitContext: builddef.GitContext{
+			Reference: "master",
+		},
+	}
+	solver := statesolver.LocalSolver{GitCacheDir: cacheDir}
+
+	content, err := solver.ReadFile(context.Background(), "app/index.php", solver.FromContext(c))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if string(content) != "<?php echo 'v2';" {
+		t.Fatalf("Unexpected content: %q", content)
+	}
+
+	dirs, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 {
+		t.Fatalf("Expected a single cached repository, got %d.", len(dirs))
+	}
+	fetched, err := git.PlainOpen(filepath.Join(cacheDir, dirs[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetched.CommitObject(plumbing.NewHash(repo.commits["second"])); err != nil {
+		t.Fatalf("Expected the resolved commit to be cached, got: %v", err)
+	}
+}
@@ -0,0 +1,361 @@
+package statesolver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// TarballCache keeps the tarballs of HTTP contexts downloaded by a solver,
+// such that each tarball is downloaded once per URL and checksum for the
+// lifetime of the solver. Tarballs with a checksum are stored in Dir, named
+// after their checksum like the blobs cached by RegistrySolver, and are thus
+// reused across runs. Other tarballs (and all of them when Dir is empty) are
+// kept in memory.
+type TarballCache struct {
+	Dir string
+
+	mu       sync.Mutex
+	tarballs map[string]*cachedTarball
+}
+
+type cachedTarball struct {
+	once    sync.Once
+	tarball tarball
+	err     error
+}
+
+// HTTPSolver is implemented by StateSolvers able to download the tarballs of
+// HTTP contexts by themselves. Tarballs are then downloaded once to lock and
+// read them.
+type HTTPSolver interface {
+	// LockHTTPContext downloads the tarball of the given HTTP context and
+	// returns the URL it's been downloaded from (once redirects are followed)
+	// along with its sha256 checksum.
+	LockHTTPContext(ctx context.Context, c *builddef.Context) (string, string, error)
+}
+
+func NewTarballCache(dir string) *TarballCache {
+	return &TarballCache{
+		Dir:      dir,
+		tarballs: map[string]*cachedTarball{},
+	}
+}
+
+// get returns the tarball of the given context, or downloads it with the
+// given func. Concurrent calls for the same tarball wait for the download
+// started by the first one. Failed downloads are retried by next calls.
+func (tc *TarballCache) get(
+	c *builddef.Context,
+	download func(path string) (tarball, error),
+) (tarball, error) {
+	key := c.Source + "\x00" + c.Checksum
+
+	tc.mu.Lock()
+	cached, ok := tc.tarballs[key]
+	if !ok {
+		cached = &cachedTarball{}
+		tc.tarballs[key] = cached
+	}
+	tc.mu.Unlock()
+
+	cached.once.Do(func() {
+		path := tc.path(c)
+		if path != "" {
+			if _, err := os.Stat(path); err == nil {
+				cached.tarball = tarball{path: path}
+				return
+			}
+		}
+		cached.tarball, cached.err = download(path)
+	})
+	if cached.err != nil {
+		tc.mu.Lock()
+		if tc.tarballs[key] == cached {
+			delete(tc.tarballs, key)
+		}
+		tc.mu.Unlock()
+		return tarball{}, cached.err
+	}
+
+	return cached.tarball, nil
+}
+
+// add stores the given tarball as the one of the given context, unless
+// there's already one. It's written to Dir when it's kept in memory and the
+// context has a checksum.
+func (tc *TarballCache) add(c *builddef.Context, t tarball) {
+	key := c.Source + "\x00" + c.Checksum
+
+	tc.mu.Lock()
+	cached, ok := tc.tarballs[key]
+	if !ok {
+		cached = &cachedTarball{}
+		tc.tarballs[key] = cached
+	}
+	tc.mu.Unlock()
+
+	cached.once.Do(func() {
+		cached.tarball = t
+		path := tc.path(c)
+		if path == "" || t.path != "" {
+			return
+		}
+		err := lockcache.WriteFileAtomic(path, func(w io.Writer) error {
+			_, err := w.Write(t.raw)
+			return err
+		})
+		if err != nil {
+			logrus.Debugf("Could not store %s in the tarball cache: %v", c.Source, err)
+			return
+		}
+		cached.tarball = tarball{path: path, url: t.url, digest: t.digest}
+	})
+}
+
+// path returns the path where the tarball of the given context is stored, or
+// an empty string if it has to be kept in memory.
+func (tc *TarballCache) path(c *builddef.Context) string {
+	if tc.Dir == "" || c.Checksum == "" {
+		return ""
+	}
+	dgst, err := digest.Parse(c.Checksum)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(tc.Dir, dgst.Algorithm().String(), dgst.Hex())
+}
+
+// tarball is a tarball stored either in memory or on disk. Downloaded
+// tarballs also have the URL they've been downloaded from, once redirects
+// are followed, and their digest.
+type tarball struct {
+	raw    []byte
+	path   string
+	url    string
+	digest digest.Digest
+}
+
+func (t tarball) open() (io.ReadCloser, error) {
+	if t.path != "" {
+		return os.Open(t.path)
+	}
+	return ioutil.NopCloser(bytes.NewReader(t.raw)), nil
+}
+
+// fetchTarball returns the tarball of the given HTTP context, from the given
+// cache if it's not nil. Downloaded tarballs are verified against the
+// checksum of the context if it has one.
+func fetchTarball(
+	ctx context.Context,
+	client *http.Client,
+	cache *TarballCache,
+	c *builddef.Context,
+) (tarball, error) {
+	if cache == nil {
+		return downloadTarball(ctx, client, c, "")
+	}
+	return cache.get(c, func(path string) (tarball, error) {
+		return downloadTarball(ctx, client, c, path)
+	})
+}
+
+// downloadTarball downloads the tarball of the given HTTP context to the
+// given path, or in memory when path is empty.
+func downloadTarball(
+	ctx context.Context,
+	client *http.Client,
+	c *builddef.Context,
+	path string,
+) (tarball, error) {
+	logrus.Debugf("Fetching %s", c.Source)
+
+	var expected digest.Digest
+	digester := digest.SHA256.Digester()
+	if c.Checksum != "" {
+		var err error
+		expected, err = digest.Parse(c.Checksum)
+		if err != nil {
+			return tarball{}, xerrors.Errorf("invalid checksum %q: %w", c.Checksum, err)
+		}
+		digester = expected.Algorithm().Digester()
+	}
+
+	req, err := http.NewRequest("GET", c.Source, nil)
+	if err != nil {
+		return tarball{}, err
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return tarball{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return tarball{}, xerrors.Errorf("could not fetch %s: unexpected status code %d",
+			c.Source, resp.StatusCode)
+	}
+
+	write := func(w io.Writer) error {
+		w = io.MultiWriter(w, digester.Hash())
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return xerrors.Errorf("could not fetch %s: %w", c.Source, err)
+		}
+		if expected != "" && digester.Digest() != expected {
+			return xerrors.Errorf("checksum of %s doesn't match: expected %s, got %s",
+				c.Source, expected, digester.Digest())
+		}
+		return nil
+	}
+
+	t := tarball{
+		url: resp.Request.URL.String(),
+	}
+	if path != "" {
+		if err := lockcache.WriteFileAtomic(path, write); err != nil {
+			return tarball{}, err
+		}
+		t.path = path
+	} else {
+		buf := &bytes.Buffer{}
+		if err := write(buf); err != nil {
+			return tarball{}, err
+		}
+		t.raw = buf.Bytes()
+	}
+
+	t.digest = digester.Digest()
+	return t, nil
+}
+
+// lockHTTPContext downloads the tarball of the given HTTP context, with the
+// given cache if it's not nil, and returns the URL it's been downloaded from
+// and its sha256 checksum. The tarball is then cached as the one of the
+// locked context, such that it's not downloaded again when it's read.
+func lockHTTPContext(
+	ctx context.Context,
+	client *http.Client,
+	cache *TarballCache,
+	c *builddef.Context,
+) (string, string, error) {
+	t, err := fetchTarball(ctx, client, cache, c)
+	if err != nil {
+		return "", "", xerrors.Errorf("could not compute checksum of %s: %w", c.Source, err)
+	}
+
+	locked := c.Copy()
+	locked.Source = t.url
+	locked.Checksum = t.digest.String()
+	if cache != nil {
+		cache.add(locked, t)
+	}
+
+	return locked.Source, locked.Checksum, nil
+}
+
+// lookupInTarball looks for the given path in a tarball, either compressed
+// with gzip or not compressed at all. Symlinks are followed.
+func lookupInTarball(t tarball, filepath string, readContent bool) (layerLookup, error) {
+	return followLinks(filepath, func(target string) (layerLookup, error) {
+		r, err := t.open()
+		if err != nil {
+			return layerLookup{}, err
+		}
+		defer r.Close()
+
+		tarR, err := openTarball(r)
+		if err != nil {
+			return layerLookup{}, err
+		}
+
+		res, err := lookupInTar(tarR, target, readContent)
+		if err != nil {
+			return layerLookup{}, xerrors.Errorf("could not read tarball: %w", err)
+		}
+		if !res.found && res.linkTarget == "" {
+			return layerLookup{}, FileNotFound
+		}
+		return res, nil
+	})
+}
+
+func openTarball(r io.Reader) (*tar.Reader, error) {
+	bufR := bufio.NewReader(r)
+	magic, err := bufR.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipR, err := gzip.NewReader(bufR)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gzipR), nil
+	}
+
+	return tar.NewReader(bufR), nil
+}
+
+func readFromHTTPContext(
+	ctx context.Context,
+	client *http.Client,
+	cache *TarballCache,
+	c *builddef.Context,
+	filepath string,
+) ([]byte, error) {
+	t, err := fetchTarball(ctx, client, cache, c)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read %s from %s: %w", filepath, c.Source, err)
+	}
+
+	res, err := lookupInTarball(t, filepath, true)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read %s from %s: %w", filepath, c.Source, err)
+	}
+
+	content, err := res.regularFileContent(filepath)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read %s from %s: %w", filepath, c.Source, err)
+	}
+
+	return content, nil
+}
+
+func statFromHTTPContext(
+	ctx context.Context,
+	client *http.Client,
+	cache *TarballCache,
+	c *builddef.Context,
+	filepath string,
+) (FileInfo, error) {
+	t, err := fetchTarball(ctx, client, cache, c)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, c.Source, err)
+	}
+
+	res, err := lookupInTarball(t, filepath, false)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, c.Source, err)
+	}
+
+	return res.info, nil
+}
@@ -0,0 +1,207 @@
+package statesolver_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestTarballCache(t *testing.T) {
+	tarball := buildLayer(conformanceFiles)
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	cacheDir, err := ioutil.TempDir("", "zbuild-tarballs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	testcases := map[string]struct {
+		checksum string
+		// expectedHits is the number of downloads expected for each
+		// solver using the cache dir.
+		expectedHits []int32
+	}{
+		"download tarballs without checksum once per solver": {
+			expectedHits: []int32{1, 1},
+		},
+		"reuse tarballs with a checksum across solvers": {
+			checksum:     digest.FromBytes(tarball).String(),
+			expectedHits: []int32{1, 0},
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			c := &builddef.Context{
+				Type:   builddef.ContextTypeHTTP,
+				Source: srv.URL + "/context.tar.gz",
+				HTTPContext: builddef.HTTPContext{
+					Checksum: tc.checksum,
+				},
+			}
+			ctx := context.Background()
+
+			for _, expectedHits := range tc.expectedHits {
+				atomic.StoreInt32(&hits, 0)
+				solver := statesolver.LocalSolver{
+					HTTPClient: srv.Client(),
+					Tarballs:   statesolver.NewTarballCache(cacheDir),
+				}
+
+				if _, err := solver.Stat(ctx, "/app", statesolver.ContextSource(c)); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if _, err := solver.FileExists(ctx, "/composer.lock", c); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				content, err := solver.ReadFile(ctx, "/composer.link", solver.FromContext(c))
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if string(content) != conformanceFiles[0].content {
+					t.Fatalf("Expected: %q\nGot: %q", conformanceFiles[0].content, content)
+				}
+
+				if hits := atomic.LoadInt32(&hits); hits != expectedHits {
+					t.Fatalf("Expected %d downloads, got %d.", expectedHits, hits)
+				}
+			}
+		})
+	}
+}
+
+// TestLockHTTPContextWithSolver checks that tarballs of HTTP contexts are
+// downloaded once to lock them and then read files from them, with the
+// HTTP client of the solver.
+func TestLockHTTPContextWithSolver(t *testing.T) {
+	tarball := buildLayer(conformanceFiles)
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest.tar.gz" {
+			http.Redirect(w, r, "/v1.tar.gz", http.StatusFound)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	cacheDir, err := ioutil.TempDir("", "zbuild-tarballs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+	solver := statesolver.LocalSolver{
+		HTTPClient: srv.Client(),
+		Tarballs:   statesolver.NewTarballCache(cacheDir),
+	}
+
+	locked, err := statesolver.LockContext(ctx, solver, &builddef.Context{
+		Type:   builddef.ContextTypeHTTP,
+		Source: srv.URL + "/latest.tar.gz",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if locked.Source != srv.URL+"/v1.tar.gz" {
+		t.Fatalf("Expected: %s\nGot: %s", srv.URL+"/v1.tar.gz", locked.Source)
+	}
+	if expected := digest.FromBytes(tarball).String(); locked.Checksum != expected {
+		t.Fatalf("Expected: %s\nGot: %s", expected, locked.Checksum)
+	}
+
+	if _, err := solver.ReadFile(ctx, "/composer.link", solver.FromContext(locked)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Fatalf("Expected 1 download, got %d.", hits)
+	}
+
+	// The locked tarball is stored in the cache dir and thus reused by other
+	// solvers.
+	other := statesolver.LocalSolver{
+		HTTPClient: srv.Client(),
+		Tarballs:   statesolver.NewTarballCache(cacheDir),
+	}
+	if _, err := other.ReadFile(ctx, "/composer.link", other.FromContext(locked)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Fatalf("Expected 1 download, got %d.", hits)
+	}
+}
+
+func TestWrappingSolversLockHTTPContextWithWrappedSolver(t *testing.T) {
+	tarball := buildLayer(conformanceFiles)
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest.tar.gz" {
+			http.Redirect(w, r, "/v1.tar.gz", http.StatusFound)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	cache := newLockCache(t)
+	defer os.RemoveAll(cache.Dir)
+
+	wrappers := map[string]func(statesolver.StateSolver) statesolver.StateSolver{
+		"caching solver": func(solver statesolver.StateSolver) statesolver.StateSolver {
+			return statesolver.NewCachingSolver(solver, cache)
+		},
+		"recorder": func(solver statesolver.StateSolver) statesolver.StateSolver {
+			return statesolver.NewRecorder(solver)
+		},
+	}
+
+	for name, wrap := range wrappers {
+		atomic.StoreInt32(&hits, 0)
+		wrapper := wrap(statesolver.LocalSolver{
+			HTTPClient: srv.Client(),
+			Tarballs:   statesolver.NewTarballCache(""),
+		})
+
+		ctx := context.Background()
+		locked, err := statesolver.LockContext(ctx, wrapper, &builddef.Context{
+			Type:   builddef.ContextTypeHTTP,
+			Source: srv.URL + "/latest.tar.gz",
+		})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %v", name, err)
+		}
+		if locked.Source != srv.URL+"/v1.tar.gz" {
+			t.Fatalf("%s: Expected: %s\nGot: %s", name, srv.URL+"/v1.tar.gz", locked.Source)
+		}
+
+		// The tarball downloaded to lock the context is reused to read it.
+		if _, err := wrapper.ReadFile(ctx, "/composer.link", wrapper.FromContext(locked)); err != nil {
+			t.Fatalf("%s: Unexpected error: %v", name, err)
+		}
+		if hits := atomic.LoadInt32(&hits); hits != 1 {
+			t.Fatalf("%s: Expected 1 download, got %d.", name, hits)
+		}
+	}
+}
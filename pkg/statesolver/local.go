@@ -4,11 +4,12 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
-	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
@@ -16,9 +17,12 @@ import (
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/xerrors"
@@ -28,10 +32,28 @@ import (
 // to read files from images and resolve image references.
 type LocalSolver struct {
 	Client *client.Client
+	// Labels are added to the containers created by the solver. Close
+	// removes every container having these labels.
 	Labels map[string]string
+	// Containers keeps the containers created by the solver, such that
+	// they're reused until the solver is closed. A new container is created
+	// (and removed) for each call when it's nil.
+	Containers *ContainerPool
 	// RootDir is the path to the root of the build context.
 	RootDir       string
 	ImageResolver remotes.Resolver
+	// GitCacheDir is the directory where git repositories used as build
+	// context are cached. They're kept in memory when it's empty.
+	GitCacheDir string
+	// LookupSecret returns the value of the secret with the given name. It's
+	// used to fetch git contexts with an auth secret.
+	LookupSecret func(name string) (string, bool)
+	// HTTPClient is used to download the tarballs of HTTP contexts.
+	// http.DefaultClient is used when it's nil.
+	HTTPClient *http.Client
+	// Tarballs keeps the tarballs of HTTP contexts downloaded by the solver.
+	// Tarballs are downloaded again for each call when it's nil.
+	Tarballs *TarballCache
 }
 
 func (s LocalSolver) ExecImage(
@@ -45,50 +67,77 @@ func (s LocalSolver) ExecImage(
 		"-c", strcmd,
 	}
 
+	if s.Containers != nil {
+		c, err := s.execContainer(ctx, imageRef)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to execute %q in %q: %w", strcmd, imageRef, err)
+		}
+
+		outbuf, err := s.execInContainer(ctx, c, cmd, shellCmd)
+		if err != nil {
+			return outbuf, xerrors.Errorf("failed to execute cmd %q in image %q: %w",
+				strcmd, imageRef, err)
+		}
+		return outbuf, nil
+	}
+
 	err := s.pullImage(ctx, imageRef)
 	if err != nil {
 		return nil, xerrors.Errorf(
-			"failed to execute %q in %q from %s: %w", strcmd, imageRef, err)
+			"failed to execute %q in %q: %w", strcmd, imageRef, err)
 	}
 
-	c, err := s.createContainer(ctx, imageRef, shellCmd)
+	c, err := s.createContainer(ctx, imageRef, nil, shellCmd)
 	if err != nil {
 		return nil, err
 	}
 	defer s.removeContainer(ctx, c)
 
-	err = s.startContainerAndWait(ctx, c)
-	outbuf, _, readErr := s.fetchContainerLogs(ctx, c, true, false)
+	exitCode, err := s.startContainerAndWait(ctx, c)
 	if err != nil {
+		return nil, xerrors.Errorf("failed to execute cmd %q in image %q: %w",
+			strcmd, imageRef, err)
+	}
+
+	outbuf, errbuf, err := s.fetchContainerLogs(ctx, c, true, true)
+	if err != nil {
+		return outbuf, err
+	}
+	if exitCode != 0 {
+		err := ExecError{
+			Cmd:      cmd,
+			ExitCode: exitCode,
+			Stdout:   outbuf.String(),
+			Stderr:   errbuf.String(),
+		}
 		return outbuf, xerrors.Errorf("failed to execute cmd %q in image %q: %w",
 			strcmd, imageRef, err)
 	}
-	return outbuf, readErr
+
+	return outbuf, nil
 }
 
-func (s LocalSolver) startContainerAndWait(ctx context.Context, containerID string) error {
+// startContainerAndWait starts the given container and returns its exit code
+// once it stops.
+func (s LocalSolver) startContainerAndWait(ctx context.Context, containerID string) (int, error) {
 	waitch, errch := s.Client.ContainerWait(ctx, containerID,
 		container.WaitConditionNextExit)
 
 	err := s.Client.ContainerStart(ctx, containerID,
 		types.ContainerStartOptions{})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	select {
 	case msg := <-waitch:
 		if msg.Error != nil {
-			return xerrors.Errorf("ContainerWait failed: %s", msg.Error.Message)
-		}
-		if msg.StatusCode != 0 {
-			return xerrors.Errorf("command exited with code %d", msg.StatusCode)
+			return 0, xerrors.Errorf("ContainerWait failed: %s", msg.Error.Message)
 		}
+		return int(msg.StatusCode), nil
 	case err := <-errch:
-		return err
+		return 0, err
 	}
-
-	return nil
 }
 
 func (s LocalSolver) fetchContainerLogs(
@@ -128,28 +177,36 @@ func (s LocalSolver) FileExists(
 	filepath string,
 	source *builddef.Context,
 ) (bool, error) {
-	if source == nil {
-		return false, nil
-	}
-
-	logrus.Debugf("Checking if file %s exists in %s context", filepath, source.Type)
-
-	// @TODO: implement a proper way to test if a file exists instead of reading it
-	_, err := s.ReadFile(ctx, filepath, s.FromContext(source))
-	found := err == nil
+	return fileExists(ctx, s, filepath, source)
+}
 
-	if source.Type == builddef.ContextTypeGit {
-		// @TODO: for now, ReadFile never returns FileNotFound when reading
-		// from a Git context. As such, we can only consider that the given
-		// file doesn't exist when it returns an error and thus we need to
-		// silent this error.
-		err = nil
+func (s LocalSolver) Stat(
+	ctx context.Context,
+	filepath string,
+	source FileSource,
+) (FileInfo, error) {
+	if source.Image != "" {
+		return s.statFromImage(ctx, source.Image, filepath)
 	}
-	if xerrors.Is(err, FileNotFound) {
-		err = nil
+	if source.Context == nil {
+		return FileInfo{}, FileNotFound
 	}
 
-	return found, err
+	logrus.Debugf("Stating %s from %s context", filepath, source.Context.Type)
+
+	switch source.Context.Type {
+	case builddef.ContextTypeLocal:
+		return statLocalDir(s.RootDir, filepath)
+	case builddef.ContextTypeGit:
+		return s.statFromGitContext(ctx, source.Context, filepath)
+	case builddef.ContextTypeHTTP:
+		return statFromHTTPContext(ctx, s.HTTPClient, s.Tarballs, source.Context, filepath)
+	case builddef.ContextTypeImage:
+		return s.statFromImage(ctx, source.Context.Source, filepath)
+	}
+
+	return FileInfo{}, xerrors.Errorf(
+		"context type %q is not supported", string(source.Context.Type))
 }
 
 func (s LocalSolver) ReadFile(
@@ -176,6 +233,10 @@ func (s LocalSolver) FromContext(
 			return s.readFromLocalContext(filepath)
 		case builddef.ContextTypeGit:
 			return s.readFromGitContext(ctx, source, filepath)
+		case builddef.ContextTypeHTTP:
+			return readFromHTTPContext(ctx, s.HTTPClient, s.Tarballs, source, filepath)
+		case builddef.ContextTypeImage:
+			return s.FromImage(source.Source)(ctx, filepath)
 		}
 
 		return []byte{}, xerrors.Errorf(
@@ -184,7 +245,13 @@ func (s LocalSolver) FromContext(
 }
 
 func (s LocalSolver) readFromLocalContext(filepath string) ([]byte, error) {
-	fullpath := path.Join(s.RootDir, filepath)
+	return readFromLocalDir(s.RootDir, filepath)
+}
+
+// readFromLocalDir reads the given file from the build context rooted at
+// rootDir.
+func readFromLocalDir(rootDir, filepath string) ([]byte, error) {
+	fullpath := path.Join(rootDir, filepath)
 	raw, err := ioutil.ReadFile(fullpath)
 	if os.IsNotExist(err) {
 		return raw, xerrors.Errorf("failed to read %s from build context: %w", filepath, FileNotFound)
@@ -195,45 +262,131 @@ func (s LocalSolver) readFromLocalContext(filepath string) ([]byte, error) {
 	return raw, nil
 }
 
+// statLocalDir stats the given path from the build context rooted at
+// rootDir.
+func statLocalDir(rootDir, filepath string) (FileInfo, error) {
+	fi, err := os.Stat(path.Join(rootDir, filepath))
+	if os.IsNotExist(err) {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from build context: %w", filepath, FileNotFound)
+	} else if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from build context: %w", filepath, err)
+	}
+
+	return newFileInfo(fi.Size(), fi.Mode()), nil
+}
+
 func (s LocalSolver) readFromGitContext(
 	ctx context.Context,
 	c *builddef.Context,
 	filepath string,
 ) ([]byte, error) {
-	repoURI := normalizeRepoURI(c)
-	sourceRef := sourceRefOrHead(c)
-	// git show fails when the filepath starts with a slash.
-	filepath = strings.TrimPrefix(filepath, "/")
+	remote, repo, hash, err := s.openGitContext(ctx, c)
+	if err != nil {
+		return []byte{}, xerrors.Errorf("failed to read %s from git context: %w", filepath, err)
+	}
 
-	outbuf, err := s.ExecImage(ctx, imageGit, []string{
-		fmt.Sprintf("git clone --depth 1 %s /tmp/repo 1>/dev/null 2>&1", repoURI),
-		"cd /tmp/repo",
-		fmt.Sprintf("git show %s:%s", sourceRef, filepath)})
+	raw, err := remote.readFile(ctx, repo, hash, filepath)
 	if err != nil {
-		return []byte{}, xerrors.Errorf(
-			"failed to read file from git context: %w", err)
+		return []byte{}, xerrors.Errorf("failed to read %s from git context: %w", filepath, err)
+	}
+
+	return raw, nil
+}
+
+func (s LocalSolver) statFromGitContext(
+	ctx context.Context,
+	c *builddef.Context,
+	filepath string,
+) (FileInfo, error) {
+	remote, repo, hash, err := s.openGitContext(ctx, c)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from git context: %w", filepath, err)
 	}
 
-	out := outbuf.Bytes()
-	logrus.Debugf("Reading %s from git context: %s", filepath, string(out))
+	fi, err := remote.stat(ctx, repo, hash, filepath)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from git context: %w", filepath, err)
+	}
 
-	return out, nil
+	return fi, nil
+}
+
+// openGitContext fetches the repository of the given git context at its
+// reference.
+func (s LocalSolver) openGitContext(
+	ctx context.Context,
+	c *builddef.Context,
+) (gitRemote, *git.Repository, plumbing.Hash, error) {
+	remote, err := newGitRemote(c, s.GitCacheDir, s.LookupSecret)
+	if err != nil {
+		return remote, nil, plumbing.ZeroHash, err
+	}
+
+	hash, refName, err := remote.resolveRef(sourceRefOrHead(c))
+	if err != nil {
+		return remote, nil, plumbing.ZeroHash, err
+	}
+
+	repo, err := remote.open(ctx, hash, refName)
+	if err != nil {
+		return remote, nil, plumbing.ZeroHash, xerrors.Errorf("could not fetch %s: %w", remote.url, err)
+	}
+
+	return remote, repo, hash, nil
+}
+
+// ResolveGitRef implements GitSolver.
+func (s LocalSolver) ResolveGitRef(ctx context.Context, c *builddef.Context) (string, error) {
+	remote, err := newGitRemote(c, s.GitCacheDir, s.LookupSecret)
+	if err != nil {
+		return "", err
+	}
+
+	hash, _, err := remote.resolveRef(sourceRefOrHead(c))
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// ResolveGitSubmodules implements GitSolver.
+func (s LocalSolver) ResolveGitSubmodules(ctx context.Context, c *builddef.Context) (map[string]string, error) {
+	_, repo, hash, err := s.openGitContext(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return submoduleCommits(repo, hash)
+}
+
+// ResolveGitCommitTime implements GitSolver.
+func (s LocalSolver) ResolveGitCommitTime(ctx context.Context, c *builddef.Context) (int64, error) {
+	_, repo, hash, err := s.openGitContext(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+
+	commit, err := gitCommit(repo, hash)
+	if err != nil {
+		return 0, err
+	}
+	return commit.Committer.When.Unix(), nil
+}
+
+// LockHTTPContext implements HTTPSolver.
+func (s LocalSolver) LockHTTPContext(ctx context.Context, c *builddef.Context) (string, string, error) {
+	return lockHTTPContext(ctx, s.HTTPClient, s.Tarballs, c)
 }
 
 func (s LocalSolver) FromImage(image string) ReadFileOpt {
 	return func(ctx context.Context, filepath string) ([]byte, error) {
 		var res []byte
 
-		err := s.pullImage(ctx, image)
-		if err != nil {
-			return res, xerrors.Errorf("failed to read %s from %s: %w", filepath, image, err)
-		}
-
-		cid, err := s.createContainer(ctx, image, []string{})
+		cid, release, err := s.imageContainer(ctx, image)
 		if err != nil {
 			return res, xerrors.Errorf("failed to read %s from %s: %w", filepath, image, err)
 		}
-		defer s.removeContainer(ctx, cid)
+		defer release()
 
 		raw, err := s.readFromContainer(ctx, cid, filepath)
 		if err != nil {
@@ -244,6 +397,40 @@ func (s LocalSolver) FromImage(image string) ReadFileOpt {
 	}
 }
 
+func (s LocalSolver) statFromImage(
+	ctx context.Context,
+	image string,
+	filepath string,
+) (FileInfo, error) {
+	cid, release, err := s.imageContainer(ctx, image)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, image, err)
+	}
+	defer release()
+
+	logrus.Debugf("Stating %s from container %s", filepath, cid)
+
+	stat, err := s.Client.ContainerStatPath(ctx, cid, filepath)
+	if client.IsErrNotFound(err) {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, image, FileNotFound)
+	} else if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, image, err)
+	}
+
+	// Docker resolves symlinks itself and returns the absolute path of their
+	// final target.
+	if stat.Mode&os.ModeSymlink != 0 && stat.LinkTarget != "" {
+		stat, err = s.Client.ContainerStatPath(ctx, cid, stat.LinkTarget)
+		if client.IsErrNotFound(err) {
+			return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, image, FileNotFound)
+		} else if err != nil {
+			return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, image, err)
+		}
+	}
+
+	return newFileInfo(stat.Size, stat.Mode), nil
+}
+
 func (s LocalSolver) readFromContainer(
 	ctx context.Context,
 	cid string,
@@ -290,6 +477,77 @@ func (s LocalSolver) readFromContainer(
 	return ioutil.ReadAll(tarR)
 }
 
+// ReadImageDir implements ImageDirSolver.
+func (s LocalSolver) ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error) {
+	cid, release, err := s.imageContainer(ctx, image)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, err)
+	}
+	defer release()
+
+	names, err := s.readDirFromContainer(ctx, cid, dirpath)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, err)
+	}
+
+	return names, nil
+}
+
+func (s LocalSolver) readDirFromContainer(
+	ctx context.Context,
+	cid string,
+	dirpath string,
+) ([]string, error) {
+	logrus.Debugf("Reading dir %s from container %s", dirpath, cid)
+
+	stat, err := s.Client.ContainerStatPath(ctx, cid, dirpath)
+	if client.IsErrNotFound(err) {
+		return nil, FileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	// Docker resolves symlinks itself and returns the absolute path of their
+	// final target.
+	if stat.Mode&os.ModeSymlink != 0 && stat.LinkTarget != "" {
+		dirpath = stat.LinkTarget
+		stat, err = s.Client.ContainerStatPath(ctx, cid, dirpath)
+		if client.IsErrNotFound(err) {
+			return nil, FileNotFound
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if !stat.Mode.IsDir() {
+		return nil, xerrors.Errorf("could not list path %q, it's not a directory", dirpath)
+	}
+
+	r, _, err := s.Client.CopyFromContainer(ctx, cid, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// Entries of the archive are prefixed with the name of the dir.
+	names := []string{}
+	tarR := tar.NewReader(r)
+	for {
+		h, err := tarR.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		parts := strings.Split(strings.Trim(h.Name, "/"), "/")
+		if len(parts) == 2 {
+			names = append(names, parts[1])
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
 func (s LocalSolver) pullImage(ctx context.Context, image string) error {
 	_, _, err := s.Client.ImageInspectWithRaw(ctx, image)
 	// Don't pull agin if the image already exists
@@ -316,17 +574,120 @@ func (s LocalSolver) pullImage(ctx context.Context, image string) error {
 	return err
 }
 
+// imageContainer returns the ID of a container of the given image to read
+// files from, along with a func to call once the container isn't used
+// anymore. The container is never started.
+func (s LocalSolver) imageContainer(ctx context.Context, image string) (string, func(), error) {
+	if s.Containers != nil {
+		c, err := s.Containers.container(containerKey{image: image}, func() (string, error) {
+			if err := s.pullImage(ctx, image); err != nil {
+				return "", err
+			}
+			return s.createContainer(ctx, image, nil, []string{})
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		return c.id, func() {}, nil
+	}
+
+	if err := s.pullImage(ctx, image); err != nil {
+		return "", nil, err
+	}
+
+	cid, err := s.createContainer(ctx, image, nil, []string{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return cid, func() { s.removeContainer(ctx, cid) }, nil
+}
+
+// execContainer returns the pooled container of the given image used to
+// execute commands. Files are never read from it, as executed commands might
+// change its filesystem.
+func (s LocalSolver) execContainer(ctx context.Context, image string) (*pooledContainer, error) {
+	return s.Containers.container(containerKey{image: image, exec: true}, func() (string, error) {
+		if err := s.pullImage(ctx, image); err != nil {
+			return "", err
+		}
+		return s.createContainer(ctx, image, keepAliveCmd, nil)
+	})
+}
+
+// execInContainer executes shellCmd in a pooled container, which is started
+// on first use. Commands executed in the same container are run one at a
+// time. cmd is the command reported by ExecErrors.
+func (s LocalSolver) execInContainer(
+	ctx context.Context,
+	c *pooledContainer,
+	cmd []string,
+	shellCmd []string,
+) (*bytes.Buffer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started {
+		err := s.Client.ContainerStart(ctx, c.id, types.ContainerStartOptions{})
+		if err != nil {
+			return nil, xerrors.Errorf("could not start container %s: %w", c.id, err)
+		}
+		c.started = true
+	}
+
+	s.Containers.recordExec()
+	logrus.Debugf("Executing %q in container %s", strings.Join(cmd, "; "), c.id)
+
+	exec, err := s.Client.ContainerExecCreate(ctx, c.id, types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          shellCmd,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+	if _, err := stdcopy.StdCopy(outbuf, errbuf, resp.Reader); err != nil {
+		return outbuf, xerrors.Errorf("failed to read output of exec %s: %w", exec.ID, err)
+	}
+
+	inspect, err := s.Client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return outbuf, err
+	}
+	if inspect.ExitCode != 0 {
+		return outbuf, ExecError{
+			Cmd:      cmd,
+			ExitCode: inspect.ExitCode,
+			Stdout:   outbuf.String(),
+			Stderr:   errbuf.String(),
+		}
+	}
+
+	return outbuf, nil
+}
+
 func (s LocalSolver) createContainer(
 	ctx context.Context,
 	image string,
+	entrypoint []string,
 	cmd []string,
 ) (string, error) {
 	logrus.Debugf("Creating container from image %s", image)
 
 	cfg := container.Config{
-		Image:  image,
-		Cmd:    cmd,
-		Labels: s.Labels,
+		Image:      image,
+		Entrypoint: entrypoint,
+		Cmd:        cmd,
+		Labels:     s.Labels,
 	}
 	hostCfg := container.HostConfig{}
 	networkCfg := network.NetworkingConfig{}
@@ -347,6 +708,80 @@ func (s LocalSolver) removeContainer(ctx context.Context, ID string) {
 }
 
 func (s LocalSolver) ResolveImageRef(ctx context.Context, imageRef string) (string, error) {
+	return resolveImageRef(ctx, s.ImageResolver, imageRef)
+}
+
+// Close removes the containers kept by the solver. When the solver has
+// Labels, every container having them is removed too, such that containers
+// created concurrently (e.g. when zbuild is interrupted) aren't left behind.
+func (s LocalSolver) Close(ctx context.Context) error {
+	if s.Containers == nil {
+		return nil
+	}
+
+	ids := map[string]struct{}{}
+	for _, id := range s.Containers.close() {
+		ids[id] = struct{}{}
+	}
+
+	var err error
+	if len(s.Labels) > 0 {
+		args := filters.NewArgs()
+		for k, v := range s.Labels {
+			args.Add("label", k+"="+v)
+		}
+
+		var containers []types.Container
+		containers, err = s.Client.ContainerList(ctx, types.ContainerListOptions{
+			All:     true,
+			Filters: args,
+		})
+		if err != nil {
+			err = xerrors.Errorf("could not list containers: %w", err)
+		}
+		for _, c := range containers {
+			ids[c.ID] = struct{}{}
+		}
+	}
+
+	for id := range ids {
+		logrus.Debugf("Removing container %s", id)
+		rmErr := s.Client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+		if rmErr != nil && !client.IsErrNotFound(rmErr) && err == nil {
+			err = xerrors.Errorf("could not remove container %s: %w", id, rmErr)
+		}
+	}
+
+	return err
+}
+
+// fileExists checks if the given file exists in the given context by stating
+// it with the given solver.
+func fileExists(
+	ctx context.Context,
+	s StateSolver,
+	filepath string,
+	source *builddef.Context,
+) (bool, error) {
+	if source == nil {
+		return false, nil
+	}
+
+	logrus.Debugf("Checking if file %s exists in %s context", filepath, source.Type)
+
+	_, err := s.Stat(ctx, filepath, ContextSource(source))
+	found := err == nil
+
+	if xerrors.Is(err, FileNotFound) {
+		err = nil
+	}
+
+	return found, err
+}
+
+// resolveImageRef resolves the digest of the given image reference with the
+// given resolver, unless the reference already has one.
+func resolveImageRef(ctx context.Context, resolver remotes.Resolver, imageRef string) (string, error) {
 	normalized, err := reference.ParseNormalizedNamed(imageRef)
 	if err != nil {
 		return "", err
@@ -356,7 +791,7 @@ func (s LocalSolver) ResolveImageRef(ctx context.Context, imageRef string) (stri
 		return canonical.String(), nil
 	}
 
-	_, desc, err := s.ImageResolver.Resolve(ctx, normalized.String())
+	_, desc, err := resolver.Resolve(ctx, normalized.String())
 	if err != nil {
 		return "", err
 	}
@@ -1,17 +1,26 @@
 package statesolver_test
 
 import (
+	"archive/tar"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/NiR-/zbuild/pkg/statesolver"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/go-test/deep"
 	"golang.org/x/xerrors"
 )
 
@@ -339,3 +348,213 @@ func TestLocalSolverFileExists(t *testing.T) {
 		})
 	}
 }
+
+// fakeDockerAPI implements the few endpoints of the Docker API used by
+// LocalSolver to read files from images and to execute commands. It records
+// the containers created and removed. Commands executed in a container
+// change its /etc/os-release file.
+type fakeDockerAPI struct {
+	mu        sync.Mutex
+	created   []container.Config
+	removed   []string
+	leftovers []string
+	started   map[string]bool
+	changed   map[string]bool
+}
+
+func (api *fakeDockerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	// Requests are prefixed by the API version (e.g. /v1.39).
+	path := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:]
+
+	switch {
+	case strings.HasPrefix(path, "/images/"):
+		json.NewEncoder(w).Encode(types.ImageInspect{ID: "sha256:image"})
+	case path == "/containers/create":
+		var cfg container.Config
+		json.NewDecoder(r.Body).Decode(&cfg)
+		api.created = append(api.created, cfg)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(container.ContainerCreateCreatedBody{
+			ID: fmt.Sprintf("container%d", len(api.created)),
+		})
+	case path == "/containers/json":
+		var containers []types.Container
+		for _, id := range api.leftovers {
+			containers = append(containers, types.Container{ID: id})
+		}
+		json.NewEncoder(w).Encode(containers)
+	case strings.HasSuffix(path, "/start") && strings.HasPrefix(path, "/containers/"):
+		if api.started == nil {
+			api.started = map[string]bool{}
+		}
+		api.started[strings.Split(path, "/")[2]] = true
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/exec") && strings.HasPrefix(path, "/containers/"):
+		cid := strings.Split(path, "/")[2]
+		if !api.started[cid] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(types.IDResponse{ID: cid})
+	case strings.HasPrefix(path, "/exec/") && strings.HasSuffix(path, "/start"):
+		if api.changed == nil {
+			api.changed = map[string]bool{}
+		}
+		api.changed[strings.Split(path, "/")[2]] = true
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprint(conn, "HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		conn.Close()
+	case strings.HasPrefix(path, "/exec/") && strings.HasSuffix(path, "/json"):
+		json.NewEncoder(w).Encode(types.ContainerExecInspect{ExitCode: 0})
+	case strings.HasSuffix(path, "/archive"):
+		if r.URL.Query().Get("path") != "/etc/os-release" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		content := "ID=debian\n"
+		if api.changed[strings.Split(path, "/")[2]] {
+			content = "ID=changed\n"
+		}
+		stat, _ := json.Marshal(types.ContainerPathStat{
+			Name: "os-release",
+			Size: int64(len(content)),
+			Mode: 0644,
+		})
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+		if r.Method == http.MethodGet {
+			tarW := tar.NewWriter(w)
+			tarW.WriteHeader(&tar.Header{
+				Name:     "os-release",
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len(content)),
+			})
+			tarW.Write([]byte(content))
+			tarW.Close()
+		}
+	case r.Method == http.MethodDelete:
+		if r.URL.Query().Get("force") != "1" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		api.removed = append(api.removed, strings.TrimPrefix(path, "/containers/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestLocalSolverReusesContainers(t *testing.T) {
+	api := &fakeDockerAPI{
+		leftovers: []string{"container1", "interrupted"},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	c, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")),
+		client.WithVersion("1.39"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"io.zbuild.session": "test"}
+	solver := statesolver.LocalSolver{
+		Client:     c,
+		Labels:     labels,
+		Containers: statesolver.NewContainerPool(),
+	}
+
+	ctx := context.Background()
+	source := statesolver.ImageSource(debianBusterSlimRef)
+	if _, err := solver.Stat(ctx, "/etc/os-release", source); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := solver.Stat(ctx, "/etc/nonexistent", source); !xerrors.Is(err, statesolver.FileNotFound) {
+		t.Fatalf("Expected: %v\nGot: %v", statesolver.FileNotFound, err)
+	}
+	content, err := solver.ReadFile(ctx, "/etc/os-release", solver.FromImage(debianBusterSlimRef))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(content) != "ID=debian\n" {
+		t.Fatalf("Expected: %q\nGot: %q", "ID=debian\n", content)
+	}
+
+	if len(api.created) != 1 {
+		t.Fatalf("Expected a single container to be created, got %d.", len(api.created))
+	}
+	if diff := deep.Equal(api.created[0].Labels, labels); diff != nil {
+		t.Fatal(diff)
+	}
+	if len(api.removed) != 0 {
+		t.Fatalf("Expected no container to be removed before the solver is closed, got: %v", api.removed)
+	}
+
+	expectedMetrics := statesolver.ContainerPoolMetrics{Created: 1, Reused: 2}
+	if diff := deep.Equal(solver.Containers.Metrics(), expectedMetrics); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if err := solver.Close(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sort.Strings(api.removed)
+	if diff := deep.Equal(api.removed, []string{"container1", "interrupted"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if _, err := solver.Stat(ctx, "/etc/os-release", source); err == nil {
+		t.Fatal("Expected an error as the solver is closed.")
+	}
+}
+
+func TestLocalSolverReadsAreNotChangedByExecs(t *testing.T) {
+	api := &fakeDockerAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	c, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")),
+		client.WithVersion("1.39"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	solver := statesolver.LocalSolver{
+		Client:     c,
+		Containers: statesolver.NewContainerPool(),
+	}
+
+	ctx := context.Background()
+	if _, err := solver.ExecImage(ctx, debianBusterSlimRef, []string{"echo ID=changed > /etc/os-release"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := solver.ReadFile(ctx, "/etc/os-release", solver.FromImage(debianBusterSlimRef))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(content) != "ID=debian\n" {
+		t.Fatalf("Expected: %q\nGot: %q", "ID=debian\n", content)
+	}
+	if _, err := solver.ExecImage(ctx, debianBusterSlimRef, []string{"cat /etc/os-release"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(api.created) != 2 {
+		t.Fatalf("Expected two containers to be created, got %d.", len(api.created))
+	}
+	expectedMetrics := statesolver.ContainerPoolMetrics{Created: 2, Reused: 1, Execs: 2}
+	if diff := deep.Equal(solver.Containers.Metrics(), expectedMetrics); diff != nil {
+		t.Fatal(diff)
+	}
+}
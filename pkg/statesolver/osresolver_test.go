@@ -35,6 +35,41 @@ BUG_REPORT_URL="https://bugs.debian.org/"`),
 				VersionID:   "9",
 			},
 		},
+		"successfully parse an os-release file with quoted values": {
+			imageRef: "registry.access.redhat.com/ubi8/ubi:8.2",
+			file: []byte(`
+NAME="Red Hat Enterprise Linux"
+VERSION="8.2 (Ootpa)"
+ID="rhel"
+ID_LIKE="fedora"
+VERSION_ID="8.2"
+PLATFORM_ID="platform:el8"
+PRETTY_NAME="Red Hat Enterprise Linux 8.2 (Ootpa)"
+ANSI_COLOR="0;31"`),
+			expected: builddef.OSRelease{
+				Name:      "rhel",
+				VersionID: "8.2",
+				IDLike:    []string{"fedora"},
+			},
+		},
+		"successfully parse an os-release file with ID_LIKE": {
+			imageRef: "ubuntu:focal",
+			file: []byte(`
+NAME="Ubuntu"
+VERSION="20.04.1 LTS (Focal Fossa)"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 20.04.1 LTS"
+VERSION_ID="20.04"
+VERSION_CODENAME=focal
+UBUNTU_CODENAME=focal`),
+			expected: builddef.OSRelease{
+				Name:        "ubuntu",
+				VersionName: "focal",
+				VersionID:   "20.04",
+				IDLike:      []string{"debian"},
+			},
+		},
 	}
 
 	for tcname := range testcases {
@@ -0,0 +1,549 @@
+package statesolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/moby/buildkit/client/llb"
+	"golang.org/x/xerrors"
+)
+
+// Recorder is a StateSolver recording the calls made to the wrapped solver
+// along with their results, such that they can be saved to a fixture file
+// and served by a Replayer later on.
+type Recorder struct {
+	Solver StateSolver
+
+	mu    sync.Mutex
+	calls map[string]recordedCall
+}
+
+// NewRecorder returns a Recorder wrapping the given solver.
+func NewRecorder(solver StateSolver) *Recorder {
+	return &Recorder{
+		Solver: solver,
+		calls:  map[string]recordedCall{},
+	}
+}
+
+// recordedCall is a call made to a StateSolver, as stored in fixture files.
+// Args identify the call and depend on the method (see the call* funcs).
+type recordedCall struct {
+	Method string         `json:"method"`
+	Args   []string       `json:"args"`
+	Output string         `json:"output,omitempty"`
+	Exists bool           `json:"exists,omitempty"`
+	Info   *FileInfo      `json:"info,omitempty"`
+	Err    *recordedError `json:"error,omitempty"`
+
+	// Submodules and CommitTime are the results of ResolveGitSubmodules and
+	// ResolveGitCommitTime.
+	Submodules map[string]string `json:"submodules,omitempty"`
+	CommitTime int64             `json:"commit_time,omitempty"`
+	// Entries is the result of ReadImageDir.
+	Entries []string `json:"entries,omitempty"`
+	// Checksum is the checksum returned by LockHTTPContext, along with the
+	// URL stored in Output.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+func (c recordedCall) key() string {
+	return c.Method + "\x00" + strings.Join(c.Args, "\x00")
+}
+
+func (c recordedCall) String() string {
+	return fmt.Sprintf("%s(%q)", c.Method, c.Args)
+}
+
+// recordedError keeps enough details about an error to replay it, such that
+// callers checking for FileNotFound or ExecErrors behave the same.
+type recordedError struct {
+	Message  string     `json:"message"`
+	NotFound bool       `json:"not_found,omitempty"`
+	Exec     *ExecError `json:"exec,omitempty"`
+}
+
+func newRecordedError(err error) *recordedError {
+	if err == nil {
+		return nil
+	}
+
+	recorded := &recordedError{
+		Message:  err.Error(),
+		NotFound: xerrors.Is(err, FileNotFound),
+	}
+	var execErr ExecError
+	if xerrors.As(err, &execErr) {
+		recorded.Exec = &execErr
+	}
+	return recorded
+}
+
+// replayedError has the message of the recorded error and wraps either
+// FileNotFound or an ExecError when the recorded error did.
+type replayedError struct {
+	message string
+	cause   error
+}
+
+func (err replayedError) Error() string {
+	return err.message
+}
+
+func (err replayedError) Unwrap() error {
+	return err.cause
+}
+
+func (recorded *recordedError) replay() error {
+	if recorded == nil {
+		return nil
+	}
+
+	err := replayedError{message: recorded.Message}
+	if recorded.NotFound {
+		err.cause = FileNotFound
+	} else if recorded.Exec != nil {
+		err.cause = *recorded.Exec
+	}
+	return err
+}
+
+func callResolveImageRef(imageRef string) recordedCall {
+	return recordedCall{Method: "ResolveImageRef", Args: []string{imageRef}}
+}
+
+func callExecImage(imageRef string, cmd []string) recordedCall {
+	return recordedCall{Method: "ExecImage", Args: append([]string{imageRef}, cmd...)}
+}
+
+func callResolveGitRef(c *builddef.Context) recordedCall {
+	return recordedCall{Method: "ResolveGitRef", Args: []string{describeContext(c)}}
+}
+
+func callResolveGitSubmodules(c *builddef.Context) recordedCall {
+	return recordedCall{Method: "ResolveGitSubmodules", Args: []string{describeContext(c)}}
+}
+
+func callResolveGitCommitTime(c *builddef.Context) recordedCall {
+	return recordedCall{Method: "ResolveGitCommitTime", Args: []string{describeContext(c)}}
+}
+
+func callLockHTTPContext(c *builddef.Context) recordedCall {
+	return recordedCall{Method: "LockHTTPContext", Args: []string{describeContext(c)}}
+}
+
+func callFileExists(filepath string, source *builddef.Context) recordedCall {
+	return recordedCall{Method: "FileExists", Args: []string{describeContext(source), filepath}}
+}
+
+func callStat(filepath string, source FileSource) recordedCall {
+	src := "image:" + source.Image
+	if source.Context != nil {
+		src = describeContext(source.Context)
+	}
+	return recordedCall{Method: "Stat", Args: []string{src, filepath}}
+}
+
+// callReadFile identifies the files read with the ReadFileOpt returned by
+// FromContext or FromImage, as ReadFileOpts can't be compared.
+func callReadFile(src, filepath string) recordedCall {
+	return recordedCall{Method: "ReadFile", Args: []string{src, filepath}}
+}
+
+func callReadImageDir(image, dirpath string) recordedCall {
+	return recordedCall{Method: "ReadImageDir", Args: []string{image, dirpath}}
+}
+
+func describeContext(c *builddef.Context) string {
+	if c == nil {
+		return "context:"
+	}
+	raw, _ := json.Marshal(c)
+	return "context:" + string(raw)
+}
+
+func (r *Recorder) record(call recordedCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[call.key()] = call
+}
+
+func (r *Recorder) ResolveImageRef(ctx context.Context, imageRef string) (string, error) {
+	resolved, err := r.Solver.ResolveImageRef(ctx, imageRef)
+
+	call := callResolveImageRef(imageRef)
+	call.Output = resolved
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return resolved, err
+}
+
+func (r *Recorder) ExecImage(
+	ctx context.Context,
+	imageRef string,
+	cmd []string,
+) (*bytes.Buffer, error) {
+	outbuf, err := r.Solver.ExecImage(ctx, imageRef, cmd)
+
+	call := callExecImage(imageRef, cmd)
+	if outbuf != nil {
+		call.Output = outbuf.String()
+	}
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return outbuf, err
+}
+
+// ResolveGitRef implements GitSolver. The wrapped solver is used to resolve
+// the reference if it implements GitSolver, otherwise git is run in a
+// container.
+func (r *Recorder) ResolveGitRef(ctx context.Context, c *builddef.Context) (string, error) {
+	ref, err := resolveGitRef(ctx, r.Solver, c)
+
+	call := callResolveGitRef(c)
+	call.Output = ref
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return ref, err
+}
+
+// ResolveGitSubmodules implements GitSolver, like ResolveGitRef.
+func (r *Recorder) ResolveGitSubmodules(ctx context.Context, c *builddef.Context) (map[string]string, error) {
+	commits, err := resolveGitSubmodules(ctx, r.Solver, c)
+
+	call := callResolveGitSubmodules(c)
+	call.Submodules = commits
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return commits, err
+}
+
+// ResolveGitCommitTime implements GitSolver, like ResolveGitRef.
+func (r *Recorder) ResolveGitCommitTime(ctx context.Context, c *builddef.Context) (int64, error) {
+	commitTime, err := resolveGitCommitTime(ctx, r.Solver, c)
+
+	call := callResolveGitCommitTime(c)
+	call.CommitTime = commitTime
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return commitTime, err
+}
+
+// LockHTTPContext implements HTTPSolver. The wrapped solver is used to
+// download the tarball if it implements HTTPSolver, otherwise it's downloaded
+// with the default HTTP client.
+func (r *Recorder) LockHTTPContext(ctx context.Context, c *builddef.Context) (string, string, error) {
+	lockedURL, checksum, err := lockHTTPContextURL(ctx, r.Solver, c)
+
+	call := callLockHTTPContext(c)
+	call.Output = lockedURL
+	call.Checksum = checksum
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return lockedURL, checksum, err
+}
+
+func (r *Recorder) FileExists(
+	ctx context.Context,
+	filepath string,
+	source *builddef.Context,
+) (bool, error) {
+	exists, err := r.Solver.FileExists(ctx, filepath, source)
+
+	call := callFileExists(filepath, source)
+	call.Exists = exists
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return exists, err
+}
+
+func (r *Recorder) Stat(
+	ctx context.Context,
+	filepath string,
+	source FileSource,
+) (FileInfo, error) {
+	fi, err := r.Solver.Stat(ctx, filepath, source)
+
+	call := callStat(filepath, source)
+	if err == nil {
+		call.Info = &fi
+	}
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return fi, err
+}
+
+// ReadImageDir implements ImageDirSolver. It fails if the wrapped solver
+// doesn't implement it.
+func (r *Recorder) ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error) {
+	names, err := ReadImageDir(ctx, r.Solver, image, dirpath)
+
+	call := callReadImageDir(image, dirpath)
+	call.Entries = names
+	call.Err = newRecordedError(err)
+	r.record(call)
+
+	return names, err
+}
+
+func (r *Recorder) ReadFile(
+	ctx context.Context,
+	filepath string,
+	opt ReadFileOpt,
+) ([]byte, error) {
+	return opt(ctx, filepath)
+}
+
+func (r *Recorder) FromContext(
+	source *builddef.Context,
+	opts ...llb.LocalOption,
+) ReadFileOpt {
+	return r.recordReadFile(describeContext(source), r.Solver.FromContext(source, opts...))
+}
+
+func (r *Recorder) FromImage(image string) ReadFileOpt {
+	return r.recordReadFile("image:"+image, r.Solver.FromImage(image))
+}
+
+func (r *Recorder) recordReadFile(src string, readFile ReadFileOpt) ReadFileOpt {
+	return func(ctx context.Context, filepath string) ([]byte, error) {
+		content, err := readFile(ctx, filepath)
+
+		call := callReadFile(src, filepath)
+		call.Output = string(content)
+		call.Err = newRecordedError(err)
+		r.record(call)
+
+		return content, err
+	}
+}
+
+// Save writes the calls recorded so far to the given fixture file. Calls are
+// sorted such that fixture files are stable across runs.
+func (r *Recorder) Save(path string) error {
+	r.mu.Lock()
+	calls := make([]recordedCall, 0, len(r.calls))
+	for _, call := range r.calls {
+		calls = append(calls, call)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].key() < calls[j].key()
+	})
+
+	raw, err := json.MarshalIndent(calls, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("could not encode fixtures: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, raw, 0640); err != nil {
+		return xerrors.Errorf("could not write fixtures to %s: %w", path, err)
+	}
+	return nil
+}
+
+// Replayer is a StateSolver serving the calls recorded by a Recorder. It
+// doesn't need Docker, Buildkit or network access, such that tests using it
+// run offline and deterministically. Calls that weren't recorded fail, and
+// recorded calls never replayed are reported by Unused.
+type Replayer struct {
+	calls map[string]recordedCall
+
+	mu   *sync.Mutex
+	used map[string]struct{}
+}
+
+// NewReplayer loads the fixture file written by Recorder.Save.
+func NewReplayer(path string) (Replayer, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Replayer{}, xerrors.Errorf("could not read fixtures: %w", err)
+	}
+
+	var calls []recordedCall
+	if err := json.Unmarshal(raw, &calls); err != nil {
+		return Replayer{}, xerrors.Errorf("could not decode fixtures from %s: %w", path, err)
+	}
+
+	r := Replayer{
+		calls: make(map[string]recordedCall, len(calls)),
+		mu:    &sync.Mutex{},
+		used:  map[string]struct{}{},
+	}
+	for _, call := range calls {
+		r.calls[call.key()] = call
+	}
+	return r, nil
+}
+
+func (r Replayer) replay(call recordedCall) (recordedCall, error) {
+	recorded, ok := r.calls[call.key()]
+	if !ok {
+		return recorded, xerrors.Errorf("no fixture recorded for %s", call)
+	}
+
+	r.mu.Lock()
+	r.used[call.key()] = struct{}{}
+	r.mu.Unlock()
+
+	return recorded, nil
+}
+
+// Unused returns the recorded calls that haven't been replayed so far. Tests
+// use it to detect stale fixtures.
+func (r Replayer) Unused() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	unused := []string{}
+	for key, call := range r.calls {
+		if _, ok := r.used[key]; !ok {
+			unused = append(unused, call.String())
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+func (r Replayer) ResolveImageRef(ctx context.Context, imageRef string) (string, error) {
+	call, err := r.replay(callResolveImageRef(imageRef))
+	if err != nil {
+		return "", err
+	}
+	return call.Output, call.Err.replay()
+}
+
+func (r Replayer) ExecImage(
+	ctx context.Context,
+	imageRef string,
+	cmd []string,
+) (*bytes.Buffer, error) {
+	call, err := r.replay(callExecImage(imageRef, cmd))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBufferString(call.Output), call.Err.replay()
+}
+
+// ResolveGitRef implements GitSolver.
+func (r Replayer) ResolveGitRef(ctx context.Context, c *builddef.Context) (string, error) {
+	call, err := r.replay(callResolveGitRef(c))
+	if err != nil {
+		return "", err
+	}
+	return call.Output, call.Err.replay()
+}
+
+// ResolveGitSubmodules implements GitSolver.
+func (r Replayer) ResolveGitSubmodules(ctx context.Context, c *builddef.Context) (map[string]string, error) {
+	call, err := r.replay(callResolveGitSubmodules(c))
+	if err != nil {
+		return nil, err
+	}
+	return call.Submodules, call.Err.replay()
+}
+
+// ResolveGitCommitTime implements GitSolver.
+func (r Replayer) ResolveGitCommitTime(ctx context.Context, c *builddef.Context) (int64, error) {
+	call, err := r.replay(callResolveGitCommitTime(c))
+	if err != nil {
+		return 0, err
+	}
+	return call.CommitTime, call.Err.replay()
+}
+
+// LockHTTPContext implements HTTPSolver.
+func (r Replayer) LockHTTPContext(ctx context.Context, c *builddef.Context) (string, string, error) {
+	call, err := r.replay(callLockHTTPContext(c))
+	if err != nil {
+		return "", "", err
+	}
+	return call.Output, call.Checksum, call.Err.replay()
+}
+
+func (r Replayer) FileExists(
+	ctx context.Context,
+	filepath string,
+	source *builddef.Context,
+) (bool, error) {
+	call, err := r.replay(callFileExists(filepath, source))
+	if err != nil {
+		return false, err
+	}
+	return call.Exists, call.Err.replay()
+}
+
+func (r Replayer) Stat(
+	ctx context.Context,
+	filepath string,
+	source FileSource,
+) (FileInfo, error) {
+	call, err := r.replay(callStat(filepath, source))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if call.Info == nil {
+		return FileInfo{}, call.Err.replay()
+	}
+	return *call.Info, call.Err.replay()
+}
+
+// ReadImageDir implements ImageDirSolver.
+func (r Replayer) ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error) {
+	call, err := r.replay(callReadImageDir(image, dirpath))
+	if err != nil {
+		return nil, err
+	}
+	if call.Err != nil {
+		return nil, call.Err.replay()
+	}
+	return call.Entries, nil
+}
+
+func (r Replayer) ReadFile(
+	ctx context.Context,
+	filepath string,
+	opt ReadFileOpt,
+) ([]byte, error) {
+	return opt(ctx, filepath)
+}
+
+func (r Replayer) FromContext(
+	source *builddef.Context,
+	opts ...llb.LocalOption,
+) ReadFileOpt {
+	return r.replayReadFile(describeContext(source))
+}
+
+func (r Replayer) FromImage(image string) ReadFileOpt {
+	return r.replayReadFile("image:" + image)
+}
+
+func (r Replayer) replayReadFile(src string) ReadFileOpt {
+	return func(ctx context.Context, filepath string) ([]byte, error) {
+		call, err := r.replay(callReadFile(src, filepath))
+		if err != nil {
+			return nil, err
+		}
+		if call.Err != nil {
+			return nil, call.Err.replay()
+		}
+		return []byte(call.Output), nil
+	}
+}
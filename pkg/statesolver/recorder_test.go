@@ -0,0 +1,229 @@
+package statesolver_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/mocks"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-test/deep"
+	"github.com/golang/mock/gomock"
+	"golang.org/x/xerrors"
+)
+
+// recordedCalls makes the same calls to the given solver and returns their
+// results, such that results of a Recorder and a Replayer can be compared.
+func recordedCalls(ctx context.Context, solver statesolver.StateSolver) []interface{} {
+	localCtx := &builddef.Context{Type: builddef.ContextTypeLocal, Source: "context"}
+	cmd := []string{"/usr/bin/env php -r \"echo ini_get('extension_dir');\""}
+	var results []interface{}
+
+	resolved, err := solver.ResolveImageRef(ctx, "debian:buster")
+	results = append(results, resolved, describeErr(err))
+
+	out, err := solver.ExecImage(ctx, pinnedDebianImage, cmd)
+	results = append(results, out.String(), describeErr(err))
+	out, err = solver.ExecImage(ctx, pinnedDebianImage, []string{"exit 127"})
+	results = append(results, out.String(), describeErr(err))
+
+	content, err := solver.ReadFile(ctx, "/etc/os-release", solver.FromImage(pinnedDebianImage))
+	results = append(results, string(content), describeErr(err))
+	content, err = solver.ReadFile(ctx, "composer.lock", solver.FromContext(localCtx))
+	results = append(results, string(content), describeErr(err))
+
+	exists, err := solver.FileExists(ctx, "composer.json", localCtx)
+	results = append(results, exists, describeErr(err))
+
+	fi, err := solver.Stat(ctx, "/etc", statesolver.ImageSource(pinnedDebianImage))
+	results = append(results, fi, describeErr(err))
+
+	names, err := statesolver.ReadImageDir(ctx, solver, pinnedDebianImage, "/etc/apt/sources.list.d")
+	results = append(results, names, describeErr(err))
+
+	locked, err := statesolver.LockContext(ctx, solver, gitCtx)
+	results = append(results, locked, describeErr(err))
+	locked, err = statesolver.LockContext(ctx, solver, httpCtx)
+	results = append(results, locked, describeErr(err))
+
+	return results
+}
+
+var gitCtx = &builddef.Context{
+	Type:   builddef.ContextTypeGit,
+	Source: "https://github.com/NiR-/zbuild.git",
+	GitContext: builddef.GitContext{
+		Reference:  "master",
+		Submodules: &withSubmodules,
+	},
+}
+
+var httpCtx = &builddef.Context{
+	Type:   builddef.ContextTypeHTTP,
+	Source: "https://github.com/NiR-/zbuild/archive/master.tar.gz",
+}
+
+// gitStateSolver is a StateSolver implementing GitSolver, HTTPSolver and
+// ImageDirSolver, as recorded solvers would usually do.
+type gitStateSolver struct {
+	*mocks.MockStateSolver
+}
+
+func (s gitStateSolver) ResolveGitRef(ctx context.Context, c *builddef.Context) (string, error) {
+	return "f6e4d1ee3e8e1ec27d9a3d6e1b2b7c0e2b1dd2a3", nil
+}
+
+func (s gitStateSolver) ResolveGitSubmodules(ctx context.Context, c *builddef.Context) (map[string]string, error) {
+	return map[string]string{"vendor/lib": "0b6a4b3d0f9c3e1c1a0a1e5d0e7b9f8c3a2d1e0f"}, nil
+}
+
+func (s gitStateSolver) ResolveGitCommitTime(ctx context.Context, c *builddef.Context) (int64, error) {
+	return 1588291200, nil
+}
+
+func (s gitStateSolver) LockHTTPContext(ctx context.Context, c *builddef.Context) (string, string, error) {
+	return "https://codeload.github.com/NiR-/zbuild/tar.gz/master",
+		"sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", nil
+}
+
+func (s gitStateSolver) ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error) {
+	return []string{"debian.sources", "pgdg.list"}, nil
+}
+
+// describeErr returns the message of the given error along with what it wraps.
+func describeErr(err error) map[string]interface{} {
+	if err == nil {
+		return nil
+	}
+
+	var execErr statesolver.ExecError
+	return map[string]interface{}{
+		"message":   err.Error(),
+		"not_found": xerrors.Is(err, statesolver.FileNotFound),
+		"exec":      xerrors.As(err, &execErr),
+		"exec_err":  execErr,
+	}
+}
+
+func newRecordedSolver(mockCtrl *gomock.Controller) statesolver.StateSolver {
+	solver := mocks.NewMockStateSolver(mockCtrl)
+	solver.EXPECT().ResolveImageRef(gomock.Any(), "debian:buster").Return(pinnedDebianImage, nil)
+
+	cmd := []string{"/usr/bin/env php -r \"echo ini_get('extension_dir');\""}
+	solver.EXPECT().ExecImage(gomock.Any(), pinnedDebianImage, cmd).
+		Return(bytes.NewBufferString("/usr/local/lib/php/extensions/no-debug-non-zts-20190902"), nil)
+	solver.EXPECT().ExecImage(gomock.Any(), pinnedDebianImage, []string{"exit 127"}).
+		Return(&bytes.Buffer{}, xerrors.Errorf("failed to execute cmd: %w", statesolver.ExecError{
+			Cmd:      []string{"exit 127"},
+			ExitCode: 127,
+			Stderr:   "not found",
+		}))
+
+	solver.EXPECT().FromImage(pinnedDebianImage).Return(statesolver.ReadFileOpt(
+		func(_ context.Context, _ string) ([]byte, error) {
+			return []byte("ID=debian\n"), nil
+		}))
+	solver.EXPECT().FromContext(gomock.Any()).Return(statesolver.ReadFileOpt(
+		func(_ context.Context, filepath string) ([]byte, error) {
+			return nil, xerrors.Errorf("failed to read %s from build context: %w", filepath, statesolver.FileNotFound)
+		}))
+
+	solver.EXPECT().FileExists(gomock.Any(), "composer.json", gomock.Any()).Return(true, nil)
+	solver.EXPECT().Stat(gomock.Any(), "/etc", statesolver.ImageSource(pinnedDebianImage)).
+		Return(statesolver.FileInfo{Mode: os.ModeDir | 0755}, nil)
+
+	return gitStateSolver{solver}
+}
+
+func TestRecorderAndReplayer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dir, err := ioutil.TempDir("", "zbuild-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixtures := filepath.Join(dir, "fixtures.json")
+
+	ctx := context.Background()
+	recorder := statesolver.NewRecorder(newRecordedSolver(mockCtrl))
+	recorded := recordedCalls(ctx, recorder)
+	if err := recorder.Save(fixtures); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	replayer, err := statesolver.NewReplayer(fixtures)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	replayed := recordedCalls(ctx, replayer)
+
+	if diff := deep.Equal(replayed, recorded); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Fixture files have to be stable across runs to be committed.
+	raw, err := ioutil.ReadFile(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = statesolver.NewRecorder(newRecordedSolver(mockCtrl))
+	recordedCalls(ctx, recorder)
+	if err := recorder.Save(fixtures); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rerecorded, err := ioutil.ReadFile(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != string(rerecorded) {
+		t.Fatalf("Expected: %s\nGot: %s", raw, rerecorded)
+	}
+}
+
+func TestReplayerFailsOnUnrecordedCalls(t *testing.T) {
+	replayer, err := statesolver.NewReplayer("testdata/fixtures.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	resolved, err := replayer.ResolveImageRef(ctx, "debian:buster")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resolved != pinnedDebianImage {
+		t.Fatalf("Expected: %s\nGot: %s", pinnedDebianImage, resolved)
+	}
+
+	_, err = replayer.ResolveImageRef(ctx, "debian:bullseye")
+	expectedErr := "no fixture recorded for ResolveImageRef([\"debian:bullseye\"])"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected: %s\nGot: %v", expectedErr, err)
+	}
+}
+
+func TestReplayerReportsUnusedFixtures(t *testing.T) {
+	replayer, err := statesolver.NewReplayer("testdata/fixtures.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{`ResolveImageRef(["debian:buster"])`}
+	if diff := deep.Equal(replayer.Unused(), expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	ctx := context.Background()
+	if _, err := replayer.ResolveImageRef(ctx, "debian:buster"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if unused := replayer.Unused(); len(unused) > 0 {
+		t.Fatalf("Expected all fixtures to be used, got: %v", unused)
+	}
+}
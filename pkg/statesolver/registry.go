@@ -0,0 +1,679 @@
+package statesolver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/lockcache"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/moby/buildkit/client/llb"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// maxSymlinks is the maximum number of symlinks followed when reading a
+	// file from an image, to detect symlink loops.
+	maxSymlinks = 40
+)
+
+// RegistrySolver is a StateSolver reading files from images by fetching
+// their manifest and layers directly from their registry. As such, it
+// doesn't need a Docker daemon, but it can't execute commands in images nor
+// read files from git contexts.
+type RegistrySolver struct {
+	// RootDir is the path to the root of the build context.
+	RootDir       string
+	ImageResolver remotes.Resolver
+	// BlobCacheDir is the directory where manifests and layers fetched from
+	// registries are stored. Blobs aren't cached when it's empty.
+	BlobCacheDir string
+	// Platform is the platform of the images read from multi-platform images.
+	// linux/amd64 is used when it's nil.
+	Platform *ocispec.Platform
+	// HTTPClient is used to download the tarballs of HTTP contexts.
+	// http.DefaultClient is used when it's nil.
+	HTTPClient *http.Client
+	// Tarballs keeps the tarballs of HTTP contexts downloaded by the solver.
+	// Tarballs are downloaded again for each call when it's nil.
+	Tarballs *TarballCache
+}
+
+// DefaultBlobCacheDir returns the directory used by RegistrySolver to cache
+// blobs (and by TarballCache to store tarballs) by default, or an empty string if the user cache dir can't be
+// determined.
+func DefaultBlobCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "zbuild", "blobs")
+}
+
+func (s RegistrySolver) ResolveImageRef(ctx context.Context, imageRef string) (string, error) {
+	return resolveImageRef(ctx, s.ImageResolver, imageRef)
+}
+
+func (s RegistrySolver) ExecImage(
+	ctx context.Context,
+	imageRef string,
+	cmd []string,
+) (*bytes.Buffer, error) {
+	return nil, xerrors.Errorf("failed to execute %q in %q: executing commands is not supported by RegistrySolver",
+		strings.Join(cmd, "; "), imageRef)
+}
+
+func (s RegistrySolver) FileExists(
+	ctx context.Context,
+	filepath string,
+	source *builddef.Context,
+) (bool, error) {
+	return fileExists(ctx, s, filepath, source)
+}
+
+func (s RegistrySolver) ReadFile(
+	ctx context.Context,
+	filepath string,
+	opt ReadFileOpt,
+) ([]byte, error) {
+	return opt(ctx, filepath)
+}
+
+func (s RegistrySolver) FromContext(
+	source *builddef.Context,
+	_ ...llb.LocalOption,
+) ReadFileOpt {
+	return func(ctx context.Context, filepath string) ([]byte, error) {
+		if source == nil {
+			return []byte{}, nil
+		}
+
+		logrus.Debugf("Reading file %s from %s context", filepath, source.Type)
+
+		switch source.Type {
+		case builddef.ContextTypeLocal:
+			return readFromLocalDir(s.RootDir, filepath)
+		case builddef.ContextTypeHTTP:
+			return readFromHTTPContext(ctx, s.HTTPClient, s.Tarballs, source, filepath)
+		case builddef.ContextTypeImage:
+			return s.FromImage(source.Source)(ctx, filepath)
+		}
+
+		return []byte{}, xerrors.Errorf(
+			"context type %q is not supported by RegistrySolver", string(source.Type))
+	}
+}
+
+// LockHTTPContext implements HTTPSolver.
+func (s RegistrySolver) LockHTTPContext(ctx context.Context, c *builddef.Context) (string, string, error) {
+	return lockHTTPContext(ctx, s.HTTPClient, s.Tarballs, c)
+}
+
+func (s RegistrySolver) FromImage(image string) ReadFileOpt {
+	return func(ctx context.Context, filepath string) ([]byte, error) {
+		layers, fetcher, err := s.fetchLayers(ctx, image)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read %s from %s: %w", filepath, image, err)
+		}
+
+		res, err := s.lookupPath(ctx, fetcher, layers, filepath, true)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read %s from %s: %w", filepath, image, err)
+		}
+
+		content, err := res.regularFileContent(filepath)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read %s from %s: %w", filepath, image, err)
+		}
+
+		return content, nil
+	}
+}
+
+func (s RegistrySolver) Stat(
+	ctx context.Context,
+	filepath string,
+	source FileSource,
+) (FileInfo, error) {
+	if source.Image != "" {
+		return s.statFromImage(ctx, source.Image, filepath)
+	}
+	if source.Context == nil {
+		return FileInfo{}, FileNotFound
+	}
+
+	switch source.Context.Type {
+	case builddef.ContextTypeLocal:
+		return statLocalDir(s.RootDir, filepath)
+	case builddef.ContextTypeHTTP:
+		return statFromHTTPContext(ctx, s.HTTPClient, s.Tarballs, source.Context, filepath)
+	case builddef.ContextTypeImage:
+		return s.statFromImage(ctx, source.Context.Source, filepath)
+	}
+
+	return FileInfo{}, xerrors.Errorf(
+		"context type %q is not supported by RegistrySolver", string(source.Context.Type))
+}
+
+// ReadImageDir implements ImageDirSolver.
+func (s RegistrySolver) ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error) {
+	layers, fetcher, err := s.fetchLayers(ctx, image)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, err)
+	}
+
+	res, err := s.lookupPath(ctx, fetcher, layers, dirpath, false)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, err)
+	}
+	if !res.info.IsDir() {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: it's not a directory", dirpath, image)
+	}
+
+	names, err := s.listDir(ctx, fetcher, layers, res.path)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: %w", dirpath, image, err)
+	}
+
+	return names, nil
+}
+
+func (s RegistrySolver) statFromImage(ctx context.Context, image, filepath string) (FileInfo, error) {
+	layers, fetcher, err := s.fetchLayers(ctx, image)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, image, err)
+	}
+
+	res, err := s.lookupPath(ctx, fetcher, layers, filepath, false)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("failed to stat %s from %s: %w", filepath, image, err)
+	}
+
+	return res.info, nil
+}
+
+// fetchLayers returns the layers of the given image, in the order they're
+// applied, and a Fetcher to fetch them.
+func (s RegistrySolver) fetchLayers(
+	ctx context.Context,
+	image string,
+) ([]ocispec.Descriptor, remotes.Fetcher, error) {
+	name, desc, err := s.ImageResolver.Resolve(ctx, image)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetcher, err := s.ImageResolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if desc.MediaType == images.MediaTypeDockerSchema2ManifestList ||
+		desc.MediaType == ocispec.MediaTypeImageIndex {
+		var index ocispec.Index
+		if err := s.fetchJSON(ctx, fetcher, desc, &index); err != nil {
+			return nil, nil, err
+		}
+
+		desc, err = s.matchPlatform(index)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if desc.MediaType != images.MediaTypeDockerSchema2Manifest &&
+		desc.MediaType != ocispec.MediaTypeImageManifest {
+		return nil, nil, xerrors.Errorf("unsupported manifest media type %q", desc.MediaType)
+	}
+
+	var manifest ocispec.Manifest
+	if err := s.fetchJSON(ctx, fetcher, desc, &manifest); err != nil {
+		return nil, nil, err
+	}
+
+	return manifest.Layers, fetcher, nil
+}
+
+func (s RegistrySolver) matchPlatform(index ocispec.Index) (ocispec.Descriptor, error) {
+	platform := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	if s.Platform != nil {
+		platform = *s.Platform
+	}
+
+	matcher := platforms.Only(platform)
+	for _, manifest := range index.Manifests {
+		if manifest.Platform != nil && matcher.Match(*manifest.Platform) {
+			return manifest, nil
+		}
+	}
+
+	return ocispec.Descriptor{}, xerrors.Errorf("no manifest found for platform %s",
+		platforms.Format(platform))
+}
+
+func (s RegistrySolver) fetchJSON(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	desc ocispec.Descriptor,
+	v interface{},
+) error {
+	r, err := s.fetchBlob(ctx, fetcher, desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return xerrors.Errorf("could not decode %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// fetchBlob returns a reader of the given blob. When BlobCacheDir is set,
+// the blob is read from the cache if it's there or downloaded and verified
+// into the cache first.
+func (s RegistrySolver) fetchBlob(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	desc ocispec.Descriptor,
+) (io.ReadCloser, error) {
+	if s.BlobCacheDir == "" {
+		r, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return nil, xerrors.Errorf("could not fetch %s: %w", desc.Digest, err)
+		}
+		return r, nil
+	}
+
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+
+	blobPath := filepath.Join(s.BlobCacheDir, desc.Digest.Algorithm().String(), desc.Digest.Hex())
+	if f, err := os.Open(blobPath); err == nil {
+		return f, nil
+	}
+
+	if err := s.downloadBlob(ctx, fetcher, desc, blobPath); err != nil {
+		return nil, xerrors.Errorf("could not fetch %s: %w", desc.Digest, err)
+	}
+
+	return os.Open(blobPath)
+}
+
+// downloadBlob writes the given blob to a temporary file first and moves it
+// to blobPath only once its digest has been verified, such that the cache
+// never contains partial or corrupted blobs.
+func (s RegistrySolver) downloadBlob(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	desc ocispec.Descriptor,
+	blobPath string,
+) error {
+	logrus.Debugf("Fetching blob %s", desc.Digest)
+
+	r, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return lockcache.WriteFileAtomic(blobPath, func(w io.Writer) error {
+		verifier := desc.Digest.Verifier()
+		if _, err := io.Copy(io.MultiWriter(w, verifier), r); err != nil {
+			return err
+		}
+		if !verifier.Verified() {
+			return xerrors.Errorf("digest mismatch")
+		}
+		return nil
+	})
+}
+
+// lookupPath looks for the given path in the layers of an image, from the
+// topmost layer to the lowest one, and stops as soon as it finds the path or
+// a whiteout hiding it. Symlinks (including the ones in the parent dirs of
+// the path) are followed. The content of regular files is read only when
+// readContent is true.
+func (s RegistrySolver) lookupPath(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	layers []ocispec.Descriptor,
+	filepath string,
+	readContent bool,
+) (layerLookup, error) {
+	return followLinks(filepath, func(target string) (layerLookup, error) {
+		return s.lookupFile(ctx, fetcher, layers, target, readContent)
+	})
+}
+
+// followLinks calls lookup with the given path until it finds a path that
+// isn't a link, or detects a symlink loop. lookup is never called for the
+// root dir.
+func followLinks(filepath string, lookup func(target string) (layerLookup, error)) (layerLookup, error) {
+	target := path.Clean("/" + filepath)
+
+	for hops := 0; hops <= maxSymlinks; hops++ {
+		if target == "/" {
+			return layerLookup{info: newFileInfo(0, os.ModeDir|0755), path: target, found: true}, nil
+		}
+
+		res, err := lookup(target)
+		if err != nil {
+			return layerLookup{}, err
+		}
+		if res.linkTarget == "" {
+			res.path = target
+			return res, nil
+		}
+
+		logrus.Debugf("Following symlink %s -> %s", target, res.linkTarget)
+		target = res.linkTarget
+	}
+
+	return layerLookup{}, xerrors.Errorf("too many levels of symbolic links")
+}
+
+// regularFileContent returns the content of the file found, or an error if
+// it's not a regular file.
+func (res layerLookup) regularFileContent(filepath string) ([]byte, error) {
+	if !res.info.IsRegular() {
+		return nil, xerrors.Errorf("could not fetch path %q, it's not a regular file", filepath)
+	}
+	return res.content, nil
+}
+
+type layerLookup struct {
+	info    FileInfo
+	content []byte
+	// path is the path the file has been found at, once links are followed.
+	path string
+	// linkTarget is the path to look up instead of the file looked up, when
+	// the file or one of its parent dirs is a link.
+	linkTarget string
+	found      bool
+	// hidden is true when a whiteout hides the file in lower layers.
+	hidden bool
+}
+
+func (s RegistrySolver) lookupFile(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	layers []ocispec.Descriptor,
+	target string,
+	readContent bool,
+) (layerLookup, error) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		res, err := s.lookupFileInLayer(ctx, fetcher, layers[i], target, readContent)
+		if err != nil {
+			return layerLookup{}, xerrors.Errorf("could not read layer %s: %w", layers[i].Digest, err)
+		}
+		if res.found || res.linkTarget != "" {
+			return res, nil
+		}
+		if res.hidden {
+			break
+		}
+	}
+
+	return layerLookup{}, FileNotFound
+}
+
+func (s RegistrySolver) lookupFileInLayer(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	layer ocispec.Descriptor,
+	target string,
+	readContent bool,
+) (layerLookup, error) {
+	r, err := s.fetchBlob(ctx, fetcher, layer)
+	if err != nil {
+		return layerLookup{}, err
+	}
+	defer r.Close()
+
+	tarR, err := decompressLayer(layer, r)
+	if err != nil {
+		return layerLookup{}, err
+	}
+
+	return lookupInTar(tarR, target, readContent)
+}
+
+// lookupInTar looks for the given path in a tarball. Whiteouts are handled as
+// in image layers.
+func lookupInTar(tarR *tar.Reader, target string, readContent bool) (layerLookup, error) {
+	var res layerLookup
+	// Tarballs don't always contain entries for the parent dirs of the
+	// files they contain, so the target is also a dir when it's the parent
+	// of another entry.
+	var implicitDir bool
+
+	for {
+		h, err := tarR.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return res, err
+		}
+
+		name := path.Clean("/" + h.Name)
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+
+		if base == whiteoutOpaque {
+			// An opaque whiteout hides the content of its dir in lower layers.
+			if isParentDir(dir, target) {
+				res.hidden = true
+			}
+			if dir == target {
+				implicitDir = true
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			removed := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if removed == target || isParentDir(removed, target) {
+				res.hidden = true
+			}
+			continue
+		}
+
+		if name == target {
+			switch h.Typeflag {
+			case tar.TypeSymlink:
+				res.linkTarget = resolveLink(name, h.Linkname)
+				return res, nil
+			case tar.TypeLink:
+				res.linkTarget = path.Clean("/" + h.Linkname)
+				return res, nil
+			}
+
+			res.info = newFileInfo(h.Size, h.FileInfo().Mode())
+			res.found = true
+			if readContent && res.info.IsRegular() {
+				res.content, err = ioutil.ReadAll(tarR)
+			}
+			return res, err
+		}
+
+		// A parent dir of the target being a symlink means the file has to
+		// be looked up at another path.
+		if h.Typeflag == tar.TypeSymlink && isParentDir(name, target) {
+			res.linkTarget = path.Join(resolveLink(name, h.Linkname),
+				strings.TrimPrefix(target, name))
+			return res, nil
+		}
+
+		if isParentDir(target, name) {
+			implicitDir = true
+		}
+	}
+
+	if implicitDir {
+		res.info = newFileInfo(0, os.ModeDir|0755)
+		res.found = true
+	}
+
+	return res, nil
+}
+
+// listDir returns the entries of the given dir once all the layers are
+// applied, from the lowest layer to the topmost one.
+func (s RegistrySolver) listDir(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	layers []ocispec.Descriptor,
+	dirpath string,
+) ([]string, error) {
+	entries := map[string]struct{}{}
+
+	for _, layer := range layers {
+		changes, err := s.listDirInLayer(ctx, fetcher, layer, dirpath)
+		if err != nil {
+			return nil, xerrors.Errorf("could not read layer %s: %w", layer.Digest, err)
+		}
+
+		if changes.hidden {
+			entries = map[string]struct{}{}
+		}
+		for _, name := range changes.removed {
+			delete(entries, name)
+		}
+		for _, name := range changes.added {
+			entries[name] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s RegistrySolver) listDirInLayer(
+	ctx context.Context,
+	fetcher remotes.Fetcher,
+	layer ocispec.Descriptor,
+	dirpath string,
+) (dirChanges, error) {
+	r, err := s.fetchBlob(ctx, fetcher, layer)
+	if err != nil {
+		return dirChanges{}, err
+	}
+	defer r.Close()
+
+	tarR, err := decompressLayer(layer, r)
+	if err != nil {
+		return dirChanges{}, err
+	}
+
+	return listDirInTar(tarR, dirpath)
+}
+
+// dirChanges are the changes made by a layer to the entries of a dir.
+type dirChanges struct {
+	added   []string
+	removed []string
+	// hidden is true when a whiteout hides the entries of the dir in lower
+	// layers.
+	hidden bool
+}
+
+// listDirInTar returns the changes made by a tarball to the entries of the
+// given dir. Whiteouts are handled as in image layers.
+func listDirInTar(tarR *tar.Reader, dirpath string) (dirChanges, error) {
+	var changes dirChanges
+
+	for {
+		h, err := tarR.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return changes, err
+		}
+
+		name := path.Clean("/" + h.Name)
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+
+		if base == whiteoutOpaque {
+			if dir == dirpath || isParentDir(dir, dirpath) {
+				changes.hidden = true
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			removed := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if dir == dirpath {
+				changes.removed = append(changes.removed, path.Base(removed))
+			} else if removed == dirpath || isParentDir(removed, dirpath) {
+				changes.hidden = true
+			}
+			continue
+		}
+
+		// Tarballs don't always contain entries for the subdirs of the dir,
+		// so they're listed from the paths of their files too.
+		if name != dirpath && isParentDir(dirpath, name) {
+			rel := strings.TrimPrefix(strings.TrimPrefix(name, dirpath), "/")
+			changes.added = append(changes.added, strings.SplitN(rel, "/", 2)[0])
+		}
+	}
+
+	return changes, nil
+}
+
+func decompressLayer(layer ocispec.Descriptor, r io.Reader) (*tar.Reader, error) {
+	switch layer.MediaType {
+	case images.MediaTypeDockerSchema2LayerGzip,
+		images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerGzip,
+		ocispec.MediaTypeImageLayerNonDistributableGzip:
+		gzipR, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gzipR), nil
+	case images.MediaTypeDockerSchema2Layer,
+		images.MediaTypeDockerSchema2LayerForeign,
+		ocispec.MediaTypeImageLayer,
+		ocispec.MediaTypeImageLayerNonDistributable:
+		return tar.NewReader(r), nil
+	}
+
+	return nil, xerrors.Errorf("unsupported layer media type %q", layer.MediaType)
+}
+
+// resolveLink returns the absolute path targeted by the symlink at the given
+// path.
+func resolveLink(name, linkname string) string {
+	if path.IsAbs(linkname) {
+		return path.Clean(linkname)
+	}
+	return path.Join(path.Dir(name), linkname)
+}
+
+func isParentDir(dir, target string) bool {
+	return dir == "/" || strings.HasPrefix(target, dir+"/")
+}
@@ -0,0 +1,437 @@
+package statesolver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/go-test/deep"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/xerrors"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+// testRegistry is a minimal implementation of the registry API serving
+// read-only images from memory.
+type testRegistry struct {
+	mu        sync.Mutex
+	manifests map[string]ocispec.Descriptor
+	blobs     map[digest.Digest][]byte
+	// blobRequests counts the number of times each blob has been fetched.
+	blobRequests map[digest.Digest]int
+}
+
+func newTestRegistry() (*testRegistry, *httptest.Server) {
+	reg := &testRegistry{
+		manifests:    map[string]ocispec.Descriptor{},
+		blobs:        map[digest.Digest][]byte{},
+		blobRequests: map[digest.Digest]int{},
+	}
+	srv := httptest.NewServer(reg)
+	return reg, srv
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/"), "/")
+	if len(segments) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	name := strings.Join(segments[:len(segments)-2], "/")
+	kind := segments[len(segments)-2]
+	ref := segments[len(segments)-1]
+
+	var desc ocispec.Descriptor
+	switch kind {
+	case "manifests":
+		var ok bool
+		if desc, ok = r.manifests[name+":"+ref]; !ok {
+			desc, ok = r.manifests[name+"@"+ref]
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case "blobs":
+		dgst := digest.Digest(ref)
+		if _, ok := r.blobs[dgst]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		desc = ocispec.Descriptor{Digest: dgst, MediaType: "application/octet-stream"}
+		if req.Method == "GET" {
+			r.blobRequests[dgst]++
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	blob := r.blobs[desc.Digest]
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "GET" {
+		w.Write(blob) //nolint:errcheck
+	}
+}
+
+func (r *testRegistry) addBlob(mediaType string, blob []byte) ocispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dgst := digest.FromBytes(blob)
+	r.blobs[dgst] = blob
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(blob)),
+	}
+}
+
+func (r *testRegistry) addJSON(mediaType string, v interface{}) ocispec.Descriptor {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return r.addBlob(mediaType, blob)
+}
+
+// addImage stores an image made of the given layers (from the lowest to the
+// topmost one) and tags it as name:tag.
+func (r *testRegistry) addImage(name, tag string, layers ...[]tarEntry) ocispec.Descriptor {
+	manifest := ocispec.Manifest{
+		Config: r.addJSON(images.MediaTypeDockerSchema2Config, ocispec.Image{}),
+	}
+	manifest.SchemaVersion = 2
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers,
+			r.addBlob(images.MediaTypeDockerSchema2LayerGzip, buildLayer(layer)))
+	}
+
+	desc := r.addJSON(images.MediaTypeDockerSchema2Manifest, manifest)
+	r.tag(name, tag, desc)
+	return desc
+}
+
+func (r *testRegistry) tag(name, tag string, desc ocispec.Descriptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.manifests[name+":"+tag] = desc
+	r.manifests[name+"@"+desc.Digest.String()] = desc
+}
+
+func buildLayer(entries []tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	gzipW := gzip.NewWriter(buf)
+	tarW := tar.NewWriter(gzipW)
+
+	for _, entry := range entries {
+		h := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			h.Mode = 0755
+		}
+		if err := tarW.WriteHeader(h); err != nil {
+			panic(err)
+		}
+		if _, err := tarW.Write([]byte(entry.content)); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := tarW.Close(); err != nil {
+		panic(err)
+	}
+	if err := gzipW.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func newRegistrySolver(srv *httptest.Server, blobCacheDir string) statesolver.RegistrySolver {
+	return statesolver.RegistrySolver{
+		ImageResolver: docker.NewResolver(docker.ResolverOptions{
+			PlainHTTP: true,
+			Client:    srv.Client(),
+		}),
+		BlobCacheDir: blobCacheDir,
+	}
+}
+
+var baseLayer = []tarEntry{
+	{name: "etc/", typeflag: tar.TypeDir},
+	{name: "etc/os-release", typeflag: tar.TypeSymlink, linkname: "../usr/lib/os-release"},
+	{name: "etc/debian_version", typeflag: tar.TypeReg, content: "10.3\n"},
+	{name: "etc/apt/", typeflag: tar.TypeDir},
+	{name: "etc/apt/sources.list", typeflag: tar.TypeReg, content: "deb http://deb.debian.org/debian buster main\n"},
+	{name: "usr/", typeflag: tar.TypeDir},
+	{name: "usr/lib/", typeflag: tar.TypeDir},
+	{name: "usr/lib/os-release", typeflag: tar.TypeReg, content: "ID=debian\nVERSION_ID=\"10\"\n"},
+	{name: "usr/local/", typeflag: tar.TypeDir},
+	{name: "usr/local/etc/", typeflag: tar.TypeDir},
+	{name: "usr/local/etc/php.ini", typeflag: tar.TypeReg, content: "memory_limit=128M\n"},
+	{name: "opt/", typeflag: tar.TypeDir},
+	{name: "opt/app/", typeflag: tar.TypeDir},
+	{name: "opt/app/config.yml", typeflag: tar.TypeReg, content: "debug: true\n"},
+	{name: "loop-a", typeflag: tar.TypeSymlink, linkname: "loop-b"},
+	{name: "loop-b", typeflag: tar.TypeSymlink, linkname: "/loop-a"},
+}
+
+var upperLayer = []tarEntry{
+	// Override a file of the base layer.
+	{name: "./usr/lib/os-release", typeflag: tar.TypeReg, content: "ID=debian\nVERSION_ID=\"10\"\nVERSION_CODENAME=buster\n"},
+	// Remove a file of the base layer.
+	{name: "etc/.wh.debian_version", typeflag: tar.TypeReg},
+	// Replace the content of a dir of the base layer.
+	{name: "etc/apt/.wh..wh..opq", typeflag: tar.TypeReg},
+	{name: "etc/apt/apt.conf", typeflag: tar.TypeReg, content: "APT::Install-Recommends false;\n"},
+	// Replace a dir of the base layer with a symlink.
+	{name: "usr/.wh.local", typeflag: tar.TypeReg},
+	{name: "usr/local", typeflag: tar.TypeSymlink, linkname: "/srv"},
+	{name: "srv/", typeflag: tar.TypeDir},
+	{name: "srv/etc/", typeflag: tar.TypeDir},
+	{name: "srv/etc/php.ini", typeflag: tar.TypeReg, content: "memory_limit=-1\n"},
+	// Remove a whole dir of the base layer.
+	{name: "opt/.wh.app", typeflag: tar.TypeReg},
+}
+
+func TestRegistrySolverReadFile(t *testing.T) {
+	testcases := map[string]struct {
+		filepath    string
+		expected    string
+		expectedErr error
+	}{
+		"read a file overridden by an upper layer through a symlink": {
+			filepath: "/etc/os-release",
+			expected: "ID=debian\nVERSION_ID=\"10\"\nVERSION_CODENAME=buster\n",
+		},
+		"read a file through a symlinked parent dir": {
+			filepath: "/usr/local/etc/php.ini",
+			expected: "memory_limit=-1\n",
+		},
+		"read a file added to an opaque dir": {
+			filepath: "/etc/apt/apt.conf",
+			expected: "APT::Install-Recommends false;\n",
+		},
+		"fail to read a file removed by a whiteout": {
+			filepath:    "/etc/debian_version",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"fail to read a file hidden by an opaque dir": {
+			filepath:    "/etc/apt/sources.list",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"fail to read a file from a removed dir": {
+			filepath:    "/opt/app/config.yml",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"fail to read a nonexistent file": {
+			filepath:    "/etc/yolo",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"fail to read a file through a symlink loop": {
+			filepath:    "/loop-a",
+			expectedErr: xerrors.New("too many levels of symbolic links"),
+		},
+		"fail to read a directory": {
+			filepath:    "/etc/apt",
+			expectedErr: xerrors.New("could not fetch path \"/etc/apt\", it's not a regular file"),
+		},
+	}
+
+	reg, srv := newTestRegistry()
+	defer srv.Close()
+
+	imageRef := strings.TrimPrefix(srv.URL, "http://") + "/library/debian:buster"
+	reg.addImage("library/debian", "buster", baseLayer, upperLayer)
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		// Subtests aren't run in parallel as the registry server is closed
+		// once the parent test returns.
+		t.Run(tcname, func(t *testing.T) {
+			solver := newRegistrySolver(srv, "")
+			ctx := context.Background()
+			content, err := solver.ReadFile(ctx, tc.filepath, solver.FromImage(imageRef))
+
+			if tc.expectedErr != nil {
+				if err == nil || !(xerrors.Is(err, tc.expectedErr) ||
+					strings.HasSuffix(err.Error(), tc.expectedErr.Error())) {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if string(content) != tc.expected {
+				t.Fatalf("Expected: %q\nGot: %q", tc.expected, string(content))
+			}
+		})
+	}
+}
+
+func TestRegistrySolverReadImageDir(t *testing.T) {
+	testcases := map[string]struct {
+		dirpath     string
+		expected    []string
+		expectedErr error
+	}{
+		"list a dir with entries removed by a whiteout": {
+			dirpath:  "/etc",
+			expected: []string{"apt", "os-release"},
+		},
+		"list an opaque dir": {
+			dirpath:  "/etc/apt",
+			expected: []string{"apt.conf"},
+		},
+		"list a dir through a symlinked parent dir": {
+			dirpath:  "/usr/local/etc",
+			expected: []string{"php.ini"},
+		},
+		"list the root dir": {
+			dirpath:  "/",
+			expected: []string{"etc", "loop-a", "loop-b", "opt", "srv", "usr"},
+		},
+		"list a dir emptied by a whiteout": {
+			dirpath:  "/opt",
+			expected: []string{},
+		},
+		"fail to list a removed dir": {
+			dirpath:     "/opt/app",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"fail to list a file": {
+			dirpath:     "/etc/apt/apt.conf",
+			expectedErr: xerrors.New("it's not a directory"),
+		},
+	}
+
+	reg, srv := newTestRegistry()
+	defer srv.Close()
+
+	imageRef := strings.TrimPrefix(srv.URL, "http://") + "/library/debian:buster"
+	reg.addImage("library/debian", "buster", baseLayer, upperLayer)
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+
+		t.Run(tcname, func(t *testing.T) {
+			solver := newRegistrySolver(srv, "")
+			ctx := context.Background()
+			names, err := solver.ReadImageDir(ctx, imageRef, tc.dirpath)
+
+			if tc.expectedErr != nil {
+				if err == nil || !(xerrors.Is(err, tc.expectedErr) ||
+					strings.HasSuffix(err.Error(), tc.expectedErr.Error())) {
+					t.Fatalf("Expected: %v\nGot: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if diff := deep.Equal(names, tc.expected); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestRegistrySolverResolveImageOS(t *testing.T) {
+	reg, srv := newTestRegistry()
+	defer srv.Close()
+
+	amd64 := reg.addImage("library/debian", "buster-amd64", baseLayer, upperLayer)
+	arm64 := reg.addImage("library/debian", "buster-arm64", baseLayer)
+	index := ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			withPlatform(arm64, "arm64"),
+			withPlatform(amd64, "amd64"),
+		},
+	}
+	index.SchemaVersion = 2
+	reg.tag("library/debian", "buster",
+		reg.addJSON(images.MediaTypeDockerSchema2ManifestList, index))
+
+	blobCacheDir, err := ioutil.TempDir("", "zbuild-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(blobCacheDir)
+
+	solver := newRegistrySolver(srv, blobCacheDir)
+	ctx := context.Background()
+	imageRef := strings.TrimPrefix(srv.URL, "http://") + "/library/debian:buster"
+
+	expected := builddef.OSRelease{
+		Name:        "debian",
+		VersionName: "buster",
+		VersionID:   "10",
+	}
+
+	for i := 0; i < 2; i++ {
+		osrelease, err := statesolver.ResolveImageOS(ctx, solver, imageRef)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if diff := deep.Equal(osrelease, expected); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+
+	// Blobs fetched during the first resolution have to be read from the
+	// blob cache afterwards.
+	for dgst, count := range reg.blobRequests {
+		if count != 1 {
+			t.Errorf("Expected blob %s to be fetched once, but it has been fetched %d times.", dgst, count)
+		}
+	}
+}
+
+func withPlatform(desc ocispec.Descriptor, arch string) ocispec.Descriptor {
+	desc.Platform = &ocispec.Platform{OS: "linux", Architecture: arch}
+	return desc
+}
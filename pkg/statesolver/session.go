@@ -0,0 +1,87 @@
+package statesolver
+
+import (
+	"context"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"golang.org/x/xerrors"
+)
+
+// BuildkitSession is a build session opened with a buildkitd daemon, such
+// that a BuildkitSolver can be used outside of a frontend (e.g. by zbuild
+// CLI when there's no Docker daemon). The build context is served by the
+// session.
+type BuildkitSession struct {
+	// Solver is the BuildkitSolver using the session. It can't be used
+	// anymore once the session is closed.
+	Solver BuildkitSolver
+
+	client *bkclient.Client
+	done   chan struct{}
+	errch  chan error
+}
+
+// NewBuildkitSession connects to the buildkitd daemon at the given address
+// and starts a build session serving the given build context dir. The
+// session lasts until it's closed.
+func NewBuildkitSession(ctx context.Context, addr, contextDir string) (*BuildkitSession, error) {
+	c, err := bkclient.New(ctx, addr, bkclient.WithFailFast())
+	if err != nil {
+		return nil, xerrors.Errorf("could not connect to buildkitd at %s: %w", addr, err)
+	}
+
+	s := &BuildkitSession{
+		client: c,
+		done:   make(chan struct{}),
+		errch:  make(chan error, 1),
+	}
+	solverch := make(chan BuildkitSolver, 1)
+
+	opt := bkclient.SolveOpt{
+		LocalDirs: map[string]string{
+			defaultContextName: contextDir,
+		},
+	}
+	// The build func hands over the gateway client and then waits for the
+	// session to be closed, as the client can't be used once it returns.
+	buildFunc := func(ctx context.Context, gw client.Client) (*client.Result, error) {
+		solverch <- NewBuildkitSolver(gw)
+
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+		}
+		return client.NewResult(), nil
+	}
+
+	go func() {
+		_, err := c.Build(ctx, opt, "zbuild", buildFunc, nil)
+		s.errch <- err
+	}()
+
+	select {
+	case s.Solver = <-solverch:
+		return s, nil
+	case err := <-s.errch:
+		c.Close()
+		if err == nil {
+			err = xerrors.New("session ended unexpectedly")
+		}
+		return nil, xerrors.Errorf("could not start a build session with buildkitd at %s: %w", addr, err)
+	}
+}
+
+// Close ends the build session and closes the connection to buildkitd.
+func (s *BuildkitSession) Close() error {
+	close(s.done)
+	err := <-s.errch
+
+	if closeErr := s.client.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to close build session: %w", err)
+	}
+	return nil
+}
@@ -3,6 +3,9 @@ package statesolver
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"os"
+	"strings"
 
 	"github.com/NiR-/zbuild/pkg/builddef"
 	"github.com/moby/buildkit/client/llb"
@@ -18,11 +21,17 @@ type StateSolver interface {
 	ResolveImageRef(ctx context.Context, imageRef string) (string, error)
 
 	// ExecImage is a method that execute a given command in the given image
-	// ref. It returns a byte buffer containing the command stdout. An error is
-	// returned if the executed command doesn't return an exit code = 0.
+	// ref. It returns a byte buffer containing the command stdout. An
+	// ExecError is returned if the executed command doesn't return an exit
+	// code = 0.
 	ExecImage(ctx context.Context, imageRef string, cmd []string) (*bytes.Buffer, error)
 	// FileExists check if the given filepath exists in the given context.
 	FileExists(ctx context.Context, filepath string, source *builddef.Context) (bool, error)
+	// Stat returns the size and the mode of the given path in either a
+	// context or an image, without reading its content. Symlinks are
+	// followed. If the path couldn't be found, it returns a FileNotFound
+	// error.
+	Stat(ctx context.Context, filepath string, source FileSource) (FileInfo, error)
 	// ReadFile is the method to use to read a given file from either an image
 	// or a local source (see From methods). It returns the file content as a
 	// byte slice if it's found. If the path couldn't be found, it returns
@@ -37,6 +46,90 @@ type StateSolver interface {
 
 type ReadFileOpt func(ctx context.Context, filepath string) ([]byte, error)
 
+// ImageDirSolver is implemented by StateSolvers able to list the entries of
+// directories of images.
+type ImageDirSolver interface {
+	// ReadImageDir returns the names of the entries of the given dir of an
+	// image, sorted by name. If the dir couldn't be found, it returns a
+	// FileNotFound error.
+	ReadImageDir(ctx context.Context, image, dirpath string) ([]string, error)
+}
+
+// ReadImageDir lists the given dir of an image with the given solver. It
+// returns an error if the solver doesn't implement ImageDirSolver.
+func ReadImageDir(ctx context.Context, solver StateSolver, image, dirpath string) ([]string, error) {
+	dirSolver, ok := solver.(ImageDirSolver)
+	if !ok {
+		return nil, xerrors.Errorf("failed to read dir %s from %s: listing dirs is not supported by %T",
+			dirpath, image, solver)
+	}
+	return dirSolver.ReadImageDir(ctx, image, dirpath)
+}
+
+// FileSource designates where Stat should look for a path: either a build
+// context or an image (see ContextSource and ImageSource).
+type FileSource struct {
+	Context *builddef.Context
+	Image   string
+}
+
+// ContextSource returns a FileSource designating the given context.
+func ContextSource(c *builddef.Context) FileSource {
+	return FileSource{Context: c}
+}
+
+// ImageSource returns a FileSource designating the given image.
+func ImageSource(image string) FileSource {
+	return FileSource{Image: image}
+}
+
+// FileInfo describes a path as returned by Stat.
+type FileInfo struct {
+	// Size is the size of regular files in bytes. It's always 0 for other
+	// types of path.
+	Size int64
+	// Mode contains both the permissions and the type of the path (e.g.
+	// os.ModeDir).
+	Mode os.FileMode
+}
+
+// newFileInfo returns a FileInfo with the given size and mode. The size is
+// only kept for regular files, as it's meaningless for other types and
+// differs between sources.
+func newFileInfo(size int64, mode os.FileMode) FileInfo {
+	if !mode.IsRegular() {
+		size = 0
+	}
+	return FileInfo{Size: size, Mode: mode}
+}
+
+// IsDir returns true if the path is a directory.
+func (fi FileInfo) IsDir() bool {
+	return fi.Mode.IsDir()
+}
+
+// IsRegular returns true if the path is a regular file.
+func (fi FileInfo) IsRegular() bool {
+	return fi.Mode.IsRegular()
+}
+
 var (
 	FileNotFound = xerrors.New("file not found")
 )
+
+// ExecError is returned by ExecImage when the executed command exits with a
+// non-zero code. Its message includes the stderr of the command.
+type ExecError struct {
+	Cmd      []string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+func (err ExecError) Error() string {
+	msg := fmt.Sprintf("command exited with code %d", err.ExitCode)
+	if stderr := strings.TrimSpace(err.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
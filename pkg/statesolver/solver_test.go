@@ -0,0 +1,440 @@
+package statesolver_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NiR-/zbuild/pkg/builddef"
+	"github.com/NiR-/zbuild/pkg/llbtest"
+	"github.com/NiR-/zbuild/pkg/statesolver"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/golang/mock/gomock"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"github.com/tonistiigi/fsutil"
+	fstypes "github.com/tonistiigi/fsutil/types"
+	"golang.org/x/xerrors"
+)
+
+// conformanceFiles are the files available in every source tested by
+// TestSolverConformance. The app dir has no explicit entry, such that
+// images have to infer it from its content.
+var conformanceFiles = []tarEntry{
+	{name: "composer.json", typeflag: tar.TypeReg, content: `{"name": "zbuild/conformance"}`},
+	{name: "composer.link", typeflag: tar.TypeSymlink, linkname: "composer.json"},
+	{name: "app/index.php", typeflag: tar.TypeReg, content: "<?php echo 'conformance';"},
+}
+
+type conformanceSource struct {
+	solver  statesolver.StateSolver
+	source  statesolver.FileSource
+	readOpt statesolver.ReadFileOpt
+}
+
+// TestSolverConformance checks that every StateSolver implementation reads
+// and stats files the same way, whatever the source is. LocalSolver isn't
+// tested with images as it needs a Docker daemon.
+func TestSolverConformance(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dir := writeConformanceDir(t)
+	defer os.RemoveAll(dir)
+
+	repoDir := writeConformanceRepo(t)
+	defer os.RemoveAll(repoDir)
+
+	reg, srv := newTestRegistry()
+	defer srv.Close()
+	imageRef := strings.TrimPrefix(srv.URL, "http://") + "/zbuild/conformance:latest"
+	reg.addImage("zbuild/conformance", "latest", conformanceFiles)
+
+	tarball := buildLayer(conformanceFiles)
+	tarballSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(tarball)
+	}))
+	defer tarballSrv.Close()
+
+	localCtx := &builddef.Context{
+		Type:   builddef.ContextTypeLocal,
+		Source: "context",
+	}
+	// zbuild CLI uses the dir given with -c as the source of local contexts.
+	cliCtx := &builddef.Context{
+		Type:   builddef.ContextTypeLocal,
+		Source: "",
+	}
+	gitCtx := &builddef.Context{
+		Type:   builddef.ContextTypeGit,
+		Source: "file://" + repoDir,
+	}
+	httpCtx := &builddef.Context{
+		Type:   builddef.ContextTypeHTTP,
+		Source: tarballSrv.URL + "/context.tar.gz",
+		HTTPContext: builddef.HTTPContext{
+			Checksum: digest.FromBytes(tarball).String(),
+		},
+	}
+	imageCtx := &builddef.Context{
+		Type:   builddef.ContextTypeImage,
+		Source: imageRef,
+	}
+
+	localSolver := statesolver.LocalSolver{RootDir: dir}
+	registrySolver := newRegistrySolver(srv, "")
+	registrySolver.RootDir = dir
+	buildkitSolver := newDirBuildkitSolver(mockCtrl, dir)
+
+	sources := map[string]conformanceSource{
+		"LocalSolver with a local context": {
+			solver:  localSolver,
+			source:  statesolver.ContextSource(localCtx),
+			readOpt: localSolver.FromContext(localCtx),
+		},
+		"LocalSolver with a git context": {
+			solver:  localSolver,
+			source:  statesolver.ContextSource(gitCtx),
+			readOpt: localSolver.FromContext(gitCtx),
+		},
+		"LocalSolver with an HTTP context": {
+			solver:  localSolver,
+			source:  statesolver.ContextSource(httpCtx),
+			readOpt: localSolver.FromContext(httpCtx),
+		},
+		"RegistrySolver with a local context": {
+			solver:  registrySolver,
+			source:  statesolver.ContextSource(localCtx),
+			readOpt: registrySolver.FromContext(localCtx),
+		},
+		"RegistrySolver with an image": {
+			solver:  registrySolver,
+			source:  statesolver.ImageSource(imageRef),
+			readOpt: registrySolver.FromImage(imageRef),
+		},
+		"RegistrySolver with an HTTP context": {
+			solver:  registrySolver,
+			source:  statesolver.ContextSource(httpCtx),
+			readOpt: registrySolver.FromContext(httpCtx),
+		},
+		"RegistrySolver with an image context": {
+			solver:  registrySolver,
+			source:  statesolver.ContextSource(imageCtx),
+			readOpt: registrySolver.FromContext(imageCtx),
+		},
+		"BuildkitSolver with a local context": {
+			solver:  buildkitSolver,
+			source:  statesolver.ContextSource(localCtx),
+			readOpt: buildkitSolver.FromContext(localCtx),
+		},
+		"BuildkitSolver with the local context of zbuild CLI": {
+			solver:  buildkitSolver,
+			source:  statesolver.ContextSource(cliCtx),
+			readOpt: buildkitSolver.FromContext(cliCtx),
+		},
+		"BuildkitSolver with an image": {
+			solver:  buildkitSolver,
+			source:  statesolver.ImageSource(imageRef),
+			readOpt: buildkitSolver.FromImage(imageRef),
+		},
+	}
+
+	testcases := map[string]struct {
+		filepath string
+		// expected is the content of the file, or nil if it's a dir.
+		expected    *string
+		expectedErr error
+	}{
+		"stat a regular file": {
+			filepath: "/composer.json",
+			expected: &conformanceFiles[0].content,
+		},
+		"stat a file in a subdir without a leading slash": {
+			filepath: "app/index.php",
+			expected: &conformanceFiles[2].content,
+		},
+		"stat a file through a symlink": {
+			filepath: "/composer.link",
+			expected: &conformanceFiles[0].content,
+		},
+		"stat a directory": {
+			filepath: "/app",
+		},
+		"fail to stat a nonexistent file": {
+			filepath:    "/composer.lock",
+			expectedErr: statesolver.FileNotFound,
+		},
+		"fail to stat a file from a nonexistent dir": {
+			filepath:    "/src/index.php",
+			expectedErr: statesolver.FileNotFound,
+		},
+	}
+
+	for srcname, src := range sources {
+		for tcname, tc := range testcases {
+			// Subtests aren't run in parallel as the sources are removed once
+			// the parent test returns.
+			t.Run(srcname+"/"+tcname, func(t *testing.T) {
+				ctx := context.Background()
+
+				fi, err := src.solver.Stat(ctx, tc.filepath, src.source)
+				if tc.expectedErr != nil {
+					if !xerrors.Is(err, tc.expectedErr) {
+						t.Fatalf("Stat - Expected: %v\nGot: %v", tc.expectedErr, err)
+					}
+				} else if err != nil {
+					t.Fatalf("Stat - Unexpected error: %v", err)
+				} else if tc.expected == nil && !fi.IsDir() {
+					t.Fatalf("Stat - Expected a dir, got mode %v.", fi.Mode)
+				} else if tc.expected != nil && (!fi.IsRegular() || fi.Size != int64(len(*tc.expected))) {
+					t.Fatalf("Stat - Expected a regular file of %d bytes, got mode %v and size %d.",
+						len(*tc.expected), fi.Mode, fi.Size)
+				}
+
+				if src.source.Context != nil {
+					exists, err := src.solver.FileExists(ctx, tc.filepath, src.source.Context)
+					if err != nil {
+						t.Fatalf("FileExists - Unexpected error: %v", err)
+					}
+					if exists != (tc.expectedErr == nil) {
+						t.Fatalf("FileExists - Expected %t, got %t.", tc.expectedErr == nil, exists)
+					}
+				}
+
+				if tc.expected == nil && tc.expectedErr == nil {
+					return
+				}
+
+				content, err := src.solver.ReadFile(ctx, tc.filepath, src.readOpt)
+				if tc.expectedErr != nil {
+					if !xerrors.Is(err, tc.expectedErr) {
+						t.Fatalf("ReadFile - Expected: %v\nGot: %v", tc.expectedErr, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("ReadFile - Unexpected error: %v", err)
+				}
+				if string(content) != *tc.expected {
+					t.Fatalf("ReadFile - Expected: %q\nGot: %q", *tc.expected, string(content))
+				}
+			})
+		}
+	}
+}
+
+func writeConformanceFiles(t *testing.T, dir string) {
+	for _, entry := range conformanceFiles {
+		fullpath := filepath.Join(dir, entry.name)
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		if entry.typeflag == tar.TypeSymlink {
+			err = os.Symlink(entry.linkname, fullpath)
+		} else {
+			err = ioutil.WriteFile(fullpath, []byte(entry.content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeConformanceDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "zbuild-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConformanceFiles(t, dir)
+	return dir
+}
+
+func writeConformanceRepo(t *testing.T) string {
+	dir := writeConformanceDir(t)
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go-git doesn't write the config file of new repositories, but it's
+	// needed to serve them.
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range conformanceFiles {
+		if _, err := wt.Add(entry.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = wt.Commit("Add conformance files", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "zbuild",
+			Email: "zbuild@example.org",
+			When:  time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// newDirBuildkitSolver returns a BuildkitSolver for which every LLB state
+// solves to the given dir. Like a BuildkitSession, the dir is only served as
+// the "context" local source, and only the files matching the include
+// patterns of local sources are available.
+func newDirBuildkitSolver(mockCtrl *gomock.Controller, dir string) statesolver.BuildkitSolver {
+	c := llbtest.NewMockClient(mockCtrl)
+	c.EXPECT().BuildOpts().AnyTimes().Return(client.BuildOpts{
+		SessionID: "<SESSION-ID>",
+		Opts:      map[string]string{},
+	})
+	c.EXPECT().Solve(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+		func(_ context.Context, req client.SolveRequest) (*client.Result, error) {
+			local, includePatterns, err := parseLocalSource(req.Definition)
+			if err != nil {
+				return nil, err
+			}
+			if local != nil && *local != "context" {
+				return nil, xerrors.Errorf("local source %q not enabled from the client", *local)
+			}
+
+			ref := dirReference{root: dir, includePatterns: includePatterns}
+			return &client.Result{
+				Refs: map[string]client.Reference{
+					"linux/amd64": ref,
+				},
+				Ref: ref,
+			}, nil
+		})
+
+	return statesolver.NewBuildkitSolver(c)
+}
+
+// parseLocalSource returns the name and the include patterns of the local
+// source of the given LLB definition. The name is nil if there's none.
+func parseLocalSource(def *pb.Definition) (*string, []string, error) {
+	for _, raw := range def.Def {
+		var op pb.Op
+		if err := op.Unmarshal(raw); err != nil {
+			return nil, nil, err
+		}
+		src := op.GetSource()
+		if src == nil || !strings.HasPrefix(src.Identifier, "local://") {
+			continue
+		}
+
+		name := strings.TrimPrefix(src.Identifier, "local://")
+		rawPatterns, ok := src.Attrs[pb.AttrIncludePatterns]
+		if !ok {
+			return &name, nil, nil
+		}
+		var patterns []string
+		if err := json.Unmarshal([]byte(rawPatterns), &patterns); err != nil {
+			return nil, nil, err
+		}
+		return &name, patterns, nil
+	}
+	return nil, nil, nil
+}
+
+// dirReference is a client.Reference backed by a local dir. Like Buildkit
+// references, StatFile doesn't follow symlinks. When includePatterns is not
+// nil, only the files transferred by fsutil with these patterns are
+// available.
+type dirReference struct {
+	root            string
+	includePatterns []string
+}
+
+// isIncluded checks whether the given file would have been transferred by
+// fsutil, such that it's available in the solved state.
+func (r dirReference) isIncluded(ctx context.Context, name string) (bool, error) {
+	if r.includePatterns == nil {
+		return true, nil
+	}
+
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	var included bool
+	err := fsutil.Walk(ctx, r.root, &fsutil.WalkOpt{
+		IncludePatterns: r.includePatterns,
+	}, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		included = included || path == name
+		return nil
+	})
+	return included, err
+}
+
+func (r dirReference) ToState() (llb.State, error) {
+	return llb.Scratch(), nil
+}
+
+func (r dirReference) ReadFile(ctx context.Context, req client.ReadRequest) ([]byte, error) {
+	if ok, err := r.isIncluded(ctx, req.Filename); err != nil || !ok {
+		return nil, notIncludedErr(req.Filename, err)
+	}
+	return ioutil.ReadFile(filepath.Join(r.root, req.Filename))
+}
+
+func (r dirReference) StatFile(ctx context.Context, req client.StatRequest) (*fstypes.Stat, error) {
+	if ok, err := r.isIncluded(ctx, req.Path); err != nil || !ok {
+		return nil, notIncludedErr(req.Path, err)
+	}
+
+	fullpath := filepath.Join(r.root, req.Path)
+	fi, err := os.Lstat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := &fstypes.Stat{
+		Path:  req.Path,
+		Mode:  uint32(fi.Mode()),
+		Size_: fi.Size(),
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if stat.Linkname, err = os.Readlink(fullpath); err != nil {
+			return nil, err
+		}
+	}
+	return stat, nil
+}
+
+// notIncludedErr returns the error of Buildkit references for files that
+// haven't been transferred.
+func notIncludedErr(name string, err error) error {
+	if err != nil {
+		return err
+	}
+	return xerrors.Errorf("stat %s: no such file or directory", name)
+}
+
+func (r dirReference) ReadDir(ctx context.Context, req client.ReadDirRequest) ([]*fstypes.Stat, error) {
+	return nil, xerrors.New("ReadDir is not implemented by dirReference")
+}